@@ -0,0 +1,28 @@
+package common
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/example/minibox/box"
+)
+
+// PushAuthMiddleware rejects the requests to the push endpoints of group which do not
+// pass the push auth rules of the box.
+func PushAuthMiddleware(group string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		auth := box.GetPushAuth()
+		if auth == nil {
+			return
+		}
+		ret := auth.Check(group, ctx.Request)
+		if ret.Allowed {
+			return
+		}
+		for _, c := range ret.Challenges {
+			ctx.Writer.Header().Add("WWW-Authenticate", c)
+		}
+		ctx.AbortWithStatus(http.StatusUnauthorized)
+	}
+}
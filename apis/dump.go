@@ -13,15 +13,17 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/olekukonko/tablewriter"
 	"github.com/rs/zerolog"
+	"github.com/example/minibox/apis/module"
 	"github.com/example/minibox/box"
 	"github.com/example/minibox/cloud"
 	"github.com/example/onvif"
-	http2 "github.com/example/turing-common/http"
 	"github.com/example/turing-common/log"
 )
 
 const DayFormat = "2006-01-02"
 
+const dumpModule = "dump"
+
 // for local ui
 type DumpAPI struct {
 	Box box.Box `inject:"box"`
@@ -37,7 +39,7 @@ func RegisterDumpAPI(injector inject.Injector, router *gin.Engine) {
 	if err := injector.Apply(api); err != nil {
 		logger.Fatal().Err(err).Msg("Failed to init debug api.")
 	}
-	http2.RegisterGinGroupHandler(&router.RouterGroup, api)
+	module.Mount(&router.RouterGroup, dumpModule, api)
 }
 
 func (d *DumpAPI) BaseURL() string {
@@ -73,6 +75,8 @@ func (d *DumpAPI) Register(group *gin.RouterGroup) {
 	group.GET("t_archive", d.TArchiveSetting)
 	group.GET("cloud_nvr", d.CloudNvr)
 	group.GET("t_cloud_nvr", d.TCloudNvr)
+	group.GET("halo", d.Halo)
+	group.GET("t_halo", d.THalo)
 }
 
 type CameraStruct struct {
@@ -141,11 +145,11 @@ func (d *DumpAPI) camera() []CameraStruct {
 			Online:       fmt.Sprintf("%+v", cam.GetOnline()),
 			Brand:        string(cam.GetBrand()),
 			Manufacturer: cam.GetManufacturer(),
-			Uri:          cam.GetUri(),
+			Uri:          box.RedactURI(cam.GetUri()),
 			//HdUri:        cam.GetHdUri(),
 			//SdUri:        cam.GetSdUri(),
 			UserName: cam.GetUserName(),
-			Password: cam.GetPassword(),
+			Password: box.RedactSecret(cam.GetPassword()),
 			//UpdatedAt:          cam.GetUpdatedAt().String(),
 			//LatestOnlineTime:   cam.GetLatestOnlineTime().String(),
 			UploadVideo: fmt.Sprintf("%+v", cam.GetUploadVideoEnabled()),
@@ -157,6 +161,11 @@ func (d *DumpAPI) camera() []CameraStruct {
 	return cams
 }
 
+// redactedJSON replies v as json with its passwords and the passwords of its uris redacted.
+func (d *DumpAPI) redactedJSON(ctx *gin.Context, v interface{}) {
+	ctx.Data(http.StatusOK, "application/json; charset=utf-8", box.RedactedJSON(v))
+}
+
 func (d *DumpAPI) Cameras(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, d.camera())
 }
@@ -188,7 +197,7 @@ func (d *DumpAPI) TCameras(ctx *gin.Context) {
 }
 
 func (d *DumpAPI) CameraSettingss(ctx *gin.Context) {
-	ctx.JSON(http.StatusOK, cloud.AllCameraSettings())
+	d.redactedJSON(ctx, cloud.AllCameraSettings())
 }
 
 func (d *DumpAPI) flatCameraSettings(settings []*cloud.CameraSettings) []CameraSettingsStruct {
@@ -241,7 +250,7 @@ func (d *DumpAPI) flatOnvifDevice(devices []onvif.Device) []OnvifDeviceStruct {
 		ret = append(ret, OnvifDeviceStruct{
 			IP:              d.Params.Xaddr,
 			Username:        d.Params.Username,
-			Password:        d.Params.Password,
+			Password:        box.RedactSecret(d.Params.Password),
 			Endpoints:       fmt.Sprintf("%+v", d.Endpoints),
 			Manufacturer:    d.Info.Manufacturer,
 			Model:           d.Info.Model,
@@ -285,7 +294,7 @@ func (d *DumpAPI) TNvr(ctx *gin.Context) {
 }
 
 func (d *DumpAPI) NvrManaged(ctx *gin.Context) {
-	ctx.JSON(http.StatusOK, d.Box.GetNVRManager().GetAllNvrManaged())
+	d.redactedJSON(ctx, d.Box.GetNVRManager().GetAllNvrManaged())
 }
 
 func (d *DumpAPI) TNvrManaged(ctx *gin.Context) {
@@ -298,7 +307,7 @@ func (d *DumpAPI) TNvrManaged(ctx *gin.Context) {
 			nvr["ip"],
 			nvr["port"],
 			nvr["username"],
-			nvr["password"],
+			box.RedactSecret(nvr["password"]),
 			nvr["online"],
 			nvr["brand"],
 			nvr["state"],
@@ -317,7 +326,7 @@ func (d *DumpAPI) TNvrManaged(ctx *gin.Context) {
 }
 
 func (d *DumpAPI) ArchiveSetting(ctx *gin.Context) {
-	ctx.JSON(http.StatusOK, box.GetArchiveTaskRunner().DumpTasks())
+	d.redactedJSON(ctx, box.GetArchiveTaskRunner().DumpTasks())
 }
 
 func (d *DumpAPI) TArchiveSetting(ctx *gin.Context) {
@@ -339,7 +348,7 @@ func (d *DumpAPI) TArchiveSetting(ctx *gin.Context) {
 			task["streamStart"],
 			task["streamEnd"],
 			task["runningStatus"],
-			task["streamUrl"],
+			box.RedactURI(task["streamUrl"]),
 		})
 	}
 
@@ -364,7 +373,7 @@ func (d *DumpAPI) foundCloudNvr() []map[string]string {
 		nvrDump["mac"] = n.MacAddress
 		nvrDump["manufacturer"] = n.Manufacturer
 		nvrDump["username"] = n.Username
-		nvrDump["password"] = n.Password
+		nvrDump["password"] = box.RedactSecret(n.Password)
 		nvrDump["model"] = n.DeviceModel
 		if n.Online != nil {
 			nvrDump["online"] = fmt.Sprintf("%+v", *n.Online)
@@ -416,3 +425,63 @@ func (d *DumpAPI) TCloudNvr(ctx *gin.Context) {
 	table.Render()
 	ctx.String(http.StatusOK, buf.String())
 }
+
+type HaloDeviceStruct struct {
+	MAC          string `json:"mac"`
+	Name         string `json:"name"`
+	Online       string `json:"online"`
+	LastSeen     string `json:"last_seen"`
+	OfflineSince string `json:"offline_since"`
+}
+
+func (d *DumpAPI) haloDevices() []HaloDeviceStruct {
+	ret := []HaloDeviceStruct{}
+	monitor := box.GetHaloMonitor()
+	if monitor == nil {
+		return ret
+	}
+	for _, dev := range monitor.Devices() {
+		offlineSince := ""
+		if dev.OfflineSince != nil {
+			offlineSince = dev.OfflineSince.Format(time.RFC3339)
+		}
+		ret = append(ret, HaloDeviceStruct{
+			MAC:          dev.MAC,
+			Name:         dev.Name,
+			Online:       fmt.Sprintf("%+v", dev.Online),
+			LastSeen:     dev.LastSeen.Format(time.RFC3339),
+			OfflineSince: offlineSince,
+		})
+	}
+	return ret
+}
+
+func (d *DumpAPI) Halo(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, d.haloDevices())
+}
+
+func (d *DumpAPI) THalo(ctx *gin.Context) {
+	devices := d.haloDevices()
+	headers := []string{}
+	headerInit := false
+	data := [][]string{}
+	for _, c := range devices {
+		singleData := []string{}
+		cReflected := reflect.TypeOf(c)
+		for i := 0; i < cReflected.NumField(); i++ {
+			field := cReflected.Field(i)
+			if !headerInit {
+				headers = append(headers, field.Name)
+			}
+			singleData = append(singleData, reflect.ValueOf(c).FieldByName(field.Name).String())
+		}
+		headerInit = true
+		data = append(data, singleData)
+	}
+	buf := new(bytes.Buffer)
+	table := tablewriter.NewWriter(buf)
+	table.SetHeader(headers)
+	table.AppendBulk(data)
+	table.Render()
+	ctx.String(http.StatusOK, buf.String())
+}
@@ -8,10 +8,11 @@ import (
 	"github.com/codegangsta/inject"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
+	"github.com/example/minibox/apis/common"
+	"github.com/example/minibox/apis/module"
 	"github.com/example/minibox/box"
 	"github.com/example/minibox/db"
 	"github.com/example/minibox/utils"
-	http2 "github.com/example/turing-common/http"
 	"github.com/example/turing-common/log"
 )
 
@@ -21,13 +22,19 @@ type GuardianAPI struct {
 	logger zerolog.Logger
 }
 
+const ModuleName = "guardian"
+
+func init() {
+	module.Register(ModuleName, Register, true)
+}
+
 func Register(injector inject.Injector, router *gin.Engine) {
 	logger := log.Logger("guardian_api")
 	api := &GuardianAPI{logger: logger}
 	if err := injector.Apply(api); err != nil {
 		logger.Fatal().Err(err).Msg("Failed to init guardian api.")
 	}
-	http2.RegisterGinGroupHandler(&router.RouterGroup, api)
+	module.Mount(&router.RouterGroup, ModuleName, api)
 }
 
 func (u *GuardianAPI) BaseURL() string {
@@ -36,6 +43,7 @@ func (u *GuardianAPI) BaseURL() string {
 
 func (u *GuardianAPI) Middlewares() []gin.HandlerFunc {
 	return []gin.HandlerFunc{
+		common.PushAuthMiddleware(box.PushAuthGroupGuardian),
 		// u.ShowContent, // for debug
 	}
 }
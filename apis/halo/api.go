@@ -10,36 +10,81 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
 
+	"github.com/example/minibox/apis/common"
+	"github.com/example/minibox/apis/module"
 	"github.com/example/minibox/box"
 	"github.com/example/minibox/cloud"
 	"github.com/example/minibox/db"
 	"github.com/example/minibox/utils"
-	http2 "github.com/example/turing-common/http"
 	"github.com/example/turing-common/log"
 )
 
+const (
+	haloBackfillInterval = time.Minute
+	haloBackfillBatch    = 200
+)
+
 type HaloAPI struct {
 	Box    box.Box   `inject:"box"`
 	DB     db.Client `inject:"db"`
 	Logger zerolog.Logger
 }
 
+const ModuleName = "halo"
+
+func init() {
+	module.Register(ModuleName, Register, true)
+	box.RegisterHaloEventTypes(haloEventNames()...)
+}
+
 func Register(injector inject.Injector, router *gin.Engine) {
 	logger := log.Logger("halo_api")
 	api := &HaloAPI{Logger: logger}
 	if err := injector.Apply(api); err != nil {
 		logger.Fatal().Err(err).Msg("Failed to init halo api.")
 	}
-	http2.RegisterGinGroupHandler(&router.RouterGroup, api)
+	module.Mount(&router.RouterGroup, ModuleName, api)
+	if series := box.GetHaloSeries(); series != nil {
+		go api.backfill(series)
+	}
+}
+
+// backfill uploads the sensor readings which failed to upload, once the cloud is
+// reachable again.
+func (h *HaloAPI) backfill(series *box.HaloSeries) {
+	ticker := time.NewTicker(haloBackfillInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		pending, err := series.PendingBackfill(haloBackfillBatch)
+		if err != nil {
+			h.Logger.Error().Err(err).Msg("failed to load halo backfill")
+			continue
+		}
+		for _, b := range pending {
+			heartbeat := cloud.HaloHeartbeat{
+				Source:       cloud.EventSourceHalo,
+				BoxId:        h.Box.GetBoxId(),
+				IotDeviceMAC: b.MAC,
+				Timestamp:    b.At.Format(utils.CloudTimeLayout),
+				Sensors:      createSensorList(b.Values, nil),
+			}
+			if err = h.Box.CloudClient().UploadHaloHeartbeat(&heartbeat); err != nil {
+				h.Logger.Debug().Err(err).Msg("halo backfill postponed, cloud is not reachable")
+				break
+			}
+			if err = series.MarkBackfilled(b); err != nil {
+				h.Logger.Error().Err(err).Str("mac", b.MAC).Msg("failed to mark halo backfill")
+			}
+		}
+	}
 }
 
 func (h *HaloAPI) BaseURL() string {
 	return "halo"
 }
 
-// Middlewares TODO: Add authorization for halo events
 func (h *HaloAPI) Middlewares() []gin.HandlerFunc {
-	return []gin.HandlerFunc{}
+	return []gin.HandlerFunc{common.PushAuthMiddleware(box.PushAuthGroupHalo)}
 }
 
 func (h *HaloAPI) Register(group *gin.RouterGroup) {
@@ -68,12 +113,17 @@ func (h *HaloAPI) UploadEvent(ctx *gin.Context) {
 		h.Logger.Error().Msgf("Unmarshal HaloEventNotification error: %s", err)
 		return
 	}
+	h.raiseEvent(event)
+}
 
+// raiseEvent runs the linkage of a Halo event and uploads it.
+func (h *HaloAPI) raiseEvent(event HaloEventNotification) {
 	eventType := getHaloEventType(event.EventType)
 	if eventType == cloud.HaloEventUnknown {
 		h.Logger.Error().Msg("unknown halo event type error")
 		return
 	}
+	box.TriggerEventLinkage(box.EventSourceHalo, event.MAC, event.EventType)
 	startTime := time.Now().Format(utils.CloudTimeLayout)
 	var eventInfo = cloud.HaloEventInfo{
 		Source:       cloud.EventSourceHalo,
@@ -87,7 +137,13 @@ func (h *HaloAPI) UploadEvent(ctx *gin.Context) {
 			DataSource:  event.DataSource,
 		},
 	}
-	if err = h.Box.CloudClient().UploadHaloEvent(&eventInfo); err != nil {
+	if bridge := box.GetMQTTBridge(); bridge != nil {
+		bridge.PublishHaloEvent(&eventInfo)
+	}
+	if hooks := box.GetWebhookDispatcher(); hooks != nil {
+		hooks.HaloEvent(event.EventType, &eventInfo)
+	}
+	if err := h.Box.CloudClient().UploadHaloEvent(&eventInfo); err != nil {
 		h.Logger.Err(err).Msgf("failed to upload halo event info to broadway")
 	}
 }
@@ -113,6 +169,9 @@ func (h *HaloAPI) UploadStatus(ctx *gin.Context) {
 		h.Logger.Error().Msgf("Unmarshal HaloHeartbeat error: %s", err)
 		return
 	}
+	if monitor := box.GetHaloMonitor(); monitor != nil {
+		monitor.Heartbeat(hb.MAC, hb.Name)
+	}
 	activeList := strings.Split(hb.Active, ",")
 	timestamp := time.Now().Format(utils.CloudTimeLayout)
 	var heartbeat = cloud.HaloHeartbeat{
@@ -123,9 +182,28 @@ func (h *HaloAPI) UploadStatus(ctx *gin.Context) {
 		Sensors:      createSensorList(hb.Sensors, activeList),
 	}
 
+	if bridge := box.GetMQTTBridge(); bridge != nil {
+		bridge.PublishHaloSensors(&heartbeat)
+	}
 	if err = h.Box.CloudClient().UploadHaloHeartbeat(&heartbeat); err != nil {
 		h.Logger.Err(err).Msgf("failed to upload halo heartbeat info to broadway")
 	}
+	if series := box.GetHaloSeries(); series != nil {
+		series.Record(hb.MAC, hb.Sensors, time.Now(), err != nil)
+	}
+	if rules := box.GetHaloRuleEngine(); rules != nil {
+		for _, f := range rules.Evaluate(hb.MAC, hb.Sensors, time.Now()) {
+			h.Logger.Info().Int64("rule_id", f.Rule.ID).Str("mac", f.MAC).Float64("value", f.Value).Msg("halo rule raised")
+			h.raiseEvent(HaloEventNotification{
+				Name:        f.Rule.Name,
+				MAC:         f.MAC,
+				EventType:   f.EventType,
+				Threshold:   f.Rule.Threshold,
+				SensorValue: f.Value,
+				DataSource:  box.HaloRuleDataSource,
+			})
+		}
+	}
 
 }
 
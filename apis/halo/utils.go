@@ -1,6 +1,10 @@
 package halo
 
-import "github.com/example/minibox/cloud"
+import (
+	"sort"
+
+	"github.com/example/minibox/cloud"
+)
 
 const (
 	Aggression      = "Aggression"
@@ -27,56 +31,47 @@ const (
 	Tamper          = "Tamper"
 )
 
+// haloEventTypes maps the Halo event names to the cloud events.
+var haloEventTypes = map[string]string{
+	Aggression:      cloud.HaloEventAggression,
+	AirQualityIndex: cloud.HaloEventAirQualityIndex,
+	CarbonMonoxide:  cloud.HaloEventCarbonMonoxide,
+	CarbonDioxide:   cloud.HaloEventCarbonDioxide,
+	Gunshot:         cloud.HaloEventGunshot,
+	HealthIndex:     cloud.HaloEventHealthIndex,
+	Help:            cloud.HaloEventHelp,
+	Humidity:        cloud.HaloEventHumidity,
+	Light:           cloud.HaloEventLight,
+	Masking:         cloud.HaloEventMasking,
+	Ammonia:         cloud.HaloEventAmmonia,
+	NitrogenDioxide: cloud.HaloEventNitrogenDioxide,
+	PM1:             cloud.HaloEventPM1,
+	PM10:            cloud.HaloEventPM10,
+	PM25:            cloud.HaloEventPM25,
+	Pressure:        cloud.HaloEventPressure,
+	Sound:           cloud.HaloEventSound,
+	Temperature:     cloud.HaloEventTemperature,
+	THC:             cloud.HaloEventTHC,
+	TVOC:            cloud.HaloEventTVOC,
+	Vape:            cloud.HaloEventVape,
+	Tamper:          cloud.HaloEventTamper,
+}
+
+// haloEventNames returns the Halo event names getHaloEventType maps to cloud events.
+func haloEventNames() []string {
+	names := make([]string, 0, len(haloEventTypes))
+	for name := range haloEventTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func getHaloEventType(event string) string {
-	switch event {
-	case Aggression:
-		event = cloud.HaloEventAggression
-	case AirQualityIndex:
-		event = cloud.HaloEventAirQualityIndex
-	case CarbonMonoxide:
-		event = cloud.HaloEventCarbonMonoxide
-	case CarbonDioxide:
-		event = cloud.HaloEventCarbonDioxide
-	case Gunshot:
-		event = cloud.HaloEventGunshot
-	case HealthIndex:
-		event = cloud.HaloEventHealthIndex
-	case Help:
-		event = cloud.HaloEventHelp
-	case Humidity:
-		event = cloud.HaloEventHumidity
-	case Light:
-		event = cloud.HaloEventLight
-	case Masking:
-		event = cloud.HaloEventMasking
-	case Ammonia:
-		event = cloud.HaloEventAmmonia
-	case NitrogenDioxide:
-		event = cloud.HaloEventNitrogenDioxide
-	case PM1:
-		event = cloud.HaloEventPM1
-	case PM10:
-		event = cloud.HaloEventPM10
-	case PM25:
-		event = cloud.HaloEventPM25
-	case Pressure:
-		event = cloud.HaloEventPressure
-	case Sound:
-		event = cloud.HaloEventSound
-	case Temperature:
-		event = cloud.HaloEventTemperature
-	case THC:
-		event = cloud.HaloEventTHC
-	case TVOC:
-		event = cloud.HaloEventTVOC
-	case Vape:
-		event = cloud.HaloEventVape
-	case Tamper:
-		event = cloud.HaloEventTamper
-	default:
-		return cloud.HaloEventUnknown
+	if eventType, ok := haloEventTypes[event]; ok {
+		return eventType
 	}
-	return event
+	return cloud.HaloEventUnknown
 }
 
 func isActive(val string, list []string) bool {
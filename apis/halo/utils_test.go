@@ -46,6 +46,13 @@ func Test_getHaloEventType(t *testing.T) {
 	}
 }
 
+func Test_haloEventNames(t *testing.T) {
+	assert.Len(t, haloEventNames(), len(haloEventTypes))
+	for _, name := range haloEventNames() {
+		assert.NotEqual(t, cloud.HaloEventUnknown, getHaloEventType(name), name)
+	}
+}
+
 func Test_createSensorList(t *testing.T) {
 	type args struct {
 		sensors map[string]float64
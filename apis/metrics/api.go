@@ -5,6 +5,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
+	"github.com/example/minibox/apis/module"
 	http2 "github.com/example/turing-common/http"
 	"github.com/example/turing-common/log"
 )
@@ -13,13 +14,19 @@ type MetricsAPI struct {
 	Logger zerolog.Logger
 }
 
+const ModuleName = "metrics"
+
+func init() {
+	module.Register(ModuleName, Register, true)
+}
+
 func Register(injector inject.Injector, router *gin.Engine) {
 	logger := log.Logger("metrics")
 	api := &MetricsAPI{Logger: logger}
 	if err := injector.Apply(api); err != nil {
 		logger.Fatal().Err(err).Msg("Failed to init metrics api.")
 	}
-	http2.RegisterGinGroupHandler(&router.RouterGroup, api)
+	module.Mount(&router.RouterGroup, ModuleName, api)
 }
 
 func (m *MetricsAPI) BaseURL() string {
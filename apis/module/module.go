@@ -0,0 +1,215 @@
+package module
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/codegangsta/inject"
+	"github.com/gin-gonic/gin"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+
+	"github.com/example/minibox/apis/common"
+	"github.com/example/minibox/box"
+	http2 "github.com/example/turing-common/http"
+	"github.com/example/turing-common/log"
+)
+
+const (
+	// ConfigKey is the section of the config file with the configs of the modules.
+	ConfigKey = "api_modules"
+
+	// DefaultMiddlewares stands for the own middlewares of a module in the middlewares
+	// of its config.
+	DefaultMiddlewares = "default"
+)
+
+// Handler is the api of a module, served under BaseURL behind Middlewares.
+type Handler interface {
+	BaseURL() string
+	Middlewares() []gin.HandlerFunc
+	Register(group *gin.RouterGroup)
+}
+
+// Config enables or disables a module, and overrides its base url and its middlewares
+// by the names of the registered middlewares. The unset fields keep the defaults of the
+// module. The modules of the push endpoints keep their push_auth middleware whatever
+// their middlewares, e.g.
+//
+//	api_modules:
+//	  sunell:
+//	    enabled: true
+//	  uniview:
+//	    base_url: LAPI/V1.0
+//	    middlewares: [default, show_content]
+type Config struct {
+	Enabled     *bool    `mapstructure:"enabled"`
+	BaseURL     *string  `mapstructure:"base_url"`
+	Middlewares []string `mapstructure:"middlewares"`
+}
+
+type module struct {
+	name     string
+	register interface{}
+	enabled  bool
+}
+
+var (
+	modules     []*module
+	middlewares = map[string]func(module string) gin.HandlerFunc{
+		"push_auth":    common.PushAuthMiddleware,
+		"show_content": showContent,
+	}
+	configs map[string]Config
+)
+
+// Register adds a module, enabled tells if it is enabled when the config file does not
+// say. register is invoked by the injector of the api server when the module is enabled,
+// it is called from the init of the module packages.
+func Register(name string, register interface{}, enabled bool) {
+	for _, m := range modules {
+		if m.name == name {
+			panic(fmt.Sprintf("api module %s registered twice", name))
+		}
+	}
+	modules = append(modules, &module{name: name, register: register, enabled: enabled})
+}
+
+// RegisterMiddleware adds a middleware which the configs of the modules can select,
+// f returns the middleware of a module.
+func RegisterMiddleware(name string, f func(module string) gin.HandlerFunc) {
+	middlewares[name] = f
+}
+
+// LoadConfig reads the configs of the modules from the config file.
+func LoadConfig(path string) (map[string]Config, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("api modules config: %w", err)
+	}
+	return DecodeConfig(v.GetStringMap(ConfigKey))
+}
+
+// DecodeConfig decodes the api_modules section of the config file.
+func DecodeConfig(raw map[string]interface{}) (map[string]Config, error) {
+	ret := make(map[string]Config)
+	if err := mapstructure.Decode(raw, &ret); err != nil {
+		return nil, fmt.Errorf("api modules config: %w", err)
+	}
+	return ret, nil
+}
+
+// Load registers the enabled modules in the order of their registration.
+func Load(injector inject.Injector, cfg map[string]Config) error {
+	if err := validate(cfg); err != nil {
+		return err
+	}
+	configs = cfg
+	logger := log.Logger("api_module")
+	for _, m := range modules {
+		if !m.isEnabled(cfg[m.name]) {
+			logger.Info().Str("module", m.name).Msg("api module disabled")
+			continue
+		}
+		if _, err := injector.Invoke(m.register); err != nil {
+			return fmt.Errorf("api module %s: %w", m.name, err)
+		}
+		logger.Info().Str("module", m.name).Msg("api module enabled")
+	}
+	return nil
+}
+
+func validate(cfg map[string]Config) error {
+	for name, c := range cfg {
+		if find(name) == nil {
+			return fmt.Errorf("unknown api module %s", name)
+		}
+		for _, mw := range c.Middlewares {
+			if _, ok := middlewares[mw]; !ok && mw != DefaultMiddlewares {
+				return fmt.Errorf("unknown middleware %s of api module %s", mw, name)
+			}
+		}
+	}
+	return nil
+}
+
+func find(name string) *module {
+	for _, m := range modules {
+		if m.name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func (m *module) isEnabled(c Config) bool {
+	if c.Enabled != nil {
+		return *c.Enabled
+	}
+	return m.enabled
+}
+
+// Mount serves the api of a module with the base url and the middlewares of its config.
+func Mount(router *gin.RouterGroup, name string, h Handler) {
+	http2.RegisterGinGroupHandler(router, &handler{Handler: h, name: name, config: configs[name]})
+}
+
+// handler overrides the base url and the middlewares of a module by its config.
+type handler struct {
+	Handler
+	name   string
+	config Config
+}
+
+func (h *handler) BaseURL() string {
+	if h.config.BaseURL != nil {
+		return *h.config.BaseURL
+	}
+	return h.Handler.BaseURL()
+}
+
+func (h *handler) Middlewares() []gin.HandlerFunc {
+	if h.config.Middlewares == nil {
+		return h.Handler.Middlewares()
+	}
+	ret := []gin.HandlerFunc{}
+	// the own middlewares of a push module start with push_auth
+	if box.IsPushAuthGroup(h.name) && !h.hasMiddleware("push_auth") && !h.hasMiddleware(DefaultMiddlewares) {
+		ret = append(ret, middlewares["push_auth"](h.name))
+	}
+	for _, name := range h.config.Middlewares {
+		if name == DefaultMiddlewares {
+			ret = append(ret, h.Handler.Middlewares()...)
+			continue
+		}
+		ret = append(ret, middlewares[name](h.name))
+	}
+	return ret
+}
+
+func (h *handler) hasMiddleware(name string) bool {
+	for _, mw := range h.config.Middlewares {
+		if mw == name {
+			return true
+		}
+	}
+	return false
+}
+
+// showContent logs the bodies of the requests with their secrets redacted, for debug.
+func showContent(module string) gin.HandlerFunc {
+	logger := log.Logger(module)
+	return func(ctx *gin.Context) {
+		raw, err := ctx.GetRawData()
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to read request body")
+			return
+		}
+		logger.Debug().Str("path", ctx.Request.URL.Path).Msgf("%s", box.RedactJSON(raw))
+
+		ctx.Request.Body = ioutil.NopCloser(bytes.NewBuffer(raw))
+		ctx.Next()
+	}
+}
@@ -0,0 +1,104 @@
+package module
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/example/minibox/apis/common"
+)
+
+type testHandler struct {
+	middlewares []gin.HandlerFunc
+}
+
+func (h *testHandler) BaseURL() string                 { return "api/test" }
+func (h *testHandler) Middlewares() []gin.HandlerFunc  { return h.middlewares }
+func (h *testHandler) Register(group *gin.RouterGroup) {}
+
+func withModules(t *testing.T, registered ...*module) {
+	saved := modules
+	modules = registered
+	t.Cleanup(func() { modules = saved })
+}
+
+func TestValidate(t *testing.T) {
+	withModules(t, &module{name: "sunell"})
+	assert.NoError(t, validate(map[string]Config{"sunell": {Middlewares: []string{DefaultMiddlewares, "show_content"}}}))
+	assert.EqualError(t, validate(map[string]Config{"hikvision": {}}), "unknown api module hikvision")
+	assert.EqualError(t, validate(map[string]Config{"sunell": {Middlewares: []string{"cors"}}}),
+		"unknown middleware cors of api module sunell")
+}
+
+func TestModuleEnabled(t *testing.T) {
+	yes, no := true, false
+	m := &module{name: "sunell"}
+	assert.False(t, m.isEnabled(Config{}))
+	assert.True(t, m.isEnabled(Config{Enabled: &yes}))
+	m.enabled = true
+	assert.False(t, m.isEnabled(Config{Enabled: &no}))
+}
+
+func TestHandlerOverrides(t *testing.T) {
+	var calls []string
+	own := func(*gin.Context) { calls = append(calls, "own") }
+	RegisterMiddleware("test", func(module string) gin.HandlerFunc {
+		return func(*gin.Context) { calls = append(calls, "test "+module) }
+	})
+	defer delete(middlewares, "test")
+	h := &testHandler{middlewares: []gin.HandlerFunc{own}}
+
+	d := &handler{Handler: h, name: "sunell"}
+	assert.Equal(t, "api/test", d.BaseURL())
+	assert.Len(t, d.Middlewares(), 1)
+
+	url := ""
+	d = &handler{Handler: h, name: "sunell", config: Config{BaseURL: &url, Middlewares: []string{"test", DefaultMiddlewares}}}
+	assert.Equal(t, "", d.BaseURL())
+	for _, f := range d.Middlewares() {
+		f(nil)
+	}
+	assert.Equal(t, []string{"test sunell", "own"}, calls)
+
+	d = &handler{Handler: h, name: "metrics", config: Config{Middlewares: []string{}}}
+	assert.Empty(t, d.Middlewares())
+}
+
+func TestHandlerPushAuth(t *testing.T) {
+	var calls []string
+	RegisterMiddleware("push_auth", func(module string) gin.HandlerFunc {
+		return func(*gin.Context) { calls = append(calls, "push_auth "+module) }
+	})
+	defer RegisterMiddleware("push_auth", common.PushAuthMiddleware)
+	h := &testHandler{middlewares: []gin.HandlerFunc{func(*gin.Context) { calls = append(calls, "own") }}}
+
+	d := &handler{Handler: h, name: "sunell", config: Config{Middlewares: []string{"show_content"}}}
+	assert.Len(t, d.Middlewares(), 2)
+	d.Middlewares()[0](nil)
+	assert.Equal(t, []string{"push_auth sunell"}, calls)
+
+	// the own middlewares of the module have it
+	d = &handler{Handler: h, name: "sunell", config: Config{Middlewares: []string{DefaultMiddlewares, "show_content"}}}
+	assert.Len(t, d.Middlewares(), 2)
+	d = &handler{Handler: h, name: "sunell", config: Config{Middlewares: []string{"show_content", "push_auth"}}}
+	assert.Len(t, d.Middlewares(), 2)
+
+	d = &handler{Handler: h, name: "metrics", config: Config{Middlewares: []string{"show_content"}}}
+	assert.Len(t, d.Middlewares(), 1)
+}
+
+func TestDecodeConfig(t *testing.T) {
+	cfg, err := DecodeConfig(map[string]interface{}{
+		"sunell":  map[string]interface{}{"enabled": true},
+		"uniview": map[string]interface{}{"base_url": "LAPI/V1.0", "middlewares": []interface{}{"default", "show_content"}},
+	})
+	assert.NoError(t, err)
+	assert.True(t, *cfg["sunell"].Enabled)
+	assert.Nil(t, cfg["sunell"].BaseURL)
+	assert.Equal(t, "LAPI/V1.0", *cfg["uniview"].BaseURL)
+	assert.Equal(t, []string{"default", "show_content"}, cfg["uniview"].Middlewares)
+
+	_, err = DecodeConfig(map[string]interface{}{"sunell": map[string]interface{}{"enabled": "maybe"}})
+	assert.Error(t, err)
+}
@@ -9,14 +9,21 @@ import (
 	"github.com/gin-gonic/gin"
 	http2 "github.com/example/turing-common/http"
 
-	"github.com/example/minibox/apis/guardian"
-	"github.com/example/minibox/apis/halo"
-	"github.com/example/minibox/apis/metrics"
+	_ "github.com/example/minibox/apis/guardian"
+	_ "github.com/example/minibox/apis/halo"
+	_ "github.com/example/minibox/apis/metrics"
+	"github.com/example/minibox/apis/module"
+	_ "github.com/example/minibox/apis/sunell"
+	_ "github.com/example/minibox/apis/thermal_1"
 	"github.com/example/minibox/apis/uniview"
 	"github.com/example/minibox/configs"
 )
 
-func newEngine(injector inject.Injector) (*gin.Engine, error) {
+func init() {
+	module.Register(dumpModule, RegisterDumpAPI, true)
+}
+
+func newEngine(injector inject.Injector, modules map[string]module.Config) (*gin.Engine, error) {
 	engine := gin.Default()
 	// TODO(nick): change this to a cors middleware
 	h := cors.New(cors.Config{
@@ -30,26 +37,28 @@ func newEngine(injector inject.Injector) (*gin.Engine, error) {
 	engine.Use(h)
 	injector.Map(engine)
 
-	initFuncs := []interface{}{
-		uniview.Register,
-		metrics.Register,
-		guardian.Register,
-		halo.Register,
-		RegisterDumpAPI,
+	if err := module.Load(injector, modules); err != nil {
+		return nil, err
 	}
-
-	for _, f := range initFuncs {
-		_, err := injector.Invoke(f)
-		if err != nil {
-			return nil, err
-		}
+	// the events of the hikvision and dahua nvrs do not depend on the enabled modules
+	if err := uniview.RegisterNVREvents(injector); err != nil {
+		return nil, err
+	}
+	// the webhook snapshots are not a module, their urls are sent in the deliveries
+	if _, err := injector.Invoke(RegisterWebhookAPI); err != nil {
+		return nil, err
 	}
 	engine.Use(http2.PromMiddleware(nil))
 	return engine, nil
 }
 
-func Run(injector inject.Injector, cfg configs.Config) error {
-	engine, err := newEngine(injector)
+// Run serves the api modules enabled by the api_modules section of configFile.
+func Run(injector inject.Injector, cfg configs.Config, configFile string) error {
+	modules, err := module.LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	engine, err := newEngine(injector, modules)
 	if err != nil {
 		return err
 	}
@@ -7,10 +7,11 @@ import (
 	"github.com/codegangsta/inject"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
+	"github.com/example/minibox/apis/common"
+	"github.com/example/minibox/apis/module"
 	"github.com/example/minibox/box"
 	"github.com/example/minibox/db"
 	"github.com/example/minibox/utils"
-	http2 "github.com/example/turing-common/http"
 	"github.com/example/turing-common/log"
 )
 
@@ -21,13 +22,19 @@ type SunellAPI struct {
 	Logger zerolog.Logger
 }
 
+const ModuleName = "sunell"
+
+func init() {
+	module.Register(ModuleName, Register, false)
+}
+
 func Register(injector inject.Injector, router *gin.Engine) {
 	logger := log.Logger("sunell_api")
 	api := &SunellAPI{Logger: logger}
 	if err := injector.Apply(api); err != nil {
 		logger.Fatal().Err(err).Msg("Failed to init sunell api.")
 	}
-	http2.RegisterGinGroupHandler(&router.RouterGroup, api)
+	module.Mount(&router.RouterGroup, ModuleName, api)
 }
 
 func (c *SunellAPI) BaseURL() string {
@@ -35,7 +42,7 @@ func (c *SunellAPI) BaseURL() string {
 }
 
 func (c *SunellAPI) Middlewares() []gin.HandlerFunc {
-	return []gin.HandlerFunc{}
+	return []gin.HandlerFunc{common.PushAuthMiddleware(box.PushAuthGroupSunell)}
 }
 
 func (c *SunellAPI) Register(group *gin.RouterGroup) {
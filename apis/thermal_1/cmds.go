@@ -13,13 +13,14 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
 	"github.com/example/minibox/apis/common"
+	"github.com/example/minibox/apis/module"
 	"github.com/example/minibox/apis/structs"
+	"github.com/example/minibox/box"
 	"github.com/example/minibox/camera/thermal_1"
 	"github.com/example/minibox/cloud"
 	"github.com/example/minibox/db"
 	"github.com/example/minibox/printer"
 	"github.com/example/minibox/utils"
-	http2 "github.com/example/turing-common/http"
 	"github.com/example/turing-common/log"
 )
 
@@ -34,6 +35,12 @@ type Thermal1API struct {
 	Base   common.ThermalBaseAPI `inject:"base"`
 }
 
+const ModuleName = "thermal_1"
+
+func init() {
+	module.Register(ModuleName, Register, false)
+}
+
 func Register(injector inject.Injector, router *gin.Engine) {
 	logger := log.Logger("thermal_1")
 	t := &Thermal1API{
@@ -45,7 +52,7 @@ func Register(injector inject.Injector, router *gin.Engine) {
 	if err := injector.Apply(t); err != nil {
 		logger.Fatal().Err(err).Msg("Failed to init thermal cmds.")
 	}
-	http2.RegisterGinGroupHandler(&router.RouterGroup, t)
+	module.Mount(&router.RouterGroup, ModuleName, t)
 }
 
 func (t *Thermal1API) BaseURL() string {
@@ -53,7 +60,7 @@ func (t *Thermal1API) BaseURL() string {
 }
 
 func (t *Thermal1API) Middlewares() []gin.HandlerFunc {
-	return []gin.HandlerFunc{}
+	return []gin.HandlerFunc{common.PushAuthMiddleware(box.PushAuthGroupThermal)}
 }
 
 func (t *Thermal1API) Register(group *gin.RouterGroup) {
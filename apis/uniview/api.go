@@ -10,11 +10,12 @@ import (
 	"github.com/codegangsta/inject"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
+	"github.com/example/minibox/apis/common"
+	"github.com/example/minibox/apis/module"
 	"github.com/example/minibox/box"
 	"github.com/example/minibox/cloud"
 	"github.com/example/minibox/db"
 	"github.com/example/minibox/utils"
-	http2 "github.com/example/turing-common/http"
 	"github.com/example/turing-common/log"
 )
 
@@ -25,6 +26,12 @@ type UniviewAPI struct {
 	Logger        zerolog.Logger
 }
 
+const ModuleName = "uniview"
+
+func init() {
+	module.Register(ModuleName, Register, true)
+}
+
 func Register(injector inject.Injector, router *gin.Engine) {
 	logger := log.Logger("uniview_api")
 	api := &UniviewAPI{
@@ -34,7 +41,7 @@ func Register(injector inject.Injector, router *gin.Engine) {
 	if err := injector.Apply(api); err != nil {
 		logger.Fatal().Err(err).Msg("Failed to init uniview api.")
 	}
-	http2.RegisterGinGroupHandler(&router.RouterGroup, api)
+	module.Mount(&router.RouterGroup, ModuleName, api)
 }
 
 func (u UniviewAPI) BaseURL() string {
@@ -43,6 +50,7 @@ func (u UniviewAPI) BaseURL() string {
 
 func (u UniviewAPI) Middlewares() []gin.HandlerFunc {
 	return []gin.HandlerFunc{
+		common.PushAuthMiddleware(box.PushAuthGroupUniview),
 		// u.ShowContent, // for debug
 	}
 }
@@ -171,6 +179,12 @@ func (u *UniviewAPI) UploadAlarm(ctx *gin.Context) {
 	default:
 		return
 	}
+	if bridge := box.GetMQTTBridge(); bridge != nil {
+		bridge.PublishAlarm(&alarmInfo)
+	}
+	if hooks := box.GetWebhookDispatcher(); hooks != nil {
+		hooks.Alarm(&alarmInfo)
+	}
 	if err = u.Box.CloudClient().UploadAlarmInfo(&alarmInfo); err != nil {
 		u.Logger.Err(err).Msgf("failed to upload alarm info to broadway")
 	}
@@ -0,0 +1,63 @@
+package uniview
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/codegangsta/inject"
+	"github.com/example/turing-common/log"
+
+	"github.com/example/minibox/apis/structs"
+	"github.com/example/minibox/box"
+	"github.com/example/minibox/camera/base"
+	"github.com/example/minibox/cloud"
+)
+
+// nvrEventTypes maps the events of the NVRs driven by a box.NVRDriver to the event types.
+var nvrEventTypes = map[string]string{
+	box.NVREventMotion:    cloud.MotionStart,
+	box.NVREventIntrusion: cloud.Intrude,
+	box.NVREventLine:      cloud.Intrude,
+}
+
+// RegisterNVREvents processes the events of the NVRs driven by a box.NVRDriver through
+// the event pipeline of the uniview api, whatever the api modules which are enabled.
+func RegisterNVREvents(injector inject.Injector) error {
+	nvrs := box.GetNVRDrivers()
+	if nvrs == nil {
+		return nil
+	}
+	api := &UniviewAPI{
+		motionProcess: newMotionProcess(),
+		Logger:        log.Logger("nvr_event"),
+	}
+	if err := injector.Apply(api); err != nil {
+		return err
+	}
+	nvrs.HandleEvents(api.handleNVREvent)
+	return nil
+}
+
+// handleNVREvent processes the motion and IVS events of the cameras of the Hikvision and
+// Dahua NVRs, the snapshot of the channel is the image of the event. Their event videos
+// are not uploaded, only the Uniview NVRs write their cache for them.
+func (u *UniviewAPI) handleNVREvent(cam base.Camera, drv box.NVRDriver, ev box.NVREvent) {
+	eventType, ok := nvrEventTypes[ev.Type]
+	if !ok {
+		return
+	}
+	recvTime := time.Now().UTC()
+	go func() {
+		snapshot, err := drv.Snapshot(ev.Channel)
+		if err != nil {
+			u.Logger.Err(err).Int("camera_id", cam.GetID()).Str("event", ev.Type).Msg("get nvr event snapshot error")
+			return
+		}
+		cfg := u.Box.GetConfig()
+		saveEvent := cfg.GetEventSavedHours() > 0
+		uploadCloud := !cfg.GetDisableCloud()
+		videoDuration := cfg.GetVideoClipDuration()
+		u.processEvent(cam, eventType, ev.Time.Unix(), base64.StdEncoding.EncodeToString(snapshot), &structs.MetaScanData{},
+			saveEvent, uploadCloud, false, recvTime, videoDuration)
+	}()
+}
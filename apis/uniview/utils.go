@@ -64,20 +64,20 @@ func (u *UniviewAPI) notifyCloudEventVideoClipUploadFailed(remoteID string, even
 	}
 }
 
-func (u *UniviewAPI) processEvent(univCam *uniview.BaseUniviewCamera, eventType string, eventTime int64, imgBase64 string,
+func (u *UniviewAPI) processEvent(cam base.Camera, eventType string, eventTime int64, imgBase64 string,
 	meta *structs.MetaScanData, saveEvent, uploadCloud, uploadVideo bool, recvTime time.Time, videoDuration int64) (remoteID string) {
 
-	remoteID, eventID, videoUploaded := u.innerProcessEvent(univCam, eventType, eventTime, imgBase64, meta, saveEvent, uploadCloud, uploadVideo, recvTime, videoDuration)
+	remoteID, eventID, videoUploaded := u.innerProcessEvent(cam, eventType, eventTime, imgBase64, meta, saveEvent, uploadCloud, uploadVideo, recvTime, videoDuration)
 	go u.notifyCloudEventVideoClipUploadFailed(remoteID, eventID, videoUploaded, uploadVideo)
 
 	return remoteID
 }
 
-func (u *UniviewAPI) innerProcessEvent(univCam *uniview.BaseUniviewCamera, eventType string, eventTime int64, imgBase64 string,
+func (u *UniviewAPI) innerProcessEvent(cam base.Camera, eventType string, eventTime int64, imgBase64 string,
 	meta *structs.MetaScanData, saveEvent, uploadCloud, uploadVideo bool, recvTime time.Time, videoDuration int64) (remoteID string, eventID uint, videoUploaded bool) {
 
-	if !cloud.HasEventType(univCam.ID, eventType) {
-		u.Logger.Warn().Msgf("you don't have license: %s on this camera: %d", eventType, univCam.ID)
+	if !cloud.HasEventType(cam.GetID(), eventType) {
+		u.Logger.Warn().Msgf("you don't have license: %s on this camera: %d", eventType, cam.GetID())
 		return
 	}
 	var err error
@@ -88,21 +88,21 @@ func (u *UniviewAPI) innerProcessEvent(univCam *uniview.BaseUniviewCamera, event
 	// Try to convert coordinates in meta
 	w, h, whErr := utils.ImageWidthHeight(imgBase64)
 	if whErr != nil {
-		u.Logger.Error().Err(whErr).Msgf("failed to calc image width height for camera %d, ipc time: %d", univCam.ID, eventTime)
+		u.Logger.Error().Err(whErr).Msgf("failed to calc image width height for camera %d, ipc time: %d", cam.GetID(), eventTime)
 	} else {
 		u.convertCoordinates(w, h, meta)
 	}
 
 	// save event in local db
 	if saveEvent {
-		if eventID, err = u.saveEventToDB(univCam.GetSN(), univCam.GetID(), eventType, imgBase64, meta, eventTime, recvTime); err == nil {
+		if eventID, err = u.saveEventToDB(cam.GetSN(), cam.GetID(), eventType, imgBase64, meta, eventTime, recvTime); err == nil {
 			saved = true
 		}
 	}
 
 	// upload event to cloud
 	if uploadCloud {
-		if remoteID, err = u.uploadEventToCloud(imgBase64, univCam.ID, eventType, recvTime, time.Unix(eventTime, 0), meta); err != nil || remoteID == "" {
+		if remoteID, err = u.uploadEventToCloud(imgBase64, cam.GetID(), eventType, recvTime, time.Unix(eventTime, 0), meta); err != nil || remoteID == "" {
 			u.Logger.Error().Err(err).Msg("failed to upload event to cloud")
 		}
 	}
@@ -116,8 +116,8 @@ func (u *UniviewAPI) innerProcessEvent(univCam *uniview.BaseUniviewCamera, event
 		if duration > 0 {
 			time.Sleep(duration)
 		}
-		if videoPath, s3File, err = u.handleEventVideo(remoteID, univCam.GetID(), startTime, endTime); err != nil {
-			u.Logger.Error().Err(err).Msgf("camera %d handle event video error,remote id %s", univCam.GetID(), remoteID)
+		if videoPath, s3File, err = u.handleEventVideo(remoteID, cam.GetID(), startTime, endTime); err != nil {
+			u.Logger.Error().Err(err).Msgf("camera %d handle event video error,remote id %s", cam.GetID(), remoteID)
 		} else {
 			videoUploaded = true
 		}
@@ -139,7 +139,7 @@ func (u *UniviewAPI) innerProcessEvent(univCam *uniview.BaseUniviewCamera, event
 	}
 
 	// upload event to cloud success, update remoteID firstly
-	if err = u.DB.UpdateEvent(eventID, remoteID, int64(univCam.ID)); err != nil {
+	if err = u.DB.UpdateEvent(eventID, remoteID, int64(cam.GetID())); err != nil {
 		u.Logger.Error().Err(err).Uint("eventID", eventID).
 			Str("remoteID", remoteID).Msg("failed to update event")
 		return
@@ -310,6 +310,17 @@ func (u *UniviewAPI) handleStandardEvent(univCam *uniview.BaseUniviewCamera, not
 		return fmt.Errorf("unsupported event type")
 	}
 
+	sourceId := strconv.Itoa(univCam.GetID())
+	if notification.StructureInfo.ObjInfo.PersonNum > 0 {
+		box.TriggerEventLinkage(box.EventSourceCamera, sourceId, personEvent)
+	}
+	if notification.StructureInfo.ObjInfo.VehicleNum > 0 {
+		box.TriggerEventLinkage(box.EventSourceCamera, sourceId, vehicleEvent)
+	}
+	if notification.StructureInfo.ObjInfo.NonMotorVehicleNum > 0 {
+		box.TriggerEventLinkage(box.EventSourceCamera, sourceId, motorCycleEvent)
+	}
+
 	if notification.StructureInfo.ObjInfo.PersonNum > 0 {
 		u.assembleEvent(univCam, notification.SrcName, personEvent, notification.Timestamp,
 			saveEvent, uploadCloud, uploadVideo,
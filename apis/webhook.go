@@ -0,0 +1,50 @@
+package apis
+
+import (
+	"net/http"
+
+	"github.com/example/minibox/box"
+	http2 "github.com/example/turing-common/http"
+	"github.com/example/turing-common/log"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+// WebhookAPI serves the snapshots of the webhook deliveries, their names are random.
+type WebhookAPI struct {
+	logger zerolog.Logger
+}
+
+func RegisterWebhookAPI(router *gin.Engine) {
+	api := &WebhookAPI{
+		logger: log.Logger("webhook_api"),
+	}
+	http2.RegisterGinGroupHandler(&router.RouterGroup, api)
+}
+
+func (w *WebhookAPI) BaseURL() string {
+	return "api/webhooks"
+}
+
+func (w *WebhookAPI) Middlewares() []gin.HandlerFunc {
+	return []gin.HandlerFunc{}
+}
+
+func (w *WebhookAPI) Register(group *gin.RouterGroup) {
+	group.GET("snapshots/:name", w.Snapshot)
+}
+
+func (w *WebhookAPI) Snapshot(c *gin.Context) {
+	hooks := box.GetWebhookDispatcher()
+	if hooks == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	path, err := hooks.SnapshotFile(c.Param("name"))
+	if err != nil {
+		w.logger.Debug().Err(err).Str("name", c.Param("name")).Msg("webhook snapshot not found")
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.File(path)
+}
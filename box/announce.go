@@ -0,0 +1,543 @@
+package box
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+
+	"github.com/example/minibox/db"
+)
+
+const (
+	// ttsCommand is the offline text to speech engine, it writes a wav file with -w.
+	ttsCommand = "espeak-ng"
+	ttsDir     = "tts"
+
+	announceMaxTextLen     = 1000
+	announceMaxRepeat      = 5
+	announceScheduleCheck  = 20 * time.Second
+	announcePollInterval   = time.Second
+	announcePlayMargin     = 5 * time.Second
+	announceDefaultTimeout = 60 * time.Second
+	announceEventCooldown  = 30 * time.Second
+	// ttsCacheTTL is how long a rendered text is kept once it is no longer spoken.
+	ttsCacheTTL      = 7 * 24 * time.Hour
+	ttsPruneInterval = time.Hour
+)
+
+var (
+	ErrAnnouncementInvalid  = errors.New("invalid announcement")
+	ErrAnnouncementNotFound = errors.New("announcement not found")
+	ErrInvalidWav           = errors.New("invalid wav file")
+)
+
+var announcer *Announcer
+
+func announceStreamId(t audioTarget) string {
+	return "announce:" + t.key()
+}
+
+// announceSchedule plays an announcement at At, "HH:MM" of the box local time, on
+// Weekdays. Empty Weekdays means every day.
+type announceSchedule struct {
+	Weekdays []time.Weekday `json:"weekdays"`
+	At       string         `json:"at"`
+}
+
+// Announcement is a text spoken on its targets at its schedules, or when a source
+// reports EventType, see PTZEventRule for the sources. It is persisted in the
+// announcements table, Targets and Schedules are stored as json, the targets with the
+// vault refs of their passwords.
+type Announcement struct {
+	ID            int64              `json:"id"`
+	Name          string             `json:"name"`
+	Text          string             `json:"text"`
+	Voice         string             `json:"voice"`
+	Speed         int                `json:"speed"`
+	Repeat        int                `json:"repeat"`
+	Enabled       bool               `json:"enabled"`
+	SourceType    string             `json:"source_type"`
+	SourceID      string             `json:"source_id"`
+	EventType     string             `json:"event_type"`
+	TargetsJSON   string             `json:"-" gorm:"column:targets"`
+	SchedulesJSON string             `json:"-" gorm:"column:schedules"`
+	Targets       []audioTarget      `json:"targets" gorm:"-"`
+	Schedules     []announceSchedule `json:"schedules" gorm:"-"`
+	CreatedAt     time.Time          `json:"-"`
+	UpdatedAt     time.Time          `json:"-"`
+}
+
+func (a *Announcement) validate() error {
+	if err := validateSpeech(a.Text, a.Speed, a.Repeat, a.Targets); err != nil {
+		return err
+	}
+	if a.EventType != "" && !isEventSource(a.SourceType) {
+		return ErrAnnouncementInvalid
+	}
+	for _, s := range a.Schedules {
+		if _, err := parseDayMinute(s.At); err != nil {
+			return ErrAnnouncementInvalid
+		}
+		for _, d := range s.Weekdays {
+			if d < time.Sunday || d > time.Saturday {
+				return ErrAnnouncementInvalid
+			}
+		}
+	}
+	return nil
+}
+
+func validateSpeech(text string, speed, repeat int, targets []audioTarget) error {
+	if strings.TrimSpace(text) == "" || len(text) > announceMaxTextLen {
+		return ErrAnnouncementInvalid
+	}
+	if speed < 0 || repeat < 0 || repeat > announceMaxRepeat || len(targets) == 0 {
+		return ErrAnnouncementInvalid
+	}
+	for _, t := range targets {
+		if t.validate() != nil {
+			return ErrAnnouncementInvalid
+		}
+	}
+	return nil
+}
+
+func (a *Announcement) encode() error {
+	targets, err := json.Marshal(a.Targets)
+	if err != nil {
+		return err
+	}
+	schedules, err := json.Marshal(a.Schedules)
+	if err != nil {
+		return err
+	}
+	a.TargetsJSON, a.SchedulesJSON = string(targets), string(schedules)
+	return nil
+}
+
+func (a *Announcement) decode() error {
+	if err := json.Unmarshal([]byte(a.TargetsJSON), &a.Targets); err != nil {
+		return err
+	}
+	if a.SchedulesJSON == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(a.SchedulesJSON), &a.Schedules)
+}
+
+func (a *Announcement) matchEvent(sourceType, sourceId, eventType string) bool {
+	return a.Enabled && a.EventType != "" && a.SourceType == sourceType &&
+		(a.SourceID == "" || strings.EqualFold(a.SourceID, sourceId)) &&
+		strings.EqualFold(a.EventType, eventType)
+}
+
+// scheduleDue tells if one of the schedules is at the minute of now.
+func (a *Announcement) scheduleDue(now time.Time) bool {
+	if !a.Enabled {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	for _, s := range a.Schedules {
+		at, err := parseDayMinute(s.At)
+		if err == nil && at == minute && hasWeekday(s.Weekdays, now.Weekday()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Announcer speaks texts on speakers and camera backchannels. The text is rendered to a
+// wav file by the offline TTS engine, then sent to each target as a backward audio
+// stream of the stream manager.
+type Announcer struct {
+	device        Box
+	db            db.Client
+	logger        zerolog.Logger
+	lock          sync.Mutex
+	announcements map[int64]*Announcement
+	// triggered is when an announcement was last spoken for an event and scheduled when
+	// for a schedule, a schedule does not hold back the events nor the opposite.
+	triggered map[int64]time.Time
+	scheduled map[int64]time.Time
+	ttsDir    string
+	now       func() time.Time
+
+	synthesize func(text, voice string, speed int) (string, error)
+	play       func(target audioTarget, file string, duration time.Duration) error
+}
+
+func NewAnnouncer(device Box, d db.Client) *Announcer {
+	a := &Announcer{
+		device:        device,
+		db:            d,
+		logger:        log.Logger("announce"),
+		announcements: make(map[int64]*Announcement),
+		triggered:     make(map[int64]time.Time),
+		scheduled:     make(map[int64]time.Time),
+		ttsDir:        filepath.Join(device.GetConfig().GetDataStoreDir(), ttsDir),
+		now:           time.Now,
+	}
+	a.synthesize = func(text, voice string, speed int) (string, error) {
+		return synthesizeSpeech(a.ttsDir, text, voice, speed)
+	}
+	a.play = a.playStream
+	announcer = a
+
+	client := d.GetDBInstance()
+	if err := client.AutoMigrate(&Announcement{}); err != nil {
+		a.logger.Error().Err(err).Msg("failed to migrate announcements")
+	}
+	var announcements []*Announcement
+	if err := client.Find(&announcements).Error; err != nil {
+		a.logger.Error().Err(err).Msg("failed to load announcements")
+	}
+	a.lock.Lock()
+	for _, v := range announcements {
+		if err := v.decode(); err != nil {
+			a.logger.Error().Err(err).Int64("announcement_id", v.ID).Msg("failed to decode announcement")
+			continue
+		}
+		if err := loadAudioTargets(d, CredentialKindAnnouncement, v.ID, v.Targets, &Announcement{}, "targets"); err != nil {
+			a.logger.Error().Err(err).Int64("announcement_id", v.ID).Msg("failed to load announcement passwords")
+		}
+		a.announcements[v.ID] = v
+	}
+	a.lock.Unlock()
+	go a.runSchedules()
+	return a
+}
+
+func GetAnnouncer() *Announcer {
+	return announcer
+}
+
+// Save creates or updates an announcement.
+func (a *Announcer) Save(v *Announcement) error {
+	if err := v.validate(); err != nil {
+		return err
+	}
+	if err := v.encode(); err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	targets := 0
+	if v.ID > 0 {
+		old, ok := a.announcements[v.ID]
+		if !ok {
+			return ErrAnnouncementNotFound
+		}
+		targets = len(old.Targets)
+	}
+	if err := a.save(v); err != nil {
+		return err
+	}
+	dropAudioTargets(CredentialKindAnnouncement, v.ID, len(v.Targets), targets)
+	a.announcements[v.ID] = v
+	return nil
+}
+
+// save stores an announcement with the vault refs of the target passwords. The passwords
+// are kept by the id of the announcement, a new announcement is created without its
+// targets first.
+func (a *Announcer) save(v *Announcement) error {
+	client := a.db.GetDBInstance()
+	row := *v
+	created := v.ID == 0
+	if created {
+		row.TargetsJSON = "[]"
+		if err := client.Create(&row).Error; err != nil {
+			return err
+		}
+	}
+	targets, err := sealAudioTargets(CredentialKindAnnouncement, row.ID, v.Targets)
+	if err == nil {
+		row.Targets = targets
+		if err = row.encode(); err == nil {
+			err = client.Save(&row).Error
+		}
+	}
+	if err != nil {
+		if created {
+			client.Where("id = ?", row.ID).Delete(&Announcement{})
+		}
+		return err
+	}
+	v.ID, v.CreatedAt, v.UpdatedAt = row.ID, row.CreatedAt, row.UpdatedAt
+	return nil
+}
+
+func (a *Announcer) Delete(id int64) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.announcements[id]; !ok {
+		return ErrAnnouncementNotFound
+	}
+	if err := a.db.GetDBInstance().Where("id = ?", id).Delete(&Announcement{}).Error; err != nil {
+		return err
+	}
+	dropAudioTargets(CredentialKindAnnouncement, id, 0, len(a.announcements[id].Targets))
+	delete(a.announcements, id)
+	delete(a.triggered, id)
+	delete(a.scheduled, id)
+	return nil
+}
+
+func (a *Announcer) List() []Announcement {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	ret := make([]Announcement, 0, len(a.announcements))
+	for _, v := range a.announcements {
+		announcement := *v
+		announcement.Targets = redactAudioTargets(v.Targets)
+		ret = append(ret, announcement)
+	}
+	return ret
+}
+
+// Speak checks a speech, then renders and plays it on the targets in the background, it
+// only returns the errors of the check.
+func (a *Announcer) Speak(text, voice string, speed, repeat int, targets []audioTarget) error {
+	if err := validateSpeech(text, speed, repeat, targets); err != nil {
+		return err
+	}
+	go a.speak(text, voice, speed, repeat, targets)
+	return nil
+}
+
+// speak renders text and plays it on the targets.
+func (a *Announcer) speak(text, voice string, speed, repeat int, targets []audioTarget) {
+	file, err := a.synthesize(text, voice, speed)
+	if err != nil {
+		a.logger.Warn().Err(err).Msg("failed to render announcement")
+		return
+	}
+	duration, err := wavFileDuration(file)
+	if err != nil {
+		a.logger.Warn().Err(err).Str("file", file).Msg("unknown tts duration")
+		duration = announceDefaultTimeout
+	}
+	if repeat == 0 {
+		repeat = 1
+	}
+	for _, t := range targets {
+		go func(t audioTarget) {
+			for i := 0; i < repeat; i++ {
+				if err := a.play(t, file, duration); err != nil {
+					a.logger.Warn().Err(err).Str("stream_id", announceStreamId(t)).Msg("failed to play announcement")
+					return
+				}
+			}
+		}(t)
+	}
+}
+
+// Trigger speaks the announcements linked to an event, at most once per cooldown.
+func (a *Announcer) Trigger(sourceType, sourceId, eventType string) {
+	a.lock.Lock()
+	now := a.now()
+	var due []Announcement
+	for _, v := range a.announcements {
+		if !v.matchEvent(sourceType, sourceId, eventType) {
+			continue
+		}
+		if last, ok := a.triggered[v.ID]; ok && now.Sub(last) < announceEventCooldown {
+			continue
+		}
+		a.triggered[v.ID] = now
+		due = append(due, *v)
+	}
+	a.lock.Unlock()
+	a.speakAll(due)
+}
+
+func (a *Announcer) runSchedules() {
+	ticker := time.NewTicker(announceScheduleCheck)
+	defer ticker.Stop()
+	pruneTicker := time.NewTicker(ttsPruneInterval)
+	defer pruneTicker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.speakAll(a.dueSchedules())
+		case <-pruneTicker.C:
+			pruneTTSCache(a.ttsDir, a.now())
+		}
+	}
+}
+
+// dueSchedules returns the announcements scheduled at the current minute which have not
+// been spoken in it yet.
+func (a *Announcer) dueSchedules() []Announcement {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := a.now()
+	minute := now.Truncate(time.Minute)
+	var due []Announcement
+	for _, v := range a.announcements {
+		if !v.scheduleDue(now) || !a.scheduled[v.ID].Before(minute) {
+			continue
+		}
+		a.scheduled[v.ID] = now
+		due = append(due, *v)
+	}
+	return due
+}
+
+func (a *Announcer) speakAll(announcements []Announcement) {
+	for _, v := range announcements {
+		if err := a.Speak(v.Text, v.Voice, v.Speed, v.Repeat, v.Targets); err != nil {
+			a.logger.Warn().Err(err).Int64("announcement_id", v.ID).Msg("failed to speak announcement")
+		}
+	}
+}
+
+// playStream sends a wav file to a target and waits until it has been played.
+func (a *Announcer) playStream(target audioTarget, file string, duration time.Duration) error {
+	outputUrl, streamType, err := audioTargetOutput(a.device, target)
+	if err != nil {
+		return err
+	}
+
+	m := newAudioTargetStreams(a.device)
+	streamId := announceStreamId(target)
+	if m.HasStream(streamId) {
+		return ErrBackwardAudioOngoing
+	}
+	if _, err := m.StartStream(streamId, streamType, file, outputUrl); err != nil {
+		return err
+	}
+	defer m.StopStream(streamId)
+
+	ticker := time.NewTicker(announcePollInterval)
+	defer ticker.Stop()
+	timeout := time.After(duration + announcePlayMargin)
+	for {
+		select {
+		case <-timeout:
+			return nil
+		case <-ticker.C:
+			if m.IsStreamStopped(streamId) {
+				return nil
+			}
+		}
+	}
+}
+
+// synthesizeSpeech renders text to a wav file of dir with the TTS engine. The files are
+// named by the hash of their input, so a text already rendered is reused, and touched so
+// that pruneTTSCache keeps it.
+func synthesizeSpeech(dir, text, voice string, speed int) (string, error) {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%s", voice, speed, text)))
+	file := filepath.Join(dir, hex.EncodeToString(sum[:])+".wav")
+	if _, err := os.Stat(file); err == nil {
+		now := time.Now()
+		os.Chtimes(file, now, now)
+		return file, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	cmd := exec.Command(ttsCommand, ttsArgs(text, voice, speed, file)...)
+	var errLog bytes.Buffer
+	cmd.Stderr = &errLog
+	if err := cmd.Run(); err != nil {
+		os.Remove(file)
+		return "", fmt.Errorf("%s: %v %s", ttsCommand, err, errLog.String())
+	}
+	return file, nil
+}
+
+// pruneTTSCache removes the rendered texts which have not been spoken for ttsCacheTTL.
+func pruneTTSCache(dir string, now time.Time) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err == nil && !e.IsDir() && now.Sub(info.ModTime()) > ttsCacheTTL {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+}
+
+func ttsArgs(text, voice string, speed int, file string) []string {
+	args := []string{"-w", file}
+	if voice != "" {
+		args = append(args, "-v", voice)
+	}
+	if speed > 0 {
+		args = append(args, "-s", strconv.Itoa(speed))
+	}
+	// stop the option parsing, a text may start with a dash.
+	return append(args, "--", text)
+}
+
+func wavFileDuration(file string) (time.Duration, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return wavDuration(f)
+}
+
+// wavDuration reads the duration of a RIFF wav from its fmt and data chunks.
+func wavDuration(r io.Reader) (time.Duration, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, ErrInvalidWav
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return 0, ErrInvalidWav
+	}
+	var byteRate uint32
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return 0, ErrInvalidWav
+		}
+		size := binary.LittleEndian.Uint32(chunk[4:8])
+		switch string(chunk[0:4]) {
+		case "fmt ":
+			if size < 16 {
+				return 0, ErrInvalidWav
+			}
+			data := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return 0, ErrInvalidWav
+			}
+			byteRate = binary.LittleEndian.Uint32(data[8:12])
+		case "data":
+			if byteRate == 0 {
+				return 0, ErrInvalidWav
+			}
+			// streamed wavs have no size, 0xffffffff, treat them as unknown.
+			if size == 0xffffffff {
+				return 0, ErrInvalidWav
+			}
+			return time.Duration(size) * time.Second / time.Duration(byteRate), nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(size+size%2)); err != nil {
+				return 0, ErrInvalidWav
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package box
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/example/turing-common/log"
+)
+
+func newTestWav(byteRate uint32, dataSize uint32) []byte {
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(36+dataSize))
+	b.WriteString("WAVE")
+	b.WriteString("fmt ")
+	binary.Write(&b, binary.LittleEndian, uint32(16))
+	binary.Write(&b, binary.LittleEndian, uint16(1))
+	binary.Write(&b, binary.LittleEndian, uint16(1))
+	binary.Write(&b, binary.LittleEndian, uint32(byteRate/2))
+	binary.Write(&b, binary.LittleEndian, byteRate)
+	binary.Write(&b, binary.LittleEndian, uint16(2))
+	binary.Write(&b, binary.LittleEndian, uint16(16))
+	b.WriteString("LIST")
+	binary.Write(&b, binary.LittleEndian, uint32(3))
+	b.Write([]byte{1, 2, 3, 0})
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, dataSize)
+	b.Write(make([]byte, dataSize))
+	return b.Bytes()
+}
+
+func TestWavDuration(t *testing.T) {
+	d, err := wavDuration(bytes.NewReader(newTestWav(44100, 110250)))
+	assert.NoError(t, err)
+	assert.Equal(t, 2500*time.Millisecond, d)
+
+	_, err = wavDuration(bytes.NewReader([]byte("RIFF\x00\x00\x00\x00AVI ")))
+	assert.Equal(t, ErrInvalidWav, err)
+	_, err = wavDuration(bytes.NewReader(newTestWav(44100, 10)[:40]))
+	assert.Equal(t, ErrInvalidWav, err)
+}
+
+func TestTTSArgs(t *testing.T) {
+	assert.Equal(t, []string{"-w", "a.wav", "--", "-hello"}, ttsArgs("-hello", "", 0, "a.wav"))
+	assert.Equal(t, []string{"-w", "a.wav", "-v", "en-us", "-s", "150", "--", "hi"}, ttsArgs("hi", "en-us", 150, "a.wav"))
+}
+
+func TestAnnouncementValidate(t *testing.T) {
+	camera := audioTarget{DeviceType: AudioDTCamera, CameraID: 1}
+	v := &Announcement{Text: "closing in 10 minutes", Targets: []audioTarget{camera},
+		Schedules: []announceSchedule{{Weekdays: []time.Weekday{time.Friday}, At: "21:50"}}}
+	assert.NoError(t, v.validate())
+
+	for _, bad := range []Announcement{
+		{Text: " ", Targets: []audioTarget{camera}},
+		{Text: "hi"},
+		{Text: "hi", Targets: []audioTarget{{DeviceType: AudioDTSpeaker, StreamUri: "10.0.0.2"}}},
+		{Text: "hi", Targets: []audioTarget{camera}, Repeat: 10},
+		{Text: "hi", Targets: []audioTarget{camera}, EventType: "Gunshot"},
+		{Text: "hi", Targets: []audioTarget{camera}, Schedules: []announceSchedule{{At: "noon"}}},
+	} {
+		assert.Equal(t, ErrAnnouncementInvalid, bad.validate(), bad)
+	}
+}
+
+func TestAnnouncerSchedulesAndEvents(t *testing.T) {
+	// 2024-01-05 is a Friday.
+	now := time.Date(2024, 1, 5, 21, 50, 10, 0, time.Local)
+	var mux sync.Mutex
+	played := make(map[string]int)
+	done := make(chan struct{}, 10)
+	a := &Announcer{
+		logger:        log.Logger("announce"),
+		announcements: make(map[int64]*Announcement),
+		triggered:     make(map[int64]time.Time),
+		scheduled:     make(map[int64]time.Time),
+		now:           func() time.Time { return now },
+		synthesize: func(text, voice string, speed int) (string, error) {
+			return "/nonexistent/" + text + ".wav", nil
+		},
+		play: func(target audioTarget, file string, duration time.Duration) error {
+			mux.Lock()
+			played[announceStreamId(target)+" "+file]++
+			mux.Unlock()
+			done <- struct{}{}
+			return nil
+		},
+	}
+	camera := audioTarget{DeviceType: AudioDTCamera, CameraID: 1}
+	a.announcements[1] = &Announcement{ID: 1, Enabled: true, Text: "closing", Targets: []audioTarget{camera},
+		Schedules: []announceSchedule{{Weekdays: []time.Weekday{time.Friday}, At: "21:50"}}}
+	a.announcements[2] = &Announcement{ID: 2, Enabled: true, Text: "evacuate", Repeat: 2, Targets: []audioTarget{camera},
+		SourceType: EventSourceHalo, EventType: "Gunshot"}
+	// a scheduled announcement which is also spoken on an event.
+	a.announcements[3] = &Announcement{ID: 3, Enabled: true, Text: "lockdown", Targets: []audioTarget{camera},
+		SourceType: EventSourceHalo, EventType: "Gunshot",
+		Schedules: []announceSchedule{{Weekdays: []time.Weekday{time.Friday}, At: "21:50"}}}
+
+	due := a.dueSchedules()
+	assert.Len(t, due, 2)
+	// the same minute is spoken once, the event is not held back by the schedule.
+	now = now.Add(20 * time.Second)
+	assert.Empty(t, a.dueSchedules())
+
+	a.Trigger(EventSourceHalo, "00:11:22:33:44:55", "Gunshot")
+	a.Trigger(EventSourceHalo, "00:11:22:33:44:55", "Gunshot")
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("announcement not played")
+		}
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	assert.Equal(t, map[string]int{
+		"announce:camera:1 /nonexistent/evacuate.wav": 2,
+		"announce:camera:1 /nonexistent/lockdown.wav": 1,
+	}, played)
+
+	// nor is the next schedule held back by the event.
+	a.announcements[3].Schedules = []announceSchedule{{At: "21:51"}}
+	now = now.Add(time.Minute)
+	due = a.dueSchedules()
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, int64(3), due[0].ID)
+	}
+
+	a.announcements[4] = &Announcement{ID: 4, Text: "hi", Targets: []audioTarget{{DeviceType: AudioDTSpeaker, StreamUri: "10.0.0.2", Username: "admin", Password: "pass"}}}
+	for _, v := range a.List() {
+		for _, target := range v.Targets {
+			assert.Empty(t, target.Password)
+		}
+	}
+	assert.Equal(t, "pass", a.announcements[4].Targets[0].Password)
+}
+
+func TestPruneTTSCache(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := filepath.Join(dir, "old.wav")
+	recent := filepath.Join(dir, "recent.wav")
+	assert.NoError(t, os.WriteFile(old, nil, 0644))
+	assert.NoError(t, os.WriteFile(recent, nil, 0644))
+	assert.NoError(t, os.Chtimes(old, now.Add(-ttsCacheTTL-time.Hour), now.Add(-ttsCacheTTL-time.Hour)))
+
+	pruneTTSCache(dir, now)
+	assert.NoFileExists(t, old)
+	assert.FileExists(t, recent)
+}
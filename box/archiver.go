@@ -57,6 +57,10 @@ const (
 var isDiskFull bool
 var isDiskFullNotified bool
 
+// isDiskFullPublished is set once the local integrations got the disk full alarm, which
+// do not wait for the cloud upload to succeed.
+var isDiskFullPublished bool
+
 type ArchiveTaskRunner struct {
 	device                                Box
 	db                                    db.Client
@@ -158,6 +162,7 @@ func (a *ArchiveTaskRunner) handleNewSegment() {
 				// Maybe user change the rtsp  port
 				// Lock a.tasks than changed the css which in a.tasks, will be more safe
 				a.lock.Lock()
+				GetRestreamProxy(a.device).Release(a.restreamConsumer(css))
 				_ = a.refreshStreamUrl(css)
 				atomic.StoreInt32(&css.RunningStatus, model.CloudStorageTaskStandby)
 				a.lock.Unlock()
@@ -284,7 +289,7 @@ func (a *ArchiveTaskRunner) HandleArchiveTasks() {
 				if !isDiskFullNotified {
 					//	Alarm
 					atime := time.Now().Format(utils.CloudTimeLayout)
-					alarmErr := a.device.CloudClient().UploadAlarmInfo(&cloud.AlarmInfo{
+					alarm := &cloud.AlarmInfo{
 						Detection: cloud.Detection{
 							Algos: cloud.AlarmTypeBoxDiskFull,
 						},
@@ -293,7 +298,17 @@ func (a *ArchiveTaskRunner) HandleArchiveTasks() {
 						StartedAt: atime,
 						EndedAt:   atime,
 						Metadata:  cloud.AlarmMetaData{},
-					})
+					}
+					if !isDiskFullPublished {
+						isDiskFullPublished = true
+						if bridge := GetMQTTBridge(); bridge != nil {
+							bridge.PublishAlarm(alarm)
+						}
+						if hooks := GetWebhookDispatcher(); hooks != nil {
+							hooks.Alarm(alarm)
+						}
+					}
+					alarmErr := a.device.CloudClient().UploadAlarmInfo(alarm)
 					if alarmErr == nil {
 						isDiskFullNotified = true
 					}
@@ -303,6 +318,7 @@ func (a *ArchiveTaskRunner) HandleArchiveTasks() {
 				a.logger.Info().Msgf("disk usage:%d <= %d, resume cloud storage", diskUsage, atr.cloudStorageResumeDiskUsage)
 				isDiskFull = false
 				isDiskFullNotified = false
+				isDiskFullPublished = false
 			}
 		} else {
 			a.logger.Error().Msgf("disk usage find err:%v", err)
@@ -552,7 +568,7 @@ func (a *ArchiveTaskRunner) getStreamUrl(setting *model.CloudStorageSetting, cam
 		if err != nil {
 			return "", fmt.Errorf("getStreamUrl:%v", err)
 		}
-		u.User = url.UserPassword(cam.GetUserName(), cam.GetPassword())
+		u.User = url.UserPassword(cam.GetUserName(), cameraPassword(cam))
 		return u.String(), nil
 	} else {
 		aiCam := cam.(base.AICamera)
@@ -15,9 +15,17 @@ func (a *ArchiveTaskRunner) processLiveTask(task *model.CloudStorageSetting) {
 		return
 	}
 
+	// share the camera pull with the live streams, the stream url is restored by
+	// refreshStreamUrl when the task stops.
+	if proxy := GetRestreamProxy(a.device); proxy.Enabled() {
+		if uri, err := proxy.Acquire(a.restreamConsumer(task), int64(task.CameraId), task.Resolution); err == nil {
+			task.StreamUrl = uri
+		}
+	}
 	task.Ctx, task.Cancel = context.WithCancel(context.Background())
 	processor, err := streamer.NewArchiver(task.Ctx, task, a.outputChan, a.stopNotify, streamer.WithDataDir(a.device.GetConfig().GetDataStoreDir()))
 	if err != nil {
+		GetRestreamProxy(a.device).Release(a.restreamConsumer(task))
 		a.logger.Err(err).Msgf("failed to start archiver task: %s", a.getTaskKey(task))
 		return
 	}
@@ -25,3 +33,8 @@ func (a *ArchiveTaskRunner) processLiveTask(task *model.CloudStorageSetting) {
 	task.RunningStatus = model.CloudStorageRunning
 	a.logger.Info().Msgf("task :%s, camera: %d is started", a.getTaskKey(task), task.CameraId)
 }
+
+// restreamConsumer is keyed by the task key, which outlives the reloads of the task.
+func (a *ArchiveTaskRunner) restreamConsumer(task *model.CloudStorageSetting) string {
+	return "archive:" + a.getTaskKey(task)
+}
@@ -0,0 +1,214 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/example/minibox/camera/base"
+	"github.com/example/minibox/db"
+	"github.com/example/minibox/stream"
+)
+
+var ErrInvalidAudioTarget = errors.New("invalid audio target")
+
+// onvifBackchannelStreamType is the stream type of the targets played through
+// OnvifBackchannels rather than the stream manager.
+const onvifBackchannelStreamType = "onvif_backchannel"
+
+// audioTarget is a device backward audio is sent to, a speaker addressed like the general
+// backward audio, a camera backchannel, or the ONVIF backchannel of a camera addressed by
+// its camera id or its rtsp url. The password of a stored target is a ref to the
+// credential vault, see sealAudioTargets.
+type audioTarget struct {
+	DeviceType AudioDeviceType `json:"device_type"`
+	CameraID   int             `json:"camera_id,omitempty"`
+	StreamUri  string          `json:"device_stream_uri,omitempty"`
+	Username   string          `json:"device_username,omitempty"`
+	Password   string          `json:"device_password,omitempty"`
+}
+
+func (t audioTarget) validate() error {
+	switch t.DeviceType {
+	case AudioDTCamera:
+		if t.CameraID < 1 {
+			return ErrInvalidAudioTarget
+		}
+	case AudioDTSpeaker:
+		if t.StreamUri == "" || t.Username == "" || t.Password == "" {
+			return ErrInvalidAudioTarget
+		}
+	case AudioDTOnvif:
+		if t.CameraID < 1 && t.StreamUri == "" {
+			return ErrInvalidAudioTarget
+		}
+	default:
+		return ErrInvalidAudioTarget
+	}
+	return nil
+}
+
+// key identifies the device of a target.
+func (t audioTarget) key() string {
+	switch {
+	case t.DeviceType == AudioDTCamera:
+		return fmt.Sprintf("camera:%d", t.CameraID)
+	case t.DeviceType == AudioDTOnvif && t.StreamUri == "":
+		return fmt.Sprintf("onvif:%d", t.CameraID)
+	case t.DeviceType == AudioDTOnvif:
+		return fmt.Sprintf("onvif:%s", t.StreamUri)
+	}
+	return fmt.Sprintf("speaker:%s", t.StreamUri)
+}
+
+// audioTargetDevice is the vault device of the password of the i-th target of owner.
+func audioTargetDevice(owner int64, i int) string {
+	return fmt.Sprintf("%d/%d", owner, i)
+}
+
+// redactAudioTargets returns a copy of targets without their passwords, to list them.
+func redactAudioTargets(targets []audioTarget) []audioTarget {
+	ret := make([]audioTarget, len(targets))
+	for i, t := range targets {
+		t.Password = ""
+		ret[i] = t
+	}
+	return ret
+}
+
+// sealAudioTargets returns the targets of owner to store, with the vault refs of their
+// passwords in place of the passwords.
+func sealAudioTargets(kind string, owner int64, targets []audioTarget) ([]audioTarget, error) {
+	ret := make([]audioTarget, len(targets))
+	for i, t := range targets {
+		if t.Password == "" {
+			dropSecret(kind, audioTargetDevice(owner, i))
+		}
+		ref, err := sealSecret(kind, audioTargetDevice(owner, i), t.Password)
+		if err != nil {
+			return nil, err
+		}
+		t.Password = ref
+		ret[i] = t
+	}
+	return ret, nil
+}
+
+// dropAudioTargets removes the passwords of the targets of owner at the indexes from from
+// to to, excluded, from the vault.
+func dropAudioTargets(kind string, owner int64, from, to int) {
+	for i := from; i < to; i++ {
+		dropSecret(kind, audioTargetDevice(owner, i))
+	}
+}
+
+// loadAudioTargets reads the passwords of the targets of owner, loaded from column of a
+// row of model, from the vault. The passwords still stored as they are are moved to the
+// vault and the column of the row is set to the targets with their refs.
+func loadAudioTargets(d db.Client, kind string, owner int64, targets []audioTarget, model interface{}, column string) error {
+	stored := make([]audioTarget, len(targets))
+	moved := false
+	var failed error
+	for i, t := range targets {
+		secret, ref, err := loadSecret(kind, audioTargetDevice(owner, i), t.Password)
+		if err != nil {
+			failed = err
+			ref = t.Password
+		}
+		moved = moved || ref != t.Password
+		targets[i].Password = secret
+		t.Password = ref
+		stored[i] = t
+	}
+	if !moved {
+		return failed
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if err := d.GetDBInstance().Model(model).Where("id = ?", owner).Update(column, string(data)).Error; err != nil {
+		return err
+	}
+	return failed
+}
+
+// audioTargetOutput returns the url and the stream type to send backward audio to a target.
+func audioTargetOutput(device Box, t audioTarget) (string, string, error) {
+	switch t.DeviceType {
+	case AudioDTCamera:
+		cam, err := device.GetCamera(t.CameraID)
+		if err != nil {
+			return "", "", err
+		}
+		aiCam, ok := cam.(base.AICamera)
+		if !ok {
+			return "", "", ErrInvalidAICamera
+		}
+		outputUrl := backwardAudioUrl(device, aiCam)
+		if outputUrl == "" {
+			return "", "", ErrNotBackwardAudioCamera
+		}
+		return outputUrl, string(stream.BackwardAudioType), nil
+	case AudioDTSpeaker:
+		outputUrl, err := backwardSpeakerAudioUrl(t.StreamUri, t.Username, t.Password)
+		if err != nil {
+			return "", "", err
+		}
+		return outputUrl, string(stream.BackwardAudioSpeaker), nil
+	case AudioDTOnvif:
+		streamUri, username, password := t.StreamUri, t.Username, t.Password
+		if streamUri == "" {
+			cam, err := device.GetCamera(t.CameraID)
+			if err != nil {
+				return "", "", err
+			}
+			streamUri, username, password = cam.GetUri(), cam.GetUserName(), cameraPassword(cam)
+		}
+		rtspUrl, err := onvifBackchannelUrl(streamUri, username, password)
+		if err != nil {
+			return "", "", err
+		}
+		return rtspUrl, onvifBackchannelStreamType, nil
+	}
+	return "", "", ErrInvalidAudioTarget
+}
+
+// audioTargetStreams plays the targets of every type, the ONVIF backchannels through
+// OnvifBackchannels and the others through the stream manager.
+type audioTargetStreams struct {
+	manager      backwardAudioStreams
+	backchannels *OnvifBackchannels
+}
+
+func newAudioTargetStreams(device Box) audioTargetStreams {
+	return audioTargetStreams{
+		manager:      stream.GetManager(device.GetConfig()),
+		backchannels: GetOnvifBackchannels(),
+	}
+}
+
+func (s audioTargetStreams) HasStream(streamId string) bool {
+	return s.backchannels.HasStream(streamId) || s.manager.HasStream(streamId)
+}
+
+func (s audioTargetStreams) StartStream(streamId, streamType, inputUrl, outputUrl string) (string, error) {
+	if streamType == onvifBackchannelStreamType {
+		return s.backchannels.Start(streamId, inputUrl, outputUrl)
+	}
+	return s.manager.StartStream(streamId, streamType, inputUrl, outputUrl)
+}
+
+func (s audioTargetStreams) StopStream(streamId string) error {
+	if s.backchannels.HasStream(streamId) {
+		return s.backchannels.Stop(streamId)
+	}
+	return s.manager.StopStream(streamId)
+}
+
+func (s audioTargetStreams) IsStreamStopped(streamId string) bool {
+	if s.backchannels.HasStream(streamId) {
+		return s.backchannels.IsStreamStopped(streamId)
+	}
+	return s.manager.IsStreamStopped(streamId)
+}
@@ -0,0 +1,392 @@
+package box
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/icholy/digest"
+)
+
+const (
+	axisMediaClipUrl      = "http://%s/axis-cgi/mediaclip.cgi"
+	axisClipTimeout       = 30 * time.Second
+	axisClipMaxSize       = 10 << 20
+	axisClipSyncWorkers   = 4
+	axisClipParamPrefix   = "root.MediaClip.M"
+	axisClipUploadField   = "file"
+	axisClipDefaultFormat = ".mp3"
+)
+
+var (
+	ErrAxisClipNotFound = errors.New("media clip not found on the speaker")
+	ErrAxisClipTooLarge = errors.New("media clip is too large")
+)
+
+// axisClip is a media clip stored on an Axis speaker, parsed from the MediaClip param
+// group. ID is the MediaID played by iotPlayAudioClip.
+type axisClip struct {
+	ID       int64  `json:"media_id"`
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	Type     string `json:"type"`
+}
+
+// parseAxisClips parses the lines of param.cgi?action=list&group=MediaClip, like
+// root.MediaClip.M3.Name=Doorbell.
+func parseAxisClips(r io.Reader) ([]axisClip, error) {
+	clips := make(map[int64]*axisClip)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, axisClipParamPrefix) {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, axisClipParamPrefix), "=")
+		if !ok {
+			continue
+		}
+		idStr, field, ok := strings.Cut(key, ".")
+		if !ok {
+			continue
+		}
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		clip, ok := clips[id]
+		if !ok {
+			clip = &axisClip{ID: id}
+			clips[id] = clip
+		}
+		switch field {
+		case "Name":
+			clip.Name = value
+		case "Location":
+			clip.Location = value
+		case "Type":
+			clip.Type = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	ret := make([]axisClip, 0, len(clips))
+	for _, clip := range clips {
+		ret = append(ret, *clip)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret, nil
+}
+
+// axisSpeaker manages the media clips of an Axis speaker through VAPIX, with digest auth.
+type axisSpeaker struct {
+	host   string
+	client *http.Client
+}
+
+func newAxisSpeaker(host, username, password string) *axisSpeaker {
+	return &axisSpeaker{
+		host: host,
+		client: &http.Client{
+			Timeout: axisClipTimeout,
+			Transport: &digest.Transport{
+				Username: username,
+				Password: password,
+			},
+		},
+	}
+}
+
+func (s *axisSpeaker) do(req *http.Request) ([]byte, error) {
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized {
+		return nil, ErrHttpAuthFailed
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status code: %d", res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	// VAPIX cgis answer errors with 200 and an "# Error" body.
+	if text := strings.TrimSpace(string(body)); strings.HasPrefix(text, "# Error") || strings.HasPrefix(text, "Error") {
+		return nil, fmt.Errorf("axis: %s", text)
+	}
+	return body, nil
+}
+
+func (s *axisSpeaker) ListClips() ([]axisClip, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(axisListClipUrl, s.host), nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return parseAxisClips(bytes.NewReader(body))
+}
+
+// UploadClip stores an audio clip on the speaker, the speaker names it after the file.
+// It returns the new clip, found by listing the clips before and after the upload.
+func (s *axisSpeaker) UploadClip(name string, data []byte) (*axisClip, error) {
+	if len(data) > axisClipMaxSize {
+		return nil, ErrAxisClipTooLarge
+	}
+	before, err := s.ListClips()
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fileName := name
+	if path.Ext(fileName) == "" {
+		fileName += axisClipDefaultFormat
+	}
+	part, err := w.CreateFormFile(axisClipUploadField, fileName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = part.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	// a bytes.Reader body can be sent again after the digest challenge.
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf(axisMediaClipUrl, s.host)+"?action=upload&media=audio",
+		bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if _, err = s.do(req); err != nil {
+		return nil, err
+	}
+
+	after, err := s.ListClips()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[int64]bool, len(before))
+	for _, c := range before {
+		known[c.ID] = true
+	}
+	for _, c := range after {
+		if !known[c.ID] {
+			return &c, nil
+		}
+	}
+	return nil, ErrAxisClipNotFound
+}
+
+func (s *axisSpeaker) DeleteClip(id int64) error {
+	req, err := http.NewRequest(http.MethodGet,
+		fmt.Sprintf(axisMediaClipUrl, s.host)+"?action=remove&clip="+strconv.FormatInt(id, 10), nil)
+	if err != nil {
+		return err
+	}
+	_, err = s.do(req)
+	return err
+}
+
+// ReplaceClip swaps the content of a clip, the new content is uploaded before the old
+// clip is removed, so a failed upload leaves the clip as it was. The returned clip has a
+// new MediaID.
+func (s *axisSpeaker) ReplaceClip(id int64, name string, data []byte) (*axisClip, error) {
+	clips, err := s.ListClips()
+	if err != nil {
+		return nil, err
+	}
+	var old *axisClip
+	for i := range clips {
+		if clips[i].ID == id {
+			old = &clips[i]
+		}
+	}
+	if old == nil {
+		return nil, ErrAxisClipNotFound
+	}
+	if name == "" {
+		name = old.Name
+	}
+	clip, err := s.UploadClip(name, data)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.DeleteClip(id); err != nil {
+		// keep a single copy of the clip.
+		s.DeleteClip(clip.ID)
+		return nil, err
+	}
+	return clip, nil
+}
+
+// downloadAxisClip fetches a clip of the cloud library.
+func downloadAxisClip(url string) ([]byte, error) {
+	client := &http.Client{Timeout: axisClipTimeout}
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download clip http status code: %d", res.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, axisClipMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > axisClipMaxSize {
+		return nil, ErrAxisClipTooLarge
+	}
+	return data, nil
+}
+
+// axisLibraryClip is a clip of the cloud library, synced to the speakers by name.
+type axisLibraryClip struct {
+	Name string `json:"name" mapstructure:"name" validate:"required"`
+	Url  string `json:"url" mapstructure:"url" validate:"required,url"`
+}
+
+type axisSpeakerAuth struct {
+	DeviceID  int64  `json:"device_id" mapstructure:"device_id"`
+	IPAddress string `json:"ip_address" mapstructure:"ip_address" validate:"required"`
+	Username  string `json:"username" mapstructure:"username" validate:"required"`
+	Password  string `json:"password" mapstructure:"password" validate:"required"`
+}
+
+// axisSpeakerInventory reports the clips of a speaker, or why they could not be listed.
+type axisSpeakerInventory struct {
+	DeviceID  int64      `json:"device_id"`
+	IPAddress string     `json:"ip_address"`
+	Clips     []axisClip `json:"clips"`
+	Uploaded  []string   `json:"uploaded,omitempty"`
+	Deleted   []string   `json:"deleted,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// syncAxisClipLibrary makes the clips of the speakers match the library: the missing
+// clips are uploaded, the ones with replace are uploaded again, and with prune the clips
+// not in the library are deleted. The library is downloaded once for all the speakers.
+func syncAxisClipLibrary(library []axisLibraryClip, speakers []axisSpeakerAuth, replace, prune bool,
+	download func(url string) ([]byte, error)) []axisSpeakerInventory {
+	var mux sync.Mutex
+	data := make(map[string][]byte)
+	downloadErr := make(map[string]error)
+	load := func(c axisLibraryClip) ([]byte, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		if d, ok := data[c.Name]; ok {
+			return d, nil
+		}
+		if err, ok := downloadErr[c.Name]; ok {
+			return nil, err
+		}
+		d, err := download(c.Url)
+		if err != nil {
+			downloadErr[c.Name] = err
+			return nil, err
+		}
+		data[c.Name] = d
+		return d, nil
+	}
+
+	ret := make([]axisSpeakerInventory, len(speakers))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < axisClipSyncWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				ret[j] = syncAxisSpeakerClips(library, speakers[j], replace, prune, load)
+			}
+		}()
+	}
+	for i := range speakers {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return ret
+}
+
+func syncAxisSpeakerClips(library []axisLibraryClip, auth axisSpeakerAuth, replace, prune bool,
+	load func(c axisLibraryClip) ([]byte, error)) axisSpeakerInventory {
+	inventory := axisSpeakerInventory{DeviceID: auth.DeviceID, IPAddress: auth.IPAddress}
+	speaker := newAxisSpeaker(auth.IPAddress, auth.Username, auth.Password)
+	clips, err := speaker.ListClips()
+	if err != nil {
+		inventory.Error = err.Error()
+		return inventory
+	}
+	if len(library) == 0 && !prune {
+		inventory.Clips = clips
+		return inventory
+	}
+	byName := make(map[string]axisClip, len(clips))
+	for _, c := range clips {
+		byName[c.Name] = c
+	}
+
+	var errs []string
+	wanted := make(map[string]bool, len(library))
+	for _, lc := range library {
+		wanted[lc.Name] = true
+		existing, ok := byName[lc.Name]
+		if ok && !replace {
+			continue
+		}
+		d, err := load(lc)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", lc.Name, err))
+			continue
+		}
+		if ok {
+			_, err = speaker.ReplaceClip(existing.ID, lc.Name, d)
+		} else {
+			_, err = speaker.UploadClip(lc.Name, d)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", lc.Name, err))
+			continue
+		}
+		inventory.Uploaded = append(inventory.Uploaded, lc.Name)
+	}
+	if prune {
+		for _, c := range clips {
+			if wanted[c.Name] {
+				continue
+			}
+			if err := speaker.DeleteClip(c.ID); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", c.Name, err))
+				continue
+			}
+			inventory.Deleted = append(inventory.Deleted, c.Name)
+		}
+	}
+
+	if inventory.Clips, err = speaker.ListClips(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	inventory.Error = strings.Join(errs, "; ")
+	return inventory
+}
@@ -0,0 +1,156 @@
+package box
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAxisSpeaker struct {
+	mux    sync.Mutex
+	nextID int64
+	clips  map[int64]string
+}
+
+func (f *fakeAxisSpeaker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	switch {
+	case r.URL.Path == "/axis-cgi/param.cgi":
+		ids := make([]int64, 0, len(f.clips))
+		for id := range f.clips {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			fmt.Fprintf(w, "root.MediaClip.M%d.Location=/etc/audioclips/%s.mp3\n", id, f.clips[id])
+			fmt.Fprintf(w, "root.MediaClip.M%d.Name=%s\n", id, f.clips[id])
+			fmt.Fprintf(w, "root.MediaClip.M%d.Type=audio\n", id)
+		}
+	case r.URL.Query().Get("action") == "upload":
+		_, header, err := r.FormFile(axisClipUploadField)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.clips[f.nextID] = strings.TrimSuffix(header.Filename, path.Ext(header.Filename))
+		f.nextID++
+		fmt.Fprint(w, "OK")
+	case r.URL.Query().Get("action") == "remove":
+		id, _ := strconv.ParseInt(r.URL.Query().Get("clip"), 10, 64)
+		if _, ok := f.clips[id]; !ok {
+			fmt.Fprint(w, "# Error: clip not found")
+			return
+		}
+		delete(f.clips, id)
+		fmt.Fprint(w, "OK")
+	}
+}
+
+func (f *fakeAxisSpeaker) names() []string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	var ret []string
+	for _, name := range f.clips {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestParseAxisClips(t *testing.T) {
+	clips, err := parseAxisClips(strings.NewReader("root.MediaClip.M10.Name=Doorbell\n" +
+		"root.MediaClip.M10.Location=/etc/audioclips/doorbell.au\n" +
+		"root.MediaClip.M2.Name=Siren=loud\n" +
+		"root.MediaClip.MaxGroups=20\n" +
+		"root.Audio.A0.Name=out\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []axisClip{
+		{ID: 2, Name: "Siren=loud"},
+		{ID: 10, Name: "Doorbell", Location: "/etc/audioclips/doorbell.au"},
+	}, clips)
+}
+
+func TestAxisSpeakerClips(t *testing.T) {
+	fake := &fakeAxisSpeaker{nextID: 5, clips: map[int64]string{1: "Siren"}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	speaker := newAxisSpeaker(strings.TrimPrefix(server.URL, "http://"), "root", "pass")
+
+	clip, err := speaker.UploadClip("Closing", []byte("mp3"))
+	assert.NoError(t, err)
+	assert.Equal(t, &axisClip{ID: 5, Name: "Closing", Location: "/etc/audioclips/Closing.mp3", Type: "audio"}, clip)
+
+	clip, err = speaker.ReplaceClip(5, "", []byte("mp3 v2"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), clip.ID)
+	assert.Equal(t, "Closing", clip.Name)
+	_, err = speaker.ReplaceClip(5, "", []byte("mp3 v3"))
+	assert.Equal(t, ErrAxisClipNotFound, err)
+
+	// a failed upload keeps the old clip.
+	_, err = speaker.ReplaceClip(6, "", make([]byte, axisClipMaxSize+1))
+	assert.Equal(t, ErrAxisClipTooLarge, err)
+	assert.Equal(t, []string{"Closing", "Siren"}, fake.names())
+
+	assert.EqualError(t, speaker.DeleteClip(9), "axis: # Error: clip not found")
+	assert.NoError(t, speaker.DeleteClip(6))
+	clips, err := speaker.ListClips()
+	assert.NoError(t, err)
+	assert.Len(t, clips, 1)
+}
+
+func TestSyncAxisClipLibrary(t *testing.T) {
+	first := &fakeAxisSpeaker{nextID: 3, clips: map[int64]string{1: "Siren", 2: "Old"}}
+	second := &fakeAxisSpeaker{nextID: 1, clips: map[int64]string{}}
+	s1, s2 := httptest.NewServer(first), httptest.NewServer(second)
+	defer s1.Close()
+	defer s2.Close()
+
+	var mux sync.Mutex
+	downloads := make(map[string]int)
+	download := func(url string) ([]byte, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		downloads[url]++
+		if url == "https://cloud/broken" {
+			return nil, fmt.Errorf("not found")
+		}
+		return []byte(url), nil
+	}
+	library := []axisLibraryClip{{Name: "Siren", Url: "https://cloud/siren"}, {Name: "Closing", Url: "https://cloud/closing"}}
+	speakers := []axisSpeakerAuth{
+		{DeviceID: 1, IPAddress: strings.TrimPrefix(s1.URL, "http://"), Username: "root", Password: "pass"},
+		{DeviceID: 2, IPAddress: strings.TrimPrefix(s2.URL, "http://"), Username: "root", Password: "pass"},
+		{DeviceID: 3, IPAddress: "127.0.0.1:1", Username: "root", Password: "pass"},
+	}
+
+	ret := syncAxisClipLibrary(library, speakers, false, true, download)
+	assert.Equal(t, []string{"Closing"}, ret[0].Uploaded)
+	assert.Equal(t, []string{"Old"}, ret[0].Deleted)
+	assert.Empty(t, ret[0].Error)
+	assert.Equal(t, []string{"Siren", "Closing"}, ret[1].Uploaded)
+	assert.Len(t, ret[1].Clips, 2)
+	assert.NotEmpty(t, ret[2].Error)
+	assert.Equal(t, []string{"Closing", "Siren"}, first.names())
+	assert.Equal(t, []string{"Closing", "Siren"}, second.names())
+	// each clip is downloaded once for all the speakers.
+	assert.Equal(t, map[string]int{"https://cloud/siren": 1, "https://cloud/closing": 1}, downloads)
+
+	library = append(library, axisLibraryClip{Name: "Broken", Url: "https://cloud/broken"})
+	ret = syncAxisClipLibrary(library, speakers[:1], true, false, download)
+	assert.Equal(t, []string{"Siren", "Closing"}, ret[0].Uploaded)
+	assert.Equal(t, "Broken: not found", ret[0].Error)
+
+	ret = syncAxisClipLibrary(nil, speakers[1:2], false, false, download)
+	assert.Len(t, ret[0].Clips, 2)
+	assert.Empty(t, ret[0].Uploaded)
+}
@@ -84,6 +84,12 @@ func (b *baseBox) UploadCameraEvent(cameraId int, file *utils.S3File, temperatur
 }
 
 func (b *baseBox) UploadPplEvent(cameraID int, meta *structs.MetaScanData, startAt time.Time, endedAt time.Time, eventType string) (string, error) {
+	if bridge := GetMQTTBridge(); bridge != nil {
+		bridge.PublishPeopleCount(cameraID, eventType, startAt, endedAt, meta)
+	}
+	if hooks := GetWebhookDispatcher(); hooks != nil {
+		hooks.CameraEvent(cameraID, eventType, startAt, endedAt, meta, "")
+	}
 	if b.apiClient == nil {
 		return "", ErrNoAPIClient
 	}
@@ -111,6 +117,21 @@ func (b *baseBox) UploadPplEvent(cameraID int, meta *structs.MetaScanData, start
 }
 
 func (b *baseBox) UploadAICameraEvent(cameraID int, file *utils.S3File, startAt, endAt, timestamp time.Time,
+	eventType string, meta *structs.MetaScanData) (string, error) {
+	if bridge := GetMQTTBridge(); bridge != nil {
+		bridge.PublishCameraEvent(cameraID, eventType, startAt, endAt, meta)
+	}
+	if hooks := GetWebhookDispatcher(); hooks != nil {
+		imageKey := ""
+		if file != nil {
+			imageKey = file.Key
+		}
+		hooks.CameraEvent(cameraID, eventType, startAt, endAt, meta, imageKey)
+	}
+	return b.uploadAICameraEvent(cameraID, file, startAt, endAt, timestamp, eventType, meta)
+}
+
+func (b *baseBox) uploadAICameraEvent(cameraID int, file *utils.S3File, startAt, endAt, timestamp time.Time,
 	eventType string, meta *structs.MetaScanData) (string, error) {
 	if b.apiClient == nil {
 		return "", errors.New("API Client not initialized")
@@ -223,6 +244,9 @@ func (b *baseBox) uploadCameraState(ctx context.Context) {
 			if len(statusM) == 0 {
 				continue
 			}
+			if bridge := GetMQTTBridge(); bridge != nil {
+				bridge.PublishCameraStates(statusM)
+			}
 
 			for _, camStatus := range statusM {
 				if camStatus.State == model.CameraStateOffline {
@@ -396,7 +420,7 @@ func (b *baseBox) retryUploadAICameraEvent(event *db.Event, cfg configs.Config)
 		return "-1", err
 	}
 
-	return b.UploadAICameraEvent(int(event.CameraID), f, event.StartedAt, event.EndedAt, event.IPCTime, event.Type, &meta)
+	return b.uploadAICameraEvent(int(event.CameraID), f, event.StartedAt, event.EndedAt, event.IPCTime, event.Type, &meta)
 }
 
 func (b *baseBox) handleRetryUploadEvents() {
@@ -1296,7 +1320,19 @@ func (b *baseBox) updateIotDevices() {
 		b.checkIotDevice(macIotDeviceMap)
 	}
 	now := time.Now().UTC()
+	monitor := GetHaloMonitor()
 	for _, iotDevice := range macIotDeviceMap {
+		// the Halo devices are tracked by their heartbeats, which raise their own alarms.
+		if monitor != nil {
+			if online, tracked := monitor.DeviceOnline(iotDevice.MacAddress); tracked {
+				iotDevice.State = utils.DeviceStatusOffline
+				if online {
+					iotDevice.State = utils.DeviceStatusOnline
+				}
+				iotDevice.LastSyncTime = now
+				continue
+			}
+		}
 		if iotDevice.Updated {
 			iotDevice.State = utils.DeviceStatusOnline
 		} else {
@@ -1304,7 +1340,7 @@ func (b *baseBox) updateIotDevices() {
 				// State change from online to offline here
 				go func(dev cloud.IotDevice) {
 					atime := time.Now().Format(utils.CloudTimeLayout)
-					err = b.apiClient.UploadAlarmInfo(&cloud.AlarmInfo{
+					alarm := &cloud.AlarmInfo{
 						Source:      cloud.AlarmSourceBridge,
 						BoxId:       b.GetBoxId(),
 						IotDeviceID: dev.ID,
@@ -1313,7 +1349,14 @@ func (b *baseBox) updateIotDevices() {
 						Detection: cloud.Detection{
 							Algos: cloud.AlarmTypeIotDeviceOffline,
 						},
-					})
+					}
+					if bridge := GetMQTTBridge(); bridge != nil {
+						bridge.PublishAlarm(alarm)
+					}
+					if hooks := GetWebhookDispatcher(); hooks != nil {
+						hooks.Alarm(alarm)
+					}
+					err = b.apiClient.UploadAlarmInfo(alarm)
 					if err != nil {
 						b.logger.Debug().Msgf("iot device offline alarm failed, mac: %s", dev.MacAddress)
 					}
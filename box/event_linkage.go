@@ -0,0 +1,23 @@
+package box
+
+const (
+	EventSourceCamera = "camera"
+	EventSourceHalo   = "halo"
+	EventSourceSip    = "sip"
+)
+
+func isEventSource(sourceType string) bool {
+	return sourceType == EventSourceCamera || sourceType == EventSourceHalo || sourceType == EventSourceSip
+}
+
+// TriggerEventLinkage runs the PTZ and announcement rules matching an event. sourceId is
+// a camera id for camera events, a MAC for Halo events or a door station id for SIP
+// events.
+func TriggerEventLinkage(sourceType, sourceId, eventType string) {
+	if linker := GetPTZEventLinker(); linker != nil {
+		linker.Trigger(sourceType, sourceId, eventType)
+	}
+	if announcer := GetAnnouncer(); announcer != nil {
+		announcer.Trigger(sourceType, sourceId, eventType)
+	}
+}
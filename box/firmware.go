@@ -0,0 +1,645 @@
+package box
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+	"github.com/example/turing-common/metrics"
+
+	"github.com/example/minibox/db"
+	"github.com/example/minibox/utils"
+)
+
+const (
+	firmwareDir             = "firmware"
+	firmwareDownloadTimeout = 30 * time.Minute
+	firmwareMaxSize         = 1 << 30
+	// firmwareVerifyTimeout bounds the reboot of a device after its upload, its version
+	// is read every firmwareVerifyInterval until it reports the version of the image.
+	firmwareVerifyTimeout  = 10 * time.Minute
+	firmwareVerifyInterval = 15 * time.Second
+	firmwareDefaultBatch   = 5
+)
+
+// The states of the firmware images.
+const (
+	FirmwareImageDownloading = "downloading"
+	FirmwareImageReady       = "ready"
+	FirmwareImageFailed      = "failed"
+)
+
+// The states of the rollouts and of the upgrades of their devices. An upgrade is skipped
+// when its rollout stops before it.
+const (
+	FirmwareRolloutRunning   = "running"
+	FirmwareRolloutSucceeded = "succeeded"
+	FirmwareRolloutFailed    = "failed"
+	FirmwareRolloutCanceled  = "canceled"
+
+	FirmwareUpgradePending   = "pending"
+	FirmwareUpgradeUploading = "uploading"
+	FirmwareUpgradeVerifying = "verifying"
+	FirmwareUpgradeSucceeded = "succeeded"
+	FirmwareUpgradeFailed    = "failed"
+	FirmwareUpgradeSkipped   = "skipped"
+)
+
+var (
+	ErrFirmwareImageInvalid   = errors.New("invalid firmware image")
+	ErrFirmwareImageNotFound  = errors.New("firmware image not found")
+	ErrFirmwareImageNotReady  = errors.New("firmware image is not downloaded")
+	ErrFirmwareImageInUse     = errors.New("firmware image is used by a running rollout")
+	ErrFirmwareChecksum       = errors.New("firmware image checksum mismatch")
+	ErrFirmwareTooLarge       = errors.New("firmware image is too large")
+	ErrFirmwareRolloutInvalid = errors.New("invalid firmware rollout")
+	ErrFirmwareRolloutRunning = errors.New("a firmware rollout is already running")
+	ErrFirmwareRolloutStopped = errors.New("firmware rollout is not running")
+	ErrFirmwareRolloutUnknown = errors.New("firmware rollout not found")
+	ErrFirmwareModelMismatch  = errors.New("firmware image is not for the model of the device")
+	ErrFirmwareBrandMismatch  = errors.New("firmware image is not for the brand of the device")
+)
+
+var firmwareManager *FirmwareManager
+
+// FirmwareImage is an image downloaded to the box from URL and checked against SHA256.
+// Version is the version the devices report once upgraded, Brand and Model, when set,
+// restrict the devices it is for. It is persisted in the firmware_images table.
+type FirmwareImage struct {
+	ID        int64             `json:"id"`
+	Name      string            `json:"name"`
+	Version   string            `json:"version"`
+	Brand     utils.CameraBrand `json:"brand"`
+	Model     string            `json:"model"`
+	URL       string            `json:"url"`
+	SHA256    string            `json:"sha256"`
+	Size      int64             `json:"size"`
+	Path      string            `json:"-"`
+	State     string            `json:"state"`
+	Error     string            `json:"error"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"-"`
+}
+
+// FirmwareTarget is a device of a rollout, a camera or an NVR managed by the box.
+type FirmwareTarget struct {
+	CameraID int    `json:"camera_id,omitempty"`
+	NvrSN    string `json:"nvr_sn,omitempty"`
+}
+
+// FirmwareRollout upgrades its devices to an image in stages: the first device alone,
+// then BatchSize devices at a time. It stops after a stage with a failed upgrade. It is
+// persisted in the firmware_rollouts table.
+type FirmwareRollout struct {
+	ID         int64              `json:"id"`
+	ImageID    int64              `json:"image_id"`
+	BatchSize  int                `json:"batch_size"`
+	State      string             `json:"state"`
+	Error      string             `json:"error"`
+	Upgrades   []*FirmwareUpgrade `json:"upgrades" gorm:"-"`
+	CreatedAt  time.Time          `json:"created_at"`
+	UpdatedAt  time.Time          `json:"-"`
+	FinishedAt *time.Time         `json:"finished_at"`
+
+	canceled bool
+}
+
+// FirmwareUpgrade is the upgrade of a device of a rollout, Progress is the percentage
+// of the image uploaded. It is persisted in the firmware_upgrades table.
+type FirmwareUpgrade struct {
+	ID          int64      `json:"id"`
+	RolloutID   int64      `json:"rollout_id"`
+	Position    int        `json:"position"`
+	CameraID    int        `json:"camera_id,omitempty"`
+	NvrSN       string     `json:"nvr_sn,omitempty"`
+	State       string     `json:"state"`
+	Progress    int        `json:"progress"`
+	FromVersion string     `json:"from_version"`
+	ToVersion   string     `json:"to_version"`
+	Error       string     `json:"error"`
+	StartedAt   *time.Time `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+	CreatedAt   time.Time  `json:"-"`
+	UpdatedAt   time.Time  `json:"-"`
+}
+
+func (u *FirmwareUpgrade) target() FirmwareTarget {
+	return FirmwareTarget{CameraID: u.CameraID, NvrSN: u.NvrSN}
+}
+
+// FirmwareManager downloads the firmware images and runs the rollouts, one at a time.
+type FirmwareManager struct {
+	device   Box
+	db       db.Client
+	logger   zerolog.Logger
+	lock     sync.Mutex
+	dir      string
+	images   map[int64]*FirmwareImage
+	rollouts map[int64]*FirmwareRollout
+	running  *FirmwareRollout
+	client   *http.Client
+	now      func() time.Time
+
+	verifyTimeout  time.Duration
+	verifyInterval time.Duration
+	driver         func(target FirmwareTarget) (FirmwareDriver, error)
+	persist        func(v interface{})
+}
+
+func NewFirmwareManager(device Box, d db.Client) *FirmwareManager {
+	m := &FirmwareManager{
+		device:         device,
+		db:             d,
+		logger:         log.Logger("firmware"),
+		dir:            filepath.Join(device.GetConfig().GetDataStoreDir(), firmwareDir),
+		images:         make(map[int64]*FirmwareImage),
+		rollouts:       make(map[int64]*FirmwareRollout),
+		client:         &http.Client{Timeout: firmwareDownloadTimeout},
+		now:            time.Now,
+		verifyTimeout:  firmwareVerifyTimeout,
+		verifyInterval: firmwareVerifyInterval,
+	}
+	m.driver = func(target FirmwareTarget) (FirmwareDriver, error) {
+		return newFirmwareDriver(device, target)
+	}
+	m.persist = m.save
+	firmwareManager = m
+
+	client := d.GetDBInstance()
+	if err := client.AutoMigrate(&FirmwareImage{}, &FirmwareRollout{}, &FirmwareUpgrade{}); err != nil {
+		m.logger.Error().Err(err).Msg("failed to migrate firmware tables")
+	}
+	var images []*FirmwareImage
+	if err := client.Find(&images).Error; err != nil {
+		m.logger.Error().Err(err).Msg("failed to load firmware images")
+	}
+	var rollouts []*FirmwareRollout
+	if err := client.Find(&rollouts).Error; err != nil {
+		m.logger.Error().Err(err).Msg("failed to load firmware rollouts")
+	}
+	var upgrades []*FirmwareUpgrade
+	if err := client.Order("position").Find(&upgrades).Error; err != nil {
+		m.logger.Error().Err(err).Msg("failed to load firmware upgrades")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, v := range images {
+		// a download does not survive a restart
+		if v.State == FirmwareImageDownloading {
+			v.State, v.Error = FirmwareImageFailed, "interrupted by a restart"
+			m.persist(v)
+		}
+		m.images[v.ID] = v
+	}
+	for _, v := range rollouts {
+		m.rollouts[v.ID] = v
+	}
+	for _, u := range upgrades {
+		if v, ok := m.rollouts[u.RolloutID]; ok {
+			v.Upgrades = append(v.Upgrades, u)
+		}
+	}
+	now := m.now()
+	for _, v := range m.rollouts {
+		if v.State == FirmwareRolloutRunning {
+			m.stopRollout(v, FirmwareRolloutFailed, "interrupted by a restart", now)
+		}
+	}
+	return m
+}
+
+func GetFirmwareManager() *FirmwareManager {
+	return firmwareManager
+}
+
+func (m *FirmwareManager) save(v interface{}) {
+	if err := m.db.GetDBInstance().Save(v).Error; err != nil {
+		m.logger.Error().Err(err).Msg("failed to save firmware state")
+	}
+}
+
+// AddImage saves an image and downloads it in the background, its state tells when it
+// is ready.
+func (m *FirmwareManager) AddImage(v *FirmwareImage) error {
+	v.SHA256 = strings.ToLower(v.SHA256)
+	if v.URL == "" || v.Version == "" {
+		return ErrFirmwareImageInvalid
+	}
+	if sum, err := hex.DecodeString(v.SHA256); err != nil || len(sum) != sha256.Size {
+		return ErrFirmwareImageInvalid
+	}
+	v.ID, v.Size, v.Path, v.State, v.Error = 0, 0, "", FirmwareImageDownloading, ""
+	if err := m.db.GetDBInstance().Create(v).Error; err != nil {
+		return err
+	}
+	image := *v
+	m.lock.Lock()
+	m.images[v.ID] = &image
+	m.lock.Unlock()
+	go m.download(image)
+	return nil
+}
+
+func (m *FirmwareManager) download(image FirmwareImage) {
+	path := filepath.Join(m.dir, fmt.Sprintf("%d.bin", image.ID))
+	size, err := m.fetch(image.URL, image.SHA256, path)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	v, ok := m.images[image.ID]
+	if !ok {
+		// deleted while downloading
+		os.Remove(path)
+		return
+	}
+	if err != nil {
+		m.logger.Error().Err(err).Int64("image_id", image.ID).Msg("failed to download firmware image")
+		v.State, v.Error = FirmwareImageFailed, err.Error()
+	} else {
+		v.State, v.Size, v.Path = FirmwareImageReady, size, path
+	}
+	m.persist(v)
+}
+
+// fetch downloads url to path and checks its sha256 sum, nothing is left at path when
+// it fails.
+func (m *FirmwareManager) fetch(url, sum, path string) (int64, error) {
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return 0, err
+	}
+	res, err := m.client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("download firmware http status code: %d", res.StatusCode)
+	}
+	tmp := path + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(res.Body, firmwareMaxSize+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	switch {
+	case err != nil:
+	case size > firmwareMaxSize:
+		err = ErrFirmwareTooLarge
+	case hex.EncodeToString(h.Sum(nil)) != sum:
+		err = ErrFirmwareChecksum
+	default:
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return size, nil
+}
+
+func (m *FirmwareManager) DeleteImage(id int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	v, ok := m.images[id]
+	if !ok {
+		return ErrFirmwareImageNotFound
+	}
+	if m.running != nil && m.running.ImageID == id {
+		return ErrFirmwareImageInUse
+	}
+	if err := m.db.GetDBInstance().Where("id = ?", id).Delete(&FirmwareImage{}).Error; err != nil {
+		return err
+	}
+	if v.Path != "" {
+		os.Remove(v.Path)
+	}
+	delete(m.images, id)
+	return nil
+}
+
+// ListImages returns the images sorted by id.
+func (m *FirmwareManager) ListImages() []FirmwareImage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make([]FirmwareImage, 0, len(m.images))
+	for _, v := range m.images {
+		ret = append(ret, *v)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// StartRollout starts the upgrade of targets to an image which is ready, in the order
+// of targets.
+func (m *FirmwareManager) StartRollout(imageID int64, batchSize int, targets []FirmwareTarget) (*FirmwareRollout, error) {
+	if len(targets) == 0 || batchSize < 0 {
+		return nil, ErrFirmwareRolloutInvalid
+	}
+	seen := make(map[FirmwareTarget]bool)
+	for _, t := range targets {
+		if (t.CameraID == 0) == (t.NvrSN == "") || seen[t] {
+			return nil, ErrFirmwareRolloutInvalid
+		}
+		seen[t] = true
+	}
+	if batchSize == 0 {
+		batchSize = firmwareDefaultBatch
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	image, ok := m.images[imageID]
+	if !ok {
+		return nil, ErrFirmwareImageNotFound
+	}
+	if image.State != FirmwareImageReady {
+		return nil, ErrFirmwareImageNotReady
+	}
+	if m.running != nil {
+		return nil, ErrFirmwareRolloutRunning
+	}
+	client := m.db.GetDBInstance()
+	v := &FirmwareRollout{ImageID: imageID, BatchSize: batchSize, State: FirmwareRolloutRunning}
+	if err := client.Create(v).Error; err != nil {
+		return nil, err
+	}
+	for i, t := range targets {
+		u := &FirmwareUpgrade{RolloutID: v.ID, Position: i, CameraID: t.CameraID, NvrSN: t.NvrSN, State: FirmwareUpgradePending}
+		if err := client.Create(u).Error; err != nil {
+			return nil, err
+		}
+		v.Upgrades = append(v.Upgrades, u)
+	}
+	m.rollouts[v.ID], m.running = v, v
+	go m.run(v, *image)
+	return copyFirmwareRollout(v), nil
+}
+
+// CancelRollout stops a rollout before its next stage, the upgrades of the running
+// stage go on as a device cannot be stopped while it flashes.
+func (m *FirmwareManager) CancelRollout(id int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	v, ok := m.rollouts[id]
+	if !ok {
+		return ErrFirmwareRolloutUnknown
+	}
+	if v.State != FirmwareRolloutRunning {
+		return ErrFirmwareRolloutStopped
+	}
+	v.canceled = true
+	return nil
+}
+
+// ListRollouts returns the rollouts with their upgrades, the latest first.
+func (m *FirmwareManager) ListRollouts() []*FirmwareRollout {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make([]*FirmwareRollout, 0, len(m.rollouts))
+	for _, v := range m.rollouts {
+		ret = append(ret, copyFirmwareRollout(v))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID > ret[j].ID })
+	return ret
+}
+
+func copyFirmwareRollout(v *FirmwareRollout) *FirmwareRollout {
+	ret := *v
+	ret.Upgrades = make([]*FirmwareUpgrade, 0, len(v.Upgrades))
+	for _, u := range v.Upgrades {
+		c := *u
+		ret.Upgrades = append(ret.Upgrades, &c)
+	}
+	return &ret
+}
+
+// firmwareStages splits n devices into the stages of a rollout: the first device, then
+// batches of batchSize.
+func firmwareStages(n, batchSize int) [][2]int {
+	if n == 0 {
+		return nil
+	}
+	stages := [][2]int{{0, 1}}
+	for i := 1; i < n; i += batchSize {
+		end := i + batchSize
+		if end > n {
+			end = n
+		}
+		stages = append(stages, [2]int{i, end})
+	}
+	return stages
+}
+
+func (m *FirmwareManager) run(v *FirmwareRollout, image FirmwareImage) {
+	for _, stage := range firmwareStages(len(v.Upgrades), v.BatchSize) {
+		m.lock.Lock()
+		canceled := v.canceled
+		m.lock.Unlock()
+		if canceled {
+			m.finish(v, FirmwareRolloutCanceled, "")
+			return
+		}
+
+		upgrades := v.Upgrades[stage[0]:stage[1]]
+		var wg sync.WaitGroup
+		for _, u := range upgrades {
+			wg.Add(1)
+			go func(u *FirmwareUpgrade) {
+				defer wg.Done()
+				m.upgrade(u, image)
+			}(u)
+		}
+		wg.Wait()
+
+		failed := 0
+		m.lock.Lock()
+		for _, u := range upgrades {
+			if u.State == FirmwareUpgradeFailed {
+				failed++
+			}
+		}
+		m.lock.Unlock()
+		if failed > 0 {
+			m.finish(v, FirmwareRolloutFailed, fmt.Sprintf("%d of %d upgrades of the stage failed", failed, len(upgrades)))
+			return
+		}
+	}
+	m.finish(v, FirmwareRolloutSucceeded, "")
+}
+
+func (m *FirmwareManager) finish(v *FirmwareRollout, state, reason string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.stopRollout(v, state, reason, m.now())
+	m.running = nil
+	m.logger.Info().Int64("rollout_id", v.ID).Str("state", state).Str("reason", reason).Msg("firmware rollout finished")
+}
+
+// stopRollout records the end of a rollout, the upgrades it has not run are skipped and
+// the ones it was running failed. m.lock is held.
+func (m *FirmwareManager) stopRollout(v *FirmwareRollout, state, reason string, now time.Time) {
+	for _, u := range v.Upgrades {
+		switch u.State {
+		case FirmwareUpgradePending:
+			u.State = FirmwareUpgradeSkipped
+		case FirmwareUpgradeUploading, FirmwareUpgradeVerifying:
+			u.State, u.Error, u.FinishedAt = FirmwareUpgradeFailed, reason, &now
+		default:
+			continue
+		}
+		m.persist(u)
+	}
+	v.State, v.Error, v.FinishedAt = state, reason, &now
+	m.persist(v)
+}
+
+// update changes an upgrade under the lock and saves it.
+func (m *FirmwareManager) update(u *FirmwareUpgrade, f func(u *FirmwareUpgrade)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	f(u)
+	m.persist(u)
+}
+
+// upgrade uploads the image to the device of u, then waits for the device to report the
+// version of the image.
+func (m *FirmwareManager) upgrade(u *FirmwareUpgrade, image FirmwareImage) {
+	logger := m.logger.With().Int64("rollout_id", u.RolloutID).Int("camera_id", u.CameraID).Str("nvr_sn", u.NvrSN).Logger()
+	err := m.upgradeDevice(u, image)
+	result := FirmwareUpgradeSucceeded
+	if err != nil {
+		result = FirmwareUpgradeFailed
+		logger.Error().Err(err).Msg("firmware upgrade failed")
+	} else {
+		logger.Info().Str("version", image.Version).Msg("firmware upgraded")
+	}
+	metrics.CounterVecAdd("firmware_upgrades_total", []string{"result"}, []string{result}, 1)
+	m.update(u, func(u *FirmwareUpgrade) {
+		now := m.now()
+		u.State, u.FinishedAt = result, &now
+		if err != nil {
+			u.Error = err.Error()
+		}
+	})
+}
+
+func (m *FirmwareManager) upgradeDevice(u *FirmwareUpgrade, image FirmwareImage) error {
+	m.update(u, func(u *FirmwareUpgrade) {
+		now := m.now()
+		u.State, u.StartedAt = FirmwareUpgradeUploading, &now
+	})
+	drv, err := m.driver(u.target())
+	if err != nil {
+		return err
+	}
+	info, err := drv.Info()
+	if err != nil {
+		return err
+	}
+	if image.Brand != "" && info.Brand != image.Brand {
+		return ErrFirmwareBrandMismatch
+	}
+	if image.Model != "" && !strings.EqualFold(info.Model, image.Model) {
+		return ErrFirmwareModelMismatch
+	}
+	m.update(u, func(u *FirmwareUpgrade) { u.FromVersion = info.Version })
+	if firmwareVersionMatches(info.Version, image.Version) {
+		m.update(u, func(u *FirmwareUpgrade) { u.Progress, u.ToVersion = 100, info.Version })
+		return nil
+	}
+
+	lastProgress := -1
+	err = drv.Upgrade(image.Path, func(sent int64) {
+		progress := 100
+		if image.Size > 0 && sent < image.Size {
+			progress = int(sent * 100 / image.Size)
+		}
+		if progress == lastProgress {
+			return
+		}
+		lastProgress = progress
+		m.lock.Lock()
+		u.Progress = progress
+		m.lock.Unlock()
+	})
+	if err != nil {
+		return err
+	}
+	m.update(u, func(u *FirmwareUpgrade) { u.State, u.Progress = FirmwareUpgradeVerifying, 100 })
+	return m.verify(u, drv, image.Version)
+}
+
+// verify waits for the device to come back with version, the device is unreachable
+// while it reboots.
+func (m *FirmwareManager) verify(u *FirmwareUpgrade, drv FirmwareDriver, version string) error {
+	deadline := m.now().Add(m.verifyTimeout)
+	err := fmt.Errorf("device did not report version %s", version)
+	for m.now().Before(deadline) {
+		time.Sleep(m.verifyInterval)
+		info, infoErr := drv.Info()
+		if infoErr != nil {
+			err = infoErr
+			continue
+		}
+		m.update(u, func(u *FirmwareUpgrade) { u.ToVersion = info.Version })
+		if firmwareVersionMatches(info.Version, version) {
+			return nil
+		}
+		err = fmt.Errorf("device reports version %s instead of %s", info.Version, version)
+	}
+	return err
+}
+
+// firmwareVersionMatches reports whether a reported version is the one of an image. The
+// devices add their build to the version, such as "V5.5.0 build 190828", so the tokens
+// of the version of the image are looked for among the reported ones: "V5.5.0" matches
+// "5.5.0 build 190828" but not "V5.5.01".
+func firmwareVersionMatches(reported, version string) bool {
+	want, got := firmwareVersionTokens(version), firmwareVersionTokens(reported)
+	if len(want) == 0 {
+		return false
+	}
+	for i := 0; i+len(want) <= len(got); i++ {
+		match := true
+		for j, t := range want {
+			if got[i+j] != t {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// firmwareVersionTokens splits a version in lower case tokens, the numbers lose their v.
+func firmwareVersionTokens(version string) []string {
+	tokens := strings.FieldsFunc(strings.ToLower(version), func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(",;()[]", r)
+	})
+	for i, t := range tokens {
+		if len(t) > 1 && t[0] == 'v' && unicode.IsDigit(rune(t[1])) {
+			tokens[i] = t[1:]
+		}
+	}
+	return tokens
+}
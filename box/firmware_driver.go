@@ -0,0 +1,479 @@
+package box
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/icholy/digest"
+
+	"github.com/example/minibox/utils"
+)
+
+// firmwareUploadTimeout bounds the upload of an image, the devices write it to their
+// flash while they read it.
+const firmwareUploadTimeout = 15 * time.Minute
+
+// The LAPI resources of the Uniview NVRs, the information of the device and the upload
+// of an upgrade package.
+const (
+	lapiDeviceInfoPath = "/LAPI/V1.0/System/DeviceInfo"
+	lapiUpgradePath    = "/LAPI/V1.0/System/Upgrade"
+)
+
+// The json commands of the thermal scanners, posted to thermalScannerPort.
+const (
+	thermalScannerPort   = 8000
+	thermalCmdVersion    = "0.2"
+	thermalCmdDeviceInfo = "device info"
+	thermalCmdUpgrade    = "upgrade"
+)
+
+// sunellUpgradeBoundary separates the SOAP envelope and the image of the MTOM request of
+// UpgradeSystemFirmware.
+const sunellUpgradeBoundary = "minibox-firmware-boundary"
+
+var ErrFirmwareUnsupported = errors.New("firmware upgrade is not supported by this device")
+
+var onvifDurationRegexp = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// FirmwareInfo is the model and the firmware version a device reports, with its brand.
+type FirmwareInfo struct {
+	Brand   utils.CameraBrand `json:"brand"`
+	Model   string            `json:"model"`
+	Version string            `json:"version"`
+}
+
+// FirmwareDriver upgrades the firmware of one device, whatever its brand is.
+type FirmwareDriver interface {
+	Info() (FirmwareInfo, error)
+	// Upgrade uploads the image file, progress is called with the bytes sent. The device
+	// reboots on its own once it has flashed the image.
+	Upgrade(file string, progress func(sent int64)) error
+}
+
+// newFirmwareDriver returns the firmware driver of a target. The Uniview NVRs are upgraded
+// through LAPI, the thermal scanners with their json commands, the Sunell cameras with
+// UpgradeSystemFirmware and the other cameras with StartFirmwareUpgrade.
+func newFirmwareDriver(device Box, target FirmwareTarget) (FirmwareDriver, error) {
+	if target.NvrSN != "" {
+		a, err := managedNVRAccess(device.GetNVRManager(), target.NvrSN)
+		if err != nil {
+			return nil, err
+		}
+		return newLAPIFirmware(fmt.Sprintf("http://%s:%d", a.ip, a.port), a.username, a.password), nil
+	}
+	cam, err := device.GetCamera(target.CameraID)
+	if err != nil {
+		return nil, err
+	}
+	if cam.GetIP() == "" {
+		return nil, ErrFirmwareUnsupported
+	}
+	switch cam.GetBrand() {
+	case utils.Thermal1:
+		return newThermalFirmware(cam.GetIP(), device.GetConfig().GetDataStoreDir()), nil
+	case utils.Sunell:
+		return newSunellFirmware(onvifDeviceService(device, cam.GetIP()), cam.GetUserName(), cameraPassword(cam)), nil
+	}
+	return newOnvifFirmware(onvifDeviceService(device, cam.GetIP()), cam.GetBrand(), cam.GetUserName(), cameraPassword(cam)), nil
+}
+
+// onvifFirmware upgrades a device with the StartFirmwareUpgrade of the ONVIF device
+// service: the image is posted to the upload uri it returns.
+type onvifFirmware struct {
+	xaddr    string
+	brand    utils.CameraBrand
+	username string
+	password string
+	client   *http.Client
+	// probe and upload share the digest transport, probe gets the challenge the upload
+	// answers.
+	probe  *http.Client
+	upload *http.Client
+}
+
+func newOnvifFirmware(xaddr string, brand utils.CameraBrand, username, password string) *onvifFirmware {
+	transport := &digest.Transport{Username: username, Password: password}
+	return &onvifFirmware{
+		xaddr:    xaddr,
+		brand:    brand,
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: onvifRequestTimeout},
+		probe:    &http.Client{Timeout: onvifRequestTimeout, Transport: transport},
+		upload:   &http.Client{Timeout: firmwareUploadTimeout, Transport: transport},
+	}
+}
+
+func (o *onvifFirmware) Info() (FirmwareInfo, error) {
+	var resp struct {
+		Model   string `xml:"Body>GetDeviceInformationResponse>Model"`
+		Version string `xml:"Body>GetDeviceInformationResponse>FirmwareVersion"`
+	}
+	if err := onvifCall(o.client, o.username, o.password, o.xaddr, `<tds:GetDeviceInformation/>`, &resp); err != nil {
+		return FirmwareInfo{}, err
+	}
+	return FirmwareInfo{Brand: o.brand, Model: resp.Model, Version: resp.Version}, nil
+}
+
+func (o *onvifFirmware) Upgrade(file string, progress func(sent int64)) error {
+	var resp struct {
+		UploadUri   string `xml:"Body>StartFirmwareUpgradeResponse>UploadUri"`
+		UploadDelay string `xml:"Body>StartFirmwareUpgradeResponse>UploadDelay"`
+	}
+	if err := onvifCall(o.client, o.username, o.password, o.xaddr, `<tds:StartFirmwareUpgrade/>`, &resp); err != nil {
+		return err
+	}
+	if resp.UploadUri == "" {
+		return ErrFirmwareUnsupported
+	}
+	delay, err := parseOnvifDuration(resp.UploadDelay)
+	if err != nil {
+		return err
+	}
+	time.Sleep(delay)
+	if err := o.preflight(resp.UploadUri); err != nil {
+		return err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, resp.UploadUri, &progressReader{r: f, progress: progress})
+	if err != nil {
+		return err
+	}
+	// the digest transport sends the image again when its challenge went stale
+	req.GetBody = func() (io.ReadCloser, error) {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{&progressReader{r: f, progress: progress}, f}, nil
+	}
+	req.ContentLength = stat.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	res, err := o.upload.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized {
+		return ErrHttpAuthFailed
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("firmware upload http status code: %d", res.StatusCode)
+	}
+	return nil
+}
+
+// preflight requests the head of url, so that the digest transport holds its challenge
+// and the image is sent once, with its credentials.
+func (o *onvifFirmware) preflight(url string) error {
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := o.probe.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized {
+		return ErrHttpAuthFailed
+	}
+	return nil
+}
+
+// sunellFirmware upgrades a Sunell camera, which has no StartFirmwareUpgrade: the image
+// is sent inline with the UpgradeSystemFirmware of the device service, as the MTOM
+// attachment of the request.
+type sunellFirmware struct {
+	*onvifFirmware
+}
+
+func newSunellFirmware(xaddr, username, password string) *sunellFirmware {
+	return &sunellFirmware{newOnvifFirmware(xaddr, utils.Sunell, username, password)}
+}
+
+func (s *sunellFirmware) Upgrade(file string, progress func(sent int64)) error {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	header, err := onvifHeader(s.username, s.password)
+	if err != nil {
+		return err
+	}
+	envelope := fmt.Sprintf(onvifEnvelope, header, `<tds:UpgradeSystemFirmware><tds:Firmware>`+
+		`<xop:Include xmlns:xop="http://www.w3.org/2004/08/xop/include" href="cid:firmware"/>`+
+		`</tds:Firmware></tds:UpgradeSystemFirmware>`)
+	head := "--" + sunellUpgradeBoundary + "\r\n" +
+		"Content-Type: application/xop+xml; charset=UTF-8; type=\"application/soap+xml\"\r\n" +
+		"Content-ID: <envelope>\r\n\r\n" + envelope + "\r\n" +
+		"--" + sunellUpgradeBoundary + "\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: binary\r\n" +
+		"Content-ID: <firmware>\r\n\r\n"
+	tail := "\r\n--" + sunellUpgradeBoundary + "--\r\n"
+	body := func() (io.ReadCloser, error) {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(strings.NewReader(head), &progressReader{r: f, progress: progress}, strings.NewReader(tail)), f}, nil
+	}
+	if err := s.preflight(s.xaddr); err != nil {
+		return err
+	}
+	r, err := body()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.xaddr, r)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	req.GetBody = body
+	req.ContentLength = int64(len(head)) + stat.Size() + int64(len(tail))
+	req.Header.Set("Content-Type", fmt.Sprintf(`multipart/related; type="application/xop+xml"; start="<envelope>"; `+
+		`start-info="application/soap+xml"; boundary=%q`, sunellUpgradeBoundary))
+	res, err := s.upload.Do(req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		res.Body.Close()
+		return ErrHttpAuthFailed
+	}
+	return onvifResponse(res, nil)
+}
+
+// thermalFirmware upgrades a thermal scanner with its json commands: the scanner
+// downloads the image from the static files of the box, as it does its backgrounds,
+// checks its md5 and reboots on it.
+type thermalFirmware struct {
+	url     string
+	dataDir string
+	client  *http.Client
+}
+
+// thermalResponse is the reply of a scanner to a command, Code is 0 on success.
+type thermalResponse struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	Model   string `json:"model"`
+	Version string `json:"firmware_version"`
+}
+
+func newThermalFirmware(ip, dataDir string) *thermalFirmware {
+	return &thermalFirmware{
+		url:     fmt.Sprintf("http://%s:%d", ip, thermalScannerPort),
+		dataDir: dataDir,
+		client:  &http.Client{Timeout: onvifRequestTimeout},
+	}
+}
+
+func (t *thermalFirmware) cmd(cmd string, args map[string]interface{}) (*thermalResponse, error) {
+	body := map[string]interface{}{"version": thermalCmdVersion, "cmd": cmd}
+	for k, v := range args {
+		body[k] = v
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.client.Post(t.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("thermal scanner http status code: %d", res.StatusCode)
+	}
+	var resp thermalResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Code != 0 {
+		return nil, fmt.Errorf("thermal scanner %s code %d: %s", cmd, resp.Code, resp.Msg)
+	}
+	return &resp, nil
+}
+
+func (t *thermalFirmware) Info() (FirmwareInfo, error) {
+	resp, err := t.cmd(thermalCmdDeviceInfo, nil)
+	if err != nil {
+		return FirmwareInfo{}, err
+	}
+	return FirmwareInfo{Brand: utils.Thermal1, Model: resp.Model, Version: resp.Version}, nil
+}
+
+// Upgrade has the scanner download the image, which is reported sent once the scanner
+// accepted it.
+func (t *thermalFirmware) Upgrade(file string, progress func(sent int64)) error {
+	name, err := filepath.Rel(t.dataDir, file)
+	if err != nil || strings.HasPrefix(name, "..") {
+		return fmt.Errorf("firmware image %s is not in the data store dir", file)
+	}
+	sum, size, err := fileMD5(file)
+	if err != nil {
+		return err
+	}
+	_, err = t.cmd(thermalCmdUpgrade, map[string]interface{}{
+		"url":  boxStaticUrl(filepath.ToSlash(name)),
+		"md5":  sum,
+		"size": size,
+	})
+	if err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(size)
+	}
+	return nil
+}
+
+// fileMD5 returns the hex md5 and the size of a file.
+func fileMD5(file string) (string, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := md5.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// lapiFirmware upgrades a Uniview NVR with LAPI: the upgrade package is posted to the NVR,
+// which flashes it and reboots.
+type lapiFirmware struct {
+	url    string
+	client *http.Client
+	upload *http.Client
+}
+
+func newLAPIFirmware(url, username, password string) *lapiFirmware {
+	transport := &digest.Transport{Username: username, Password: password}
+	return &lapiFirmware{
+		url:    url,
+		client: &http.Client{Timeout: onvifRequestTimeout, Transport: transport},
+		upload: &http.Client{Timeout: firmwareUploadTimeout, Transport: transport},
+	}
+}
+
+func (l *lapiFirmware) Info() (FirmwareInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, l.url+lapiDeviceInfoPath, nil)
+	if err != nil {
+		return FirmwareInfo{}, err
+	}
+	var info struct {
+		DeviceModel     string `json:"DeviceModel"`
+		FirmwareVersion string `json:"FirmwareVersion"`
+	}
+	if err := lapiDo(l.client, req, &info); err != nil {
+		return FirmwareInfo{}, err
+	}
+	return FirmwareInfo{Brand: utils.Uniview, Model: info.DeviceModel, Version: info.FirmwareVersion}, nil
+}
+
+func (l *lapiFirmware) Upgrade(file string, progress func(sent int64)) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, l.url+lapiUpgradePath, &progressReader{r: f, progress: progress})
+	if err != nil {
+		return err
+	}
+	// the digest transport sends the package again after the challenge
+	req.GetBody = func() (io.ReadCloser, error) {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{&progressReader{r: f, progress: progress}, f}, nil
+	}
+	req.ContentLength = stat.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return lapiDo(l.upload, req, nil)
+}
+
+// parseOnvifDuration parses the xs:duration of the ONVIF responses, without years and
+// months. An empty duration is 0.
+func parseOnvifDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	m := onvifDurationRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid onvif duration %q", s)
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute} {
+		if m[i+1] != "" {
+			n, _ := strconv.Atoi(m[i+1])
+			d += time.Duration(n) * unit
+		}
+	}
+	if m[4] != "" {
+		secs, _ := strconv.ParseFloat(m[4], 64)
+		d += time.Duration(secs * float64(time.Second))
+	}
+	return d, nil
+}
+
+// progressReader reports the bytes read so far.
+type progressReader struct {
+	r        io.Reader
+	sent     int64
+	progress func(sent int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.sent += int64(n)
+		if p.progress != nil {
+			p.progress(p.sent)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,178 @@
+package box
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/example/minibox/utils"
+)
+
+func TestParseOnvifDuration(t *testing.T) {
+	for s, d := range map[string]time.Duration{
+		"":          0,
+		"PT0S":      0,
+		"PT5S":      5 * time.Second,
+		"PT1M30.5S": 90*time.Second + 500*time.Millisecond,
+		"P1DT2H":    26 * time.Hour,
+	} {
+		v, err := parseOnvifDuration(s)
+		assert.NoError(t, err)
+		assert.Equal(t, d, v, s)
+	}
+	_, err := parseOnvifDuration("5s")
+	assert.Error(t, err)
+}
+
+func TestOnvifFirmwareUpgrade(t *testing.T) {
+	var uploaded []byte
+	var methods []string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/upload" {
+			methods = append(methods, r.Method)
+			if r.Method == http.MethodPost {
+				assert.Equal(t, "application/octet-stream", r.Header.Get("Content-Type"))
+				uploaded, _ = io.ReadAll(r.Body)
+			}
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case strings.Contains(string(body), "GetDeviceInformation"):
+			fmt.Fprint(w, `<Envelope><Body><GetDeviceInformationResponse><Model>IPC-1</Model>`+
+				`<FirmwareVersion>V1.0</FirmwareVersion></GetDeviceInformationResponse></Body></Envelope>`)
+		case strings.Contains(string(body), "StartFirmwareUpgrade"):
+			fmt.Fprintf(w, `<Envelope><Body><StartFirmwareUpgradeResponse><UploadUri>%s/upload</UploadUri>`+
+				`<UploadDelay>PT0S</UploadDelay></StartFirmwareUpgradeResponse></Body></Envelope>`, server.URL)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "1.bin")
+	assert.NoError(t, os.WriteFile(file, []byte("firmware"), 0644))
+	drv := newOnvifFirmware(server.URL+"/onvif/device_service", utils.Hikvision, "admin", "pw")
+	info, err := drv.Info()
+	assert.NoError(t, err)
+	assert.Equal(t, FirmwareInfo{Brand: utils.Hikvision, Model: "IPC-1", Version: "V1.0"}, info)
+
+	var sent int64
+	assert.NoError(t, drv.Upgrade(file, func(n int64) { sent = n }))
+	assert.Equal(t, "firmware", string(uploaded))
+	assert.Equal(t, []string{http.MethodHead, http.MethodPost}, methods)
+	assert.EqualValues(t, 8, sent)
+}
+
+func TestSunellFirmwareUpgrade(t *testing.T) {
+	var uploaded string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/related") {
+			uploaded = string(body)
+			fmt.Fprint(w, `<Envelope><Body><UpgradeSystemFirmwareResponse><Message>ok</Message>`+
+				`</UpgradeSystemFirmwareResponse></Body></Envelope>`)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "1.bin")
+	assert.NoError(t, os.WriteFile(file, []byte("firmware"), 0644))
+	var sent int64
+	drv := newSunellFirmware(server.URL+"/onvif/device_service", "admin", "pw")
+	assert.NoError(t, drv.Upgrade(file, func(n int64) { sent = n }))
+	assert.Contains(t, uploaded, `<tds:UpgradeSystemFirmware><tds:Firmware><xop:Include`)
+	assert.Contains(t, uploaded, "Content-ID: <firmware>\r\n\r\nfirmware\r\n--"+sunellUpgradeBoundary+"--")
+	assert.EqualValues(t, 8, sent)
+}
+
+func TestThermalFirmwareUpgrade(t *testing.T) {
+	var cmds []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cmd map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&cmd))
+		cmds = append(cmds, cmd)
+		switch cmd["cmd"] {
+		case thermalCmdDeviceInfo:
+			fmt.Fprint(w, `{"code":0,"model":"TS-1","firmware_version":"2.1"}`)
+		case thermalCmdUpgrade:
+			fmt.Fprint(w, `{"code":0}`)
+		default:
+			fmt.Fprint(w, `{"code":1,"msg":"unknown cmd"}`)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "firmware"), 0755))
+	file := filepath.Join(dir, "firmware", "1.bin")
+	assert.NoError(t, os.WriteFile(file, []byte("firmware"), 0644))
+	drv := newThermalFirmware("127.0.0.1", dir)
+	drv.url = server.URL
+	info, err := drv.Info()
+	assert.NoError(t, err)
+	assert.Equal(t, FirmwareInfo{Brand: utils.Thermal1, Model: "TS-1", Version: "2.1"}, info)
+
+	var sent int64
+	assert.NoError(t, drv.Upgrade(file, func(n int64) { sent = n }))
+	assert.EqualValues(t, 8, sent)
+	assert.Len(t, cmds, 2)
+	assert.Equal(t, thermalCmdVersion, cmds[1]["version"])
+	assert.Equal(t, boxStaticUrl("firmware/1.bin"), cmds[1]["url"])
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum([]byte("firmware"))), cmds[1]["md5"])
+
+	assert.Error(t, drv.Upgrade(filepath.Join(t.TempDir(), "2.bin"), nil))
+}
+
+func TestLAPIFirmwareUpgrade(t *testing.T) {
+	var uploaded []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case lapiDeviceInfoPath:
+			fmt.Fprint(w, `{"Response":{"StatusCode":0,"StatusString":"Succeed","Data":{"DeviceModel":"NVR301","FirmwareVersion":"NVR-B3601.16.10.210202"}}}`)
+		case lapiUpgradePath:
+			assert.Equal(t, http.MethodPost, r.Method)
+			uploaded, _ = io.ReadAll(r.Body)
+			if len(uploaded) == 0 {
+				fmt.Fprint(w, `{"Response":{"StatusCode":1,"StatusString":"Invalid package"}}`)
+				return
+			}
+			fmt.Fprint(w, `{"Response":{"StatusCode":0,"StatusString":"Succeed"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	drv := newLAPIFirmware(server.URL, "admin", "pw")
+	info, err := drv.Info()
+	assert.NoError(t, err)
+	assert.Equal(t, FirmwareInfo{Brand: utils.Uniview, Model: "NVR301", Version: "NVR-B3601.16.10.210202"}, info)
+
+	file := filepath.Join(t.TempDir(), "1.bin")
+	assert.NoError(t, os.WriteFile(file, []byte("firmware"), 0644))
+	var sent int64
+	assert.NoError(t, drv.Upgrade(file, func(n int64) { sent = n }))
+	assert.Equal(t, "firmware", string(uploaded))
+	assert.EqualValues(t, 8, sent)
+
+	empty := filepath.Join(t.TempDir(), "2.bin")
+	assert.NoError(t, os.WriteFile(empty, nil, 0644))
+	assert.EqualError(t, drv.Upgrade(empty, nil), "lapi status 1: Invalid package")
+}
@@ -0,0 +1,167 @@
+package box
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/example/minibox/utils"
+)
+
+type fakeFirmwareDriver struct {
+	lock     sync.Mutex
+	info     FirmwareInfo
+	next     string
+	err      error
+	upgraded int
+}
+
+func (d *fakeFirmwareDriver) Info() (FirmwareInfo, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.info, nil
+}
+
+func (d *fakeFirmwareDriver) Upgrade(file string, progress func(sent int64)) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	progress(50)
+	progress(100)
+	d.upgraded++
+	d.info.Version = d.next
+	return nil
+}
+
+func newTestFirmwareManager(drivers map[FirmwareTarget]*fakeFirmwareDriver) *FirmwareManager {
+	return &FirmwareManager{
+		images:         make(map[int64]*FirmwareImage),
+		rollouts:       make(map[int64]*FirmwareRollout),
+		now:            time.Now,
+		verifyTimeout:  50 * time.Millisecond,
+		verifyInterval: time.Millisecond,
+		driver: func(target FirmwareTarget) (FirmwareDriver, error) {
+			d, ok := drivers[target]
+			if !ok {
+				return nil, ErrFirmwareUnsupported
+			}
+			return d, nil
+		},
+		persist: func(v interface{}) {},
+	}
+}
+
+func newTestFirmwareRollout(batchSize int, targets ...FirmwareTarget) *FirmwareRollout {
+	v := &FirmwareRollout{ID: 1, BatchSize: batchSize, State: FirmwareRolloutRunning}
+	for i, t := range targets {
+		v.Upgrades = append(v.Upgrades, &FirmwareUpgrade{RolloutID: 1, Position: i, CameraID: t.CameraID, NvrSN: t.NvrSN, State: FirmwareUpgradePending})
+	}
+	return v
+}
+
+func TestFirmwareStages(t *testing.T) {
+	assert.Nil(t, firmwareStages(0, 2))
+	assert.Equal(t, [][2]int{{0, 1}}, firmwareStages(1, 2))
+	assert.Equal(t, [][2]int{{0, 1}, {1, 3}, {3, 5}, {5, 6}}, firmwareStages(6, 2))
+}
+
+func TestFirmwareRollout(t *testing.T) {
+	image := FirmwareImage{ID: 1, Version: "V2.0", Model: "IPC-1", Size: 100}
+	nvr, cam, current := FirmwareTarget{NvrSN: "NVR1"}, FirmwareTarget{CameraID: 2}, FirmwareTarget{CameraID: 3}
+	drivers := map[FirmwareTarget]*fakeFirmwareDriver{
+		nvr:     {info: FirmwareInfo{Model: "IPC-1", Version: "V1.0 build 1"}, next: "V2.0 build 2"},
+		cam:     {info: FirmwareInfo{Model: "ipc-1", Version: "V1.0"}, next: "V2.0"},
+		current: {info: FirmwareInfo{Model: "IPC-1", Version: "V2.0"}},
+	}
+	m := newTestFirmwareManager(drivers)
+	v := newTestFirmwareRollout(2, nvr, cam, current)
+	m.rollouts[v.ID], m.running = v, v
+	m.run(v, image)
+
+	assert.Equal(t, FirmwareRolloutSucceeded, v.State)
+	assert.Nil(t, m.running)
+	for _, u := range v.Upgrades {
+		assert.Equal(t, FirmwareUpgradeSucceeded, u.State)
+		assert.Equal(t, 100, u.Progress)
+	}
+	assert.Equal(t, "V1.0 build 1", v.Upgrades[0].FromVersion)
+	assert.Equal(t, "V2.0 build 2", v.Upgrades[0].ToVersion)
+	assert.Equal(t, 0, drivers[current].upgraded)
+}
+
+func TestFirmwareRolloutStopsAfterFailedStage(t *testing.T) {
+	image := FirmwareImage{ID: 1, Version: "V2.0"}
+	canary, next := FirmwareTarget{CameraID: 1}, FirmwareTarget{CameraID: 2}
+	drivers := map[FirmwareTarget]*fakeFirmwareDriver{
+		canary: {info: FirmwareInfo{Version: "V1.0"}, next: "V1.0"},
+		next:   {info: FirmwareInfo{Version: "V1.0"}, next: "V2.0"},
+	}
+	m := newTestFirmwareManager(drivers)
+	v := newTestFirmwareRollout(5, canary, next)
+	m.run(v, image)
+
+	assert.Equal(t, FirmwareRolloutFailed, v.State)
+	assert.Equal(t, FirmwareUpgradeFailed, v.Upgrades[0].State)
+	assert.Equal(t, "device reports version V1.0 instead of V2.0", v.Upgrades[0].Error)
+	assert.Equal(t, FirmwareUpgradeSkipped, v.Upgrades[1].State)
+	assert.Equal(t, 0, drivers[next].upgraded)
+
+	v = newTestFirmwareRollout(5, canary, FirmwareTarget{CameraID: 9})
+	m.run(v, FirmwareImage{ID: 1, Version: "V2.0", Model: "IPC-2"})
+	assert.Equal(t, ErrFirmwareModelMismatch.Error(), v.Upgrades[0].Error)
+	assert.Equal(t, FirmwareUpgradeSkipped, v.Upgrades[1].State)
+
+	v = newTestFirmwareRollout(5, canary, FirmwareTarget{CameraID: 9})
+	m.run(v, FirmwareImage{ID: 1, Version: "V2.0", Brand: utils.Uniview})
+	assert.Equal(t, ErrFirmwareBrandMismatch.Error(), v.Upgrades[0].Error)
+
+	v = newTestFirmwareRollout(5, canary, next)
+	v.canceled = true
+	m.run(v, image)
+	assert.Equal(t, FirmwareRolloutCanceled, v.State)
+	assert.Equal(t, FirmwareUpgradeSkipped, v.Upgrades[0].State)
+}
+
+func TestFirmwareVersionMatches(t *testing.T) {
+	assert.True(t, firmwareVersionMatches("V5.5.0 build 190828", "V5.5.0"))
+	assert.True(t, firmwareVersionMatches("5.5.0 build 190828", "v5.5.0"))
+	assert.True(t, firmwareVersionMatches("V5.5.0 build 190828", "V5.5.0 Build 190828"))
+	assert.False(t, firmwareVersionMatches("V5.5.01 build 190828", "V5.5.0"))
+	assert.False(t, firmwareVersionMatches("V5.5.0 build 190828", "5.5"))
+	assert.False(t, firmwareVersionMatches("V5.5.0 build 190828", "V5.5.0 build 1908"))
+	assert.False(t, firmwareVersionMatches("V5.5.0", ""))
+}
+
+func TestFirmwareFetch(t *testing.T) {
+	image := []byte("firmware")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(image)
+	}))
+	defer server.Close()
+	sum := sha256.Sum256(image)
+	m := newTestFirmwareManager(nil)
+	m.dir, m.client = t.TempDir(), server.Client()
+	path := filepath.Join(m.dir, "1.bin")
+
+	_, err := m.fetch(server.URL, hex.EncodeToString(make([]byte, sha256.Size)), path)
+	assert.Equal(t, ErrFirmwareChecksum, err)
+	_, err = os.Stat(path + ".part")
+	assert.True(t, os.IsNotExist(err))
+
+	size, err := m.fetch(server.URL, hex.EncodeToString(sum[:]), path)
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(image), size)
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, image, data)
+}
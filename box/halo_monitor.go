@@ -0,0 +1,316 @@
+package box
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+
+	"github.com/example/minibox/cloud"
+	"github.com/example/minibox/db"
+	"github.com/example/minibox/utils"
+)
+
+const (
+	haloDefaultOfflineSecs = 300
+	haloMinOfflineSecs     = 30
+	haloMonitorInterval    = 15 * time.Second
+	// haloLastSeenSaveDelay limits the writes of the last seen times of the devices.
+	haloLastSeenSaveDelay = time.Minute
+	haloIotDevicesRefresh = 10 * time.Minute
+)
+
+var ErrHaloMonitorConfigInvalid = errors.New("invalid halo monitor config")
+
+var haloMonitor *HaloMonitor
+
+// HaloMonitorConfig is the silence after which a Halo device is offline. There is a
+// single row in the halo_monitor_configs table.
+type HaloMonitorConfig struct {
+	ID          int64     `json:"-"`
+	Enabled     bool      `json:"enabled"`
+	OfflineSecs int       `json:"offline_secs"`
+	CreatedAt   time.Time `json:"-"`
+	UpdatedAt   time.Time `json:"-"`
+}
+
+func (c *HaloMonitorConfig) validate() error {
+	if c.OfflineSecs != 0 && c.OfflineSecs < haloMinOfflineSecs {
+		return ErrHaloMonitorConfigInvalid
+	}
+	return nil
+}
+
+func (c *HaloMonitorConfig) offlineAfter() time.Duration {
+	if c.OfflineSecs == 0 {
+		return haloDefaultOfflineSecs * time.Second
+	}
+	return time.Duration(c.OfflineSecs) * time.Second
+}
+
+// HaloDevice is a Halo device which sent heartbeats to the box, persisted in the
+// halo_devices table.
+type HaloDevice struct {
+	MAC          string     `json:"mac" gorm:"primary_key"`
+	Name         string     `json:"name"`
+	Online       bool       `json:"online"`
+	LastSeen     time.Time  `json:"last_seen"`
+	OfflineSince *time.Time `json:"offline_since"`
+	CreatedAt    time.Time  `json:"-"`
+	UpdatedAt    time.Time  `json:"-"`
+}
+
+// HaloMonitor tracks the heartbeats of the Halo devices, and raises the IoT device
+// offline and online alarms when they stop and come back.
+type HaloMonitor struct {
+	device  Box
+	db      db.Client
+	logger  zerolog.Logger
+	lock    sync.Mutex
+	config  HaloMonitorConfig
+	devices map[string]*HaloDevice
+	saved   map[string]time.Time
+	now     func() time.Time
+
+	iotLock        sync.Mutex
+	iotDevices     map[string]*cloud.IotDevice
+	iotDevicesTime time.Time
+
+	save  func(v *HaloDevice)
+	raise func(mac string, online bool)
+}
+
+func NewHaloMonitor(device Box, d db.Client) *HaloMonitor {
+	m := &HaloMonitor{
+		device:  device,
+		db:      d,
+		logger:  log.Logger("halo_monitor"),
+		config:  HaloMonitorConfig{Enabled: true},
+		devices: make(map[string]*HaloDevice),
+		saved:   make(map[string]time.Time),
+		now:     time.Now,
+	}
+	m.save = m.saveDevice
+	m.raise = m.raiseAlarm
+	haloMonitor = m
+
+	client := d.GetDBInstance()
+	if err := client.AutoMigrate(&HaloMonitorConfig{}, &HaloDevice{}); err != nil {
+		m.logger.Error().Err(err).Msg("failed to migrate halo monitor tables")
+	}
+	var configs []HaloMonitorConfig
+	if err := client.Limit(1).Find(&configs).Error; err != nil {
+		m.logger.Error().Err(err).Msg("failed to load halo monitor config")
+	}
+	if len(configs) > 0 {
+		m.config = configs[0]
+	}
+	var devices []*HaloDevice
+	if err := client.Find(&devices).Error; err != nil {
+		m.logger.Error().Err(err).Msg("failed to load halo devices")
+	}
+	m.restore(devices)
+	go m.run()
+	return m
+}
+
+// restore adds the devices saved before a restart. The online devices are seen at the
+// startup, the heartbeats sent while the box was down were lost, not missed.
+func (m *HaloMonitor) restore(devices []*HaloDevice) {
+	now := m.now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, v := range devices {
+		if v.Online {
+			v.LastSeen = now
+		}
+		m.devices[haloMacKey(v.MAC)] = v
+	}
+}
+
+func GetHaloMonitor() *HaloMonitor {
+	return haloMonitor
+}
+
+// haloMacKey normalizes the MAC addresses of the heartbeats and of the cloud devices.
+func haloMacKey(mac string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac))
+}
+
+func (m *HaloMonitor) Config() HaloMonitorConfig {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.config
+}
+
+func (m *HaloMonitor) SaveConfig(c HaloMonitorConfig) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	c.ID, c.CreatedAt = m.config.ID, m.config.CreatedAt
+	if err := m.db.GetDBInstance().Save(&c).Error; err != nil {
+		return err
+	}
+	m.config = c
+	return nil
+}
+
+// Devices returns the known devices, sorted by MAC.
+func (m *HaloMonitor) Devices() []HaloDevice {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make([]HaloDevice, 0, len(m.devices))
+	for _, v := range m.devices {
+		ret = append(ret, *v)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].MAC < ret[j].MAC })
+	return ret
+}
+
+// Heartbeat records a heartbeat of a device, a device back from offline raises the
+// online alarm.
+func (m *HaloMonitor) Heartbeat(mac, name string) {
+	if mac == "" {
+		return
+	}
+	now := m.now()
+	key := haloMacKey(mac)
+	m.lock.Lock()
+	v, ok := m.devices[key]
+	if !ok {
+		v = &HaloDevice{MAC: mac, Online: true}
+		m.devices[key] = v
+	}
+	back := !v.Online
+	v.Name, v.LastSeen, v.Online, v.OfflineSince = name, now, true, nil
+	save := !ok || back || now.Sub(m.saved[key]) >= haloLastSeenSaveDelay
+	if save {
+		m.saved[key] = now
+	}
+	enabled := m.config.Enabled
+	device := *v
+	m.lock.Unlock()
+
+	if save {
+		m.save(&device)
+	}
+	if back {
+		m.logger.Info().Str("mac", mac).Msg("halo device online")
+		if enabled {
+			m.raise(mac, true)
+		}
+	}
+}
+
+// DeviceOnline returns the state of the device of a MAC, tracked tells if it sent
+// heartbeats to the box.
+func (m *HaloMonitor) DeviceOnline(mac string) (online, tracked bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	v, ok := m.devices[haloMacKey(mac)]
+	if !ok {
+		return false, false
+	}
+	return v.Online, true
+}
+
+func (m *HaloMonitor) run() {
+	ticker := time.NewTicker(haloMonitorInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.check()
+	}
+}
+
+// check marks the devices silent for longer than the config offline, and raises their
+// offline alarms.
+func (m *HaloMonitor) check() {
+	now := m.now()
+	m.lock.Lock()
+	offlineAfter, enabled := m.config.offlineAfter(), m.config.Enabled
+	var offline []HaloDevice
+	for _, v := range m.devices {
+		if v.Online && now.Sub(v.LastSeen) > offlineAfter {
+			since := v.LastSeen
+			v.Online, v.OfflineSince = false, &since
+			offline = append(offline, *v)
+		}
+	}
+	m.lock.Unlock()
+
+	for i := range offline {
+		m.logger.Warn().Str("mac", offline[i].MAC).Time("last_seen", offline[i].LastSeen).Msg("halo device offline")
+		m.save(&offline[i])
+		if enabled {
+			m.raise(offline[i].MAC, false)
+		}
+	}
+}
+
+func (m *HaloMonitor) saveDevice(v *HaloDevice) {
+	if err := m.db.GetDBInstance().Save(v).Error; err != nil {
+		m.logger.Error().Err(err).Str("mac", v.MAC).Msg("failed to save halo device")
+	}
+}
+
+// iotDevice returns the cloud IoT device of a MAC, the devices are refreshed every
+// haloIotDevicesRefresh.
+func (m *HaloMonitor) iotDevice(mac string) *cloud.IotDevice {
+	m.iotLock.Lock()
+	defer m.iotLock.Unlock()
+	if m.iotDevices == nil || m.now().Sub(m.iotDevicesTime) > haloIotDevicesRefresh {
+		devices, err := m.device.CloudClient().GetIotDevices()
+		if err != nil {
+			m.logger.Warn().Err(err).Msg("failed to get iot devices")
+		} else {
+			m.iotDevices, m.iotDevicesTime = make(map[string]*cloud.IotDevice), m.now()
+			for _, d := range devices {
+				m.iotDevices[haloMacKey(d.MacAddress)] = d
+			}
+		}
+	}
+	return m.iotDevices[haloMacKey(mac)]
+}
+
+func (m *HaloMonitor) raiseAlarm(mac string, online bool) {
+	detection := cloud.Detection{
+		Algos: cloud.AlarmTypeIotDeviceOffline,
+	}
+	if online {
+		detection = cloud.Detection{
+			Algos: cloud.AlarmTypeIotDeviceOnline,
+		}
+	}
+	atime := m.now().Format(utils.CloudTimeLayout)
+	alarm := &cloud.AlarmInfo{
+		Source:    cloud.AlarmSourceBridge,
+		BoxId:     m.device.GetBoxId(),
+		StartedAt: atime,
+		EndedAt:   atime,
+		Detection: detection,
+	}
+	dev := m.iotDevice(mac)
+	if dev != nil {
+		alarm.IotDeviceID = dev.ID
+	}
+	if bridge := GetMQTTBridge(); bridge != nil {
+		bridge.PublishAlarm(alarm)
+	}
+	if hooks := GetWebhookDispatcher(); hooks != nil {
+		hooks.Alarm(alarm)
+	}
+	if dev == nil {
+		m.logger.Warn().Str("mac", mac).Msg("halo device is not an iot device of the cloud, alarm not uploaded")
+		return
+	}
+	if err := m.device.CloudClient().UploadAlarmInfo(alarm); err != nil {
+		m.logger.Error().Err(err).Str("mac", mac).Bool("online", online).Msg("failed to upload halo device alarm")
+	}
+}
@@ -0,0 +1,114 @@
+package box
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/example/turing-common/log"
+)
+
+type haloMonitorAlarm struct {
+	mac    string
+	online bool
+}
+
+func newTestHaloMonitor(now *time.Time) (*HaloMonitor, *[]haloMonitorAlarm, *int) {
+	var lock sync.Mutex
+	var alarms []haloMonitorAlarm
+	var saves int
+	m := &HaloMonitor{
+		logger:  log.Logger("halo_monitor"),
+		config:  HaloMonitorConfig{Enabled: true, OfflineSecs: 60},
+		devices: make(map[string]*HaloDevice),
+		saved:   make(map[string]time.Time),
+		now:     func() time.Time { return *now },
+	}
+	m.save = func(v *HaloDevice) {
+		lock.Lock()
+		defer lock.Unlock()
+		saves++
+	}
+	m.raise = func(mac string, online bool) {
+		lock.Lock()
+		defer lock.Unlock()
+		alarms = append(alarms, haloMonitorAlarm{mac: mac, online: online})
+	}
+	return m, &alarms, &saves
+}
+
+func TestHaloMonitorConfig(t *testing.T) {
+	assert.NoError(t, (&HaloMonitorConfig{}).validate())
+	assert.Equal(t, ErrHaloMonitorConfigInvalid, (&HaloMonitorConfig{OfflineSecs: 10}).validate())
+	assert.Equal(t, 300*time.Second, (&HaloMonitorConfig{}).offlineAfter())
+	assert.Equal(t, 90*time.Second, (&HaloMonitorConfig{OfflineSecs: 90}).offlineAfter())
+	assert.Equal(t, "aabbccddeeff", haloMacKey("AA:BB:CC:DD:EE:FF"))
+	assert.Equal(t, "aabbccddeeff", haloMacKey("aa-bb-cc-dd-ee-ff"))
+}
+
+func TestHaloMonitorOffline(t *testing.T) {
+	now := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	m, alarms, saves := newTestHaloMonitor(&now)
+
+	m.Heartbeat("AA:BB:CC:DD:EE:FF", "hall")
+	now = now.Add(30 * time.Second)
+	m.Heartbeat("aa:bb:cc:dd:ee:ff", "hall")
+	assert.Equal(t, 1, *saves)
+	assert.Len(t, m.Devices(), 1)
+
+	now = now.Add(50 * time.Second)
+	m.check()
+	assert.Empty(t, *alarms)
+
+	now = now.Add(20 * time.Second)
+	m.check()
+	m.check()
+	assert.Equal(t, []haloMonitorAlarm{{mac: "AA:BB:CC:DD:EE:FF", online: false}}, *alarms)
+	devices := m.Devices()
+	assert.False(t, devices[0].Online)
+	assert.Equal(t, now.Add(-70*time.Second), *devices[0].OfflineSince)
+	assert.Equal(t, 2, *saves)
+
+	now = now.Add(time.Hour)
+	m.Heartbeat("AA:BB:CC:DD:EE:FF", "hall")
+	assert.Equal(t, haloMonitorAlarm{mac: "AA:BB:CC:DD:EE:FF", online: true}, (*alarms)[1])
+	devices = m.Devices()
+	assert.True(t, devices[0].Online)
+	assert.Nil(t, devices[0].OfflineSince)
+	assert.Equal(t, now, devices[0].LastSeen)
+
+	// a disabled monitor tracks the devices without alarms
+	m.config.Enabled = false
+	now = now.Add(time.Hour)
+	m.check()
+	assert.Len(t, *alarms, 2)
+	assert.False(t, m.Devices()[0].Online)
+}
+
+func TestHaloMonitorRestore(t *testing.T) {
+	now := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	m, alarms, _ := newTestHaloMonitor(&now)
+	lastSeen := now.Add(-time.Hour)
+	m.restore([]*HaloDevice{
+		{MAC: "AA:BB:CC:DD:EE:FF", Online: true, LastSeen: lastSeen},
+		{MAC: "11:22:33:44:55:66", LastSeen: lastSeen, OfflineSince: &lastSeen},
+	})
+
+	// the box was down, the online device gets a full offline period.
+	m.check()
+	assert.Empty(t, *alarms)
+	online, tracked := m.DeviceOnline("aa-bb-cc-dd-ee-ff")
+	assert.True(t, online)
+	assert.True(t, tracked)
+	online, tracked = m.DeviceOnline("11:22:33:44:55:66")
+	assert.False(t, online)
+	assert.True(t, tracked)
+	_, tracked = m.DeviceOnline("00:00:00:00:00:01")
+	assert.False(t, tracked)
+
+	now = now.Add(2 * time.Minute)
+	m.check()
+	assert.Equal(t, []haloMonitorAlarm{{mac: "AA:BB:CC:DD:EE:FF", online: false}}, *alarms)
+}
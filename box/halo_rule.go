@@ -0,0 +1,289 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+
+	"github.com/example/minibox/db"
+)
+
+const (
+	HaloRuleAbove = "above"
+	HaloRuleBelow = "below"
+
+	// HaloRuleDataSource is the data source of the events raised by the rules.
+	HaloRuleDataSource = "minibox_rule"
+
+	// haloRuleMaxGap resets a rule when a device stops reporting a sensor.
+	haloRuleMaxGap = 5 * time.Minute
+)
+
+var (
+	ErrHaloRuleInvalid  = errors.New("invalid halo rule")
+	ErrHaloRuleNotFound = errors.New("halo rule not found")
+)
+
+var haloRuleEngine *HaloRuleEngine
+
+// haloEventTypes are the Halo event names the halo module maps to cloud events, the only
+// ones a rule can raise.
+var haloEventTypes = make(map[string]bool)
+
+// RegisterHaloEventTypes registers the Halo event names known to the halo module.
+func RegisterHaloEventTypes(names ...string) {
+	for _, name := range names {
+		haloEventTypes[name] = true
+	}
+}
+
+// HaloRule raises EventType for a Halo device when Sensor stays above, or below,
+// Threshold for DurationSecs during its schedules. It is raised once until the value
+// goes back past the threshold by Hysteresis. An empty MAC matches all the devices.
+// EventType is a Halo event name, the sensor when it is empty. It is persisted in the
+// halo_rules table, Schedules are stored as json.
+type HaloRule struct {
+	ID            int64            `json:"id"`
+	Name          string           `json:"name"`
+	Enabled       bool             `json:"enabled"`
+	MAC           string           `json:"mac"`
+	Sensor        string           `json:"sensor"`
+	Operator      string           `json:"operator"`
+	Threshold     float64          `json:"threshold"`
+	Hysteresis    float64          `json:"hysteresis"`
+	DurationSecs  int              `json:"duration_secs"`
+	EventType     string           `json:"event_type"`
+	SchedulesJSON string           `json:"-" gorm:"column:schedules"`
+	Schedules     []scheduleWindow `json:"schedules" gorm:"-"`
+	CreatedAt     time.Time        `json:"-"`
+	UpdatedAt     time.Time        `json:"-"`
+}
+
+func (r *HaloRule) validate() error {
+	if r.Sensor == "" || r.Hysteresis < 0 || r.DurationSecs < 0 {
+		return ErrHaloRuleInvalid
+	}
+	if r.Operator != HaloRuleAbove && r.Operator != HaloRuleBelow {
+		return ErrHaloRuleInvalid
+	}
+	if !haloEventTypes[r.eventType()] {
+		return ErrHaloRuleInvalid
+	}
+	for _, s := range r.Schedules {
+		if !s.valid() {
+			return ErrHaloRuleInvalid
+		}
+	}
+	return nil
+}
+
+func (r *HaloRule) encode() error {
+	schedules, err := json.Marshal(r.Schedules)
+	if err != nil {
+		return err
+	}
+	r.SchedulesJSON = string(schedules)
+	return nil
+}
+
+func (r *HaloRule) decode() error {
+	if r.SchedulesJSON == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(r.SchedulesJSON), &r.Schedules)
+}
+
+func (r *HaloRule) eventType() string {
+	if r.EventType == "" {
+		return r.Sensor
+	}
+	return r.EventType
+}
+
+// exceeds tells if v is past the threshold.
+func (r *HaloRule) exceeds(v float64) bool {
+	if r.Operator == HaloRuleBelow {
+		return v < r.Threshold
+	}
+	return v > r.Threshold
+}
+
+// cleared tells if v is back past the threshold by the hysteresis.
+func (r *HaloRule) cleared(v float64) bool {
+	if r.Operator == HaloRuleBelow {
+		return v >= r.Threshold+r.Hysteresis
+	}
+	return v <= r.Threshold-r.Hysteresis
+}
+
+// HaloRuleFiring is a rule raised for a device by a reading.
+type HaloRuleFiring struct {
+	Rule      HaloRule
+	MAC       string
+	EventType string
+	Value     float64
+}
+
+type haloRuleKey struct {
+	id  int64
+	mac string
+}
+
+// haloRuleState is the state of a rule for a device: since is when the value went past
+// the threshold, zero when it is not.
+type haloRuleState struct {
+	since    time.Time
+	lastSeen time.Time
+	fired    bool
+}
+
+// HaloRuleEngine evaluates the rules over the heartbeats of the Halo devices.
+type HaloRuleEngine struct {
+	db     db.Client
+	logger zerolog.Logger
+	lock   sync.Mutex
+	rules  map[int64]*HaloRule
+	states map[haloRuleKey]*haloRuleState
+}
+
+func NewHaloRuleEngine(d db.Client) *HaloRuleEngine {
+	e := &HaloRuleEngine{
+		db:     d,
+		logger: log.Logger("halo_rule"),
+		rules:  make(map[int64]*HaloRule),
+		states: make(map[haloRuleKey]*haloRuleState),
+	}
+	haloRuleEngine = e
+
+	client := d.GetDBInstance()
+	if err := client.AutoMigrate(&HaloRule{}); err != nil {
+		e.logger.Error().Err(err).Msg("failed to migrate halo rules")
+	}
+	var rules []*HaloRule
+	if err := client.Find(&rules).Error; err != nil {
+		e.logger.Error().Err(err).Msg("failed to load halo rules")
+	}
+	e.lock.Lock()
+	for _, v := range rules {
+		if err := v.decode(); err != nil {
+			e.logger.Error().Err(err).Int64("rule_id", v.ID).Msg("failed to decode halo rule")
+			continue
+		}
+		e.rules[v.ID] = v
+	}
+	e.lock.Unlock()
+	return e
+}
+
+func GetHaloRuleEngine() *HaloRuleEngine {
+	return haloRuleEngine
+}
+
+// Save creates or updates a rule, its states are reset.
+func (e *HaloRuleEngine) Save(v *HaloRule) error {
+	if err := v.validate(); err != nil {
+		return err
+	}
+	if err := v.encode(); err != nil {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if v.ID > 0 {
+		old, ok := e.rules[v.ID]
+		if !ok {
+			return ErrHaloRuleNotFound
+		}
+		v.CreatedAt = old.CreatedAt
+	}
+	if err := e.db.GetDBInstance().Save(v).Error; err != nil {
+		return err
+	}
+	e.rules[v.ID] = v
+	e.resetStates(v.ID)
+	return nil
+}
+
+func (e *HaloRuleEngine) Delete(id int64) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if _, ok := e.rules[id]; !ok {
+		return ErrHaloRuleNotFound
+	}
+	if err := e.db.GetDBInstance().Where("id = ?", id).Delete(&HaloRule{}).Error; err != nil {
+		return err
+	}
+	delete(e.rules, id)
+	e.resetStates(id)
+	return nil
+}
+
+func (e *HaloRuleEngine) List() []HaloRule {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	ret := make([]HaloRule, 0, len(e.rules))
+	for _, v := range e.rules {
+		ret = append(ret, *v)
+	}
+	return ret
+}
+
+func (e *HaloRuleEngine) resetStates(id int64) {
+	for key := range e.states {
+		if key.id == id {
+			delete(e.states, key)
+		}
+	}
+}
+
+// Evaluate runs the rules over the sensors of a heartbeat of a device received at now,
+// and returns the rules to raise.
+func (e *HaloRuleEngine) Evaluate(mac string, sensors map[string]float64, now time.Time) []HaloRuleFiring {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var ret []HaloRuleFiring
+	for _, r := range e.rules {
+		if !r.Enabled || (r.MAC != "" && !strings.EqualFold(r.MAC, mac)) {
+			continue
+		}
+		v, ok := sensors[r.Sensor]
+		if !ok {
+			continue
+		}
+		key := haloRuleKey{id: r.ID, mac: strings.ToLower(mac)}
+		if !scheduleActive(r.Schedules, now) {
+			delete(e.states, key)
+			continue
+		}
+		s, ok := e.states[key]
+		if !ok || now.Sub(s.lastSeen) > haloRuleMaxGap {
+			s = &haloRuleState{}
+			e.states[key] = s
+		}
+		s.lastSeen = now
+		if s.fired {
+			if r.cleared(v) {
+				s.since, s.fired = time.Time{}, false
+			}
+			continue
+		}
+		if !r.exceeds(v) {
+			s.since = time.Time{}
+			continue
+		}
+		if s.since.IsZero() {
+			s.since = now
+		}
+		if now.Sub(s.since) >= time.Duration(r.DurationSecs)*time.Second {
+			s.fired = true
+			ret = append(ret, HaloRuleFiring{Rule: *r, MAC: mac, EventType: r.eventType(), Value: v})
+		}
+	}
+	return ret
+}
@@ -0,0 +1,86 @@
+package box
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHaloRuleValidate(t *testing.T) {
+	RegisterHaloEventTypes("Vape", "Aggression")
+	assert.NoError(t, (&HaloRule{Sensor: "Vape", Operator: HaloRuleAbove, Threshold: 20, DurationSecs: 30}).validate())
+	assert.NoError(t, (&HaloRule{Sensor: "Sound", Operator: HaloRuleAbove, EventType: "Aggression"}).validate())
+	for _, r := range []HaloRule{
+		{Operator: HaloRuleAbove},
+		{Sensor: "Sound", Operator: HaloRuleAbove},
+		{Sensor: "Vape", Operator: HaloRuleAbove, EventType: "Smoke"},
+		{Sensor: "Vape", Operator: ">"},
+		{Sensor: "Vape", Operator: HaloRuleAbove, Hysteresis: -1},
+		{Sensor: "Vape", Operator: HaloRuleAbove, Schedules: []scheduleWindow{{Start: "08:00", End: "08:00"}}},
+		{Sensor: "Vape", Operator: HaloRuleAbove, Schedules: []scheduleWindow{{Start: "8h", End: "16:00"}}},
+	} {
+		assert.Equal(t, ErrHaloRuleInvalid, r.validate())
+	}
+}
+
+func newTestHaloRuleEngine(rules ...*HaloRule) *HaloRuleEngine {
+	e := &HaloRuleEngine{rules: make(map[int64]*HaloRule), states: make(map[haloRuleKey]*haloRuleState)}
+	for _, r := range rules {
+		e.rules[r.ID] = r
+	}
+	return e
+}
+
+func TestHaloRuleEngineEvaluate(t *testing.T) {
+	e := newTestHaloRuleEngine(&HaloRule{ID: 1, Enabled: true, Sensor: "Vape", Operator: HaloRuleAbove,
+		Threshold: 20, Hysteresis: 5, DurationSecs: 30})
+	at := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	vape := func(v float64, secs int) []HaloRuleFiring {
+		return e.Evaluate("AA:BB", map[string]float64{"Vape": v}, at.Add(time.Duration(secs)*time.Second))
+	}
+
+	assert.Empty(t, vape(25, 0))
+	assert.Empty(t, vape(25, 20))
+	// a dip restarts the duration
+	assert.Empty(t, vape(19, 25))
+	assert.Empty(t, vape(30, 30))
+	assert.Empty(t, vape(30, 50))
+	fired := vape(31, 60)
+	assert.Len(t, fired, 1)
+	assert.Equal(t, HaloRuleFiring{Rule: *e.rules[1], MAC: "AA:BB", EventType: "Vape", Value: 31}, fired[0])
+
+	// raised once until cleared by the hysteresis
+	assert.Empty(t, vape(40, 120))
+	assert.Empty(t, vape(18, 130))
+	assert.Empty(t, vape(30, 140))
+	assert.Empty(t, vape(14, 150))
+	assert.Empty(t, vape(30, 160))
+	assert.Len(t, vape(30, 190), 1)
+
+	// other devices and sensors have their own states
+	assert.Empty(t, e.Evaluate("cc:dd", map[string]float64{"Vape": 30}, at.Add(200*time.Second)))
+	assert.Empty(t, e.Evaluate("AA:BB", map[string]float64{"CO2cal": 3000}, at.Add(200*time.Second)))
+}
+
+func TestHaloRuleEngineScheduleAndGap(t *testing.T) {
+	e := newTestHaloRuleEngine(
+		&HaloRule{ID: 1, Enabled: true, MAC: "aa:bb", Sensor: "Sound", Operator: HaloRuleAbove, Threshold: 80,
+			EventType: "Aggression", Schedules: []scheduleWindow{{Weekdays: []time.Weekday{time.Monday}, Start: "08:00", End: "16:00"}}},
+		&HaloRule{ID: 2, Enabled: true, Sensor: "Humidity", Operator: HaloRuleBelow, Threshold: 20, DurationSecs: 60},
+		&HaloRule{ID: 3, Sensor: "Humidity", Operator: HaloRuleBelow, Threshold: 20},
+	)
+	monday := time.Date(2024, 5, 6, 7, 59, 0, 0, time.Local)
+	assert.Empty(t, e.Evaluate("aa:bb", map[string]float64{"Sound": 90}, monday))
+	fired := e.Evaluate("AA:BB", map[string]float64{"Sound": 90}, monday.Add(time.Minute))
+	assert.Len(t, fired, 1)
+	assert.Equal(t, "Aggression", fired[0].EventType)
+	assert.Empty(t, e.Evaluate("ee:ff", map[string]float64{"Sound": 90}, monday.Add(time.Minute)))
+
+	assert.Empty(t, e.Evaluate("aa:bb", map[string]float64{"Humidity": 10}, monday))
+	// a device which stopped reporting starts over
+	assert.Empty(t, e.Evaluate("aa:bb", map[string]float64{"Humidity": 10}, monday.Add(10*time.Minute)))
+	fired = e.Evaluate("aa:bb", map[string]float64{"Humidity": 10}, monday.Add(11*time.Minute))
+	assert.Len(t, fired, 1)
+	assert.Equal(t, int64(2), fired[0].Rule.ID)
+}
@@ -0,0 +1,342 @@
+package box
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+
+	"github.com/example/minibox/db"
+)
+
+// The sensor readings of the Halo devices are kept as min/max/sum/count buckets of two
+// resolutions: minutes for the recent history, and hours, downsampled from the same
+// readings, for the long one.
+const (
+	haloMinuteResolution = 60
+	haloHourResolution   = 3600
+
+	haloMinuteRetention   = 48 * time.Hour
+	haloHourRetention     = 90 * 24 * time.Hour
+	haloBackfillRetention = 7 * 24 * time.Hour
+	haloFlushInterval     = 30 * time.Second
+	haloPruneInterval     = time.Hour
+	haloMaxPoints         = 2000
+)
+
+var (
+	ErrHaloQueryInvalid = errors.New("invalid halo sensor query")
+)
+
+var haloSeries *HaloSeries
+
+// HaloReading is a bucket of the readings of a sensor of a Halo device, persisted in the
+// halo_readings table. Pending minute buckets have readings which were not uploaded to
+// the cloud, they are backfilled once it is reachable again with the average of these
+// readings only.
+type HaloReading struct {
+	ID         int64     `json:"-"`
+	MAC        string    `json:"mac" gorm:"index:idx_halo_reading"`
+	Sensor     string    `json:"sensor" gorm:"index:idx_halo_reading"`
+	Resolution int       `json:"resolution" gorm:"index:idx_halo_reading"`
+	BucketAt   time.Time `json:"bucket_at" gorm:"index:idx_halo_reading"`
+	Count      int       `json:"count"`
+	Min        float64   `json:"min"`
+	Max        float64   `json:"max"`
+	Sum        float64   `json:"sum"`
+	Pending    bool      `json:"-" gorm:"index"`
+	// PendingCount and PendingSum are the readings which were not uploaded.
+	PendingCount int     `json:"-"`
+	PendingSum   float64 `json:"-"`
+}
+
+func (r *HaloReading) add(v float64, pending bool) {
+	if r.Count == 0 || v < r.Min {
+		r.Min = v
+	}
+	if r.Count == 0 || v > r.Max {
+		r.Max = v
+	}
+	r.Count++
+	r.Sum += v
+	if pending {
+		r.Pending = true
+		r.PendingCount++
+		r.PendingSum += v
+	}
+}
+
+// pendingAvg is the average of the readings to backfill, the buckets written before the
+// pending readings were counted apart are backfilled whole.
+func (r *HaloReading) pendingAvg() float64 {
+	if r.PendingCount > 0 {
+		return r.PendingSum / float64(r.PendingCount)
+	}
+	return r.Sum / float64(r.Count)
+}
+
+func (r *HaloReading) merge(o *HaloReading) {
+	if o.Count == 0 {
+		return
+	}
+	if r.Count == 0 || o.Min < r.Min {
+		r.Min = o.Min
+	}
+	if r.Count == 0 || o.Max > r.Max {
+		r.Max = o.Max
+	}
+	r.Count += o.Count
+	r.Sum += o.Sum
+}
+
+func (r *HaloReading) end() time.Time {
+	return r.BucketAt.Add(time.Duration(r.Resolution) * time.Second)
+}
+
+type haloBucketKey struct {
+	mac        string
+	sensor     string
+	resolution int
+	at         int64
+}
+
+// HaloSeriesPoint is the aggregate of the readings of a sensor in an interval starting at
+// Time, in unix seconds.
+type HaloSeriesPoint struct {
+	Time  int64   `json:"time"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+	Count int     `json:"count"`
+}
+
+// HaloBackfill is the average of the sensors of a device in a minute which was not
+// uploaded to the cloud.
+type HaloBackfill struct {
+	MAC    string
+	At     time.Time
+	Values map[string]float64
+	ids    []int64
+}
+
+// HaloSeries stores the sensor readings of the Halo devices. The open buckets are kept in
+// memory and written when they are closed.
+type HaloSeries struct {
+	db      db.Client
+	logger  zerolog.Logger
+	lock    sync.Mutex
+	buckets map[haloBucketKey]*HaloReading
+	now     func() time.Time
+}
+
+func NewHaloSeries(d db.Client) *HaloSeries {
+	s := &HaloSeries{
+		db:      d,
+		logger:  log.Logger("halo_series"),
+		buckets: make(map[haloBucketKey]*HaloReading),
+		now:     time.Now,
+	}
+	haloSeries = s
+
+	if err := d.GetDBInstance().AutoMigrate(&HaloReading{}); err != nil {
+		s.logger.Error().Err(err).Msg("failed to migrate halo readings")
+	}
+	go s.run()
+	return s
+}
+
+func GetHaloSeries() *HaloSeries {
+	return haloSeries
+}
+
+// Record adds the readings of a heartbeat, pending tells they were not uploaded to the
+// cloud.
+func (s *HaloSeries) Record(mac string, sensors map[string]float64, at time.Time, pending bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for sensor, v := range sensors {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		for _, resolution := range []int{haloMinuteResolution, haloHourResolution} {
+			bucketAt := at.Truncate(time.Duration(resolution) * time.Second)
+			key := haloBucketKey{mac: mac, sensor: sensor, resolution: resolution, at: bucketAt.Unix()}
+			r, ok := s.buckets[key]
+			if !ok {
+				r = &HaloReading{MAC: mac, Sensor: sensor, Resolution: resolution, BucketAt: bucketAt}
+				s.buckets[key] = r
+			}
+			r.add(v, pending && resolution == haloMinuteResolution)
+		}
+	}
+}
+
+// Query returns the min/max/avg of a sensor per interval seconds in [from, to). The
+// minute buckets are used for the intervals shorter than an hour in their retention.
+func (s *HaloSeries) Query(mac, sensor string, from, to time.Time, interval int) ([]HaloSeriesPoint, error) {
+	if mac == "" || sensor == "" || !from.Before(to) || interval <= 0 {
+		return nil, ErrHaloQueryInvalid
+	}
+	resolution := haloHourResolution
+	if interval < haloHourResolution && s.now().Sub(from) <= haloMinuteRetention {
+		resolution = haloMinuteResolution
+	}
+	// an interval is a whole number of buckets
+	interval = (interval + resolution - 1) / resolution * resolution
+	step := time.Duration(interval) * time.Second
+	from = from.Truncate(time.Duration(resolution) * time.Second)
+	if to.Sub(from)/step > haloMaxPoints {
+		return nil, ErrHaloQueryInvalid
+	}
+
+	var rows []HaloReading
+	err := s.db.GetDBInstance().Where("mac = ? AND sensor = ? AND resolution = ? AND bucket_at >= ? AND bucket_at < ?",
+		mac, sensor, resolution, from, to).Order("bucket_at").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	for _, r := range s.buckets {
+		if r.MAC == mac && r.Sensor == sensor && r.Resolution == resolution && !r.BucketAt.Before(from) && r.BucketAt.Before(to) {
+			rows = append(rows, *r)
+		}
+	}
+	s.lock.Unlock()
+	return aggregateHaloReadings(rows, from, step), nil
+}
+
+// aggregateHaloReadings merges the buckets into points of step from from.
+func aggregateHaloReadings(rows []HaloReading, from time.Time, step time.Duration) []HaloSeriesPoint {
+	points := make(map[int64]*HaloReading)
+	for i := range rows {
+		at := from.Add(rows[i].BucketAt.Sub(from) / step * step).Unix()
+		p, ok := points[at]
+		if !ok {
+			p = &HaloReading{}
+			points[at] = p
+		}
+		p.merge(&rows[i])
+	}
+	ret := make([]HaloSeriesPoint, 0, len(points))
+	for at, p := range points {
+		ret = append(ret, HaloSeriesPoint{Time: at, Min: p.Min, Max: p.Max, Avg: p.Sum / float64(p.Count), Count: p.Count})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Time < ret[j].Time })
+	return ret
+}
+
+// PendingBackfill returns the oldest minutes of a device which were not uploaded to the
+// cloud, at most limit minutes, each with all its sensors.
+func (s *HaloSeries) PendingBackfill(limit int) ([]HaloBackfill, error) {
+	var minutes []struct {
+		MAC      string
+		BucketAt time.Time
+	}
+	client := s.db.GetDBInstance()
+	err := client.Model(&HaloReading{}).Select("mac, bucket_at").
+		Where("pending = ? AND resolution = ?", true, haloMinuteResolution).
+		Group("mac, bucket_at").Order("bucket_at").Limit(limit).Scan(&minutes).Error
+	if err != nil || len(minutes) == 0 {
+		return nil, err
+	}
+	keys := make(map[haloBucketKey]bool, len(minutes))
+	for _, m := range minutes {
+		keys[haloBucketKey{mac: m.MAC, at: m.BucketAt.Unix()}] = true
+	}
+	var rows []HaloReading
+	err = client.Where("pending = ? AND resolution = ? AND bucket_at >= ? AND bucket_at <= ?",
+		true, haloMinuteResolution, minutes[0].BucketAt, minutes[len(minutes)-1].BucketAt).Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	selected := rows[:0]
+	for _, r := range rows {
+		if keys[haloBucketKey{mac: r.MAC, at: r.BucketAt.Unix()}] {
+			selected = append(selected, r)
+		}
+	}
+	return groupHaloBackfill(selected), nil
+}
+
+// groupHaloBackfill gathers the pending buckets by device and minute, oldest first.
+func groupHaloBackfill(rows []HaloReading) []HaloBackfill {
+	var ret []HaloBackfill
+	index := make(map[haloBucketKey]int)
+	for _, r := range rows {
+		key := haloBucketKey{mac: r.MAC, at: r.BucketAt.Unix()}
+		i, ok := index[key]
+		if !ok {
+			i = len(ret)
+			index[key] = i
+			ret = append(ret, HaloBackfill{MAC: r.MAC, At: r.BucketAt, Values: make(map[string]float64)})
+		}
+		ret[i].Values[r.Sensor] = r.pendingAvg()
+		ret[i].ids = append(ret[i].ids, r.ID)
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].At.Before(ret[j].At) })
+	return ret
+}
+
+// MarkBackfilled clears the pending readings of the buckets of b once it is uploaded.
+func (s *HaloSeries) MarkBackfilled(b HaloBackfill) error {
+	return s.db.GetDBInstance().Model(&HaloReading{}).Where("id IN (?)", b.ids).
+		Updates(map[string]interface{}{"pending": false, "pending_count": 0, "pending_sum": 0}).Error
+}
+
+func (s *HaloSeries) run() {
+	flush := time.NewTicker(haloFlushInterval)
+	defer flush.Stop()
+	var pruned time.Time
+	for range flush.C {
+		s.flush()
+		if now := s.now(); now.Sub(pruned) > haloPruneInterval {
+			pruned = now
+			s.prune()
+		}
+	}
+}
+
+// flush writes the closed buckets.
+func (s *HaloSeries) flush() {
+	now := s.now()
+	var closed []*HaloReading
+	s.lock.Lock()
+	for key, r := range s.buckets {
+		if !r.end().After(now) {
+			closed = append(closed, r)
+			delete(s.buckets, key)
+		}
+	}
+	s.lock.Unlock()
+	client := s.db.GetDBInstance()
+	for _, r := range closed {
+		if err := client.Create(r).Error; err != nil {
+			s.logger.Error().Err(err).Str("mac", r.MAC).Str("sensor", r.Sensor).Msg("failed to save halo reading")
+		}
+	}
+}
+
+// prune removes the buckets out of retention, the pending minutes are kept longer for
+// the backfill.
+func (s *HaloSeries) prune() {
+	now := s.now()
+	client := s.db.GetDBInstance()
+	err := client.Where("resolution = ? AND pending = ? AND bucket_at < ?", haloMinuteResolution, false, now.Add(-haloMinuteRetention)).
+		Delete(&HaloReading{}).Error
+	if err == nil {
+		err = client.Where("resolution = ? AND bucket_at < ?", haloMinuteResolution, now.Add(-haloBackfillRetention)).
+			Delete(&HaloReading{}).Error
+	}
+	if err == nil {
+		err = client.Where("resolution = ? AND bucket_at < ?", haloHourResolution, now.Add(-haloHourRetention)).
+			Delete(&HaloReading{}).Error
+	}
+	if err != nil {
+		s.logger.Warn().Err(err).Msg("failed to prune halo readings")
+	}
+}
@@ -0,0 +1,74 @@
+package box
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHaloSeriesRecord(t *testing.T) {
+	s := &HaloSeries{buckets: make(map[haloBucketKey]*HaloReading)}
+	at := time.Date(2024, 5, 1, 10, 0, 10, 0, time.UTC)
+	s.Record("aa:bb", map[string]float64{"CO2cal": 400, "PM2.5": math.NaN()}, at, false)
+	s.Record("aa:bb", map[string]float64{"CO2cal": 600}, at.Add(20*time.Second), true)
+	s.Record("aa:bb", map[string]float64{"CO2cal": 500}, at.Add(time.Minute), false)
+	assert.Len(t, s.buckets, 3)
+
+	minute := s.buckets[haloBucketKey{mac: "aa:bb", sensor: "CO2cal", resolution: haloMinuteResolution, at: at.Truncate(time.Minute).Unix()}]
+	assert.Equal(t, &HaloReading{MAC: "aa:bb", Sensor: "CO2cal", Resolution: haloMinuteResolution,
+		BucketAt: at.Truncate(time.Minute), Count: 2, Min: 400, Max: 600, Sum: 1000, Pending: true, PendingCount: 1, PendingSum: 600}, minute)
+	hour := s.buckets[haloBucketKey{mac: "aa:bb", sensor: "CO2cal", resolution: haloHourResolution, at: at.Truncate(time.Hour).Unix()}]
+	assert.Equal(t, 3, hour.Count)
+	assert.Equal(t, 1500.0, hour.Sum)
+	assert.False(t, hour.Pending)
+	assert.Equal(t, at.Truncate(time.Hour).Add(time.Hour), hour.end())
+}
+
+func TestGroupHaloBackfill(t *testing.T) {
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	backfill := groupHaloBackfill([]HaloReading{
+		{ID: 1, MAC: "aa:bb", Sensor: "CO2cal", BucketAt: at.Add(time.Minute), Count: 2, Sum: 1000, PendingCount: 1, PendingSum: 600},
+		{ID: 2, MAC: "aa:bb", Sensor: "CO2cal", BucketAt: at, Count: 2, Sum: 800, PendingCount: 2, PendingSum: 800},
+		{ID: 3, MAC: "cc:dd", Sensor: "CO2cal", BucketAt: at, Count: 1, Sum: 500, PendingCount: 1, PendingSum: 500},
+		{ID: 4, MAC: "aa:bb", Sensor: "Temp", BucketAt: at, Count: 3, Sum: 60, Pending: true},
+	})
+	assert.Equal(t, []HaloBackfill{
+		{MAC: "aa:bb", At: at, Values: map[string]float64{"CO2cal": 400, "Temp": 20}, ids: []int64{2, 4}},
+		{MAC: "cc:dd", At: at, Values: map[string]float64{"CO2cal": 500}, ids: []int64{3}},
+		{MAC: "aa:bb", At: at.Add(time.Minute), Values: map[string]float64{"CO2cal": 600}, ids: []int64{1}},
+	}, backfill)
+}
+
+func TestAggregateHaloReadings(t *testing.T) {
+	from := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	rows := []HaloReading{
+		{BucketAt: from.Add(4 * time.Minute), Count: 1, Min: 9, Max: 9, Sum: 9},
+		{BucketAt: from, Count: 2, Min: 1, Max: 3, Sum: 4},
+		{BucketAt: from.Add(time.Minute), Count: 2, Min: 2, Max: 6, Sum: 8},
+	}
+	points := aggregateHaloReadings(rows, from, 2*time.Minute)
+	assert.Equal(t, []HaloSeriesPoint{
+		{Time: from.Unix(), Min: 1, Max: 6, Avg: 3, Count: 4},
+		{Time: from.Add(4 * time.Minute).Unix(), Min: 9, Max: 9, Avg: 9, Count: 1},
+	}, points)
+}
+
+func TestHaloSeriesQueryInvalid(t *testing.T) {
+	now := time.Now()
+	s := &HaloSeries{buckets: make(map[haloBucketKey]*HaloReading), now: time.Now}
+	for _, q := range []struct {
+		mac, sensor string
+		from, to    time.Time
+		interval    int
+	}{
+		{"", "CO2cal", now.Add(-time.Hour), now, 60},
+		{"aa:bb", "CO2cal", now, now.Add(-time.Hour), 60},
+		{"aa:bb", "CO2cal", now.Add(-time.Hour), now, 0},
+		{"aa:bb", "CO2cal", now.Add(-40 * time.Hour), now, 60},
+	} {
+		_, err := s.Query(q.mac, q.sensor, q.from, q.to, q.interval)
+		assert.Equal(t, ErrHaloQueryInvalid, err)
+	}
+}
@@ -1,14 +1,11 @@
 package box
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"math/big"
 	"net/http"
 	"net/url"
 	"os"
@@ -67,6 +64,19 @@ const (
 	GetPTZPresets                 = "nest.box.camera.get_ptz_presets"
 	SetPTZPreset                  = "nest.box.camera.set_ptz_preset"
 	GoToPTZPreset                 = "nest.box.camera.go_to_ptz_preset"
+	PTZHome                       = "nest.box.camera.ptz_home"
+	PTZAbsoluteMove               = "nest.box.camera.ptz_absolute_move"
+	PTZRelativeMove               = "nest.box.camera.ptz_relative_move"
+	PTZClickToCenter              = "nest.box.camera.ptz_click_to_center"
+	PTZAreaZoom                   = "nest.box.camera.ptz_area_zoom"
+	SavePTZTour                   = "nest.box.camera.ptz_tour.save"
+	DeletePTZTour                 = "nest.box.camera.ptz_tour.delete"
+	ListPTZTours                  = "nest.box.camera.ptz_tour.list"
+	PTZLock                       = "nest.box.camera.ptz_lock.acquire"
+	PTZUnlock                     = "nest.box.camera.ptz_lock.release"
+	SavePTZEventRule              = "nest.box.camera.ptz_event_rule.save"
+	DeletePTZEventRule            = "nest.box.camera.ptz_event_rule.delete"
+	ListPTZEventRules             = "nest.box.camera.ptz_event_rule.list"
 	GetRecordsLegacy              = "box.camera.get_records"
 	GetRecords                    = "nest.box.camera.get_records"
 	GetRecordsDaily               = "nest.box.camera.get_records_daily"
@@ -90,9 +100,18 @@ const (
 	IotDiscover                   = "nest.box.discover_devices"
 	StartMultiStream              = "nest.box.camera.start_multi_streams"
 	StartMultiCastStream          = "nest.box.camera.start_multi_cast_streams"
+	StartMosaicStream             = "nest.box.camera.start_mosaic_stream"
+	GetStreamHealth               = "nest.box.camera.get_stream_health"
+	GetRestreamStatus             = "nest.box.camera.get_restream_status"
 	IotPlayAudioClip              = "nest.box.iot.play_audio_clip"
 	IotStopAudioClip              = "nest.box.iot.stop_audio_clip"
 	IotValidateSpeaker            = "nest.box.iot.validate_speaker"
+	IotListAudioClips             = "nest.box.iot.list_audio_clips"
+	IotUploadAudioClip            = "nest.box.iot.upload_audio_clip"
+	IotReplaceAudioClip           = "nest.box.iot.replace_audio_clip"
+	IotDeleteAudioClip            = "nest.box.iot.delete_audio_clip"
+	IotSyncAudioClips             = "nest.box.iot.sync_audio_clips"
+	IotAudioClipInventory         = "nest.box.iot.audio_clip_inventory"
 	NestPtzCtrl                   = "nest.box.camera.ptz_ctrl"
 	NestStreamAction              = "nest.box.camera.stream.action"
 	NestStartBackwardAudio        = "nest.box.camera.backward_audio.start"
@@ -101,6 +120,50 @@ const (
 	NestGeneralStartBackwardAudio = "nest.box.general.backward_audio.start"
 	NestGeneralStopBackwardAudio  = "nest.box.general.backward_audio.stop"
 	NestGeneralHeartbeatAudio     = "nest.box.general.backward_audio.heartbeat"
+	AnnounceSpeak                 = "nest.box.general.announce.speak"
+	SaveAnnouncement              = "nest.box.general.announce.save"
+	DeleteAnnouncement            = "nest.box.general.announce.delete"
+	ListAnnouncements             = "nest.box.general.announce.list"
+	SaveSpeakerGroup              = "nest.box.general.speaker_group.save"
+	DeleteSpeakerGroup            = "nest.box.general.speaker_group.delete"
+	ListSpeakerGroups             = "nest.box.general.speaker_group.list"
+	SaveSipConfig                 = "nest.box.general.sip.config.save"
+	GetSipConfig                  = "nest.box.general.sip.config.get"
+	GetSipStatus                  = "nest.box.general.sip.status"
+	SaveSipDoorStation            = "nest.box.general.sip.door_station.save"
+	DeleteSipDoorStation          = "nest.box.general.sip.door_station.delete"
+	ListSipDoorStations           = "nest.box.general.sip.door_station.list"
+	SaveMqttConfig                = "nest.box.general.mqtt.config.save"
+	GetMqttConfig                 = "nest.box.general.mqtt.config.get"
+	GetMqttStatus                 = "nest.box.general.mqtt.status"
+	SaveWebhook                   = "nest.box.general.webhook.save"
+	DeleteWebhook                 = "nest.box.general.webhook.delete"
+	ListWebhooks                  = "nest.box.general.webhook.list"
+	TestWebhook                   = "nest.box.general.webhook.test"
+	ListWebhookDeliveries         = "nest.box.general.webhook.deliveries"
+	QueryHaloSensors              = "nest.box.general.halo.sensors.query"
+	SaveHaloRule                  = "nest.box.general.halo.rule.save"
+	DeleteHaloRule                = "nest.box.general.halo.rule.delete"
+	ListHaloRules                 = "nest.box.general.halo.rule.list"
+	SaveHaloMonitorConfig         = "nest.box.general.halo.monitor.config.save"
+	GetHaloMonitorConfig          = "nest.box.general.halo.monitor.config.get"
+	ListHaloDevices               = "nest.box.general.halo.devices"
+	SavePushAuthRule              = "nest.box.general.push_auth.rule.save"
+	DeletePushAuthRule            = "nest.box.general.push_auth.rule.delete"
+	ListPushAuthRules             = "nest.box.general.push_auth.rule.list"
+	SaveNVRRotation               = "nest.box.general.nvr.rotation.save"
+	DeleteNVRRotation             = "nest.box.general.nvr.rotation.delete"
+	ListNVRRotations              = "nest.box.general.nvr.rotation.list"
+	RotateNVRPassword             = "nest.box.general.nvr.rotation.rotate"
+	ListCredentials               = "nest.box.general.credential.list"
+	AddFirmwareImage              = "nest.box.general.firmware.image.add"
+	DeleteFirmwareImage           = "nest.box.general.firmware.image.delete"
+	ListFirmwareImages            = "nest.box.general.firmware.image.list"
+	StartFirmwareRollout          = "nest.box.general.firmware.rollout.start"
+	CancelFirmwareRollout         = "nest.box.general.firmware.rollout.cancel"
+	ListFirmwareRollouts          = "nest.box.general.firmware.rollout.list"
+	ListNVRStorage                = "nest.box.general.nvr.storage.list"
+	GetNVRStorageHistory          = "nest.box.general.nvr.storage.history"
 )
 
 const (
@@ -149,23 +212,48 @@ var ErrHttpAuthFailed = errors.New("The username or password is incorrect")
 type handler struct {
 	log               zerolog.Logger
 	registeredActions map[string]func(websocket.Message) ([]byte, error)
+	sessionActions    map[string]func(websocket.Message, wsSession) ([]byte, error)
 	device            Box
 	searcher          *discover.SearcherProcessor
 }
 
+var handlerOnce sync.Once
+var boxHandler websocket.Handler
+
 func NewHandler(device Box) websocket.Handler {
 	h := &handler{log: log.Logger("Handle"), device: device, searcher: device.GetSearcher()}
 	h.registerActions()
 	return h
 }
 
+// GetHandler returns the handler of the box, shared by the cloud websocket and the MQTT
+// commands.
+func GetHandler(device Box) websocket.Handler {
+	handlerOnce.Do(func() {
+		boxHandler = NewHandler(device)
+	})
+	return boxHandler
+}
+
 func (h *handler) Handle(payload []byte) ([]byte, error) {
+	// the cloud only authenticates itself, not the user who sends a message.
+	return h.handle(payload, wsSession{})
+}
+
+// handle runs the action of a message, the session is the user the transport of the
+// message authenticated.
+func (h *handler) handle(payload []byte, session wsSession) ([]byte, error) {
 	msg, err := websocket.ToMessage(payload)
 	if err != nil {
-		h.log.Error().Msgf("ToMessage err: %s, content: %s", err, string(payload))
+		h.log.Error().Msgf("ToMessage err: %s, content: %s", err, RedactJSON(payload))
 		return msg.ReplyMessage(err).Marshal(), err
 	}
 
+	if actionFunc, ok := h.sessionActions[msg.GetAction()]; ok {
+		data, err := actionFunc(msg, session)
+		go metrics.WSCounterCollect(msg.GetAction(), err)
+		return data, err
+	}
 	actionFunc, ok := h.registeredActions[msg.GetAction()]
 	if ok {
 		data, err := actionFunc(msg)
@@ -191,6 +279,9 @@ func (h *handler) registerActions() {
 		StartWebStream:           h.startStream,
 		StartMultiStream:         h.startMultiStream,
 		StartMultiCastStream:     h.startMultiStream,
+		StartMosaicStream:        h.startMosaicStream,
+		GetStreamHealth:          h.getStreamHealth,
+		GetRestreamStatus:        h.getRestreamStatus,
 		RecordVideo:              h.recordVideo,
 		Search:                   h.search,
 		ValidateDvr:              h.validateDvr,
@@ -202,10 +293,13 @@ func (h *handler) registerActions() {
 		GetRecordsLegacy:         h.getRecords,
 		GetRecords:               h.getRecords,
 		GetRecordsDaily:          h.getRecordsDaily,
-		PTZCtrl:                  h.ptzCtrl,
 		GetPTZPresets:            h.getPTZPresets,
-		SetPTZPreset:             h.setPTZPreset,
-		GoToPTZPreset:            h.goToPTZPreset,
+		SavePTZTour:              h.savePTZTour,
+		DeletePTZTour:            h.deletePTZTour,
+		ListPTZTours:             h.listPTZTours,
+		SavePTZEventRule:         h.savePTZEventRule,
+		DeletePTZEventRule:       h.deletePTZEventRule,
+		ListPTZEventRules:        h.listPTZEventRules,
 		StreamAction:             h.streamAction,
 		ArchiveSetting:           h.handleArchiveSettings,
 		StreamSettings:           h.streamSettings,
@@ -229,16 +323,79 @@ func (h *handler) registerActions() {
 		IotPlayAudioClip:              h.iotPlayAudioClip,
 		IotStopAudioClip:              h.iotStopAudioClip,
 		IotValidateSpeaker:            h.iotValidateSpeaker,
+		IotListAudioClips:             h.iotListAudioClips,
+		IotUploadAudioClip:            h.iotUploadAudioClip,
+		IotReplaceAudioClip:           h.iotReplaceAudioClip,
+		IotDeleteAudioClip:            h.iotDeleteAudioClip,
+		IotSyncAudioClips:             h.iotSyncAudioClips,
+		IotAudioClipInventory:         h.iotAudioClipInventory,
 		NestStreamAction:              h.streamAction,
-		NestPtzCtrl:                   h.ptzCtrl,
 		NestStartBackwardAudio:        h.startBackwardAudio,
 		NestHeartbeatAudio:            h.heartBackwardAudio,
 		NestStopBackwardAudio:         h.stopBackwardAudio,
 		NestGeneralStartBackwardAudio: h.startGeneralBackwardAudio,
 		NestGeneralStopBackwardAudio:  h.stopGeneralBackwardAudio,
 		NestGeneralHeartbeatAudio:     h.heartbeatGeneralBackwardAudio,
+		AnnounceSpeak:                 h.announceSpeak,
+		SaveAnnouncement:              h.saveAnnouncement,
+		DeleteAnnouncement:            h.deleteAnnouncement,
+		ListAnnouncements:             h.listAnnouncements,
+		SaveSpeakerGroup:              h.saveSpeakerGroup,
+		DeleteSpeakerGroup:            h.deleteSpeakerGroup,
+		ListSpeakerGroups:             h.listSpeakerGroups,
+		SaveSipConfig:                 h.saveSipConfig,
+		GetSipConfig:                  h.getSipConfig,
+		GetSipStatus:                  h.getSipStatus,
+		SaveSipDoorStation:            h.saveSipDoorStation,
+		DeleteSipDoorStation:          h.deleteSipDoorStation,
+		ListSipDoorStations:           h.listSipDoorStations,
+		SaveMqttConfig:                h.saveMqttConfig,
+		GetMqttConfig:                 h.getMqttConfig,
+		GetMqttStatus:                 h.getMqttStatus,
+		SaveWebhook:                   h.saveWebhook,
+		DeleteWebhook:                 h.deleteWebhook,
+		ListWebhooks:                  h.listWebhooks,
+		TestWebhook:                   h.testWebhook,
+		ListWebhookDeliveries:         h.listWebhookDeliveries,
+		QueryHaloSensors:              h.queryHaloSensors,
+		SaveHaloRule:                  h.saveHaloRule,
+		DeleteHaloRule:                h.deleteHaloRule,
+		ListHaloRules:                 h.listHaloRules,
+		SaveHaloMonitorConfig:         h.saveHaloMonitorConfig,
+		GetHaloMonitorConfig:          h.getHaloMonitorConfig,
+		ListHaloDevices:               h.listHaloDevices,
+		SavePushAuthRule:              h.savePushAuthRule,
+		DeletePushAuthRule:            h.deletePushAuthRule,
+		ListPushAuthRules:             h.listPushAuthRules,
+		SaveNVRRotation:               h.saveNVRRotation,
+		DeleteNVRRotation:             h.deleteNVRRotation,
+		ListNVRRotations:              h.listNVRRotations,
+		RotateNVRPassword:             h.rotateNVRPassword,
+		ListCredentials:               h.listCredentials,
+		AddFirmwareImage:              h.addFirmwareImage,
+		DeleteFirmwareImage:           h.deleteFirmwareImage,
+		ListFirmwareImages:            h.listFirmwareImages,
+		StartFirmwareRollout:          h.startFirmwareRollout,
+		CancelFirmwareRollout:         h.cancelFirmwareRollout,
+		ListFirmwareRollouts:          h.listFirmwareRollouts,
+		ListNVRStorage:                h.listNVRStorage,
+		GetNVRStorageHistory:          h.getNVRStorageHistory,
 	}
 	h.registeredActions = actions
+	// the PTZ commands are arbitrated by the user of the session.
+	h.sessionActions = map[string]func(websocket.Message, wsSession) ([]byte, error){
+		PTZCtrl:          h.ptzCtrl,
+		NestPtzCtrl:      h.ptzCtrl,
+		SetPTZPreset:     h.setPTZPreset,
+		GoToPTZPreset:    h.goToPTZPreset,
+		PTZHome:          h.ptzHome,
+		PTZAbsoluteMove:  h.ptzAbsoluteMove,
+		PTZRelativeMove:  h.ptzRelativeMove,
+		PTZClickToCenter: h.ptzClickToCenter,
+		PTZAreaZoom:      h.ptzAreaZoom,
+		PTZLock:          h.ptzLock,
+		PTZUnlock:        h.ptzUnlock,
+	}
 }
 
 func (h *handler) unknownAction(msg websocket.Message) ([]byte, error) {
@@ -335,6 +492,13 @@ func (h *handler) validateDvr(msg websocket.Message) ([]byte, error) {
 	dev := h.searcher.GetDeviceByHost(req.Host)
 	brand := utils.GetCameraBrand(dev.Info.Manufacturer)
 	_, port := utils.ParseXAddr(dev.Params.Xaddr)
+	if drvBrand := nvrBrand(dev.Info.Manufacturer); drvBrand != "" {
+		drv, err := newNVRDriver(drvBrand, req.Host, port, req.Username, req.Password)
+		if err != nil {
+			return msg.ReplyMessage(err).Marshal(), err
+		}
+		return h.validateDriverDvr(msg, req, drv, port, dev.Info.MACAddress)
+	}
 	cameras := make([]validateDvrCameraRet, 0)
 	wg := sync.WaitGroup{}
 	nc := univiewapi.NewNvrClient(req.Host, req.Username, req.Password, port,
@@ -730,12 +894,16 @@ func (h handler) startStream(msg websocket.Message) ([]byte, error) {
 		h.log.Error().Err(err).Msg("failed to create input stream uri.")
 		return msg.ReplyMessage(err).Marshal(), err
 	}
+	if srp.Arg.StreamParam.StartTime == 0 {
+		inputUri = h.getRestreamInputUri(restreamStreamConsumer(streamId), cam, resolution, inputUri)
+	}
 
 	// getStreamEncodeInfo must be before StartStream for that the Web/Mobile player's first frame can be I frame
 	encodeInfo := h.getStreamEncodeInfo(cam, resolution)
 
 	outputUri, err = h.getStreamManager().StartStream(streamId, streamType, inputUri, outputUri)
 	if err != nil {
+		GetRestreamProxy(h.device).Release(restreamStreamConsumer(streamId))
 		if err == scheduler.CommandDroppedError {
 			return msg.ReplyMessage(websocket.Err{
 				Code:           -1,
@@ -747,7 +915,8 @@ func (h handler) startStream(msg websocket.Message) ([]byte, error) {
 		}
 	}
 
-	h.log.Info().Str("streamid", streamId).Msgf("pull stream from %s and send to %s", inputUri, outputUri)
+	GetStreamHealthMonitor(h.device).Track(streamId, int64(cam.GetID()), streamType, resolution, inputUri, outputUri)
+	h.log.Info().Str("streamid", streamId).Msgf("pull stream from %s and send to %s", RedactURI(inputUri), outputUri)
 	return msg.ReplyMessage(streamResponse{BaseUri: baseUri, StreamType: streamType,
 		StreamId: streamId, OutputUri: outputUri, EncodeInfo: encodeInfo}).Marshal(), err
 }
@@ -804,15 +973,21 @@ func (h handler) startMultiStream(msg websocket.Message) ([]byte, error) {
 			singleStream.Err.Message = err.Error()
 			continue
 		}
+		if v.StartTime == 0 {
+			inputUri = h.getRestreamInputUri(restreamStreamConsumer(singleStream.StreamId), cam, resolution, inputUri)
+		}
 
 		encodeInfo := h.getStreamEncodeInfo(cam, resolution)
 		rtmpUrl, err = h.getStreamManager().StartStream(singleStream.StreamId, singleStream.StreamType, inputUri, rtmpUrl)
 		if err != nil {
+			GetRestreamProxy(h.device).Release(restreamStreamConsumer(singleStream.StreamId))
 			singleStream.Err.Code = -1
 			singleStream.Err.Message = err.Error()
 			continue
 		}
 
+		GetStreamHealthMonitor(h.device).Track(singleStream.StreamId, singleStream.CameraId, singleStream.StreamType, resolution, inputUri, rtmpUrl)
+
 		webrtcUrl := strings.Replace(singleStream.BaseUri, "rtmp", "webrtc", 1)
 		webrtcUrl = strings.Replace(webrtcUrl, ":1935", "", 1)
 		webrtcUrl = fmt.Sprintf("%s/%d/%s", webrtcUrl, singleStream.CameraId, singleStream.StreamId)
@@ -825,7 +1000,7 @@ func (h handler) startMultiStream(msg websocket.Message) ([]byte, error) {
 			}
 		}
 
-		h.log.Info().Msgf("pull stream from %s and send to %s, webrtc url is %s, rtmp url is %s", inputUri, rtmpUrl, webrtcUrl, rtmpUri)
+		h.log.Info().Msgf("pull stream from %s and send to %s, webrtc url is %s, rtmp url is %s", RedactURI(inputUri), rtmpUrl, webrtcUrl, rtmpUri)
 		singleStream.OutputUri = webrtcUrl
 		singleStream.RtmpUri = rtmpUri
 		singleStream.EncodeInfo = encodeInfo
@@ -868,6 +1043,10 @@ func (h handler) streamAction(msg websocket.Message) ([]byte, error) {
 		status = stream.Speeded
 	case stream.Stop:
 		err = h.getStreamManager().StopStream(sar.StreamId)
+		GetMosaicComposer().Stop(sar.StreamId)
+		GetStreamHealthMonitor(h.device).Untrack(sar.StreamId)
+		GetRestreamProxy(h.device).Release(restreamStreamConsumer(sar.StreamId))
+		GetRestreamProxy(h.device).ReleasePrefix(restreamMosaicConsumer(sar.StreamId))
 		status = stream.Closed
 	case stream.ForceKeyFrame:
 		cam, err := h.getCameraFromArgs(msg.GetArgs())
@@ -895,6 +1074,15 @@ func (h handler) streamAction(msg websocket.Message) ([]byte, error) {
 	}).Marshal(), err
 }
 
+// getStreamHealth reports the quality of every running stream.
+func (h handler) getStreamHealth(msg websocket.Message) ([]byte, error) {
+	return msg.ReplyMessage(GetStreamHealthMonitor(h.device).All()).Marshal(), nil
+}
+
+func (h handler) getRestreamStatus(msg websocket.Message) ([]byte, error) {
+	return msg.ReplyMessage(GetRestreamProxy(h.device).All()).Marshal(), nil
+}
+
 // handleArchiveSettings handle the cloud settings action.
 func (h handler) handleArchiveSettings(msg websocket.Message) ([]byte, error) {
 	args, err := json.Marshal(msg.GetArgs())
@@ -1067,7 +1255,7 @@ func (h handler) updateCameraFromCloud(msg websocket.Message) ([]byte, error) {
 	if cloudNvrs, nvrErr := h.device.CloudClient().GetNvrs(); nvrErr != nil {
 		h.log.Error().Err(nvrErr).Msgf("get nvrs from cloud failed")
 	} else {
-		h.log.Debug().Msgf("get nvrs from cloud success, nvrs: %+v", cloudNvrs)
+		h.log.Debug().Msgf("get nvrs from cloud success, nvrs: %s", RedactedJSON(cloudNvrs))
 		h.device.SetCloudNvrs(cloudNvrs)
 	}
 
@@ -1597,6 +1785,8 @@ func (h *handler) getStreamInputUri(cam base.Camera, resolution string, startTim
 				unvCam := aiCam.(*uniview.BaseUniviewCamera)
 				err = unvCam.NvrWriteCacheToDisk(unvCam.GetChannel(), streamID, startTime, endTime)
 			}
+		case utils.Hikvision, utils.Dahua:
+			inputUri, err = getDriverPlaybackUri(cam, inputUri, startTime, endTime)
 		default:
 			err = errors.New("does not support this brand yet")
 		}
@@ -1611,8 +1801,8 @@ func (h *handler) getStreamInputUri(cam base.Camera, resolution string, startTim
 	if u.Scheme == "" || u.Host == "" || u.Path == "" {
 		return "", errors.New("invalid input stream uri")
 	}
-	if u.User == nil && cam.GetUserName() != "" && cam.GetPassword() != "" {
-		u.User = url.UserPassword(cam.GetUserName(), cam.GetPassword())
+	if password := cameraPassword(cam); u.User == nil && cam.GetUserName() != "" && password != "" {
+		u.User = url.UserPassword(cam.GetUserName(), password)
 	}
 
 	q := u.Query()
@@ -1626,6 +1816,29 @@ func (h *handler) getStreamInputUri(cam base.Camera, resolution string, startTim
 	return u.String(), nil
 }
 
+// getRestreamInputUri shares the live pull of cam through the rtsp proxy, so that the
+// NVR only serves one session per stream. The query of inputUri is kept for the
+// stream.Manager. It falls back to inputUri when the stream can not be proxied.
+func (h *handler) getRestreamInputUri(consumer string, cam base.Camera, resolution, inputUri string) string {
+	proxy := GetRestreamProxy(h.device)
+	if !proxy.Enabled() {
+		return inputUri
+	}
+	u, err := url.Parse(inputUri)
+	if err != nil {
+		return inputUri
+	}
+	localUri, err := proxy.Acquire(consumer, int64(cam.GetID()), resolution)
+	if err != nil {
+		h.log.Warn().Err(err).Int("camera_id", cam.GetID()).Msg("failed to proxy stream, pull from camera directly")
+		return inputUri
+	}
+	if u.RawQuery != "" {
+		localUri += "?" + u.RawQuery
+	}
+	return localUri
+}
+
 func (h *handler) getStreamOutputUri(streamType string, token streamRequestToken) string {
 	switch stream.OutputType(streamType) {
 	case stream.HlsType:
@@ -1670,6 +1883,13 @@ func (h *handler) getRecords(msg websocket.Message) ([]byte, error) {
 		}
 		return msg.ReplyMessage(&retRecords).Marshal(), nil
 	}
+	if isDriverBrand(cam.GetBrand()) {
+		retRecords, err := h.getDriverRecords(cam, req.Begin, req.End)
+		if err != nil {
+			return msg.ReplyMessage(err).Marshal(), err
+		}
+		return msg.ReplyMessage(retRecords).Marshal(), nil
+	}
 	return nil, err
 }
 
@@ -1737,50 +1957,7 @@ func (h *handler) getNvrSDInfos(msg websocket.Message) ([]byte, error) {
 }
 
 func (h *handler) changeNvrUserInfo(username, password, nvrSN, newPassword string) error {
-	nc, err := h.device.GetNVRManager().GetNVRClientBySN(nvrSN)
-	if err != nil {
-		return err
-	}
-
-	rsaInfo, err := nc.GetSystemSecurityRSA()
-	if err != nil {
-		return err
-	}
-	// var bigN *big.Int
-	bigN := new(big.Int)
-	_, ok := bigN.SetString(rsaInfo.RSAPublicKeyN, 16)
-	if !ok {
-		return fmt.Errorf("bigInt error")
-	}
-
-	rsaPublicKeyE, err := strconv.Atoi(rsaInfo.RSAPublicKeyE)
-	if err != nil {
-		return fmt.Errorf("rsa E fail")
-	}
-	pub := rsa.PublicKey{
-		N: bigN,
-		E: rsaPublicKeyE,
-	}
-
-	rsaPassword, err := rsa.EncryptPKCS1v15(rand.Reader, &pub, []byte(password))
-	if err != nil {
-		return fmt.Errorf("old password rsa encrypt error")
-	}
-	base64Password := base64.StdEncoding.EncodeToString(rsaPassword)
-
-	rsaNewPassword, err := rsa.EncryptPKCS1v15(rand.Reader, &pub, []byte(newPassword))
-	if err != nil {
-		return fmt.Errorf("new password rsa encrypt error")
-	}
-	base64NewPassword := base64.StdEncoding.EncodeToString(rsaNewPassword)
-
-	info := &univiewapi.SecurityUserPINInfo{
-		UserName:     username,
-		CurrentPIN:   base64Password,
-		NewPIN:       base64NewPassword,
-		RSAPublicKey: rsaInfo,
-	}
-	return nc.PutSystemSecurityUserPIN(info)
+	return changeNvrPassword(h.device.GetNVRManager(), username, password, nvrSN, newPassword)
 }
 
 func (h *handler) setNvrUserInfo(msg websocket.Message) ([]byte, error) {
@@ -1809,7 +1986,7 @@ func (h *handler) setNvrUserInfo(msg websocket.Message) ([]byte, error) {
 		return msg.ReplyMessage(err).Marshal(), err
 	}
 
-	username, password, _, _, err := h.device.GetNVRManager().ReadNVRFromDB(req.NvrSN)
+	username, password, err := readNVRCredential(h.device.GetNVRManager(), req.NvrSN)
 	if err != nil {
 		return msg.ReplyMessage(err).Marshal(), err
 	}
@@ -1819,6 +1996,10 @@ func (h *handler) setNvrUserInfo(msg websocket.Message) ([]byte, error) {
 	}
 
 	err = h.changeNvrUserInfo(username, password, req.NvrSN, req.NewPassword)
+	if err == nil {
+		// a ref in the table of the NVR manager reads the new password from the vault
+		sealNVRCredential(req.NvrSN, username, req.NewPassword)
+	}
 	return msg.ReplyMessage(err).Marshal(), err
 }
 
@@ -2173,7 +2354,7 @@ func (h *handler) startBackwardAudio(msg websocket.Message) ([]byte, error) {
 		return msg.ReplyMessage(err).Marshal(), err
 	}
 
-	h.log.Info().Msgf("pull stream from %s and send to %s", inputUrl, outputUri)
+	h.log.Info().Msgf("pull stream from %s and send to %s", RedactURI(inputUrl), outputUri)
 	audioEncodeType := AudioEncodeTypeG711U // default set to mulaw
 	if cam.GetBrand() == utils.Uniview {
 		audioEncodeType = AudioEncodeTypeG711U
@@ -2214,7 +2395,12 @@ func (h *handler) stopBackwardAudio(msg websocket.Message) ([]byte, error) {
 }
 
 func (h *handler) getBackwardAudioUrl(aiCam base.AICamera) string {
-	nc, err := h.device.GetNVRManager().GetNVRClientBySN(aiCam.GetNvrSN())
+	return backwardAudioUrl(h.device, aiCam)
+}
+
+// backwardAudioUrl returns the talk url of a camera on its NVR, or "" if it has none.
+func backwardAudioUrl(device Box, aiCam base.AICamera) string {
+	nc, err := device.GetNVRManager().GetNVRClientBySN(aiCam.GetNvrSN())
 	if err != nil {
 		return ""
 	}
@@ -2227,8 +2413,8 @@ func (h *handler) getBackwardAudioUrl(aiCam base.AICamera) string {
 		if u.Scheme == "" || u.Host == "" || u.Path == "" {
 			return ""
 		}
-		if u.User == nil && aiCam.GetUserName() != "" && aiCam.GetPassword() != "" {
-			u.User = url.UserPassword(aiCam.GetUserName(), aiCam.GetPassword())
+		if password := cameraPassword(aiCam); u.User == nil && aiCam.GetUserName() != "" && password != "" {
+			u.User = url.UserPassword(aiCam.GetUserName(), password)
 		}
 		return u.String()
 	}
@@ -2413,7 +2599,7 @@ func (h *handler) iotDiscover(msg websocket.Message) ([]byte, error) {
 			time.Sleep(time.Duration(reportInterval) * time.Second)
 			arpDeviceMap := h.device.GetArpSearcher().GetDevices()
 			h.log.Debug().Msgf("iot discover arp devices: %+v", arpDeviceMap)
-			h.log.Debug().Msgf("iot discover onvif devices: %+v", onvifDevices)
+			h.log.Debug().Msgf("iot discover onvif devices: %s", RedactedJSON(onvifDevices))
 			// Filter onvif device
 			onvifDeviceMapFiltered := make(map[string]onvif.Device)
 			for index := range onvifDevices {
@@ -2456,7 +2642,7 @@ func (h *handler) iotDiscover(msg websocket.Message) ([]byte, error) {
 			}
 
 			h.log.Debug().Msgf("iot discover arp devices filtered: %+v", arpDeviceMapFiltered)
-			h.log.Debug().Msgf("iot discover onvif devices filtered: %+v", onvifDeviceMapFiltered)
+			h.log.Debug().Msgf("iot discover onvif devices filtered: %s", RedactedJSON(onvifDeviceMapFiltered))
 
 			// Merge arp devices and onvif devices
 			resp.Devices = h.mergeDevices(arpDeviceMapFiltered, onvifDeviceMapFiltered)
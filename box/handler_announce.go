@@ -0,0 +1,75 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/example/turing-common/websocket"
+)
+
+var ErrAnnounceDisabled = errors.New("announcement is not running on this box")
+
+func (h *handler) announceSpeak(msg websocket.Message) ([]byte, error) {
+	a := GetAnnouncer()
+	if a == nil {
+		return msg.ReplyMessage(ErrAnnounceDisabled).Marshal(), ErrAnnounceDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &announceSpeakReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := a.Speak(req.Text, req.Voice, req.Speed, req.Repeat, req.Targets); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+func (h *handler) saveAnnouncement(msg websocket.Message) ([]byte, error) {
+	a := GetAnnouncer()
+	if a == nil {
+		return msg.ReplyMessage(ErrAnnounceDisabled).Marshal(), ErrAnnounceDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	v := &Announcement{}
+	if err := json.Unmarshal(args, v); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := a.Save(v); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(v).Marshal(), nil
+}
+
+func (h *handler) deleteAnnouncement(msg websocket.Message) ([]byte, error) {
+	a := GetAnnouncer()
+	if a == nil {
+		return msg.ReplyMessage(ErrAnnounceDisabled).Marshal(), ErrAnnounceDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &deleteAnnouncementReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := a.Delete(req.ID); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+func (h *handler) listAnnouncements(msg websocket.Message) ([]byte, error) {
+	a := GetAnnouncer()
+	if a == nil {
+		return msg.ReplyMessage(ErrAnnounceDisabled).Marshal(), ErrAnnounceDisabled
+	}
+	return msg.ReplyMessage(a.List()).Marshal(), nil
+}
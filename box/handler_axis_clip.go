@@ -0,0 +1,116 @@
+package box
+
+import (
+	"errors"
+
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/example/turing-common/websocket"
+)
+
+var ErrAudioClipUrlRequired = errors.New("url of the clip is required")
+
+func decodeAudioClipReq(msg websocket.Message) (*actIotAudioClipReq, error) {
+	var req actIotAudioClipReq
+	if err := mapstructure.Decode(msg.GetArgs(), &req); err != nil {
+		return nil, err
+	}
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (h *handler) iotListAudioClips(msg websocket.Message) ([]byte, error) {
+	req, err := decodeAudioClipReq(msg)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	clips, err := newAxisSpeaker(req.IPAddress, req.Username, req.Password).ListClips()
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(clips).Marshal(), nil
+}
+
+// iotUploadAudioClip downloads a clip from its url and stores it on the speaker.
+func (h *handler) iotUploadAudioClip(msg websocket.Message) ([]byte, error) {
+	req, err := decodeAudioClipReq(msg)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if req.Url == "" || req.Name == "" {
+		return msg.ReplyMessage(ErrAudioClipUrlRequired).Marshal(), ErrAudioClipUrlRequired
+	}
+	data, err := downloadAxisClip(req.Url)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	clip, err := newAxisSpeaker(req.IPAddress, req.Username, req.Password).UploadClip(req.Name, data)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(clip).Marshal(), nil
+}
+
+// iotReplaceAudioClip replaces the content of the clip MediaID, the reply has its new
+// MediaID.
+func (h *handler) iotReplaceAudioClip(msg websocket.Message) ([]byte, error) {
+	req, err := decodeAudioClipReq(msg)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if req.Url == "" {
+		return msg.ReplyMessage(ErrAudioClipUrlRequired).Marshal(), ErrAudioClipUrlRequired
+	}
+	data, err := downloadAxisClip(req.Url)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	clip, err := newAxisSpeaker(req.IPAddress, req.Username, req.Password).ReplaceClip(req.MediaID, req.Name, data)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(clip).Marshal(), nil
+}
+
+func (h *handler) iotDeleteAudioClip(msg websocket.Message) ([]byte, error) {
+	req, err := decodeAudioClipReq(msg)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err = newAxisSpeaker(req.IPAddress, req.Username, req.Password).DeleteClip(req.MediaID); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+// iotSyncAudioClips syncs the cloud clip library to the speakers, the reply has the clip
+// inventory of each speaker after the sync.
+func (h *handler) iotSyncAudioClips(msg websocket.Message) ([]byte, error) {
+	var req actIotSyncAudioClipsReq
+	if err := mapstructure.Decode(msg.GetArgs(), &req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := req.Validate(); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	inventories := syncAxisClipLibrary(req.Library, req.Speakers, req.Replace, req.Prune, downloadAxisClip)
+	for _, inv := range inventories {
+		if inv.Error != "" {
+			h.log.Warn().Str("ip", inv.IPAddress).Msgf("audio clip sync: %s", inv.Error)
+		}
+	}
+	return msg.ReplyMessage(inventories).Marshal(), nil
+}
+
+func (h *handler) iotAudioClipInventory(msg websocket.Message) ([]byte, error) {
+	var req actIotSyncAudioClipsReq
+	if err := mapstructure.Decode(msg.GetArgs(), &req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := req.Validate(); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(syncAxisClipLibrary(nil, req.Speakers, false, false, downloadAxisClip)).Marshal(), nil
+}
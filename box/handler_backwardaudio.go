@@ -1,6 +1,7 @@
 package box
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
@@ -23,6 +24,16 @@ func (h *handler) startGeneralBackwardAudio(msg websocket.Message) ([]byte, erro
 		return msg.ReplyMessage(err).Marshal(), err
 	}
 
+	if bwar.DeviceType == AudioDTGroup {
+		return h.startGroupBackwardAudio(msg, bwar)
+	}
+	if bwar.DeviceType == AudioDTOnvif {
+		return h.startOnvifBackwardAudio(msg, bwar)
+	}
+	if bwar.DeviceType == AudioDTSip {
+		return h.startSipBackwardAudio(msg, bwar)
+	}
+
 	// backward audio is only allowed one audio input to camera.
 	if h.getStreamManager().HasStream(bwar.StreamId) {
 		return msg.ReplyMessage(websocket.Err{
@@ -53,7 +64,7 @@ func (h *handler) startGeneralBackwardAudio(msg websocket.Message) ([]byte, erro
 		return msg.ReplyMessage(err).Marshal(), err
 	}
 
-	h.log.Info().Msgf("start general backward audio pull stream from %s and send to %s,outputUrl %s", inputUrl, outputUri, outputUrl)
+	h.log.Info().Msgf("start general backward audio pull stream from %s and send to %s,outputUrl %s", inputUrl, outputUri, RedactURI(outputUrl))
 	return msg.ReplyMessage(backwardAudioResp{EncodeInfo: AudioEncodeInfo{
 		EncodeType: audioEncodeType,
 	}}).Marshal(), err
@@ -70,6 +81,25 @@ func (h *handler) stopGeneralBackwardAudio(msg websocket.Message) ([]byte, error
 		return msg.ReplyMessage(err).Marshal(), err
 	}
 
+	if groups := GetSpeakerGroups(); groups != nil && groups.HasSession(bwar.StreamId) {
+		if err = groups.Stop(bwar.StreamId); err != nil {
+			return msg.ReplyMessage(err).Marshal(), err
+		}
+		return msg.ReplyMessage(nil).Marshal(), nil
+	}
+	if backchannels := GetOnvifBackchannels(); backchannels.HasStream(bwar.StreamId) {
+		if err = backchannels.Stop(bwar.StreamId); err != nil {
+			return msg.ReplyMessage(err).Marshal(), err
+		}
+		return msg.ReplyMessage(nil).Marshal(), nil
+	}
+	if agent := GetSIPAgent(); agent != nil && agent.HasStream(bwar.StreamId) {
+		if err = agent.Stop(bwar.StreamId); err != nil {
+			return msg.ReplyMessage(err).Marshal(), err
+		}
+		return msg.ReplyMessage(nil).Marshal(), nil
+	}
+
 	// backward audio has not started.
 	if !h.getStreamManager().HasStream(bwar.StreamId) {
 		return msg.ReplyMessage(websocket.Err{
@@ -89,6 +119,10 @@ func (h *handler) stopGeneralBackwardAudio(msg websocket.Message) ([]byte, error
 }
 
 func (h *handler) getBackwardSpeakerAudioUrl(host, username, password string) (string, error) {
+	return backwardSpeakerAudioUrl(host, username, password)
+}
+
+func backwardSpeakerAudioUrl(host, username, password string) (string, error) {
 	if !strings.HasPrefix(host, "http") {
 		host = "http://" + host
 	}
@@ -111,6 +145,32 @@ func (h *handler) heartbeatGeneralBackwardAudio(msg websocket.Message) ([]byte,
 		return msg.ReplyMessage(err).Marshal(), err
 	}
 
+	if groups := GetSpeakerGroups(); groups != nil && groups.HasSession(args.StreamId) {
+		return h.heartbeatGroupBackwardAudio(msg, groups, args.StreamId)
+	}
+	if backchannels := GetOnvifBackchannels(); backchannels.HasStream(args.StreamId) {
+		if backchannels.IsStreamStopped(args.StreamId) {
+			h.log.Info().Msgf("onvif backchannel stream_id %s status is stopped", args.StreamId)
+			return msg.ReplyMessage(websocket.Err{
+				Code:           -2,
+				DevelopMessage: ErrBackwardAudioHasStopped.Error(),
+				Message:        ErrBackwardAudioHasStopped.Error(),
+			}).Marshal(), nil
+		}
+		return msg.ReplyMessage(nil).Marshal(), nil
+	}
+	if agent := GetSIPAgent(); agent != nil && agent.HasStream(args.StreamId) {
+		if agent.IsStreamStopped(args.StreamId) {
+			h.log.Info().Msgf("sip call stream_id %s status is stopped", args.StreamId)
+			return msg.ReplyMessage(websocket.Err{
+				Code:           -2,
+				DevelopMessage: ErrBackwardAudioHasStopped.Error(),
+				Message:        ErrBackwardAudioHasStopped.Error(),
+			}).Marshal(), nil
+		}
+		return msg.ReplyMessage(nil).Marshal(), nil
+	}
+
 	// backward audio has not started.
 	if !h.getStreamManager().HasStream(args.StreamId) {
 		h.log.Info().Msgf("speaker stream_id %s not exist", args.StreamId)
@@ -133,3 +193,201 @@ func (h *handler) heartbeatGeneralBackwardAudio(msg websocket.Message) ([]byte,
 	h.log.Debug().Msgf("speaker stream_id %s status is alive", args.StreamId)
 	return msg.ReplyMessage(nil).Marshal(), nil
 }
+
+// startOnvifBackwardAudio talks to a camera through its ONVIF audio backchannel, the
+// camera is addressed by its rtsp url, or by its camera id. The reply has the codec
+// negotiated with the camera.
+func (h *handler) startOnvifBackwardAudio(msg websocket.Message, bwar generalStartBackwardAudioReq) ([]byte, error) {
+	if GetOnvifBackchannels().HasStream(bwar.StreamId) || h.getStreamManager().HasStream(bwar.StreamId) {
+		return msg.ReplyMessage(websocket.Err{
+			Code:           -1,
+			DevelopMessage: ErrBackwardAudioOngoing.Error(),
+			Message:        ErrBackwardAudioOngoing.Error(),
+		}).Marshal(), nil
+	}
+	streamUri, username, password := bwar.DeviceStreamUri, bwar.DeviceUsername, bwar.DevicePassword
+	if streamUri == "" {
+		cam, err := h.device.GetCamera(int(bwar.DeviceId))
+		if err != nil {
+			return msg.ReplyMessage(err).Marshal(), err
+		}
+		streamUri, username, password = cam.GetUri(), cam.GetUserName(), cameraPassword(cam)
+	}
+	rtspUrl, err := onvifBackchannelUrl(streamUri, username, password)
+	if err != nil {
+		return msg.ReplyMessage(errors.New("invalid camera rtsp url")).Marshal(), nil
+	}
+	encodeType, err := GetOnvifBackchannels().Start(bwar.StreamId, bwar.OutputUri, rtspUrl)
+	if err == ErrOnvifNoBackchannel || err == ErrOnvifBackchannelCodec {
+		return msg.ReplyMessage(websocket.Err{
+			Code:           -1,
+			DevelopMessage: err.Error(),
+			Message:        ErrNotBackwardAudioCamera.Error(),
+		}).Marshal(), nil
+	}
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+
+	h.log.Info().Msgf("start onvif backward audio pull stream from %s and send to %s", bwar.OutputUri, RedactURI(streamUri))
+	return msg.ReplyMessage(backwardAudioResp{EncodeInfo: AudioEncodeInfo{
+		EncodeType: encodeType,
+	}}).Marshal(), nil
+}
+
+// startSipBackwardAudio calls a sip target, an extension of the PBX or a sip uri, and
+// sends the backward audio to it once answered.
+func (h *handler) startSipBackwardAudio(msg websocket.Message, bwar generalStartBackwardAudioReq) ([]byte, error) {
+	agent := GetSIPAgent()
+	if agent == nil {
+		return msg.ReplyMessage(ErrSipDisabled).Marshal(), ErrSipDisabled
+	}
+	if agent.HasStream(bwar.StreamId) || h.getStreamManager().HasStream(bwar.StreamId) {
+		return msg.ReplyMessage(websocket.Err{
+			Code:           -1,
+			DevelopMessage: ErrBackwardAudioOngoing.Error(),
+			Message:        ErrBackwardAudioOngoing.Error(),
+		}).Marshal(), nil
+	}
+	// the callee may ring for minutes, the answer is reported over the websocket.
+	err := agent.Call(bwar.StreamId, bwar.OutputUri, bwar.DeviceStreamUri, func(encodeType string, err error) {
+		status := sipCallStatus{StreamId: bwar.StreamId, Status: SipCallAnswered, EncodeType: encodeType}
+		if err != nil {
+			h.log.Warn().Err(err).Str("streamid", bwar.StreamId).Msg("sip backward audio call failed")
+			status = sipCallStatus{StreamId: bwar.StreamId, Status: SipCallFailed, Err: err.Error()}
+		}
+		h.reportSipCall(status)
+	})
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+
+	h.log.Info().Msgf("start sip backward audio pull stream from %s and call %s", bwar.OutputUri, RedactURI(bwar.DeviceStreamUri))
+	return msg.ReplyMessage(sipCallStatus{StreamId: bwar.StreamId, Status: SipCallCalling}).Marshal(), nil
+}
+
+func (h *handler) reportSipCall(status sipCallStatus) {
+	ws := h.device.WsClient()
+	if ws == nil {
+		return
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"act": SipCallReport,
+		"arg": status,
+	})
+	if err != nil {
+		return
+	}
+	ws.Send(payload)
+}
+
+// startGroupBackwardAudio fans a backward audio session out to the members of a speaker
+// group, the reply has the status of each member.
+func (h *handler) startGroupBackwardAudio(msg websocket.Message, bwar generalStartBackwardAudioReq) ([]byte, error) {
+	groups := GetSpeakerGroups()
+	if groups == nil {
+		return msg.ReplyMessage(ErrSpeakerGroupDisabled).Marshal(), ErrSpeakerGroupDisabled
+	}
+	if groups.HasSession(bwar.StreamId) || h.getStreamManager().HasStream(bwar.StreamId) {
+		return msg.ReplyMessage(websocket.Err{
+			Code:           -1,
+			DevelopMessage: ErrBackwardAudioOngoing.Error(),
+			Message:        ErrBackwardAudioOngoing.Error(),
+		}).Marshal(), nil
+	}
+	members, err := groups.Start(bwar.StreamId, bwar.DeviceId, bwar.OutputUri)
+	if err != nil {
+		h.log.Warn().Err(err).Msgf("failed to start backward audio of speaker group %d", bwar.DeviceId)
+		if members == nil {
+			return msg.ReplyMessage(err).Marshal(), err
+		}
+		reasons := make([]string, 0, len(members))
+		for _, m := range members {
+			reasons = append(reasons, m.Error)
+		}
+		return msg.ReplyMessage(websocket.Err{
+			Code:           -1,
+			DevelopMessage: fmt.Sprintf("%s: %s", err, strings.Join(reasons, "; ")),
+			Message:        err.Error(),
+		}).Marshal(), nil
+	}
+
+	h.log.Info().Msgf("start backward audio pull stream from %s and send to speaker group %d", bwar.OutputUri, bwar.DeviceId)
+	return msg.ReplyMessage(speakerGroupAudioResp{
+		EncodeInfo: AudioEncodeInfo{EncodeType: AudioEncodeTypeG711U},
+		Members:    members,
+	}).Marshal(), nil
+}
+
+func (h *handler) heartbeatGroupBackwardAudio(msg websocket.Message, groups *SpeakerGroups, streamId string) ([]byte, error) {
+	members, err := groups.Heartbeat(streamId)
+	if err == ErrBackwardAudioHasStopped {
+		h.log.Info().Msgf("speaker group stream_id %s status is stopped", streamId)
+		return msg.ReplyMessage(websocket.Err{
+			Code:           -2,
+			DevelopMessage: ErrBackwardAudioHasStopped.Error(),
+			Message:        ErrBackwardAudioHasStopped.Error(),
+		}).Marshal(), nil
+	}
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(speakerGroupAudioResp{
+		EncodeInfo: AudioEncodeInfo{EncodeType: AudioEncodeTypeG711U},
+		Members:    members,
+	}).Marshal(), nil
+}
+
+func (h *handler) saveSpeakerGroup(msg websocket.Message) ([]byte, error) {
+	groups := GetSpeakerGroups()
+	if groups == nil {
+		return msg.ReplyMessage(ErrSpeakerGroupDisabled).Marshal(), ErrSpeakerGroupDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	group := &SpeakerGroup{}
+	if err := json.Unmarshal(args, group); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	for _, m := range group.Members {
+		if m.DeviceType != AudioDTCamera {
+			continue
+		}
+		if _, err := h.device.GetCamera(m.CameraID); err != nil {
+			return msg.ReplyMessage(err).Marshal(), err
+		}
+	}
+	if err := groups.Save(group); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(group.ID).Marshal(), nil
+}
+
+func (h *handler) deleteSpeakerGroup(msg websocket.Message) ([]byte, error) {
+	groups := GetSpeakerGroups()
+	if groups == nil {
+		return msg.ReplyMessage(ErrSpeakerGroupDisabled).Marshal(), ErrSpeakerGroupDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &deleteSpeakerGroupReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := groups.Delete(req.ID); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+func (h *handler) listSpeakerGroups(msg websocket.Message) ([]byte, error) {
+	groups := GetSpeakerGroups()
+	if groups == nil {
+		return msg.ReplyMessage(ErrSpeakerGroupDisabled).Marshal(), ErrSpeakerGroupDisabled
+	}
+	return msg.ReplyMessage(groups.List()).Marshal(), nil
+}
@@ -0,0 +1,104 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/example/turing-common/websocket"
+)
+
+var ErrFirmwareDisabled = errors.New("firmware upgrade is not running on this box")
+
+// addFirmwareImage replies once the image is saved, before it is downloaded.
+func (h *handler) addFirmwareImage(msg websocket.Message) ([]byte, error) {
+	m := GetFirmwareManager()
+	if m == nil {
+		return msg.ReplyMessage(ErrFirmwareDisabled).Marshal(), ErrFirmwareDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	v := &FirmwareImage{}
+	if err := json.Unmarshal(args, v); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := m.AddImage(v); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(v).Marshal(), nil
+}
+
+func (h *handler) deleteFirmwareImage(msg websocket.Message) ([]byte, error) {
+	m := GetFirmwareManager()
+	if m == nil {
+		return msg.ReplyMessage(ErrFirmwareDisabled).Marshal(), ErrFirmwareDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &firmwareIdReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := m.DeleteImage(req.ID); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+func (h *handler) listFirmwareImages(msg websocket.Message) ([]byte, error) {
+	m := GetFirmwareManager()
+	if m == nil {
+		return msg.ReplyMessage(ErrFirmwareDisabled).Marshal(), ErrFirmwareDisabled
+	}
+	return msg.ReplyMessage(m.ListImages()).Marshal(), nil
+}
+
+func (h *handler) startFirmwareRollout(msg websocket.Message) ([]byte, error) {
+	m := GetFirmwareManager()
+	if m == nil {
+		return msg.ReplyMessage(ErrFirmwareDisabled).Marshal(), ErrFirmwareDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &startFirmwareRolloutReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	v, err := m.StartRollout(req.ImageID, req.BatchSize, req.Targets)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(v).Marshal(), nil
+}
+
+func (h *handler) cancelFirmwareRollout(msg websocket.Message) ([]byte, error) {
+	m := GetFirmwareManager()
+	if m == nil {
+		return msg.ReplyMessage(ErrFirmwareDisabled).Marshal(), ErrFirmwareDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &firmwareIdReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := m.CancelRollout(req.ID); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+func (h *handler) listFirmwareRollouts(msg websocket.Message) ([]byte, error) {
+	m := GetFirmwareManager()
+	if m == nil {
+		return msg.ReplyMessage(ErrFirmwareDisabled).Marshal(), ErrFirmwareDisabled
+	}
+	return msg.ReplyMessage(m.ListRollouts()).Marshal(), nil
+}
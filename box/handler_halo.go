@@ -0,0 +1,116 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/example/turing-common/websocket"
+)
+
+var (
+	ErrHaloSeriesDisabled  = errors.New("halo sensor history is not running on this box")
+	ErrHaloRulesDisabled   = errors.New("halo rules are not running on this box")
+	ErrHaloMonitorDisabled = errors.New("halo monitor is not running on this box")
+)
+
+func (h *handler) queryHaloSensors(msg websocket.Message) ([]byte, error) {
+	series := GetHaloSeries()
+	if series == nil {
+		return msg.ReplyMessage(ErrHaloSeriesDisabled).Marshal(), ErrHaloSeriesDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &queryHaloSensorsReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	points, err := series.Query(req.MAC, req.Sensor, time.Unix(req.StartTime, 0), time.Unix(req.EndTime, 0), req.Interval)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(points).Marshal(), nil
+}
+
+func (h *handler) saveHaloRule(msg websocket.Message) ([]byte, error) {
+	rules := GetHaloRuleEngine()
+	if rules == nil {
+		return msg.ReplyMessage(ErrHaloRulesDisabled).Marshal(), ErrHaloRulesDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	r := &HaloRule{}
+	if err := json.Unmarshal(args, r); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := rules.Save(r); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(r).Marshal(), nil
+}
+
+func (h *handler) deleteHaloRule(msg websocket.Message) ([]byte, error) {
+	rules := GetHaloRuleEngine()
+	if rules == nil {
+		return msg.ReplyMessage(ErrHaloRulesDisabled).Marshal(), ErrHaloRulesDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &deleteHaloRuleReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := rules.Delete(req.ID); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+func (h *handler) listHaloRules(msg websocket.Message) ([]byte, error) {
+	rules := GetHaloRuleEngine()
+	if rules == nil {
+		return msg.ReplyMessage(ErrHaloRulesDisabled).Marshal(), ErrHaloRulesDisabled
+	}
+	return msg.ReplyMessage(rules.List()).Marshal(), nil
+}
+
+func (h *handler) saveHaloMonitorConfig(msg websocket.Message) ([]byte, error) {
+	monitor := GetHaloMonitor()
+	if monitor == nil {
+		return msg.ReplyMessage(ErrHaloMonitorDisabled).Marshal(), ErrHaloMonitorDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	c := HaloMonitorConfig{}
+	if err := json.Unmarshal(args, &c); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := monitor.SaveConfig(c); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(monitor.Config()).Marshal(), nil
+}
+
+func (h *handler) getHaloMonitorConfig(msg websocket.Message) ([]byte, error) {
+	monitor := GetHaloMonitor()
+	if monitor == nil {
+		return msg.ReplyMessage(ErrHaloMonitorDisabled).Marshal(), ErrHaloMonitorDisabled
+	}
+	return msg.ReplyMessage(monitor.Config()).Marshal(), nil
+}
+
+func (h *handler) listHaloDevices(msg websocket.Message) ([]byte, error) {
+	monitor := GetHaloMonitor()
+	if monitor == nil {
+		return msg.ReplyMessage(ErrHaloMonitorDisabled).Marshal(), ErrHaloMonitorDisabled
+	}
+	return msg.ReplyMessage(monitor.Devices()).Marshal(), nil
+}
@@ -0,0 +1,128 @@
+package box
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/example/turing-common/websocket"
+	"github.com/go-playground/validator/v10"
+
+	"github.com/example/minibox/scheduler"
+	"github.com/example/minibox/utils"
+)
+
+// startMosaicStream composes the sub streams of several cameras into one grid video,
+// and publishes it through the stream.Manager like a single camera stream.
+func (h handler) startMosaicStream(msg websocket.Message) ([]byte, error) {
+	var srp mosaicStreamRequestParam
+	if err := json.Unmarshal(msg.Marshal(), &srp); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	mValidator := validator.New()
+	if err := mValidator.Struct(srp); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	req := srp.Arg
+	if req.Width <= 0 || req.Height <= 0 {
+		req.Width, req.Height = mosaicDefaultWidth, mosaicDefaultHeight
+	}
+
+	cells, err := parseMosaicLayout(req.Layout, req.Cells, req.Width, req.Height)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if len(req.CameraIds) > len(cells) {
+		err = fmt.Errorf("%d cameras do not fit in layout %s", len(req.CameraIds), req.Layout)
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if h.getStreamManager().HasStream(req.StreamId) || GetMosaicComposer().Has(req.StreamId) {
+		err = fmt.Errorf("stream %s already exists", req.StreamId)
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+
+	// A camera that can not be pulled keeps its tile, as a black one.
+	inputs := make([]string, len(req.CameraIds))
+	cellInfos := make([]mosaicCellInfo, len(req.CameraIds))
+	pulled := 0
+	for i, cameraId := range req.CameraIds {
+		cellInfos[i] = mosaicCellInfo{CameraId: cameraId, Cell: cells[i]}
+		cam, err := h.getCameraFromCameraId(cameraId)
+		if err != nil {
+			cellInfos[i].Err = err.Error()
+			continue
+		}
+		inputUri, err := h.getStreamInputUri(cam, string(utils.SD), 0, 0, streamAction{})
+		if err != nil {
+			h.log.Error().Err(err).Int64("camera_id", cameraId).Msg("failed to create mosaic input stream uri.")
+			cellInfos[i].Err = err.Error()
+			continue
+		}
+		inputs[i] = h.getRestreamInputUri(restreamMosaicConsumer(req.StreamId)+strconv.Itoa(i), cam, string(utils.SD), inputUri)
+		pulled++
+	}
+	if pulled == 0 {
+		err = fmt.Errorf("no camera of the mosaic can be pulled")
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+
+	mosaicUri, err := GetMosaicComposer().Start(req.StreamId, inputs, cells, req.Width, req.Height)
+	if err != nil {
+		GetRestreamProxy(h.device).ReleasePrefix(restreamMosaicConsumer(req.StreamId))
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	streamType := h.getStreamType(req.StreamType)
+	outputUri := h.getStreamOutputUri(req.StreamType, req.Token)
+	go h.publishMosaic(req.StreamId, streamType, mosaicUri, outputUri)
+	h.log.Info().Str("streamid", req.StreamId).Msgf("compose mosaic of %d cameras and send to %s", pulled, outputUri)
+	return msg.ReplyMessage(mosaicStreamResponse{
+		BaseUri:    req.Token.BaseUri,
+		StreamType: streamType,
+		StreamId:   req.StreamId,
+		OutputUri:  outputUri,
+		Width:      req.Width,
+		Height:     req.Height,
+		Cells:      cellInfos,
+		Status:     MosaicStreamStarting,
+	}).Marshal(), nil
+}
+
+// publishMosaic starts the stream.Manager on the mosaic once the composer had the time to
+// publish it, the first pull fails otherwise, and reports whether the output plays. A
+// mosaic stopped meanwhile is not started.
+func (h handler) publishMosaic(streamId, streamType, mosaicUri, outputUri string) {
+	time.Sleep(mosaicWarmupDuration)
+	if !GetMosaicComposer().Has(streamId) {
+		return
+	}
+	outputUri, err := h.getStreamManager().StartStream(streamId, streamType, mosaicUri, outputUri)
+	if err != nil {
+		GetMosaicComposer().Stop(streamId)
+		GetRestreamProxy(h.device).ReleasePrefix(restreamMosaicConsumer(streamId))
+		h.log.Error().Err(err).Str("streamid", streamId).Msg("failed to start mosaic stream.")
+		status := mosaicStreamStatus{StreamId: streamId, Status: MosaicStreamFailed, Err: err.Error()}
+		if err == scheduler.CommandDroppedError {
+			status.DevelopMessage = scheduler.ResourceLimit
+		}
+		h.reportMosaic(status)
+		return
+	}
+	GetStreamHealthMonitor(h.device).Track(streamId, 0, streamType, "", mosaicUri, outputUri)
+	h.reportMosaic(mosaicStreamStatus{StreamId: streamId, Status: MosaicStreamStarted, OutputUri: outputUri})
+}
+
+func (h handler) reportMosaic(status mosaicStreamStatus) {
+	ws := h.device.WsClient()
+	if ws == nil {
+		return
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"act": MosaicStreamReport,
+		"arg": status,
+	})
+	if err != nil {
+		return
+	}
+	ws.Send(payload)
+}
@@ -0,0 +1,45 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/example/turing-common/websocket"
+)
+
+var ErrMqttDisabled = errors.New("mqtt is not running on this box")
+
+func (h *handler) saveMqttConfig(msg websocket.Message) ([]byte, error) {
+	bridge := GetMQTTBridge()
+	if bridge == nil {
+		return msg.ReplyMessage(ErrMqttDisabled).Marshal(), ErrMqttDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	c := MQTTConfig{}
+	if err := json.Unmarshal(args, &c); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := bridge.SaveConfig(c); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(bridge.Config()).Marshal(), nil
+}
+
+func (h *handler) getMqttConfig(msg websocket.Message) ([]byte, error) {
+	bridge := GetMQTTBridge()
+	if bridge == nil {
+		return msg.ReplyMessage(ErrMqttDisabled).Marshal(), ErrMqttDisabled
+	}
+	return msg.ReplyMessage(bridge.Config()).Marshal(), nil
+}
+
+func (h *handler) getMqttStatus(msg websocket.Message) ([]byte, error) {
+	bridge := GetMQTTBridge()
+	if bridge == nil {
+		return msg.ReplyMessage(ErrMqttDisabled).Marshal(), ErrMqttDisabled
+	}
+	return msg.ReplyMessage(bridge.Status()).Marshal(), nil
+}
@@ -0,0 +1,130 @@
+package box
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/example/turing-common/websocket"
+
+	"github.com/example/minibox/camera/base"
+	"github.com/example/minibox/utils"
+)
+
+// validateDriverDvr validates an NVR driven by an NVRDriver, it replies as validateDvr.
+func (h *handler) validateDriverDvr(msg websocket.Message, req *validateDvrReq, drv NVRDriver, port uint16, mac string) ([]byte, error) {
+	sn, err := drv.SerialNumber()
+	if err != nil {
+		h.log.Err(err).Str("act", ValidateDvr).Msg("get nvr serial number error")
+		return msg.ReplyMessage(ErrInvalid).Marshal(), err
+	}
+	channels, err := drv.Channels()
+	if err != nil {
+		h.log.Err(err).Str("act", ValidateDvr).Msg("get nvr channels error")
+		return msg.ReplyMessage(ErrInvalid).Marshal(), err
+	}
+	if nvrs := GetNVRDrivers(); nvrs != nil && len(channels) > 0 {
+		err := nvrs.Save(&DriverNVR{
+			SN:       sn,
+			Brand:    drv.Brand(),
+			Host:     req.Host,
+			Port:     port,
+			Username: req.Username,
+			Password: req.Password,
+		})
+		if err != nil {
+			h.log.Err(err).Str("act", ValidateDvr).Msg("save nvr error")
+		}
+	}
+	rtspPort, err := drv.RTSPPort()
+	if err != nil {
+		h.log.Error().Str("act", ValidateDvr).Msgf("get network port failed")
+	}
+
+	cameras := make([]validateDvrCameraRet, 0)
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	for _, c := range channels {
+		// compatible with previous APP
+		if !c.Online && !req.WithChannelStatus {
+			continue
+		}
+		c := c
+		status := uint32(ChannelStatusOnline)
+		if !c.Online {
+			status = ChannelStatusNetworkDisconnected
+		}
+		serialNumber := c.SerialNumber
+		if serialNumber == "" {
+			serialNumber = fmt.Sprintf(utils.OEMSnFormat, sn, c.ID)
+		}
+		sdUri, uri, hdUri := drv.StreamUris(c.ID, rtspPort)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			camRet := validateDvrCameraRet{
+				ChannelName:   c.Name,
+				ChannelId:     c.ID,
+				ChannelStatus: status,
+				MacAddress:    mac,
+				NvrSN:         sn,
+				SDUri:         sdUri,
+				Uri:           uri,
+				HDUri:         hdUri,
+				SerialNo:      serialNumber,
+				Brand:         string(drv.Brand()),
+				Manufacturer:  c.Manufacturer,
+				Model:         c.Model,
+			}
+			if c.Online {
+				snapshot, err := drv.Snapshot(c.ID)
+				if err != nil {
+					h.log.Err(err).Str("act", ValidateDvr).Msg("get snapshot error")
+				} else if s3File := h.uploadSnapshotToS3(snapshot); s3File != nil {
+					camRet.Snapshot = s3File
+				}
+			}
+			mu.Lock()
+			cameras = append(cameras, camRet)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	data := validateDvrRet{
+		Cameras: cameras,
+	}
+	buff, _ := json.Marshal(data)
+	h.log.Info().RawJSON("data", buff).Str("act", ValidateDvr).Msg("reply")
+	return msg.ReplyMessage(data).Marshal(), nil
+}
+
+// getDriverRecords returns the recordings of a camera of an NVR driven by an NVRDriver.
+func (h *handler) getDriverRecords(cam base.Camera, begin, end int64) (*getRecordsRet, error) {
+	drv, channel, err := cameraNVRDriver(cam)
+	if err != nil {
+		return nil, err
+	}
+	records, err := drv.SearchRecords(channel, begin, end)
+	if err != nil {
+		return nil, err
+	}
+	ret := &getRecordsRet{Records: make([]record, 0, len(records))}
+	for _, r := range records {
+		ret.Records = append(ret.Records, record{Type: r.Type, Begin: r.Begin, End: r.End})
+	}
+	ret.Num = uint32(len(ret.Records))
+	return ret, nil
+}
+
+// getDriverPlaybackUri returns the playback uri of a camera of an NVR driven by an
+// NVRDriver, inputUri is its live uri.
+func getDriverPlaybackUri(cam base.Camera, inputUri string, startTime, endTime int64) (string, error) {
+	drv, channel, err := cameraNVRDriver(cam)
+	if err != nil {
+		return "", err
+	}
+	return drv.PlaybackUri(inputUri, channel, startTime, endTime)
+}
@@ -0,0 +1,89 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/example/turing-common/websocket"
+)
+
+var (
+	ErrNVRRotationDisabled     = errors.New("nvr password rotation is not running on this box")
+	ErrCredentialVaultDisabled = errors.New("credential vault is not running on this box")
+)
+
+func (h *handler) saveNVRRotation(msg websocket.Message) ([]byte, error) {
+	rotator := GetNVRPasswordRotator()
+	if rotator == nil {
+		return msg.ReplyMessage(ErrNVRRotationDisabled).Marshal(), ErrNVRRotationDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	v := &NVRRotation{}
+	if err := json.Unmarshal(args, v); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := rotator.Save(v); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(v).Marshal(), nil
+}
+
+func (h *handler) deleteNVRRotation(msg websocket.Message) ([]byte, error) {
+	rotator := GetNVRPasswordRotator()
+	if rotator == nil {
+		return msg.ReplyMessage(ErrNVRRotationDisabled).Marshal(), ErrNVRRotationDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &nvrRotationReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := rotator.Delete(req.NvrSN); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+func (h *handler) listNVRRotations(msg websocket.Message) ([]byte, error) {
+	rotator := GetNVRPasswordRotator()
+	if rotator == nil {
+		return msg.ReplyMessage(ErrNVRRotationDisabled).Marshal(), ErrNVRRotationDisabled
+	}
+	return msg.ReplyMessage(rotator.List()).Marshal(), nil
+}
+
+// rotateNVRPassword rotates the password of an NVR now, the reply waits for the new
+// password to be checked.
+func (h *handler) rotateNVRPassword(msg websocket.Message) ([]byte, error) {
+	rotator := GetNVRPasswordRotator()
+	if rotator == nil {
+		return msg.ReplyMessage(ErrNVRRotationDisabled).Marshal(), ErrNVRRotationDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &nvrRotationReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := rotator.Rotate(req.NvrSN); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+// listCredentials lists the credentials of the vault, the passwords are never replied.
+func (h *handler) listCredentials(msg websocket.Message) ([]byte, error) {
+	vault := GetCredentialVault()
+	if vault == nil {
+		return msg.ReplyMessage(ErrCredentialVaultDisabled).Marshal(), ErrCredentialVaultDisabled
+	}
+	return msg.ReplyMessage(vault.List()).Marshal(), nil
+}
@@ -0,0 +1,40 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/example/turing-common/websocket"
+)
+
+var ErrNVRStorageDisabled = errors.New("nvr storage monitoring is not running on this box")
+
+// listNVRStorage replies the last polled disks of the NVRs, unlike getNvrSDInfos which
+// reads them from the NVRs.
+func (h *handler) listNVRStorage(msg websocket.Message) ([]byte, error) {
+	m := GetNVRStorageMonitor()
+	if m == nil {
+		return msg.ReplyMessage(ErrNVRStorageDisabled).Marshal(), ErrNVRStorageDisabled
+	}
+	return msg.ReplyMessage(m.List()).Marshal(), nil
+}
+
+func (h *handler) getNVRStorageHistory(msg websocket.Message) ([]byte, error) {
+	m := GetNVRStorageMonitor()
+	if m == nil {
+		return msg.ReplyMessage(ErrNVRStorageDisabled).Marshal(), ErrNVRStorageDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &nvrStorageHistoryReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	samples, err := m.History(req.NvrSN, req.StartTime, req.EndTime)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(samples).Marshal(), nil
+}
@@ -0,0 +1,67 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/example/turing-common/websocket"
+)
+
+var ErrPTZEventDisabled = errors.New("ptz event linkage is not running on this box")
+
+func (h *handler) savePTZEventRule(msg websocket.Message) ([]byte, error) {
+	linker := GetPTZEventLinker()
+	if linker == nil {
+		return msg.ReplyMessage(ErrPTZEventDisabled).Marshal(), ErrPTZEventDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	rule := &PTZEventRule{}
+	if err := json.Unmarshal(args, rule); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if _, err := h.device.GetCamera(rule.TargetCameraID); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := linker.Save(rule); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(rule).Marshal(), nil
+}
+
+func (h *handler) deletePTZEventRule(msg websocket.Message) ([]byte, error) {
+	linker := GetPTZEventLinker()
+	if linker == nil {
+		return msg.ReplyMessage(ErrPTZEventDisabled).Marshal(), ErrPTZEventDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &deletePtzEventRuleReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := linker.Delete(req.ID); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+func (h *handler) listPTZEventRules(msg websocket.Message) ([]byte, error) {
+	linker := GetPTZEventLinker()
+	if linker == nil {
+		return msg.ReplyMessage(ErrPTZEventDisabled).Marshal(), ErrPTZEventDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &listPtzEventRulesReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(linker.List(req.CameraID)).Marshal(), nil
+}
@@ -0,0 +1,74 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/example/turing-common/websocket"
+)
+
+var ErrPTZTourDisabled = errors.New("ptz tour is not running on this box")
+
+func (h *handler) savePTZTour(msg websocket.Message) ([]byte, error) {
+	runner := GetPTZTourRunner()
+	if runner == nil {
+		return msg.ReplyMessage(ErrPTZTourDisabled).Marshal(), ErrPTZTourDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	tour := &PTZTour{}
+	if err := json.Unmarshal(args, tour); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if _, err := h.device.GetCamera(tour.CameraID); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := runner.Save(tour); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(tour).Marshal(), nil
+}
+
+func (h *handler) deletePTZTour(msg websocket.Message) ([]byte, error) {
+	runner := GetPTZTourRunner()
+	if runner == nil {
+		return msg.ReplyMessage(ErrPTZTourDisabled).Marshal(), ErrPTZTourDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &deletePtzTourReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := runner.Delete(req.ID); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+func (h *handler) listPTZTours(msg websocket.Message) ([]byte, error) {
+	runner := GetPTZTourRunner()
+	if runner == nil {
+		return msg.ReplyMessage(ErrPTZTourDisabled).Marshal(), ErrPTZTourDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &listPtzToursReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(runner.List(req.CameraID)).Marshal(), nil
+}
+
+// notifyPTZManualControl pauses the tour of a camera a user is controlling.
+func notifyPTZManualControl(cameraId int) {
+	if runner := GetPTZTourRunner(); runner != nil {
+		runner.NotifyManualControl(cameraId)
+	}
+}
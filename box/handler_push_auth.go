@@ -0,0 +1,56 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/example/turing-common/websocket"
+)
+
+var ErrPushAuthDisabled = errors.New("push auth is not running on this box")
+
+func (h *handler) savePushAuthRule(msg websocket.Message) ([]byte, error) {
+	auth := GetPushAuth()
+	if auth == nil {
+		return msg.ReplyMessage(ErrPushAuthDisabled).Marshal(), ErrPushAuthDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	v := &PushAuthRule{}
+	if err := json.Unmarshal(args, v); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := auth.Save(v); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(v).Marshal(), nil
+}
+
+func (h *handler) deletePushAuthRule(msg websocket.Message) ([]byte, error) {
+	auth := GetPushAuth()
+	if auth == nil {
+		return msg.ReplyMessage(ErrPushAuthDisabled).Marshal(), ErrPushAuthDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &deletePushAuthRuleReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := auth.Delete(req.ID); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+func (h *handler) listPushAuthRules(msg websocket.Message) ([]byte, error) {
+	auth := GetPushAuth()
+	if auth == nil {
+		return msg.ReplyMessage(ErrPushAuthDisabled).Marshal(), ErrPushAuthDisabled
+	}
+	return msg.ReplyMessage(auth.List()).Marshal(), nil
+}
@@ -0,0 +1,91 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/example/turing-common/websocket"
+)
+
+var ErrSipDisabled = errors.New("sip is not running on this box")
+
+func (h *handler) saveSipConfig(msg websocket.Message) ([]byte, error) {
+	agent := GetSIPAgent()
+	if agent == nil {
+		return msg.ReplyMessage(ErrSipDisabled).Marshal(), ErrSipDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	c := SIPConfig{}
+	if err := json.Unmarshal(args, &c); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := agent.SaveConfig(c); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(agent.Config()).Marshal(), nil
+}
+
+func (h *handler) getSipConfig(msg websocket.Message) ([]byte, error) {
+	agent := GetSIPAgent()
+	if agent == nil {
+		return msg.ReplyMessage(ErrSipDisabled).Marshal(), ErrSipDisabled
+	}
+	return msg.ReplyMessage(agent.Config()).Marshal(), nil
+}
+
+func (h *handler) getSipStatus(msg websocket.Message) ([]byte, error) {
+	agent := GetSIPAgent()
+	if agent == nil {
+		return msg.ReplyMessage(ErrSipDisabled).Marshal(), ErrSipDisabled
+	}
+	return msg.ReplyMessage(agent.Status()).Marshal(), nil
+}
+
+func (h *handler) saveSipDoorStation(msg websocket.Message) ([]byte, error) {
+	agent := GetSIPAgent()
+	if agent == nil {
+		return msg.ReplyMessage(ErrSipDisabled).Marshal(), ErrSipDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	s := &SIPDoorStation{}
+	if err := json.Unmarshal(args, s); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := agent.SaveDoorStation(s); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(s).Marshal(), nil
+}
+
+func (h *handler) deleteSipDoorStation(msg websocket.Message) ([]byte, error) {
+	agent := GetSIPAgent()
+	if agent == nil {
+		return msg.ReplyMessage(ErrSipDisabled).Marshal(), ErrSipDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &deleteSipDoorStationReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := agent.DeleteDoorStation(req.ID); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+func (h *handler) listSipDoorStations(msg websocket.Message) ([]byte, error) {
+	agent := GetSIPAgent()
+	if agent == nil {
+		return msg.ReplyMessage(ErrSipDisabled).Marshal(), ErrSipDisabled
+	}
+	return msg.ReplyMessage(agent.ListDoorStations()).Marshal(), nil
+}
@@ -131,6 +131,60 @@ type multistreamResponse struct {
 	Param []*streamInfo `json:"param" mapstructure:"param"`
 }
 
+type mosaicStreamReq struct {
+	StreamId   string             `json:"stream_id" validate:"required"`
+	StreamType string             `json:"stream_type"`
+	Layout     string             `json:"layout" validate:"required"`
+	Cells      []mosaicCellReq    `json:"cells"`
+	Width      int                `json:"width"`
+	Height     int                `json:"height"`
+	CameraIds  []int64            `json:"camera_ids" validate:"required,min=1"`
+	Token      streamRequestToken `json:"token"`
+}
+
+type mosaicStreamRequestParam struct {
+	Id  string          `json:"id" validate:"required"`
+	Act string          `json:"act" validate:"required"`
+	Arg mosaicStreamReq `json:"arg" validate:"required"`
+}
+
+type mosaicCellInfo struct {
+	CameraId int64      `json:"camera_id"`
+	Cell     mosaicCell `json:"cell"`
+	Err      string     `json:"err,omitempty"`
+}
+
+type mosaicStreamResponse struct {
+	BaseUri    string           `json:"base_uri"`
+	StreamType string           `json:"stream_type"`
+	StreamId   string           `json:"stream_id"`
+	OutputUri  string           `json:"uri"`
+	Width      int              `json:"width"`
+	Height     int              `json:"height"`
+	Cells      []mosaicCellInfo `json:"cells"`
+	Status     string           `json:"status"`
+}
+
+// mosaicStreamStatus is the report of a mosaic stream the stream.Manager started, or
+// failed to start with Err, DevelopMessage is scheduler.ResourceLimit when the stream was
+// dropped for lack of resources.
+type mosaicStreamStatus struct {
+	StreamId       string `json:"stream_id"`
+	Status         string `json:"status"`
+	OutputUri      string `json:"uri,omitempty"`
+	Err            string `json:"err,omitempty"`
+	DevelopMessage string `json:"develop_message,omitempty"`
+}
+
+// sipCallStatus is the status of the call of a backward audio session, answered with
+// EncodeType or failed with Err.
+type sipCallStatus struct {
+	StreamId   string `json:"stream_id"`
+	Status     string `json:"status"`
+	EncodeType string `json:"encode_type,omitempty"`
+	Err        string `json:"err,omitempty"`
+}
+
 type validateCamReq struct {
 	BoxId    string `json:"box_id"`
 	Uri      string `json:"uri"`
@@ -211,7 +265,23 @@ type searchDevice struct {
 	Devices []device `json:"devices"`
 }
 
+// wsSession is the user the transport of a message authenticated, never the body of the
+// message, which the clients write.
+type wsSession struct {
+	UserID string
+	Role   string
+}
+
+// ptzLockArg identifies who sends a PTZ command, for the PTZ lock arbitration. Only the
+// lease comes from the args, the owner and the role come from the session of the transport.
+type ptzLockArg struct {
+	Owner     string `json:"-"`
+	Role      string `json:"-"`
+	LeaseSecs int    `json:"lease_secs"`
+}
+
 type ptzCtrlMsg struct {
+	ptzLockArg
 	CameraID int    `json:"camera_id"`
 	Command  string `json:"cmd"`
 	HSpeed   int    `json:"h_speed"`
@@ -233,15 +303,84 @@ type getPtzPresetsRet struct {
 }
 
 type setPtzPresetReq struct {
+	ptzLockArg
 	CameraID int       `json:"camera_id"`
 	Preset   ptzPreset `json:"preset"`
 }
 
 type goToPtzPresetReq struct {
+	ptzLockArg
 	CameraID int    `json:"camera_id"`
 	PresetID uint32 `json:"preset_id"`
 }
 
+type ptzHomeReq struct {
+	ptzLockArg
+	CameraID int  `json:"camera_id"`
+	Set      bool `json:"set"`
+}
+
+type deletePtzTourReq struct {
+	ID int64 `json:"id"`
+}
+
+type listPtzToursReq struct {
+	CameraID int `json:"camera_id"`
+}
+
+type deletePtzEventRuleReq struct {
+	ID int64 `json:"id"`
+}
+
+type listPtzEventRulesReq struct {
+	CameraID int `json:"camera_id"`
+}
+
+type ptzLockReq struct {
+	ptzLockArg
+	CameraID int `json:"camera_id"`
+}
+
+type ptzAbsoluteMoveReq struct {
+	ptzLockArg
+	CameraID int     `json:"camera_id"`
+	Pan      float64 `json:"pan" validate:"gte=-1,lte=1"`
+	Tilt     float64 `json:"tilt" validate:"gte=-1,lte=1"`
+	Zoom     float64 `json:"zoom" validate:"gte=0,lte=1"`
+}
+
+type ptzRelativeMoveReq struct {
+	ptzLockArg
+	CameraID int     `json:"camera_id"`
+	Pan      float64 `json:"pan" validate:"gte=-1,lte=1"`
+	Tilt     float64 `json:"tilt" validate:"gte=-1,lte=1"`
+	Zoom     float64 `json:"zoom" validate:"gte=-1,lte=1"`
+}
+
+// ptzClickToCenterReq is a point of the video frame, normalized to [0,1] from the top left.
+type ptzClickToCenterReq struct {
+	ptzLockArg
+	CameraID int     `json:"camera_id"`
+	X        float64 `json:"x" validate:"gte=0,lte=1"`
+	Y        float64 `json:"y" validate:"gte=0,lte=1"`
+	HFov     float64 `json:"h_fov"`
+	VFov     float64 `json:"v_fov"`
+	MaxZoom  float64 `json:"max_zoom"`
+}
+
+// ptzAreaZoomReq is a rectangle of the video frame, normalized to [0,1] from the top left.
+type ptzAreaZoomReq struct {
+	ptzLockArg
+	CameraID int     `json:"camera_id"`
+	X        float64 `json:"x" validate:"gte=0,lte=1"`
+	Y        float64 `json:"y" validate:"gte=0,lte=1"`
+	W        float64 `json:"w" validate:"gt=0,lte=1"`
+	H        float64 `json:"h" validate:"gt=0,lte=1"`
+	HFov     float64 `json:"h_fov"`
+	VFov     float64 `json:"v_fov"`
+	MaxZoom  float64 `json:"max_zoom"`
+}
+
 type streamActionReq struct {
 	StreamId string  `json:"stream_id" validate:"required" mapstructure:"stream_id"`
 	Action   string  `json:"action" validate:"required" mapstructure:"action"`
@@ -320,6 +459,9 @@ type AudioDeviceType string
 var (
 	AudioDTCamera  AudioDeviceType = "camera"
 	AudioDTSpeaker AudioDeviceType = "speaker"
+	AudioDTGroup   AudioDeviceType = "group"
+	AudioDTOnvif   AudioDeviceType = "onvif"
+	AudioDTSip     AudioDeviceType = "sip"
 )
 
 type generalStartBackwardAudioReq struct {
@@ -336,6 +478,15 @@ func (req *generalStartBackwardAudioReq) Validate() error {
 	if req.StreamId == "" || req.OutputUri == "" {
 		return errors.New("stream_id, output_uri can not be empty")
 	}
+	if req.DeviceType == AudioDTGroup && req.DeviceId < 1 {
+		return errors.New("device_id of the speaker group is empty")
+	}
+	if req.DeviceType == AudioDTOnvif && req.DeviceStreamUri == "" && req.DeviceId < 1 {
+		return errors.New("device stream_uri and device_id are empty")
+	}
+	if req.DeviceType == AudioDTSip && req.DeviceStreamUri == "" {
+		return errors.New("device stream_uri of the sip target is empty")
+	}
 	if req.DeviceType == AudioDTSpeaker {
 		if req.DeviceUsername == "" || req.DevicePassword == "" {
 			return errors.New("username or password is empty")
@@ -353,6 +504,18 @@ type generalBackwardAudioReq struct {
 	StreamId   string          `json:"stream_id" validate:"required" mapstructure:"stream_id"`
 }
 
+type announceSpeakReq struct {
+	Text    string        `json:"text"`
+	Voice   string        `json:"voice"`
+	Speed   int           `json:"speed"`
+	Repeat  int           `json:"repeat"`
+	Targets []audioTarget `json:"targets"`
+}
+
+type deleteAnnouncementReq struct {
+	ID int64 `json:"id"`
+}
+
 type backwardAudioReq struct {
 	CameraId  int    `json:"camera_id" validate:"required" mapstructure:"camera_id"`
 	StreamId  string `json:"stream_id" validate:"required" mapstructure:"stream_id"`
@@ -363,6 +526,64 @@ type backwardAudioResp struct {
 	EncodeInfo AudioEncodeInfo `json:"encode_info"`
 }
 
+type speakerGroupAudioResp struct {
+	EncodeInfo AudioEncodeInfo       `json:"encode_info"`
+	Members    []speakerMemberStatus `json:"members"`
+}
+
+type deleteSpeakerGroupReq struct {
+	ID int64 `json:"id"`
+}
+
+type deleteSipDoorStationReq struct {
+	ID int64 `json:"id"`
+}
+
+type webhookIdReq struct {
+	ID int64 `json:"id"`
+}
+
+type listWebhookDeliveriesReq struct {
+	WebhookID int64 `json:"webhook_id"`
+	Limit     int   `json:"limit"`
+}
+
+type deleteHaloRuleReq struct {
+	ID int64 `json:"id"`
+}
+
+type deletePushAuthRuleReq struct {
+	ID int64 `json:"id"`
+}
+
+type nvrRotationReq struct {
+	NvrSN string `json:"nvr_sn"`
+}
+
+type firmwareIdReq struct {
+	ID int64 `json:"id"`
+}
+
+type startFirmwareRolloutReq struct {
+	ImageID   int64            `json:"image_id"`
+	BatchSize int              `json:"batch_size"`
+	Targets   []FirmwareTarget `json:"targets"`
+}
+
+type nvrStorageHistoryReq struct {
+	NvrSN     string `json:"nvr_sn"`
+	StartTime int64  `json:"start_time"`
+	EndTime   int64  `json:"end_time"`
+}
+
+type queryHaloSensorsReq struct {
+	MAC       string `json:"mac"`
+	Sensor    string `json:"sensor"`
+	StartTime int64  `json:"start_time"`
+	EndTime   int64  `json:"end_time"`
+	Interval  int    `json:"interval"`
+}
+
 type AudioEncodeInfo struct {
 	EncodeType string `json:"encode_type"`
 }
@@ -466,3 +687,31 @@ type actIotValidateSpeakerResp struct {
 	Status string `json:"status" mapstructure:"status"`
 	Msg    string `json:"msg" mapstructure:"msg"`
 }
+
+type actIotAudioClipReq struct {
+	BoxID     string `json:"box_id" mapstructure:"box_id" validate:"required"`
+	DeviceID  int64  `json:"device_id" mapstructure:"device_id" validate:"required"`
+	IPAddress string `json:"ip_address" mapstructure:"ip_address" validate:"required"`
+	Username  string `json:"username" mapstructure:"username" validate:"required"`
+	Password  string `json:"password" mapstructure:"password" validate:"required"`
+	MediaID   int64  `json:"media_id" mapstructure:"media_id"`
+	Name      string `json:"name" mapstructure:"name"`
+	// Url is where the box downloads the clip from, e.g. a presigned url of the cloud library.
+	Url string `json:"url" mapstructure:"url" validate:"omitempty,url"`
+}
+
+func (req *actIotAudioClipReq) Validate() error {
+	return validator.New().Struct(req)
+}
+
+type actIotSyncAudioClipsReq struct {
+	BoxID    string            `json:"box_id" mapstructure:"box_id" validate:"required"`
+	Library  []axisLibraryClip `json:"library" mapstructure:"library" validate:"dive"`
+	Speakers []axisSpeakerAuth `json:"speakers" mapstructure:"speakers" validate:"required,dive"`
+	Replace  bool              `json:"replace" mapstructure:"replace"`
+	Prune    bool              `json:"prune" mapstructure:"prune"`
+}
+
+func (req *actIotSyncAudioClipsReq) Validate() error {
+	return validator.New().Struct(req)
+}
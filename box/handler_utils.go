@@ -53,20 +53,23 @@ func (h *handler) md5Sum(filePath string) string {
 	return fmt.Sprintf("%x", md5.Sum(buf))
 }
 
-func (h *handler) processBackgroundSettings(settings *thermal_1.BackgroundSettings) {
-	localAddr := utils.GetLocalIp()
-	prefixUrl := fmt.Sprintf("%s:8081/api/static/", localAddr)
+// boxStaticUrl is the url the devices download a file of the data store dir of the box
+// from.
+func boxStaticUrl(name string) string {
+	return fmt.Sprintf("%s:8081/api/static/%s", utils.GetLocalIp(), name)
+}
 
+func (h *handler) processBackgroundSettings(settings *thermal_1.BackgroundSettings) {
 	if settings.QuestionnaireDetailImgEn != "" {
 		filePath, fileName := h.downloadS3(settings.QuestionnaireDetailImgEn)
 		settings.QuestionnaireDetailImgEnMd5 = h.md5Sum(filePath)
-		settings.QuestionnaireDetailImgEn = fmt.Sprintf("%s%s", prefixUrl, fileName)
+		settings.QuestionnaireDetailImgEn = boxStaticUrl(fileName)
 	}
 
 	if settings.QuestionnaireDetailImgSp != "" {
 		filePath, fileName := h.downloadS3(settings.QuestionnaireDetailImgSp)
 		settings.QuestionnaireDetailImgSpMd5 = h.md5Sum(filePath)
-		settings.QuestionnaireDetailImgSp = fmt.Sprintf("%s%s", prefixUrl, fileName)
+		settings.QuestionnaireDetailImgSp = boxStaticUrl(fileName)
 	}
 	if settings.Splash != "" {
 		filePath, fileName := h.downloadS3(settings.Splash)
@@ -77,6 +80,6 @@ func (h *handler) processBackgroundSettings(settings *thermal_1.BackgroundSettin
 			settings.SplashName = fmt.Sprintf("%s.avi", splashNamePre)
 		}
 		settings.SplashMd5 = h.md5Sum(filePath)
-		settings.Splash = fmt.Sprintf("%s%s", prefixUrl, fileName)
+		settings.Splash = boxStaticUrl(fileName)
 	}
 }
@@ -0,0 +1,95 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/example/turing-common/websocket"
+)
+
+var ErrWebhookDisabled = errors.New("webhooks are not running on this box")
+
+func (h *handler) saveWebhook(msg websocket.Message) ([]byte, error) {
+	hooks := GetWebhookDispatcher()
+	if hooks == nil {
+		return msg.ReplyMessage(ErrWebhookDisabled).Marshal(), ErrWebhookDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	v := &Webhook{}
+	if err := json.Unmarshal(args, v); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := hooks.Save(v); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(v).Marshal(), nil
+}
+
+func (h *handler) deleteWebhook(msg websocket.Message) ([]byte, error) {
+	hooks := GetWebhookDispatcher()
+	if hooks == nil {
+		return msg.ReplyMessage(ErrWebhookDisabled).Marshal(), ErrWebhookDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &webhookIdReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := hooks.Delete(req.ID); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+func (h *handler) listWebhooks(msg websocket.Message) ([]byte, error) {
+	hooks := GetWebhookDispatcher()
+	if hooks == nil {
+		return msg.ReplyMessage(ErrWebhookDisabled).Marshal(), ErrWebhookDisabled
+	}
+	return msg.ReplyMessage(hooks.List()).Marshal(), nil
+}
+
+func (h *handler) testWebhook(msg websocket.Message) ([]byte, error) {
+	hooks := GetWebhookDispatcher()
+	if hooks == nil {
+		return msg.ReplyMessage(ErrWebhookDisabled).Marshal(), ErrWebhookDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &webhookIdReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err := hooks.Test(req.ID); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+func (h *handler) listWebhookDeliveries(msg websocket.Message) ([]byte, error) {
+	hooks := GetWebhookDispatcher()
+	if hooks == nil {
+		return msg.ReplyMessage(ErrWebhookDisabled).Marshal(), ErrWebhookDisabled
+	}
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &listWebhookDeliveriesReq{}
+	if err := json.Unmarshal(args, req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	deliveries, err := hooks.Deliveries(req.WebhookID, req.Limit)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(deliveries).Marshal(), nil
+}
@@ -0,0 +1,84 @@
+package box
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/icholy/digest"
+)
+
+// lapiResponse is the envelope of the LAPI responses, StatusCode is 0 on success.
+type lapiResponse struct {
+	Response struct {
+		StatusCode   int             `json:"StatusCode"`
+		StatusString string          `json:"StatusString"`
+		Data         json.RawMessage `json:"Data"`
+	} `json:"Response"`
+}
+
+// lapiClient sends the LAPI requests the goshawk client of the NVRManager has no call
+// for, to a Uniview NVR at url.
+type lapiClient struct {
+	url    string
+	client *http.Client
+}
+
+func newLAPIClient(url, username, password string) *lapiClient {
+	return &lapiClient{
+		url: url,
+		client: &http.Client{
+			Timeout:   onvifRequestTimeout,
+			Transport: &digest.Transport{Username: username, Password: password},
+		},
+	}
+}
+
+// do sends a LAPI request with body encoded to json, when set, and decodes the data of its
+// response into data, when set.
+func (l *lapiClient) do(method, path string, body, data interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, l.url+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return lapiDo(l.client, req, data)
+}
+
+// lapiDo sends a LAPI request and decodes the data of its response into data, when set.
+func lapiDo(client *http.Client, req *http.Request, data interface{}) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized {
+		return ErrHttpAuthFailed
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("lapi http status code: %d", res.StatusCode)
+	}
+	var resp lapiResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Response.StatusCode != 0 {
+		return fmt.Errorf("lapi status %d: %s", resp.Response.StatusCode, resp.Response.StatusString)
+	}
+	if data == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Response.Data, data)
+}
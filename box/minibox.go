@@ -73,6 +73,7 @@ func init() {
 		"motorcycle_enter":     "motorcycle_enter:118",
 		"motion_start":         "motion_start:119",
 		"people_count":         "people_count:120",
+		"doorbell":             "doorbell:121",
 	}
 }
 
@@ -261,8 +262,11 @@ type baseBox struct {
 	srs             Srs
 }
 
+// UpdateNVR stores an NVR of the NVR manager. Its password is kept in the vault and the
+// table of the NVR manager stores its ref, which ResolveSecret reads back where the
+// clients of the NVR are built.
 func (b *baseBox) UpdateNVR(sn string, user string, password string, brand utils.CameraBrand, ip string, port uint16) {
-	b.nvrManager.StoreNVRToDB(sn, user, password, ip, brand, port)
+	b.nvrManager.StoreNVRToDB(sn, user, sealNVRCredential(sn, user, password), ip, brand, port)
 }
 
 func newBox(cfg configs.Config, boxInfo *configs.BoxInfo, db db.Client) *baseBox {
@@ -336,7 +340,7 @@ func (b *baseBox) connectWebsocketServer() error {
 		WebsocketURL: cfg.GetWebsocketServerUrl(),
 		GetCookies:   b.getLastCookies,
 		Agent:        agent,
-		Handler:      NewHandler(b),
+		Handler:      GetHandler(b),
 	}, websocket.PingPeriod(cfg.GetWebsocketPingPeriod()),
 		websocket.ReconnectSleep(cfg.GetWebsocketReconnectSleepPeriod()))
 	if err != nil {
@@ -381,7 +385,7 @@ func (b *baseBox) UpdateCameras() error {
 	if cloudNvrs, nvrErr := b.CloudClient().GetNvrs(); nvrErr != nil {
 		b.logger.Error().Err(nvrErr).Msgf("get nvrs from cloud failed")
 	} else {
-		b.logger.Debug().Msgf("get nvrs from cloud success, nvrs: %+v", cloudNvrs)
+		b.logger.Debug().Msgf("get nvrs from cloud success, nvrs: %s", RedactedJSON(cloudNvrs))
 		b.SetCloudNvrs(cloudNvrs)
 	}
 
@@ -426,7 +430,7 @@ func (b *baseBox) updateCameras() error {
 			cb = utils.CameraBrand(c.Brand)
 		}
 		if c.ID <= 0 || len(c.SN) <= 0 {
-			logger.Error().Int("id", c.ID).Msgf("invalid camera: %+v, either SN or ID is empty", c)
+			logger.Error().Int("id", c.ID).Msgf("invalid camera: %s, either SN or ID is empty", RedactedJSON(c))
 			continue
 		}
 
@@ -451,6 +455,7 @@ func (b *baseBox) updateCameras() error {
 			//	set nvrSN
 			aiCam.SetNvrSN(c.NvrSN)
 		}
+		putCameraCredential(cam.GetID(), cam.GetUserName(), cam.GetPassword())
 	}
 
 	// if api client is not initialized during heartbeat, camera will be added to cloud here
@@ -0,0 +1,229 @@
+package box
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+)
+
+const (
+	MosaicStreamReport = "nest.box.camera.mosaic_stream_report"
+
+	// The mosaic is published once the composer runs, its status is reported when the
+	// stream.Manager started or failed to start it.
+	MosaicStreamStarting = "starting"
+	MosaicStreamStarted  = "started"
+	MosaicStreamFailed   = "failed"
+
+	mosaicLayoutCustom   = "custom"
+	mosaicDefaultWidth   = 1920
+	mosaicDefaultHeight  = 1080
+	mosaicMaxCells       = 16
+	mosaicPublishUrl     = "rtmp://127.0.0.1:1935/live/mosaic/%s"
+	mosaicWarmupDuration = 3 * time.Second
+)
+
+var ErrMosaicLayout = errors.New("invalid mosaic layout")
+
+var mosaicOnce sync.Once
+var mosaicComposer *MosaicComposer
+
+// mosaicCell is one tile of the mosaic, in pixels of the output canvas.
+type mosaicCell struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// mosaicCellReq is a custom layout tile, normalized to [0,1] of the output canvas.
+type mosaicCellReq struct {
+	X float64 `json:"x" mapstructure:"x"`
+	Y float64 `json:"y" mapstructure:"y"`
+	W float64 `json:"w" mapstructure:"w"`
+	H float64 `json:"h" mapstructure:"h"`
+}
+
+// parseMosaicLayout returns the cells of a "<cols>x<rows>" grid layout, or of a custom
+// layout when layout is "custom".
+func parseMosaicLayout(layout string, custom []mosaicCellReq, width, height int) ([]mosaicCell, error) {
+	if width <= 0 || height <= 0 {
+		return nil, ErrMosaicLayout
+	}
+	if layout == mosaicLayoutCustom {
+		if len(custom) == 0 || len(custom) > mosaicMaxCells {
+			return nil, ErrMosaicLayout
+		}
+		cells := make([]mosaicCell, 0, len(custom))
+		for _, c := range custom {
+			if c.X < 0 || c.Y < 0 || c.W <= 0 || c.H <= 0 || c.X+c.W > 1 || c.Y+c.H > 1 {
+				return nil, ErrMosaicLayout
+			}
+			cell := mosaicCell{
+				X: evenFloor(c.X * float64(width)),
+				Y: evenFloor(c.Y * float64(height)),
+				W: evenFloor(c.W * float64(width)),
+				H: evenFloor(c.H * float64(height)),
+			}
+			if cell.W == 0 || cell.H == 0 {
+				return nil, ErrMosaicLayout
+			}
+			cells = append(cells, cell)
+		}
+		return cells, nil
+	}
+
+	parts := strings.Split(strings.ToLower(layout), "x")
+	if len(parts) != 2 {
+		return nil, ErrMosaicLayout
+	}
+	cols, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, ErrMosaicLayout
+	}
+	rows, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, ErrMosaicLayout
+	}
+	if cols <= 0 || rows <= 0 || cols*rows > mosaicMaxCells {
+		return nil, ErrMosaicLayout
+	}
+	w, h := evenFloor(float64(width)/float64(cols)), evenFloor(float64(height)/float64(rows))
+	cells := make([]mosaicCell, 0, cols*rows)
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			cells = append(cells, mosaicCell{X: c * w, Y: r * h, W: w, H: h})
+		}
+	}
+	return cells, nil
+}
+
+// evenFloor rounds down to an even pixel count, yuv420p needs even dimensions.
+func evenFloor(v float64) int {
+	return int(v) &^ 1
+}
+
+// buildMosaicArgs builds the ffmpeg arguments that compose the inputs into the cells and
+// publish the result to output. An empty input is rendered as a black tile.
+func buildMosaicArgs(inputs []string, cells []mosaicCell, width, height int, output string) []string {
+	args := []string{"-loglevel", "error"}
+	for i, input := range inputs {
+		if input == "" {
+			args = append(args, "-f", "lavfi", "-i",
+				fmt.Sprintf("color=c=black:s=%dx%d:r=25", cells[i].W, cells[i].H))
+			continue
+		}
+		if strings.HasPrefix(input, "rtsp") {
+			args = append(args, "-rtsp_transport", "tcp")
+		}
+		args = append(args, "-i", input)
+	}
+
+	var filter strings.Builder
+	var layout []string
+	for i := range inputs {
+		filter.WriteString(fmt.Sprintf("[%d:v]scale=%d:%d,setsar=1,setpts=PTS-STARTPTS[v%d];", i, cells[i].W, cells[i].H, i))
+		layout = append(layout, fmt.Sprintf("%d_%d", cells[i].X, cells[i].Y))
+	}
+	if len(inputs) == 1 {
+		// xstack needs at least 2 inputs
+		filter.WriteString(fmt.Sprintf("[v0]pad=%d:%d:%d:%d:color=black[out]", width, height, cells[0].X, cells[0].Y))
+	} else {
+		for i := range inputs {
+			filter.WriteString(fmt.Sprintf("[v%d]", i))
+		}
+		filter.WriteString(fmt.Sprintf("xstack=inputs=%d:layout=%s:fill=black,pad=%d:%d:0:0:color=black[out]",
+			len(inputs), strings.Join(layout, "|"), width, height))
+	}
+
+	args = append(args,
+		"-filter_complex", filter.String(),
+		"-map", "[out]",
+		"-an",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-tune", "zerolatency",
+		"-pix_fmt", "yuv420p",
+		"-g", "50",
+		"-f", "flv", output,
+	)
+	return args
+}
+
+// MosaicComposer runs one ffmpeg composition process per mosaic stream. The composed
+// video is published to the local srs, and picked up from there by the stream.Manager.
+type MosaicComposer struct {
+	log       zerolog.Logger
+	mux       sync.Mutex
+	processes map[string]*exec.Cmd
+}
+
+func GetMosaicComposer() *MosaicComposer {
+	mosaicOnce.Do(func() {
+		mosaicComposer = &MosaicComposer{
+			log:       log.Logger("mosaic"),
+			processes: make(map[string]*exec.Cmd),
+		}
+	})
+	return mosaicComposer
+}
+
+// Start composes inputs into cells and returns the local uri the mosaic is published to.
+func (m *MosaicComposer) Start(streamId string, inputs []string, cells []mosaicCell, width, height int) (string, error) {
+	if len(inputs) == 0 || len(inputs) > len(cells) {
+		return "", ErrMosaicLayout
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.processes[streamId]; ok {
+		return "", fmt.Errorf("mosaic stream %s already exists", streamId)
+	}
+
+	output := fmt.Sprintf(mosaicPublishUrl, streamId)
+	cmd := exec.Command("ffmpeg", buildMosaicArgs(inputs, cells, width, height, output)...)
+	var errLog bytes.Buffer
+	cmd.Stderr = &errLog
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	m.processes[streamId] = cmd
+	go func() {
+		err := cmd.Wait()
+		m.mux.Lock()
+		if m.processes[streamId] == cmd {
+			delete(m.processes, streamId)
+		}
+		m.mux.Unlock()
+		m.log.Info().Err(err).Str("stream_id", streamId).Msgf("mosaic composer exited: %s", errLog.String())
+	}()
+	return output, nil
+}
+
+func (m *MosaicComposer) Has(streamId string) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	_, ok := m.processes[streamId]
+	return ok
+}
+
+func (m *MosaicComposer) Stop(streamId string) {
+	m.mux.Lock()
+	cmd, ok := m.processes[streamId]
+	delete(m.processes, streamId)
+	m.mux.Unlock()
+	if !ok || cmd.Process == nil {
+		return
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		m.log.Warn().Err(err).Str("stream_id", streamId).Msg("failed to stop mosaic composer")
+	}
+}
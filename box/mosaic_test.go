@@ -0,0 +1,66 @@
+package box
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMosaicLayout(t *testing.T) {
+	cells, err := parseMosaicLayout("2x2", nil, 1920, 1080)
+	assert.NoError(t, err)
+	assert.Equal(t, []mosaicCell{
+		{X: 0, Y: 0, W: 960, H: 540},
+		{X: 960, Y: 0, W: 960, H: 540},
+		{X: 0, Y: 540, W: 960, H: 540},
+		{X: 960, Y: 540, W: 960, H: 540},
+	}, cells)
+
+	cells, err = parseMosaicLayout("3x3", nil, 1920, 1080)
+	assert.NoError(t, err)
+	assert.Len(t, cells, 9)
+	for _, c := range cells {
+		assert.Equal(t, 640, c.W)
+		assert.Equal(t, 360, c.H)
+	}
+
+	cells, err = parseMosaicLayout(mosaicLayoutCustom, []mosaicCellReq{
+		{X: 0, Y: 0, W: 0.75, H: 1},
+		{X: 0.75, Y: 0, W: 0.25, H: 0.5},
+		{X: 0.75, Y: 0.5, W: 0.25, H: 0.5},
+	}, 1920, 1080)
+	assert.NoError(t, err)
+	assert.Equal(t, []mosaicCell{
+		{X: 0, Y: 0, W: 1440, H: 1080},
+		{X: 1440, Y: 0, W: 480, H: 540},
+		{X: 1440, Y: 540, W: 480, H: 540},
+	}, cells)
+
+	for _, layout := range []string{"", "2", "ax2", "0x2", "5x5"} {
+		_, err = parseMosaicLayout(layout, nil, 1920, 1080)
+		assert.Equal(t, ErrMosaicLayout, err, layout)
+	}
+	_, err = parseMosaicLayout(mosaicLayoutCustom, []mosaicCellReq{{X: 0.5, Y: 0, W: 0.75, H: 1}}, 1920, 1080)
+	assert.Equal(t, ErrMosaicLayout, err)
+	_, err = parseMosaicLayout(mosaicLayoutCustom, nil, 1920, 1080)
+	assert.Equal(t, ErrMosaicLayout, err)
+}
+
+func TestBuildMosaicArgs(t *testing.T) {
+	cells, _ := parseMosaicLayout("2x1", nil, 1280, 360)
+	args := buildMosaicArgs([]string{"rtsp://10.0.0.2/unicast/c1/s1/live", ""}, cells, 1280, 360, "rtmp://out")
+	cmd := strings.Join(args, " ")
+
+	assert.Contains(t, cmd, "-rtsp_transport tcp -i rtsp://10.0.0.2/unicast/c1/s1/live")
+	assert.Contains(t, cmd, "-f lavfi -i color=c=black:s=640x360:r=25")
+	assert.Contains(t, cmd, "[0:v]scale=640:360,setsar=1,setpts=PTS-STARTPTS[v0];")
+	assert.Contains(t, cmd, "[v0][v1]xstack=inputs=2:layout=0_0|640_0:fill=black,pad=1280:360:0:0:color=black[out]")
+	assert.Equal(t, "rtmp://out", args[len(args)-1])
+
+	cells, _ = parseMosaicLayout("2x2", nil, 1280, 720)
+	args = buildMosaicArgs([]string{"rtsp://10.0.0.2/unicast/c1/s1/live"}, cells, 1280, 720, "rtmp://out")
+	cmd = strings.Join(args, " ")
+	assert.NotContains(t, cmd, "xstack")
+	assert.Contains(t, cmd, "[0:v]scale=640:360,setsar=1,setpts=PTS-STARTPTS[v0];[v0]pad=1280:720:0:0:color=black[out]")
+}
@@ -0,0 +1,564 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+	"github.com/example/turing-common/websocket"
+
+	"github.com/example/minibox/apis/structs"
+	"github.com/example/minibox/cloud"
+	"github.com/example/minibox/db"
+)
+
+// The topics of the bridge, under <prefix>/<box_id>:
+//
+//	status                         "online" or "offline", retained, also the last will
+//	cameras/<camera_id>/state      camera state, retained
+//	cameras/<camera_id>/events     AI events
+//	cameras/<camera_id>/people     people counts
+//	alarms                         alarm infos
+//	halo/<mac>/events              Halo events
+//	halo/<mac>/sensors             Halo sensor readings
+//	commands/<action>              subscribed, a websocket message of action, {"id", "arg"}
+//	replies/<action>               the reply of a command
+const (
+	mqttDefaultPrefix  = "minibox"
+	mqttConnectTimeout = 10 * time.Second
+	mqttPublishTimeout = 5 * time.Second
+	mqttDisconnectMs   = 250
+	mqttQueueSize      = 256
+	mqttCommandsSize   = 16
+	mqttStatusOnline   = "online"
+	mqttStatusOffline  = "offline"
+)
+
+var (
+	ErrMQTTConfigInvalid = errors.New("invalid mqtt config")
+	ErrMQTTTimeout       = errors.New("mqtt request timed out")
+	ErrMQTTCommandDenied = errors.New("mqtt command is not allowed")
+	ErrMQTTCommandBusy   = errors.New("too many mqtt commands are running")
+)
+
+var mqttBridge *MQTTBridge
+
+// MQTTConfig is the broker the box publishes to, BrokerUrl is tcp://, ssl://, ws:// or
+// wss://. Commands are the websocket actions allowed on the command topics, none by
+// default. There is a single row in the mqtt_configs table, the password is stored as a
+// ref to the credential vault.
+type MQTTConfig struct {
+	ID           int64     `json:"-"`
+	Enabled      bool      `json:"enabled"`
+	BrokerUrl    string    `json:"broker_url"`
+	ClientID     string    `json:"client_id"`
+	Username     string    `json:"username"`
+	Password     string    `json:"password,omitempty"`
+	TopicPrefix  string    `json:"topic_prefix"`
+	QoS          byte      `json:"qos"`
+	CommandsJSON string    `json:"-" gorm:"column:commands"`
+	Commands     []string  `json:"commands" gorm:"-"`
+	CreatedAt    time.Time `json:"-"`
+	UpdatedAt    time.Time `json:"-"`
+}
+
+func (c *MQTTConfig) validate() error {
+	if c.QoS > 2 || strings.ContainsAny(c.TopicPrefix, "+#") {
+		return ErrMQTTConfigInvalid
+	}
+	for _, action := range c.Commands {
+		if action == "" || strings.ContainsAny(action, "/+#") {
+			return ErrMQTTConfigInvalid
+		}
+	}
+	if !c.Enabled {
+		return nil
+	}
+	u, err := url.Parse(c.BrokerUrl)
+	if err != nil || u.Host == "" {
+		return ErrMQTTConfigInvalid
+	}
+	switch u.Scheme {
+	case "tcp", "ssl", "ws", "wss":
+		return nil
+	}
+	return ErrMQTTConfigInvalid
+}
+
+func (c *MQTTConfig) encode() error {
+	commands, err := json.Marshal(c.Commands)
+	if err != nil {
+		return err
+	}
+	c.CommandsJSON = string(commands)
+	return nil
+}
+
+func (c *MQTTConfig) decode() error {
+	if c.CommandsJSON == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(c.CommandsJSON), &c.Commands)
+}
+
+func (c *MQTTConfig) prefix() string {
+	if c.TopicPrefix == "" {
+		return mqttDefaultPrefix
+	}
+	return strings.Trim(c.TopicPrefix, "/")
+}
+
+func (c *MQTTConfig) allowCommand(action string) bool {
+	for _, v := range c.Commands {
+		if v == action {
+			return true
+		}
+	}
+	return false
+}
+
+// mqttTopic joins the topic levels under prefix/boxId, a level can not have the
+// separator or the wildcards.
+func mqttTopic(prefix, boxId string, levels ...string) string {
+	replacer := strings.NewReplacer("/", "_", "+", "_", "#", "_")
+	parts := []string{prefix, replacer.Replace(boxId)}
+	for _, l := range levels {
+		parts = append(parts, replacer.Replace(l))
+	}
+	return strings.Join(parts, "/")
+}
+
+// mqttClient is the part of the MQTT client used by the bridge.
+type mqttClient interface {
+	Publish(topic string, qos byte, retained bool, payload []byte) error
+	Subscribe(topic string, qos byte, handler func(topic string, payload []byte)) error
+	Disconnect()
+}
+
+type pahoClient struct {
+	client mqtt.Client
+}
+
+// newPahoClient connects to the broker in the background, it reconnects until
+// Disconnect.
+func newPahoClient(c MQTTConfig, clientId, willTopic string, onConnect func(mqttClient), onLost func(error)) (mqttClient, error) {
+	p := &pahoClient{}
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.BrokerUrl).
+		SetClientID(clientId).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetConnectTimeout(mqttConnectTimeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(willTopic, mqttStatusOffline, c.QoS, true).
+		SetOnConnectHandler(func(mqtt.Client) { onConnect(p) }).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) { onLost(err) })
+	p.client = mqtt.NewClient(opts)
+	p.client.Connect()
+	return p, nil
+}
+
+func waitMQTTToken(token mqtt.Token) error {
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		return ErrMQTTTimeout
+	}
+	return token.Error()
+}
+
+func (p *pahoClient) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	return waitMQTTToken(p.client.Publish(topic, qos, retained, payload))
+}
+
+func (p *pahoClient) Subscribe(topic string, qos byte, handler func(topic string, payload []byte)) error {
+	return waitMQTTToken(p.client.Subscribe(topic, qos, func(_ mqtt.Client, m mqtt.Message) {
+		handler(m.Topic(), m.Payload())
+	}))
+}
+
+func (p *pahoClient) Disconnect() {
+	p.client.Disconnect(mqttDisconnectMs)
+}
+
+type mqttPublication struct {
+	topic    string
+	retained bool
+	payload  []byte
+}
+
+// mqttCommand is the websocket message of a command topic, waiting for the worker.
+type mqttCommand struct {
+	action  string
+	payload []byte
+}
+
+// MQTTStatus is the state of the bridge reported to the app.
+type MQTTStatus struct {
+	Enabled   bool   `json:"enabled"`
+	Connected bool   `json:"connected"`
+	Broker    string `json:"broker"`
+	LastError string `json:"last_error,omitempty"`
+	Published uint64 `json:"published"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// mqttCameraEvent is the payload of the events and the people counts of a camera.
+type mqttCameraEvent struct {
+	CameraID  int                   `json:"camera_id"`
+	EventType string                `json:"event_type"`
+	StartedAt time.Time             `json:"started_at"`
+	EndedAt   time.Time             `json:"ended_at"`
+	Meta      *structs.MetaScanData `json:"meta,omitempty"`
+}
+
+// MQTTBridge publishes the data the box sends to the cloud to a local MQTT broker, and
+// runs the websocket actions received on its command topics. The publications are
+// queued and dropped while the broker is not connected.
+type MQTTBridge struct {
+	device    Box
+	db        db.Client
+	logger    zerolog.Logger
+	lock      sync.Mutex
+	config    MQTTConfig
+	boxId     string
+	client    mqttClient
+	connected bool
+	lastError string
+	published uint64
+	dropped   uint64
+	states    map[int]cloud.CameraState
+	queue     chan mqttPublication
+	commands  chan mqttCommand
+	done      chan struct{}
+
+	connect func(c MQTTConfig, clientId, willTopic string, onConnect func(mqttClient), onLost func(error)) (mqttClient, error)
+	handle  func(payload []byte) ([]byte, error)
+}
+
+func NewMQTTBridge(device Box, d db.Client) *MQTTBridge {
+	m := &MQTTBridge{
+		device:  device,
+		db:      d,
+		logger:  log.Logger("mqtt"),
+		states:  make(map[int]cloud.CameraState),
+		connect: newPahoClient,
+		handle:  GetHandler(device).Handle,
+	}
+	mqttBridge = m
+
+	client := d.GetDBInstance()
+	if err := client.AutoMigrate(&MQTTConfig{}); err != nil {
+		m.logger.Error().Err(err).Msg("failed to migrate mqtt config")
+	}
+	if err := client.Limit(1).Find(&m.config).Error; err != nil {
+		m.logger.Error().Err(err).Msg("failed to load mqtt config")
+	}
+	if err := m.config.decode(); err != nil {
+		m.logger.Error().Err(err).Msg("failed to decode mqtt config")
+	}
+	if err := migrateSecret(d, CredentialKindMQTT, credentialDeviceConfig, &m.config.Password, &MQTTConfig{}, "password", "id = ?", m.config.ID); err != nil {
+		m.logger.Error().Err(err).Msg("failed to load mqtt password")
+	}
+	if m.config.Enabled {
+		if err := m.start(m.config); err != nil {
+			m.logger.Error().Err(err).Msg("failed to start mqtt bridge")
+		}
+	}
+	return m
+}
+
+func GetMQTTBridge() *MQTTBridge {
+	return mqttBridge
+}
+
+// Config returns the config without its password.
+func (m *MQTTBridge) Config() MQTTConfig {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	c := m.config
+	c.Password = ""
+	return c
+}
+
+// SaveConfig stores the config and reconnects with it. An empty password keeps the saved
+// one of the same username.
+func (m *MQTTBridge) SaveConfig(c MQTTConfig) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if err := c.encode(); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	if c.Password == "" && c.Username == m.config.Username {
+		c.Password = m.config.Password
+	}
+	c.ID, c.CreatedAt = m.config.ID, m.config.CreatedAt
+	row := c
+	password, err := sealSecret(CredentialKindMQTT, credentialDeviceConfig, c.Password)
+	if err == nil {
+		row.Password = password
+		err = m.db.GetDBInstance().Save(&row).Error
+	}
+	if err != nil {
+		m.lock.Unlock()
+		return err
+	}
+	c.ID, c.CreatedAt, c.UpdatedAt = row.ID, row.CreatedAt, row.UpdatedAt
+	m.config = c
+	m.lock.Unlock()
+
+	m.stop()
+	if !c.Enabled {
+		return nil
+	}
+	return m.start(c)
+}
+
+func (m *MQTTBridge) Status() MQTTStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return MQTTStatus{
+		Enabled:   m.config.Enabled,
+		Connected: m.connected,
+		Broker:    m.config.BrokerUrl,
+		LastError: m.lastError,
+		Published: m.published,
+		Dropped:   m.dropped,
+	}
+}
+
+func (m *MQTTBridge) start(c MQTTConfig) error {
+	boxId := m.device.GetBoxId()
+	clientId := c.ClientID
+	if clientId == "" {
+		clientId = mqttDefaultPrefix + "-" + boxId
+	}
+	m.lock.Lock()
+	m.config, m.boxId = c, boxId
+	m.lock.Unlock()
+	client, err := m.connect(c, clientId, mqttTopic(c.prefix(), boxId, "status"), m.onConnect, m.onLost)
+	if err != nil {
+		m.lock.Lock()
+		m.lastError = err.Error()
+		m.lock.Unlock()
+		return err
+	}
+	m.serve(client)
+	return nil
+}
+
+// serve publishes the queue with client and runs the commands until stop.
+func (m *MQTTBridge) serve(client mqttClient) {
+	m.lock.Lock()
+	queue, done := make(chan mqttPublication, mqttQueueSize), make(chan struct{})
+	commands := make(chan mqttCommand, mqttCommandsSize)
+	m.client, m.queue, m.commands, m.done = client, queue, commands, done
+	qos := m.config.QoS
+	m.lock.Unlock()
+
+	// the commands run out of the callbacks of the client, which would not receive the
+	// other messages meanwhile.
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case c := <-commands:
+				m.runCommand(c)
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case p := <-queue:
+				if err := client.Publish(p.topic, qos, p.retained, p.payload); err != nil {
+					m.logger.Warn().Err(err).Str("topic", p.topic).Msg("mqtt publish failed")
+					m.lock.Lock()
+					m.dropped++
+					m.lock.Unlock()
+					continue
+				}
+				m.lock.Lock()
+				m.published++
+				m.lock.Unlock()
+			}
+		}
+	}()
+}
+
+// stop marks the box offline and disconnects from the broker.
+func (m *MQTTBridge) stop() {
+	m.lock.Lock()
+	client, done, connected := m.client, m.done, m.connected
+	c, boxId := m.config, m.boxId
+	m.client, m.queue, m.commands, m.done, m.connected = nil, nil, nil, nil, false
+	m.lock.Unlock()
+	if client == nil {
+		return
+	}
+	close(done)
+	if connected {
+		client.Publish(mqttTopic(c.prefix(), boxId, "status"), c.QoS, true, []byte(mqttStatusOffline))
+	}
+	client.Disconnect()
+}
+
+// onConnect runs on each connection: the box is marked online, the command topics are
+// subscribed and the camera states are published again.
+func (m *MQTTBridge) onConnect(client mqttClient) {
+	m.lock.Lock()
+	m.connected = true
+	m.lastError = ""
+	m.states = make(map[int]cloud.CameraState)
+	c, boxId := m.config, m.boxId
+	m.lock.Unlock()
+	m.logger.Info().Str("broker", c.BrokerUrl).Msg("mqtt connected")
+
+	if err := client.Publish(mqttTopic(c.prefix(), boxId, "status"), c.QoS, true, []byte(mqttStatusOnline)); err != nil {
+		m.logger.Warn().Err(err).Msg("failed to publish mqtt status")
+	}
+	if len(c.Commands) == 0 {
+		return
+	}
+	if err := client.Subscribe(mqttTopic(c.prefix(), boxId, "commands")+"/+", c.QoS, m.handleCommand); err != nil {
+		m.logger.Error().Err(err).Msg("failed to subscribe mqtt commands")
+	}
+}
+
+func (m *MQTTBridge) onLost(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.connected = false
+	m.lastError = err.Error()
+	m.logger.Warn().Err(err).Msg("mqtt connection lost")
+}
+
+// publish queues a json payload on the topic levels under the box.
+func (m *MQTTBridge) publish(payload interface{}, retained bool, levels ...string) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		m.logger.Error().Err(err).Msg("failed to marshal mqtt payload")
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.queue == nil {
+		return
+	}
+	if !m.connected {
+		m.dropped++
+		return
+	}
+	select {
+	case m.queue <- mqttPublication{topic: mqttTopic(m.config.prefix(), m.boxId, levels...), retained: retained, payload: data}:
+	default:
+		m.dropped++
+	}
+}
+
+func (m *MQTTBridge) PublishCameraEvent(cameraId int, eventType string, startAt, endAt time.Time, meta *structs.MetaScanData) {
+	m.publish(mqttCameraEvent{CameraID: cameraId, EventType: eventType, StartedAt: startAt, EndedAt: endAt, Meta: meta},
+		false, "cameras", strconv.Itoa(cameraId), "events")
+}
+
+func (m *MQTTBridge) PublishPeopleCount(cameraId int, eventType string, startAt, endAt time.Time, meta *structs.MetaScanData) {
+	m.publish(mqttCameraEvent{CameraID: cameraId, EventType: eventType, StartedAt: startAt, EndedAt: endAt, Meta: meta},
+		false, "cameras", strconv.Itoa(cameraId), "people")
+}
+
+func (m *MQTTBridge) PublishAlarm(alarm *cloud.AlarmInfo) {
+	m.publish(alarm, false, "alarms")
+}
+
+func (m *MQTTBridge) PublishHaloEvent(event *cloud.HaloEventInfo) {
+	m.publish(event, false, "halo", event.IotDeviceMAC, "events")
+}
+
+func (m *MQTTBridge) PublishHaloSensors(heartbeat *cloud.HaloHeartbeat) {
+	m.publish(heartbeat, false, "halo", heartbeat.IotDeviceMAC, "sensors")
+}
+
+// PublishCameraStates publishes the states which changed since the last call, retained.
+func (m *MQTTBridge) PublishCameraStates(states map[int]cloud.CameraState) {
+	m.lock.Lock()
+	var changed []cloud.CameraState
+	if m.connected {
+		for id, s := range states {
+			if old, ok := m.states[id]; ok && reflect.DeepEqual(old, s) {
+				continue
+			}
+			m.states[id] = s
+			changed = append(changed, s)
+		}
+	}
+	m.lock.Unlock()
+	for _, s := range changed {
+		m.publish(s, true, "cameras", strconv.Itoa(s.CameraID), "state")
+	}
+}
+
+// handleCommand queues the websocket action of a command topic for the worker if it is
+// allowed. The commands run as the default operator, a session in the payload is dropped.
+func (m *MQTTBridge) handleCommand(topic string, payload []byte) {
+	action := topic[strings.LastIndex(topic, "/")+1:]
+	m.lock.Lock()
+	allowed := m.config.allowCommand(action)
+	commands := m.commands
+	m.lock.Unlock()
+
+	msg := make(map[string]interface{})
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			m.publish(mqttCommandError(nil, action, err), false, "replies", action)
+			return
+		}
+	}
+	if !allowed {
+		m.logger.Warn().Str("action", action).Msg("mqtt command denied")
+		m.publish(mqttCommandError(msg["id"], action, ErrMQTTCommandDenied), false, "replies", action)
+		return
+	}
+	delete(msg, "session")
+	msg["act"] = action
+	req, _ := json.Marshal(msg)
+	select {
+	case commands <- mqttCommand{action: action, payload: req}:
+	default:
+		m.logger.Warn().Str("action", action).Msg("mqtt command dropped")
+		m.publish(mqttCommandError(msg["id"], action, ErrMQTTCommandBusy), false, "replies", action)
+	}
+}
+
+// runCommand runs a command and publishes its reply.
+func (m *MQTTBridge) runCommand(c mqttCommand) {
+	reply, err := m.handle(c.payload)
+	if err != nil {
+		m.logger.Warn().Err(err).Str("action", c.action).Msg("mqtt command failed")
+	}
+	if len(reply) == 0 {
+		return
+	}
+	m.publish(json.RawMessage(reply), false, "replies", c.action)
+}
+
+func mqttCommandError(id interface{}, action string, err error) map[string]interface{} {
+	return map[string]interface{}{
+		"id":  id,
+		"act": action,
+		"err": websocket.Err{Code: -1, DevelopMessage: err.Error(), Message: err.Error()},
+	}
+}
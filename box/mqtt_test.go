@@ -0,0 +1,189 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/example/turing-common/log"
+
+	"github.com/example/minibox/cloud"
+)
+
+type fakeMQTTPublication struct {
+	topic    string
+	retained bool
+	payload  string
+}
+
+type fakeMQTTClient struct {
+	lock      sync.Mutex
+	published []fakeMQTTPublication
+	handlers  map[string]func(topic string, payload []byte)
+	closed    bool
+}
+
+func (c *fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.published = append(c.published, fakeMQTTPublication{topic: topic, retained: retained, payload: string(payload)})
+	return nil
+}
+
+func (c *fakeMQTTClient) Subscribe(topic string, qos byte, handler func(topic string, payload []byte)) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.handlers == nil {
+		c.handlers = make(map[string]func(topic string, payload []byte))
+	}
+	c.handlers[topic] = handler
+	return nil
+}
+
+func (c *fakeMQTTClient) Disconnect() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+}
+
+func (c *fakeMQTTClient) topics() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var topics []string
+	for _, p := range c.published {
+		topics = append(topics, p.topic)
+	}
+	return topics
+}
+
+func (c *fakeMQTTClient) last() fakeMQTTPublication {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.published[len(c.published)-1]
+}
+
+func newTestMQTTBridge(c MQTTConfig) (*MQTTBridge, *fakeMQTTClient) {
+	client := &fakeMQTTClient{}
+	m := &MQTTBridge{
+		logger: log.Logger("mqtt"),
+		config: c,
+		boxId:  "box-1",
+		states: make(map[int]cloud.CameraState),
+	}
+	m.serve(client)
+	m.onConnect(client)
+	return m, client
+}
+
+func TestMQTTConfigValidate(t *testing.T) {
+	assert.NoError(t, (&MQTTConfig{}).validate())
+	assert.NoError(t, (&MQTTConfig{Enabled: true, BrokerUrl: "tcp://10.0.0.5:1883", QoS: 1}).validate())
+	assert.NoError(t, (&MQTTConfig{Enabled: true, BrokerUrl: "wss://broker.local/mqtt"}).validate())
+
+	for _, c := range []MQTTConfig{
+		{Enabled: true},
+		{Enabled: true, BrokerUrl: "http://10.0.0.5:1883"},
+		{Enabled: true, BrokerUrl: "tcp://10.0.0.5:1883", QoS: 3},
+		{TopicPrefix: "site/#"},
+		{Commands: []string{"nest.box.ptz/+"}},
+	} {
+		assert.Equal(t, ErrMQTTConfigInvalid, c.validate())
+	}
+}
+
+func TestMQTTTopic(t *testing.T) {
+	assert.Equal(t, "minibox", (&MQTTConfig{}).prefix())
+	assert.Equal(t, "site/a", (&MQTTConfig{TopicPrefix: "/site/a/"}).prefix())
+	assert.Equal(t, "minibox/box-1/halo/aa_bb/events", mqttTopic("minibox", "box-1", "halo", "aa/bb", "events"))
+	assert.Equal(t, "minibox/box_1/cameras/3/state", mqttTopic("minibox", "box#1", "cameras", "3", "state"))
+}
+
+func TestMQTTBridgePublish(t *testing.T) {
+	m, client := newTestMQTTBridge(MQTTConfig{Enabled: true, TopicPrefix: "site"})
+	defer m.stop()
+	assert.Equal(t, fakeMQTTPublication{topic: "site/box-1/status", retained: true, payload: "online"}, client.last())
+
+	m.PublishCameraEvent(3, "intrude", time.Unix(0, 0).UTC(), time.Unix(1, 0).UTC(), nil)
+	m.PublishHaloSensors(&cloud.HaloHeartbeat{IotDeviceMAC: "aa:bb"})
+	m.PublishAlarm(&cloud.AlarmInfo{BoxId: "box-1"})
+	assert.Eventually(t, func() bool { return len(client.topics()) == 4 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{
+		"site/box-1/status",
+		"site/box-1/cameras/3/events",
+		"site/box-1/halo/aa:bb/sensors",
+		"site/box-1/alarms",
+	}, client.topics())
+
+	event := mqttCameraEvent{}
+	client.lock.Lock()
+	assert.NoError(t, json.Unmarshal([]byte(client.published[1].payload), &event))
+	client.lock.Unlock()
+	assert.Equal(t, 3, event.CameraID)
+	assert.Equal(t, "intrude", event.EventType)
+
+	m.onLost(errors.New("broker gone"))
+	m.PublishAlarm(&cloud.AlarmInfo{})
+	status := m.Status()
+	assert.False(t, status.Connected)
+	assert.Equal(t, "broker gone", status.LastError)
+	assert.Equal(t, uint64(3), status.Published)
+	assert.Equal(t, uint64(1), status.Dropped)
+}
+
+func TestMQTTBridgeCameraStates(t *testing.T) {
+	m, client := newTestMQTTBridge(MQTTConfig{Enabled: true})
+	defer m.stop()
+
+	m.PublishCameraStates(map[int]cloud.CameraState{1: {CameraID: 1}, 2: {CameraID: 2}})
+	assert.Eventually(t, func() bool { return len(client.topics()) == 3 }, time.Second, 10*time.Millisecond)
+	m.PublishCameraStates(map[int]cloud.CameraState{1: {CameraID: 1}, 2: {CameraID: 2}})
+
+	// a reconnection publishes the retained states again
+	m.onConnect(client)
+	m.PublishCameraStates(map[int]cloud.CameraState{1: {CameraID: 1}})
+	assert.Eventually(t, func() bool { return len(client.topics()) == 5 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "minibox/box-1/cameras/1/state", client.last().topic)
+	assert.True(t, client.last().retained)
+}
+
+func TestMQTTBridgeCommands(t *testing.T) {
+	m, client := newTestMQTTBridge(MQTTConfig{Enabled: true, Commands: []string{GetMqttStatus}})
+	defer m.stop()
+	var lock sync.Mutex
+	var handled []string
+	m.handle = func(payload []byte) ([]byte, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		handled = append(handled, string(payload))
+		return []byte(`{"id":"1","act":"nest.box.general.mqtt.status","arg":{}}`), nil
+	}
+	commands := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, handled...)
+	}
+	client.lock.Lock()
+	handler, ok := client.handlers["minibox/box-1/commands/+"]
+	client.lock.Unlock()
+	assert.True(t, ok)
+
+	// the command runs on the worker, without the session of its payload.
+	handler("minibox/box-1/commands/"+GetMqttStatus, []byte(`{"id":"1","arg":{},"session":{"user_id":"root","role":"admin"}}`))
+	assert.Eventually(t, func() bool { return len(client.topics()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{`{"act":"nest.box.general.mqtt.status","arg":{},"id":"1"}`}, commands())
+	assert.Equal(t, "minibox/box-1/replies/"+GetMqttStatus, client.last().topic)
+
+	handler("minibox/box-1/commands/"+SaveMqttConfig, []byte(`{"id":"2","arg":{}}`))
+	assert.Eventually(t, func() bool { return len(client.topics()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Len(t, commands(), 1)
+	assert.Contains(t, client.last().payload, ErrMQTTCommandDenied.Error())
+
+	// without commands nothing is subscribed
+	m, client = newTestMQTTBridge(MQTTConfig{Enabled: true})
+	defer m.stop()
+	assert.Empty(t, client.handlers)
+}
@@ -0,0 +1,565 @@
+package box
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/icholy/digest"
+
+	"github.com/example/minibox/utils"
+)
+
+const (
+	dahuaTimeout        = 10 * time.Second
+	dahuaRtspPort       = 554
+	dahuaSearchPageSize = 100
+	dahuaSearchMaxPages = 20
+	dahuaTimeLayout     = "2006-01-02 15:04:05"
+	dahuaTrackLayout    = "2006_01_02_15_04_05"
+	dahuaMaxEventSize   = 1 << 20
+	dahuaMaxPTZSpeed    = 8
+	// dahuaEventHeartbeat is the interval in seconds of the heartbeats of the event
+	// stream, they keep it open when there is no event.
+	dahuaEventHeartbeat = 5
+	// dahuaMainStream and dahuaSubStream are the subtypes of the streams of a channel.
+	dahuaMainStream = 0
+	dahuaSubStream  = 1
+	// dahuaClockLayout is the layout of the current time of an NVR, without the leading
+	// zeros of the month and the day.
+	dahuaClockLayout = "2006-1-2 15:04:05"
+	// dahuaZoneTTL is how long the time zone of an NVR is kept, the zones are whole
+	// multiples of dahuaZoneInterval.
+	dahuaZoneTTL      = time.Hour
+	dahuaZoneInterval = 15 * time.Minute
+)
+
+var ErrDahuaResponse = errors.New("unexpected dahua cgi response")
+
+// dahuaEventTypes maps the eventManager codes to the NVR event types.
+var dahuaEventTypes = map[string]string{
+	"VideoMotion":          NVREventMotion,
+	"VideoLoss":            NVREventVideoLoss,
+	"VideoBlind":           NVREventTamper,
+	"CrossLineDetection":   NVREventLine,
+	"CrossRegionDetection": NVREventIntrusion,
+}
+
+// dahuaPTZCodes maps the ptzCmdMap commands to the ptz.cgi codes.
+var dahuaPTZCodes = map[string]string{
+	"turn_left":        "Left",
+	"turn_right":       "Right",
+	"turn_upper":       "Up",
+	"turn_lower":       "Down",
+	"turn_left_upper":  "LeftUp",
+	"turn_left_lower":  "LeftDown",
+	"turn_right_upper": "RightUp",
+	"turn_right_lower": "RightDown",
+	"zoom_in":          "ZoomTele",
+	"zoom_out":         "ZoomWide",
+}
+
+// dahuaPTZSpeed is the ptz.cgi speed of a ptz_ctrl speed, ptz.cgi speeds are in [1,8].
+func dahuaPTZSpeed(speed int) int {
+	return int(math.Max(1, math.Round(onvifSpeed(speed)*dahuaMaxPTZSpeed)))
+}
+
+// dahuaNVR drives a Dahua NVR or camera through its HTTP CGIs, with digest auth. The
+// channels are 1-based as in the rtsp uris, the CGIs listing them are 0-based.
+type dahuaNVR struct {
+	host     string
+	port     uint16
+	username string
+	password string
+	client   *http.Client
+	// stream has no timeout, the event stream stays open.
+	stream *http.Client
+
+	lock sync.Mutex
+	// loc is the time zone of the NVR, the CGIs take and return local times. It is read
+	// again when it expires to follow the daylight saving changes.
+	loc        *time.Location
+	locExpires time.Time
+	// moves keeps the code of the continuous move of each channel, ptz.cgi stops a
+	// move with the code which started it.
+	moves map[uint32]string
+}
+
+func newDahuaNVR(host string, port uint16, username, password string) *dahuaNVR {
+	return &dahuaNVR{
+		host:     host,
+		port:     port,
+		username: username,
+		password: password,
+		client: &http.Client{
+			Timeout:   dahuaTimeout,
+			Transport: &digest.Transport{Username: username, Password: password},
+		},
+		stream: &http.Client{
+			Transport: &digest.Transport{Username: username, Password: password},
+		},
+		moves: make(map[uint32]string),
+	}
+}
+
+func (n *dahuaNVR) url(path string) string {
+	host := n.host
+	if n.port != 0 && n.port != 80 {
+		host = net.JoinHostPort(n.host, strconv.Itoa(int(n.port)))
+	}
+	return "http://" + host + path
+}
+
+// get requests a CGI, its query is written as is since the CGIs do not decode the
+// brackets of the indexed keys.
+func (n *dahuaNVR) get(path string) ([]byte, error) {
+	res, err := n.client.Get(n.url(path))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized {
+		return nil, ErrHttpAuthFailed
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status code: %d", res.StatusCode)
+	}
+	return data, nil
+}
+
+// getValues requests a CGI which replies key=value lines.
+func (n *dahuaNVR) getValues(path string) (map[string]string, error) {
+	data, err := n.get(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseDahuaValues(string(data)), nil
+}
+
+func parseDahuaValues(data string) map[string]string {
+	ret := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if ok {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// dahuaIndexes returns the indexes of the keys prefix[i]suffix of values, sorted.
+func dahuaIndexes(values map[string]string, prefix, suffix string) []int {
+	var ret []int
+	for k := range values {
+		if !strings.HasPrefix(k, prefix+"[") || !strings.HasSuffix(k, "]"+suffix) {
+			continue
+		}
+		i, err := strconv.Atoi(k[len(prefix)+1 : len(k)-len(suffix)-1])
+		if err == nil {
+			ret = append(ret, i)
+		}
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+// location returns the time zone of the NVR, the offset of its current time rounded to
+// dahuaZoneInterval.
+func (n *dahuaNVR) location() (*time.Location, error) {
+	now := time.Now()
+	n.lock.Lock()
+	loc, expires := n.loc, n.locExpires
+	n.lock.Unlock()
+	if loc != nil && now.Before(expires) {
+		return loc, nil
+	}
+	values, err := n.getValues("/cgi-bin/global.cgi?action=getCurrentTime")
+	if err != nil {
+		return nil, err
+	}
+	local, err := time.Parse(dahuaClockLayout, values["result"])
+	if err != nil {
+		return nil, ErrDahuaResponse
+	}
+	offset := local.Sub(now.UTC()).Round(dahuaZoneInterval)
+	loc = time.FixedZone("", int(offset/time.Second))
+	n.lock.Lock()
+	n.loc, n.locExpires = loc, now.Add(dahuaZoneTTL)
+	n.lock.Unlock()
+	return loc, nil
+}
+
+func (n *dahuaNVR) Brand() utils.CameraBrand {
+	return utils.Dahua
+}
+
+func (n *dahuaNVR) SerialNumber() (string, error) {
+	values, err := n.getValues("/cgi-bin/magicBox.cgi?action=getSerialNo")
+	if err != nil {
+		return "", err
+	}
+	if values["sn"] == "" {
+		return "", ErrDahuaResponse
+	}
+	return values["sn"], nil
+}
+
+// Channels lists the channels of ChannelTitle. The remote cameras and their states are
+// read from LogicDeviceManager, the cameras have no such CGI and their channels are
+// always online.
+func (n *dahuaNVR) Channels() ([]NVRChannel, error) {
+	titles, err := n.getValues("/cgi-bin/configManager.cgi?action=getConfig&name=ChannelTitle")
+	if err != nil {
+		return nil, err
+	}
+	states, err := n.getValues("/cgi-bin/LogicDeviceManager.cgi?action=getCameraState&uniqueChannels[0]=-1")
+	if errors.Is(err, ErrHttpAuthFailed) {
+		return nil, err
+	}
+	standalone := err != nil
+	state := make(map[int]string)
+	for _, i := range dahuaIndexes(states, "states", ".channel") {
+		c, _ := strconv.Atoi(states[fmt.Sprintf("states[%d].channel", i)])
+		state[c] = states[fmt.Sprintf("states[%d].connectionState", i)]
+	}
+	sources := make(map[int]map[string]string)
+	if !standalone {
+		cameras, err := n.getValues("/cgi-bin/LogicDeviceManager.cgi?action=getCameraAll")
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range dahuaIndexes(cameras, "camera", ".Channel") {
+			c, _ := strconv.Atoi(cameras[fmt.Sprintf("camera[%d].Channel", i)])
+			prefix := fmt.Sprintf("camera[%d].DeviceInfo.", i)
+			sources[c] = map[string]string{
+				"Address":    cameras[prefix+"Address"],
+				"Mac":        cameras[prefix+"Mac"],
+				"SerialNo":   cameras[prefix+"SerialNo"],
+				"DeviceType": cameras[prefix+"DeviceType"],
+			}
+		}
+	}
+
+	var ret []NVRChannel
+	for _, i := range dahuaIndexes(titles, "table.ChannelTitle", ".Name") {
+		if !standalone && (state[i] == "" || state[i] == "Empty") {
+			continue
+		}
+		source := sources[i]
+		ret = append(ret, NVRChannel{
+			ID:           uint32(i + 1),
+			Name:         titles[fmt.Sprintf("table.ChannelTitle[%d].Name", i)],
+			Online:       standalone || state[i] == "Connected",
+			IP:           source["Address"],
+			MAC:          source["Mac"],
+			SerialNumber: source["SerialNo"],
+			Manufacturer: string(utils.Dahua),
+			Model:        source["DeviceType"],
+		})
+	}
+	return ret, nil
+}
+
+func (n *dahuaNVR) RTSPPort() (uint16, error) {
+	values, err := n.getValues("/cgi-bin/configManager.cgi?action=getConfig&name=RTSP")
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.ParseUint(values["table.RTSP.Port"], 10, 16)
+	if err != nil || port == 0 {
+		return dahuaRtspPort, nil
+	}
+	return uint16(port), nil
+}
+
+func (n *dahuaNVR) StreamUris(channel uint32, rtspPort uint16) (sd, uri, hd string) {
+	if rtspPort == 0 {
+		rtspPort = dahuaRtspPort
+	}
+	host := net.JoinHostPort(n.host, strconv.Itoa(int(rtspPort)))
+	main := fmt.Sprintf("rtsp://%s/cam/realmonitor?channel=%d&subtype=%d", host, channel, dahuaMainStream)
+	sub := fmt.Sprintf("rtsp://%s/cam/realmonitor?channel=%d&subtype=%d", host, channel, dahuaSubStream)
+	return sub, main, main
+}
+
+// Channel parses the channel of /cam/realmonitor and /cam/playback.
+func (n *dahuaNVR) Channel(uri string) (uint32, bool) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return 0, false
+	}
+	if path := strings.TrimSuffix(u.Path, "/"); path != "/cam/realmonitor" && path != "/cam/playback" {
+		return 0, false
+	}
+	channel, err := strconv.ParseUint(u.Query().Get("channel"), 10, 32)
+	if err != nil || channel == 0 {
+		return 0, false
+	}
+	return uint32(channel), true
+}
+
+func (n *dahuaNVR) Snapshot(channel uint32) ([]byte, error) {
+	return n.get(fmt.Sprintf("/cgi-bin/snapshot.cgi?channel=%d", channel))
+}
+
+// dahuaRecordType maps the flags of the recordings to the record types of the Uniview
+// NVRs: 0 for the continuous recordings and 1 for the event ones.
+func dahuaRecordType(flags []string) uint32 {
+	for _, f := range flags {
+		if f != "Timing" {
+			return 1
+		}
+	}
+	return 0
+}
+
+// SearchRecords searches the recordings with mediaFileFind: a finder is created, the
+// search is started and the files are read by pages until the finder has no more.
+func (n *dahuaNVR) SearchRecords(channel uint32, begin, end int64) ([]NVRRecord, error) {
+	loc, err := n.location()
+	if err != nil {
+		return nil, err
+	}
+	values, err := n.getValues("/cgi-bin/mediaFileFind.cgi?action=factory.create")
+	if err != nil {
+		return nil, err
+	}
+	object := values["result"]
+	if object == "" {
+		return nil, ErrDahuaResponse
+	}
+	defer func() {
+		n.get("/cgi-bin/mediaFileFind.cgi?action=close&object=" + object)
+		n.get("/cgi-bin/mediaFileFind.cgi?action=destroy&object=" + object)
+	}()
+
+	_, err = n.get(fmt.Sprintf("/cgi-bin/mediaFileFind.cgi?action=findFile&object=%s&condition.Channel=%d"+
+		"&condition.StartTime=%s&condition.EndTime=%s&condition.Types[0]=dav", object, channel,
+		url.PathEscape(time.Unix(begin, 0).In(loc).Format(dahuaTimeLayout)),
+		url.PathEscape(time.Unix(end, 0).In(loc).Format(dahuaTimeLayout))))
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []NVRRecord
+	for page := 0; page < dahuaSearchMaxPages; page++ {
+		values, err := n.getValues(fmt.Sprintf("/cgi-bin/mediaFileFind.cgi?action=findNextFile&object=%s&count=%d",
+			object, dahuaSearchPageSize))
+		if err != nil {
+			return nil, err
+		}
+		found, err := strconv.Atoi(values["found"])
+		if err != nil {
+			return nil, ErrDahuaResponse
+		}
+		for _, i := range dahuaIndexes(values, "items", ".StartTime") {
+			prefix := fmt.Sprintf("items[%d].", i)
+			b, err := time.ParseInLocation(dahuaTimeLayout, values[prefix+"StartTime"], loc)
+			if err != nil {
+				return nil, ErrDahuaResponse
+			}
+			e, err := time.ParseInLocation(dahuaTimeLayout, values[prefix+"EndTime"], loc)
+			if err != nil {
+				return nil, ErrDahuaResponse
+			}
+			var flags []string
+			for _, f := range dahuaIndexes(values, prefix+"Flags", "") {
+				flags = append(flags, values[fmt.Sprintf("%sFlags[%d]", prefix, f)])
+			}
+			ret = append(ret, NVRRecord{Type: dahuaRecordType(flags), Begin: b.Unix(), End: e.Unix()})
+		}
+		if found < dahuaSearchPageSize {
+			break
+		}
+	}
+	return ret, nil
+}
+
+func (n *dahuaNVR) PlaybackUri(liveUri string, channel uint32, begin, end int64) (string, error) {
+	u, err := url.Parse(liveUri)
+	if err != nil {
+		return "", err
+	}
+	loc, err := n.location()
+	if err != nil {
+		return "", err
+	}
+	u.Path = "/cam/playback"
+	u.RawQuery = fmt.Sprintf("channel=%d&starttime=%s&endtime=%s", channel,
+		time.Unix(begin, 0).In(loc).Format(dahuaTrackLayout), time.Unix(end, 0).In(loc).Format(dahuaTrackLayout))
+	return u.String(), nil
+}
+
+func (n *dahuaNVR) PTZ(channel uint32) PTZDriver {
+	return &dahuaPTZ{nvr: n, channel: channel}
+}
+
+// Events attaches to eventManager.cgi, a multipart stream of Code=<code>;action=<action>;
+// index=<channel> parts and of heartbeats.
+func (n *dahuaNVR) Events(ctx context.Context, handle func(NVREvent)) error {
+	codes := make([]string, 0, len(dahuaEventTypes))
+	for code := range dahuaEventTypes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	path := fmt.Sprintf("/cgi-bin/eventManager.cgi?action=attach&codes=[%s]&heartbeat=%d",
+		strings.Join(codes, ","), dahuaEventHeartbeat)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, n.url(path), nil)
+	if err != nil {
+		return err
+	}
+	res, err := n.stream.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized {
+		return ErrHttpAuthFailed
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("http status code: %d", res.StatusCode)
+	}
+	_, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return ErrDahuaResponse
+	}
+	r := multipart.NewReader(res.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(io.LimitReader(part, dahuaMaxEventSize))
+		if err != nil {
+			return err
+		}
+		if ev, ok := parseDahuaEvent(string(data)); ok {
+			handle(ev)
+		}
+	}
+}
+
+// parseDahuaEvent parses Code=VideoMotion;action=Start;index=0, the data of the IVS
+// events follows as ;data={...} and is ignored.
+func parseDahuaEvent(data string) (NVREvent, bool) {
+	data = strings.TrimSpace(data)
+	if i := strings.Index(data, ";data="); i >= 0 {
+		data = data[:i]
+	}
+	fields := make(map[string]string)
+	for _, f := range strings.Split(data, ";") {
+		if k, v, ok := strings.Cut(f, "="); ok {
+			fields[k] = v
+		}
+	}
+	eventType, ok := dahuaEventTypes[fields["Code"]]
+	if !ok {
+		return NVREvent{}, false
+	}
+	index, err := strconv.ParseUint(fields["index"], 10, 32)
+	if err != nil {
+		return NVREvent{}, false
+	}
+	return NVREvent{
+		Channel: uint32(index) + 1,
+		Type:    eventType,
+		Active:  fields["action"] != "Stop",
+		Time:    time.Now(),
+	}, true
+}
+
+// dahuaPTZ drives a channel of a Dahua NVR through ptz.cgi. The home position has no
+// CGI, the presets are set without their names.
+type dahuaPTZ struct {
+	nvr     *dahuaNVR
+	channel uint32
+}
+
+func (p *dahuaPTZ) do(action, code string, arg1, arg2, arg3 int) error {
+	_, err := p.nvr.get(fmt.Sprintf("/cgi-bin/ptz.cgi?action=%s&channel=%d&code=%s&arg1=%d&arg2=%d&arg3=%d",
+		action, p.channel, code, arg1, arg2, arg3))
+	return err
+}
+
+func (p *dahuaPTZ) Move(cmd string, hSpeed, vSpeed int) error {
+	if cmd == "stop" {
+		p.nvr.lock.Lock()
+		code, ok := p.nvr.moves[p.channel]
+		delete(p.nvr.moves, p.channel)
+		p.nvr.lock.Unlock()
+		if !ok {
+			code = dahuaPTZCodes["turn_upper"]
+		}
+		return p.do("stop", code, 0, 0, 0)
+	}
+	code, ok := dahuaPTZCodes[cmd]
+	if !ok {
+		return ErrPTZUnsupported
+	}
+	if err := p.do("start", code, dahuaPTZSpeed(vSpeed), dahuaPTZSpeed(hSpeed), 0); err != nil {
+		return err
+	}
+	p.nvr.lock.Lock()
+	p.nvr.moves[p.channel] = code
+	p.nvr.lock.Unlock()
+	return nil
+}
+
+func (p *dahuaPTZ) GetPresets() ([]ptzPreset, int, error) {
+	values, err := p.nvr.getValues(fmt.Sprintf("/cgi-bin/ptz.cgi?action=getPresets&channel=%d", p.channel))
+	if err != nil {
+		return nil, 0, err
+	}
+	indexes := dahuaIndexes(values, "presets", ".Index")
+	ret := make([]ptzPreset, 0, len(indexes))
+	for _, i := range indexes {
+		id, err := strconv.Atoi(values[fmt.Sprintf("presets[%d].Index", i)])
+		if err != nil {
+			continue
+		}
+		ret = append(ret, ptzPreset{ID: id, Name: values[fmt.Sprintf("presets[%d].Name", i)]})
+	}
+	return ret, len(ret), nil
+}
+
+func (p *dahuaPTZ) SetPreset(preset ptzPreset) error {
+	return p.do("start", "SetPreset", 0, preset.ID, 0)
+}
+
+func (p *dahuaPTZ) GoToPreset(presetId uint32) error {
+	return p.do("start", "GotoPreset", 0, int(presetId), 0)
+}
+
+func (p *dahuaPTZ) GoToHome() error {
+	return ErrPTZUnsupported
+}
+
+func (p *dahuaPTZ) SetHome() error {
+	return ErrPTZUnsupported
+}
+
+func (p *dahuaPTZ) AbsoluteMove(pan, tilt, zoom float64) error {
+	return ErrPTZUnsupported
+}
+
+func (p *dahuaPTZ) RelativeMove(pan, tilt, zoom float64) error {
+	return ErrPTZUnsupported
+}
@@ -0,0 +1,185 @@
+package box
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDahuaNVR(t *testing.T, handler http.HandlerFunc) *dahuaNVR {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	nvr := newDahuaNVR(host, uint16(p), "admin", "pw")
+	nvr.loc, nvr.locExpires = time.UTC, time.Now().Add(time.Hour)
+	return nvr
+}
+
+func TestDahuaChannels(t *testing.T) {
+	nvr := newTestDahuaNVR(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path + "?" + r.URL.Query().Get("action") {
+		case "/cgi-bin/configManager.cgi?getConfig":
+			fmt.Fprint(w, "table.ChannelTitle[0].Name=Door\r\ntable.ChannelTitle[1].Name=Yard\r\ntable.ChannelTitle[2].Name=Channel3\r\n")
+		case "/cgi-bin/LogicDeviceManager.cgi?getCameraState":
+			fmt.Fprint(w, "states[0].channel=0\r\nstates[0].connectionState=Connected\r\n"+
+				"states[1].channel=1\r\nstates[1].connectionState=Unconnect\r\n"+
+				"states[2].channel=2\r\nstates[2].connectionState=Empty\r\n")
+		case "/cgi-bin/LogicDeviceManager.cgi?getCameraAll":
+			fmt.Fprint(w, "camera[0].Channel=0\r\ncamera[0].DeviceInfo.Address=10.0.0.11\r\n"+
+				"camera[0].DeviceInfo.DeviceType=IPC-HDW\r\ncamera[0].DeviceInfo.SerialNo=6F0\r\n")
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	channels, err := nvr.Channels()
+	assert.NoError(t, err)
+	assert.Equal(t, []NVRChannel{
+		{ID: 1, Name: "Door", Online: true, IP: "10.0.0.11", SerialNumber: "6F0", Manufacturer: "Dahua", Model: "IPC-HDW"},
+		{ID: 2, Name: "Yard", Manufacturer: "Dahua"},
+	}, channels)
+
+	camera := newTestDahuaNVR(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cgi-bin/configManager.cgi" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, "table.ChannelTitle[0].Name=Gate\r\n")
+	})
+	channels, err = camera.Channels()
+	assert.NoError(t, err)
+	assert.Equal(t, []NVRChannel{{ID: 1, Name: "Gate", Online: true, Manufacturer: "Dahua"}}, channels)
+}
+
+func TestDahuaSearchRecords(t *testing.T) {
+	var actions []string
+	nvr := newTestDahuaNVR(t, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		actions = append(actions, q.Get("action"))
+		switch q.Get("action") {
+		case "factory.create":
+			fmt.Fprint(w, "result=308\r\n")
+		case "findFile":
+			assert.Equal(t, "308", q.Get("object"))
+			assert.Equal(t, "3", q.Get("condition.Channel"))
+			assert.Equal(t, "2024-05-01 10:00:00", q.Get("condition.StartTime"))
+			fmt.Fprint(w, "OK\r\n")
+		case "findNextFile":
+			fmt.Fprint(w, "found=2\r\n"+
+				"items[0].Channel=2\r\nitems[0].StartTime=2024-05-01 10:00:00\r\nitems[0].EndTime=2024-05-01 10:30:00\r\n"+
+				"items[0].Flags[0]=Timing\r\n"+
+				"items[1].Channel=2\r\nitems[1].StartTime=2024-05-01 10:30:00\r\nitems[1].EndTime=2024-05-01 10:40:00\r\n"+
+				"items[1].Flags[0]=Timing\r\nitems[1].Flags[1]=Motion\r\n")
+		default:
+			fmt.Fprint(w, "OK\r\n")
+		}
+	})
+	begin := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC).Unix()
+	records, err := nvr.SearchRecords(3, begin, begin+3600)
+	assert.NoError(t, err)
+	assert.Equal(t, []NVRRecord{
+		{Type: 0, Begin: begin, End: begin + 1800},
+		{Type: 1, Begin: begin + 1800, End: begin + 2400},
+	}, records)
+	assert.Equal(t, []string{"factory.create", "findFile", "findNextFile", "close", "destroy"}, actions)
+}
+
+func TestDahuaLocation(t *testing.T) {
+	var reads int
+	nvr := newTestDahuaNVR(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/cgi-bin/global.cgi", r.URL.Path)
+		assert.Equal(t, "getCurrentTime", r.URL.Query().Get("action"))
+		reads++
+		// the clock of the nvr is a few seconds late on UTC+5:30
+		fmt.Fprintf(w, "result=%s\r\n", time.Now().UTC().Add(5*time.Hour+30*time.Minute-3*time.Second).Format(dahuaClockLayout))
+	})
+	nvr.loc = nil
+
+	loc, err := nvr.location()
+	assert.NoError(t, err)
+	_, offset := time.Date(2024, 5, 1, 10, 0, 0, 0, loc).Zone()
+	assert.Equal(t, 5*3600+30*60, offset)
+
+	_, err = nvr.location()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, reads)
+
+	nvr.locExpires = time.Now()
+	_, err = nvr.location()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, reads)
+}
+
+func TestDahuaUris(t *testing.T) {
+	nvr := newDahuaNVR("10.0.0.2", 0, "admin", "pw")
+	nvr.loc, nvr.locExpires = time.UTC, time.Now().Add(time.Hour)
+	sd, uri, hd := nvr.StreamUris(3, 0)
+	assert.Equal(t, "rtsp://10.0.0.2:554/cam/realmonitor?channel=3&subtype=1", sd)
+	assert.Equal(t, "rtsp://10.0.0.2:554/cam/realmonitor?channel=3&subtype=0", uri)
+	assert.Equal(t, uri, hd)
+
+	channel, ok := nvr.Channel(uri)
+	assert.True(t, ok)
+	assert.EqualValues(t, 3, channel)
+	_, ok = nvr.Channel("rtsp://10.0.0.2:554/Streaming/Channels/301")
+	assert.False(t, ok)
+
+	begin := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC).Unix()
+	playback, err := nvr.PlaybackUri("rtsp://admin:pw@10.0.0.2:554/cam/realmonitor?channel=3&subtype=0", 3, begin, begin+60)
+	assert.NoError(t, err)
+	assert.Equal(t, "rtsp://admin:pw@10.0.0.2:554/cam/playback?channel=3&starttime=2024_05_01_10_00_00&endtime=2024_05_01_10_01_00", playback)
+}
+
+func TestDahuaEvents(t *testing.T) {
+	nvr := newTestDahuaNVR(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/cgi-bin/eventManager.cgi", r.URL.Path)
+		assert.Equal(t, "attach", r.URL.Query().Get("action"))
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=myboundary")
+		for _, body := range []string{
+			"Heartbeat",
+			"Code=VideoMotion;action=Start;index=1",
+			"Code=CrossLineDetection;action=Pulse;index=0;data={\n\"Name\" : \"Rule1\"\n}",
+			"Code=VideoBlind;action=Stop;index=2",
+			"Code=AlarmLocal;action=Start;index=0",
+		} {
+			fmt.Fprintf(w, "--myboundary\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s\r\n", len(body), body)
+		}
+	})
+	var events []NVREvent
+	err := nvr.Events(context.Background(), func(ev NVREvent) { events = append(events, ev) })
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	for i := range events {
+		assert.False(t, events[i].Time.IsZero())
+		events[i].Time = time.Time{}
+	}
+	assert.Equal(t, []NVREvent{
+		{Channel: 2, Type: NVREventMotion, Active: true},
+		{Channel: 1, Type: NVREventLine, Active: true},
+		{Channel: 3, Type: NVREventTamper},
+	}, events)
+}
+
+func TestDahuaPTZMove(t *testing.T) {
+	var queries []string
+	nvr := newTestDahuaNVR(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/cgi-bin/ptz.cgi", r.URL.Path)
+		queries = append(queries, r.URL.RawQuery)
+		fmt.Fprint(w, "OK\r\n")
+	})
+	ptz := nvr.PTZ(2)
+	assert.NoError(t, ptz.Move("zoom_in", 9, 0))
+	assert.NoError(t, ptz.Move("stop", 0, 0))
+	assert.Equal(t, ErrPTZUnsupported, ptz.Move("focus_near", 1, 1))
+	assert.Equal(t, []string{
+		"action=start&channel=2&code=ZoomTele&arg1=4&arg2=8&arg3=0",
+		"action=stop&channel=2&code=ZoomTele&arg1=0&arg2=0&arg3=0",
+	}, queries)
+}
@@ -0,0 +1,127 @@
+package box
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/example/minibox/camera/base"
+	"github.com/example/minibox/utils"
+)
+
+// The types of the events of the NVRs, the drivers map their events to them.
+const (
+	NVREventMotion    = "motion"
+	NVREventVideoLoss = "video_loss"
+	NVREventTamper    = "tamper"
+	NVREventLine      = "line_crossing"
+	NVREventIntrusion = "intrusion"
+)
+
+var ErrNVRBrandUnsupported = errors.New("nvr brand is not supported by a driver")
+
+// NVRChannel is a channel of an NVR, with the camera plugged in it.
+type NVRChannel struct {
+	ID           uint32
+	Name         string
+	Online       bool
+	IP           string
+	MAC          string
+	SerialNumber string
+	Manufacturer string
+	Model        string
+}
+
+// NVRRecord is a recording of a channel, Begin and End are unix seconds.
+type NVRRecord struct {
+	Type  uint32
+	Begin int64
+	End   int64
+}
+
+// NVREvent is an event of a channel read from the event stream of an NVR, Active is
+// false when the event stops.
+type NVREvent struct {
+	Channel uint32
+	Type    string
+	Active  bool
+	Time    time.Time
+}
+
+// NVRDriver is the access to an NVR whatever its brand is. The Uniview NVRs keep their
+// LAPI clients of the NVRManager, the other brands are driven by an NVRDriver.
+type NVRDriver interface {
+	Brand() utils.CameraBrand
+	SerialNumber() (string, error)
+	Channels() ([]NVRChannel, error)
+	RTSPPort() (uint16, error)
+	// StreamUris returns the sub, main and high definition live uris of a channel.
+	StreamUris(channel uint32, rtspPort uint16) (sd, uri, hd string)
+	// Channel returns the channel of a live or playback uri of the NVR.
+	Channel(uri string) (uint32, bool)
+	Snapshot(channel uint32) ([]byte, error)
+	// SearchRecords returns the recordings of a channel in [begin, end].
+	SearchRecords(channel uint32, begin, end int64) ([]NVRRecord, error)
+	// PlaybackUri returns the rtsp uri of the recordings of a channel in [begin, end],
+	// liveUri is the live uri of the channel.
+	PlaybackUri(liveUri string, channel uint32, begin, end int64) (string, error)
+	PTZ(channel uint32) PTZDriver
+	// Events reads the event stream of the NVR until ctx is done or the stream fails.
+	Events(ctx context.Context, handle func(NVREvent)) error
+}
+
+// nvrBrand returns the brand of the NVRs driven by an NVRDriver from the manufacturer
+// of an ONVIF device, empty for the others.
+func nvrBrand(manufacturer string) utils.CameraBrand {
+	manufacturer = strings.ToLower(manufacturer)
+	switch {
+	case strings.Contains(manufacturer, "hikvision"):
+		return utils.Hikvision
+	case strings.Contains(manufacturer, "dahua"):
+		return utils.Dahua
+	}
+	return ""
+}
+
+// isDriverBrand reports whether the cameras of brand are driven by an NVRDriver.
+func isDriverBrand(brand utils.CameraBrand) bool {
+	return brand == utils.Hikvision || brand == utils.Dahua
+}
+
+// newNVRDriver returns the driver of an NVR of brand at host:port.
+func newNVRDriver(brand utils.CameraBrand, host string, port uint16, username, password string) (NVRDriver, error) {
+	switch brand {
+	case utils.Hikvision:
+		return newHikvisionNVR(host, port, username, password), nil
+	case utils.Dahua:
+		return newDahuaNVR(host, port, username, password), nil
+	}
+	return nil, ErrNVRBrandUnsupported
+}
+
+// cameraNVRDriver returns the driver of the NVR of a camera and its channel. The NVR is
+// the host of the live uri of the camera, with the port and the credentials saved by
+// validateDvr when it is known.
+func cameraNVRDriver(cam base.Camera) (NVRDriver, uint32, error) {
+	u, err := url.Parse(cam.GetUri())
+	if err != nil || u.Host == "" {
+		return nil, 0, ErrNVRBrandUnsupported
+	}
+	var drv NVRDriver
+	if nvrs := GetNVRDrivers(); nvrs != nil {
+		drv = nvrs.DriverByHost(u.Hostname())
+	}
+	if drv == nil || drv.Brand() != cam.GetBrand() {
+		drv, err = newNVRDriver(cam.GetBrand(), u.Hostname(), 0, cam.GetUserName(), cameraPassword(cam))
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	channel, ok := drv.Channel(cam.GetUri())
+	if !ok {
+		return nil, 0, ErrNVRBrandUnsupported
+	}
+	return drv, channel, nil
+}
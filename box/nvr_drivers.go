@@ -0,0 +1,317 @@
+package box
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+
+	"github.com/example/minibox/camera/base"
+	"github.com/example/minibox/cloud"
+	"github.com/example/minibox/db"
+	"github.com/example/minibox/utils"
+)
+
+const (
+	nvrEventsMinBackoff = 5 * time.Second
+	nvrEventsMaxBackoff = time.Minute
+	// nvrAlarmInterval limits the alarms of an event of a channel, the NVRs repeat the
+	// active events every second while they last.
+	nvrAlarmInterval = time.Minute
+)
+
+var nvrDrivers *NVRDrivers
+
+// nvrEventDetection returns the detection of the NVR events raised as camera alarms.
+func nvrEventDetection(eventType string) (cloud.Detection, bool) {
+	switch eventType {
+	case NVREventVideoLoss:
+		return cloud.Detection{Algos: cloud.AlarmTypeVideoLossStarted}, true
+	case NVREventTamper:
+		return cloud.Detection{Algos: cloud.AlarmTypeVideoTamperStarted}, true
+	}
+	return cloud.Detection{}, false
+}
+
+// DriverNVR is an NVR driven by an NVRDriver, added by validateDvr. It is persisted in
+// the driver_nvrs table, its password is kept in the credential vault when the box has
+// one.
+type DriverNVR struct {
+	SN        string            `json:"sn" gorm:"primary_key"`
+	Brand     utils.CameraBrand `json:"brand"`
+	Host      string            `json:"host"`
+	Port      uint16            `json:"port"`
+	Username  string            `json:"username"`
+	Password  string            `json:"-"`
+	CreatedAt time.Time         `json:"-"`
+	UpdatedAt time.Time         `json:"-"`
+}
+
+type nvrAlarmKey struct {
+	sn      string
+	channel uint32
+	event   string
+}
+
+// NVRDrivers keeps the drivers of the NVRs which are not Uniview ones, and raises the
+// alarms of their event streams. Their other events are passed to the handler set by
+// HandleEvents.
+type NVRDrivers struct {
+	device  Box
+	db      db.Client
+	logger  zerolog.Logger
+	lock    sync.Mutex
+	nvrs    map[string]*DriverNVR
+	drivers map[string]NVRDriver
+	cancels map[string]context.CancelFunc
+	alarms  map[nvrAlarmKey]time.Time
+	handle  func(cam base.Camera, drv NVRDriver, ev NVREvent)
+	now     func() time.Time
+
+	newDriver func(brand utils.CameraBrand, host string, port uint16, username, password string) (NVRDriver, error)
+	raise     func(alarm *cloud.AlarmInfo)
+}
+
+func NewNVRDrivers(device Box, d db.Client) *NVRDrivers {
+	m := &NVRDrivers{
+		device:    device,
+		db:        d,
+		logger:    log.Logger("nvr_drivers"),
+		nvrs:      make(map[string]*DriverNVR),
+		drivers:   make(map[string]NVRDriver),
+		cancels:   make(map[string]context.CancelFunc),
+		alarms:    make(map[nvrAlarmKey]time.Time),
+		now:       time.Now,
+		newDriver: newNVRDriver,
+	}
+	m.raise = m.raiseAlarm
+	nvrDrivers = m
+
+	client := d.GetDBInstance()
+	if err := client.AutoMigrate(&DriverNVR{}); err != nil {
+		m.logger.Error().Err(err).Msg("failed to migrate driver nvrs")
+	}
+	var nvrs []*DriverNVR
+	if err := client.Find(&nvrs).Error; err != nil {
+		m.logger.Error().Err(err).Msg("failed to load driver nvrs")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, v := range nvrs {
+		m.loadPassword(v)
+		if err := m.start(v); err != nil {
+			m.logger.Error().Err(err).Str("sn", v.SN).Msg("failed to start nvr driver")
+		}
+	}
+	return m
+}
+
+func GetNVRDrivers() *NVRDrivers {
+	return nvrDrivers
+}
+
+// Save adds or updates an NVR, its event stream is restarted.
+func (m *NVRDrivers) Save(v *DriverNVR) error {
+	if v.SN == "" || v.Host == "" {
+		return ErrInvalid
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if old, ok := m.nvrs[v.SN]; ok {
+		v.CreatedAt = old.CreatedAt
+	}
+	row := *v
+	if vault := GetCredentialVault(); vault != nil {
+		if err := vault.Put(CredentialKindNVR, v.SN, v.Username, v.Password); err != nil {
+			return err
+		}
+		row.Password = vaultRef(CredentialKindNVR, v.SN)
+	}
+	if err := m.db.GetDBInstance().Save(&row).Error; err != nil {
+		return err
+	}
+	v.CreatedAt, v.UpdatedAt = row.CreatedAt, row.UpdatedAt
+	saved := *v
+	return m.start(&saved)
+}
+
+// loadPassword reads the password of a loaded NVR from the vault. A password still in
+// the driver_nvrs table is moved to the vault, with the username of the NVR.
+func (m *NVRDrivers) loadPassword(v *DriverNVR) {
+	vault := GetCredentialVault()
+	if vault == nil || v.Password == "" {
+		return
+	}
+	if _, _, ok := parseVaultRef(v.Password); ok {
+		password, _, err := loadSecret(CredentialKindNVR, v.SN, v.Password)
+		if err != nil {
+			m.logger.Error().Err(err).Str("sn", v.SN).Msg("failed to read nvr credential")
+		}
+		v.Password = password
+		return
+	}
+	if err := vault.Put(CredentialKindNVR, v.SN, v.Username, v.Password); err != nil {
+		m.logger.Error().Err(err).Str("sn", v.SN).Msg("failed to move nvr credential to the vault")
+		return
+	}
+	ref := vaultRef(CredentialKindNVR, v.SN)
+	if err := m.db.GetDBInstance().Model(&DriverNVR{}).Where("sn = ?", v.SN).Update("password", ref).Error; err != nil {
+		m.logger.Error().Err(err).Str("sn", v.SN).Msg("failed to clear nvr password")
+	}
+}
+
+// start runs the driver of an NVR in place of the running one.
+func (m *NVRDrivers) start(v *DriverNVR) error {
+	drv, err := m.newDriver(v.Brand, v.Host, v.Port, v.Username, v.Password)
+	if err != nil {
+		return err
+	}
+	if cancel, ok := m.cancels[v.SN]; ok {
+		cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.nvrs[v.SN], m.drivers[v.SN], m.cancels[v.SN] = v, drv, cancel
+	go m.watch(ctx, *v, drv)
+	return nil
+}
+
+// List returns the NVRs sorted by SN.
+func (m *NVRDrivers) List() []DriverNVR {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make([]DriverNVR, 0, len(m.nvrs))
+	for _, v := range m.nvrs {
+		ret = append(ret, *v)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].SN < ret[j].SN })
+	return ret
+}
+
+// DriverByHost returns the driver of the NVR at host, nil when it is not known.
+func (m *NVRDrivers) DriverByHost(host string) NVRDriver {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for sn, v := range m.nvrs {
+		if v.Host == host {
+			return m.drivers[sn]
+		}
+	}
+	return nil
+}
+
+// HandleEvents sets the handler of the events which are not raised as alarms, such as
+// the motion and IVS ones. An event of a camera is passed once per event interval.
+func (m *NVRDrivers) HandleEvents(handle func(cam base.Camera, drv NVRDriver, ev NVREvent)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.handle = handle
+}
+
+// watch reads the event stream of an NVR until ctx is done, it is reopened with backoff
+// when it fails.
+func (m *NVRDrivers) watch(ctx context.Context, nvr DriverNVR, drv NVRDriver) {
+	backoff := nvrEventsMinBackoff
+	for {
+		start := m.now()
+		err := drv.Events(ctx, func(ev NVREvent) {
+			m.handleEvent(nvr, drv, ev)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if m.now().Sub(start) > nvrEventsMaxBackoff {
+			backoff = nvrEventsMinBackoff
+		}
+		m.logger.Warn().Err(err).Str("sn", nvr.SN).Dur("backoff", backoff).Msg("nvr event stream closed")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > nvrEventsMaxBackoff {
+			backoff = nvrEventsMaxBackoff
+		}
+	}
+}
+
+func (m *NVRDrivers) handleEvent(nvr DriverNVR, drv NVRDriver, ev NVREvent) {
+	if !ev.Active {
+		return
+	}
+	detection, alarm := nvrEventDetection(ev.Type)
+	interval := nvrAlarmInterval
+	m.lock.Lock()
+	handle := m.handle
+	m.lock.Unlock()
+	if !alarm {
+		if handle == nil {
+			return
+		}
+		interval = time.Duration(m.device.GetConfig().GetEventIntervalSecs()) * time.Second
+	}
+	now := m.now()
+	key := nvrAlarmKey{sn: nvr.SN, channel: ev.Channel, event: ev.Type}
+	m.lock.Lock()
+	last, raised := m.alarms[key]
+	if raised && now.Sub(last) < interval {
+		m.lock.Unlock()
+		return
+	}
+	m.alarms[key] = now
+	m.lock.Unlock()
+
+	cam, ok := m.cameraOfChannel(nvr, drv, ev.Channel)
+	if !ok {
+		m.logger.Debug().Str("sn", nvr.SN).Uint32("channel", ev.Channel).Str("event", ev.Type).Msg("nvr event of an unknown camera")
+		return
+	}
+	if !alarm {
+		handle(cam, drv, ev)
+		return
+	}
+	atime := now.Format(utils.CloudTimeLayout)
+	m.raise(&cloud.AlarmInfo{
+		Source:    cloud.AlarmSourceBridge,
+		BoxId:     m.device.GetBoxId(),
+		CameraId:  cam.GetID(),
+		StartedAt: atime,
+		EndedAt:   atime,
+		IPCTime:   ev.Time.Format(utils.CloudTimeLayout),
+		Detection: detection,
+	})
+}
+
+// cameraOfChannel returns the camera of a channel of an NVR, the cameras of the NVR
+// stream from its host.
+func (m *NVRDrivers) cameraOfChannel(nvr DriverNVR, drv NVRDriver, channel uint32) (base.Camera, bool) {
+	for _, cam := range m.device.GetCamGroup().AllCameras() {
+		if cam.GetBrand() != nvr.Brand || cam.GetID() <= 0 {
+			continue
+		}
+		u, err := url.Parse(cam.GetUri())
+		if err != nil || u.Hostname() != nvr.Host {
+			continue
+		}
+		if c, ok := drv.Channel(cam.GetUri()); ok && c == channel {
+			return cam, true
+		}
+	}
+	return nil, false
+}
+
+func (m *NVRDrivers) raiseAlarm(alarm *cloud.AlarmInfo) {
+	if bridge := GetMQTTBridge(); bridge != nil {
+		bridge.PublishAlarm(alarm)
+	}
+	if hooks := GetWebhookDispatcher(); hooks != nil {
+		hooks.Alarm(alarm)
+	}
+	if err := m.device.CloudClient().UploadAlarmInfo(alarm); err != nil {
+		m.logger.Error().Err(err).Msg("failed to upload nvr alarm")
+	}
+}
@@ -0,0 +1,508 @@
+package box
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/icholy/digest"
+
+	"github.com/example/minibox/utils"
+)
+
+const (
+	hikvisionTimeout         = 10 * time.Second
+	hikvisionRtspPort        = 554
+	hikvisionSearchPageSize  = 50
+	hikvisionSearchMaxPages  = 20
+	hikvisionTimeLayout      = "2006-01-02T15:04:05Z"
+	hikvisionTrackTimeLayout = "20060102T150405Z"
+	hikvisionMaxEventSize    = 1 << 20
+	// hikvisionMainStream and hikvisionSubStream are the stream ids of a channel, the
+	// track of a stream is 100 * channel + stream.
+	hikvisionMainStream = 1
+	hikvisionSubStream  = 2
+)
+
+var ErrHikvisionResponse = errors.New("unexpected isapi response")
+
+// hikvisionEventTypes maps the ISAPI event types to the NVR event types.
+var hikvisionEventTypes = map[string]string{
+	"vmd":             NVREventMotion,
+	"videoloss":       NVREventVideoLoss,
+	"shelteralarm":    NVREventTamper,
+	"tamperdetection": NVREventTamper,
+	"linedetection":   NVREventLine,
+	"fielddetection":  NVREventIntrusion,
+}
+
+// hikvisionPTZSpeed is the ISAPI speed of a ptz_ctrl speed, ISAPI speeds are in [-100,100].
+func hikvisionPTZSpeed(v float64, speed int) int {
+	return int(v * onvifSpeed(speed) * 100)
+}
+
+// hikvisionNVR drives a Hikvision NVR through ISAPI, with digest auth.
+type hikvisionNVR struct {
+	host     string
+	port     uint16
+	username string
+	password string
+	client   *http.Client
+	// stream has no timeout, the alert stream stays open.
+	stream *http.Client
+}
+
+func newHikvisionNVR(host string, port uint16, username, password string) *hikvisionNVR {
+	return &hikvisionNVR{
+		host:     host,
+		port:     port,
+		username: username,
+		password: password,
+		client: &http.Client{
+			Timeout:   hikvisionTimeout,
+			Transport: &digest.Transport{Username: username, Password: password},
+		},
+		stream: &http.Client{
+			Transport: &digest.Transport{Username: username, Password: password},
+		},
+	}
+}
+
+func (n *hikvisionNVR) url(path string) string {
+	host := n.host
+	if n.port != 0 && n.port != 80 {
+		host = net.JoinHostPort(n.host, strconv.Itoa(int(n.port)))
+	}
+	return "http://" + host + path
+}
+
+// hikvisionStatus is the ResponseStatus of the ISAPI errors and of the PUTs.
+type hikvisionStatus struct {
+	StatusCode    int    `xml:"statusCode"`
+	StatusString  string `xml:"statusString"`
+	SubStatusCode string `xml:"subStatusCode"`
+}
+
+func (n *hikvisionNVR) do(method, path string, body interface{}, ret interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := xml.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(append([]byte(xml.Header), data...))
+	}
+	req, err := http.NewRequest(method, n.url(path), reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized {
+		return ErrHttpAuthFailed
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		status := hikvisionStatus{}
+		if xml.Unmarshal(data, &status) == nil && status.SubStatusCode != "" {
+			return fmt.Errorf("isapi %s %s: %s", method, path, status.SubStatusCode)
+		}
+		return fmt.Errorf("http status code: %d", res.StatusCode)
+	}
+	if ret == nil {
+		return nil
+	}
+	if b, ok := ret.(*[]byte); ok {
+		*b = data
+		return nil
+	}
+	return xml.Unmarshal(data, ret)
+}
+
+func (n *hikvisionNVR) Brand() utils.CameraBrand {
+	return utils.Hikvision
+}
+
+func (n *hikvisionNVR) SerialNumber() (string, error) {
+	info := struct {
+		SerialNumber string `xml:"serialNumber"`
+	}{}
+	if err := n.do(http.MethodGet, "/ISAPI/System/deviceInfo", nil, &info); err != nil {
+		return "", err
+	}
+	return info.SerialNumber, nil
+}
+
+type hikvisionInputChannel struct {
+	ID     uint32 `xml:"id"`
+	Name   string `xml:"name"`
+	Source struct {
+		IPAddress string `xml:"ipAddress"`
+		Model     string `xml:"model"`
+		Serial    string `xml:"serialNumber"`
+		MAC       string `xml:"macAddress"`
+	} `xml:"sourceInputPortDescriptor"`
+}
+
+type hikvisionChannelStatus struct {
+	ID     uint32 `xml:"id"`
+	Online bool   `xml:"online"`
+}
+
+func (n *hikvisionNVR) Channels() ([]NVRChannel, error) {
+	channels := struct {
+		Channels []hikvisionInputChannel `xml:"InputProxyChannel"`
+	}{}
+	if err := n.do(http.MethodGet, "/ISAPI/ContentMgmt/InputProxy/channels", nil, &channels); err != nil {
+		return nil, err
+	}
+	statuses := struct {
+		Statuses []hikvisionChannelStatus `xml:"InputProxyChannelStatus"`
+	}{}
+	if err := n.do(http.MethodGet, "/ISAPI/ContentMgmt/InputProxy/channels/status", nil, &statuses); err != nil {
+		return nil, err
+	}
+	online := make(map[uint32]bool)
+	for _, s := range statuses.Statuses {
+		online[s.ID] = s.Online
+	}
+	ret := make([]NVRChannel, 0, len(channels.Channels))
+	for _, c := range channels.Channels {
+		ret = append(ret, NVRChannel{
+			ID:           c.ID,
+			Name:         c.Name,
+			Online:       online[c.ID],
+			IP:           c.Source.IPAddress,
+			MAC:          c.Source.MAC,
+			SerialNumber: c.Source.Serial,
+			Manufacturer: string(utils.Hikvision),
+			Model:        c.Source.Model,
+		})
+	}
+	return ret, nil
+}
+
+func (n *hikvisionNVR) RTSPPort() (uint16, error) {
+	accesses := struct {
+		Protocols []struct {
+			Protocol string `xml:"protocol"`
+			Port     uint16 `xml:"portNo"`
+		} `xml:"AdminAccessProtocol"`
+	}{}
+	if err := n.do(http.MethodGet, "/ISAPI/Security/adminAccesses", nil, &accesses); err != nil {
+		return 0, err
+	}
+	for _, p := range accesses.Protocols {
+		if strings.EqualFold(p.Protocol, "RTSP") && p.Port > 0 {
+			return p.Port, nil
+		}
+	}
+	return hikvisionRtspPort, nil
+}
+
+func (n *hikvisionNVR) StreamUris(channel uint32, rtspPort uint16) (sd, uri, hd string) {
+	if rtspPort == 0 {
+		rtspPort = hikvisionRtspPort
+	}
+	host := net.JoinHostPort(n.host, strconv.Itoa(int(rtspPort)))
+	main := fmt.Sprintf("rtsp://%s/Streaming/Channels/%d", host, 100*channel+hikvisionMainStream)
+	sub := fmt.Sprintf("rtsp://%s/Streaming/Channels/%d", host, 100*channel+hikvisionSubStream)
+	return sub, main, main
+}
+
+// Channel parses the track of /Streaming/Channels/<track> and /Streaming/tracks/<track>.
+func (n *hikvisionNVR) Channel(uri string) (uint32, bool) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return 0, false
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 3 || !strings.EqualFold(parts[0], "Streaming") {
+		return 0, false
+	}
+	if !strings.EqualFold(parts[1], "Channels") && !strings.EqualFold(parts[1], "tracks") {
+		return 0, false
+	}
+	track, err := strconv.ParseUint(parts[2], 10, 32)
+	if err != nil || track < 100 {
+		return 0, false
+	}
+	return uint32(track / 100), true
+}
+
+func (n *hikvisionNVR) Snapshot(channel uint32) ([]byte, error) {
+	var ret []byte
+	path := fmt.Sprintf("/ISAPI/Streaming/channels/%d/picture", 100*channel+hikvisionMainStream)
+	if err := n.do(http.MethodGet, path, nil, &ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+type hikvisionTimeSpan struct {
+	StartTime string `xml:"startTime"`
+	EndTime   string `xml:"endTime"`
+}
+
+type hikvisionSearch struct {
+	XMLName      xml.Name            `xml:"CMSearchDescription"`
+	SearchID     string              `xml:"searchID"`
+	TrackIDs     []uint32            `xml:"trackIDList>trackID"`
+	TimeSpans    []hikvisionTimeSpan `xml:"timeSpanList>timeSpan"`
+	MaxResults   int                 `xml:"maxResults"`
+	Position     int                 `xml:"searchResultPostion"`
+	MetadataList []string            `xml:"metadataList>metadataDescriptor"`
+}
+
+type hikvisionSearchResult struct {
+	Status     string `xml:"responseStatusStrg"`
+	NumMatches int    `xml:"numOfMatches"`
+	Matches    []struct {
+		TimeSpan   hikvisionTimeSpan `xml:"timeSpan"`
+		RecordType string            `xml:"metadataMatches>metadataDescriptor"`
+	} `xml:"matchList>searchMatchItem"`
+}
+
+// hikvisionRecordType maps the metadata of the recordings to the record types of the
+// Uniview NVRs: 0 for the continuous recordings and 1 for the event ones.
+func hikvisionRecordType(metadata string) uint32 {
+	if metadata == "" || strings.HasSuffix(strings.ToLower(metadata), "/timing") {
+		return 0
+	}
+	return 1
+}
+
+func (n *hikvisionNVR) SearchRecords(channel uint32, begin, end int64) ([]NVRRecord, error) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	search := hikvisionSearch{
+		SearchID: strings.ToUpper(hex.EncodeToString(id)),
+		TrackIDs: []uint32{100*channel + hikvisionMainStream},
+		TimeSpans: []hikvisionTimeSpan{{
+			StartTime: time.Unix(begin, 0).UTC().Format(hikvisionTimeLayout),
+			EndTime:   time.Unix(end, 0).UTC().Format(hikvisionTimeLayout),
+		}},
+		MaxResults:   hikvisionSearchPageSize,
+		MetadataList: []string{"//recordType.meta.std-cgi.com"},
+	}
+	var ret []NVRRecord
+	for page := 0; page < hikvisionSearchMaxPages; page++ {
+		result := hikvisionSearchResult{}
+		if err := n.do(http.MethodPost, "/ISAPI/ContentMgmt/search", &search, &result); err != nil {
+			return nil, err
+		}
+		for _, m := range result.Matches {
+			b, err := time.Parse(hikvisionTimeLayout, m.TimeSpan.StartTime)
+			if err != nil {
+				return nil, ErrHikvisionResponse
+			}
+			e, err := time.Parse(hikvisionTimeLayout, m.TimeSpan.EndTime)
+			if err != nil {
+				return nil, ErrHikvisionResponse
+			}
+			ret = append(ret, NVRRecord{Type: hikvisionRecordType(m.RecordType), Begin: b.Unix(), End: e.Unix()})
+		}
+		if result.Status != "MORE" || len(result.Matches) == 0 {
+			break
+		}
+		search.Position += len(result.Matches)
+	}
+	return ret, nil
+}
+
+func (n *hikvisionNVR) PlaybackUri(liveUri string, channel uint32, begin, end int64) (string, error) {
+	u, err := url.Parse(liveUri)
+	if err != nil {
+		return "", err
+	}
+	u.Path = fmt.Sprintf("/Streaming/tracks/%d", 100*channel+hikvisionMainStream)
+	u.RawQuery = fmt.Sprintf("starttime=%s&endtime=%s",
+		time.Unix(begin, 0).UTC().Format(hikvisionTrackTimeLayout), time.Unix(end, 0).UTC().Format(hikvisionTrackTimeLayout))
+	return u.String(), nil
+}
+
+func (n *hikvisionNVR) PTZ(channel uint32) PTZDriver {
+	return &hikvisionPTZ{nvr: n, channel: channel}
+}
+
+// hikvisionAlert is an EventNotificationAlert of the alert stream.
+type hikvisionAlert struct {
+	ChannelID  uint32 `xml:"channelID"`
+	DynChannel uint32 `xml:"dynChannelID"`
+	DateTime   string `xml:"dateTime"`
+	EventType  string `xml:"eventType"`
+	EventState string `xml:"eventState"`
+}
+
+// Events reads /ISAPI/Event/notification/alertStream, a multipart stream of
+// EventNotificationAlert documents. The heartbeats have the videoloss type and the
+// inactive state on channel 0, they are skipped.
+func (n *hikvisionNVR) Events(ctx context.Context, handle func(NVREvent)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, n.url("/ISAPI/Event/notification/alertStream"), nil)
+	if err != nil {
+		return err
+	}
+	res, err := n.stream.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized {
+		return ErrHttpAuthFailed
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("http status code: %d", res.StatusCode)
+	}
+	_, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return ErrHikvisionResponse
+	}
+	return readHikvisionAlerts(multipart.NewReader(res.Body, params["boundary"]), handle)
+}
+
+func readHikvisionAlerts(r *multipart.Reader, handle func(NVREvent)) error {
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(part.Header.Get("Content-Type"), "xml") {
+			io.Copy(io.Discard, part)
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(part, hikvisionMaxEventSize))
+		if err != nil {
+			return err
+		}
+		if ev, ok := parseHikvisionAlert(data); ok {
+			handle(ev)
+		}
+	}
+}
+
+func parseHikvisionAlert(data []byte) (NVREvent, bool) {
+	alert := hikvisionAlert{}
+	if err := xml.Unmarshal(data, &alert); err != nil {
+		return NVREvent{}, false
+	}
+	channel := alert.ChannelID
+	if channel == 0 {
+		channel = alert.DynChannel
+	}
+	eventType, ok := hikvisionEventTypes[strings.ToLower(alert.EventType)]
+	if !ok || channel == 0 {
+		return NVREvent{}, false
+	}
+	at, err := time.Parse(time.RFC3339, alert.DateTime)
+	if err != nil {
+		at = time.Now()
+	}
+	return NVREvent{
+		Channel: channel,
+		Type:    eventType,
+		Active:  strings.EqualFold(alert.EventState, "active"),
+		Time:    at,
+	}, true
+}
+
+// hikvisionPTZ drives a channel of a Hikvision NVR through /ISAPI/PTZCtrl.
+type hikvisionPTZ struct {
+	nvr     *hikvisionNVR
+	channel uint32
+}
+
+type hikvisionPTZData struct {
+	XMLName xml.Name `xml:"PTZData"`
+	Pan     int      `xml:"pan"`
+	Tilt    int      `xml:"tilt"`
+	Zoom    int      `xml:"zoom"`
+}
+
+type hikvisionPreset struct {
+	XMLName xml.Name `xml:"PTZPreset"`
+	ID      int      `xml:"id"`
+	Name    string   `xml:"presetName"`
+	Enabled bool     `xml:"enabled"`
+}
+
+func (p *hikvisionPTZ) path(format string, args ...interface{}) string {
+	return fmt.Sprintf("/ISAPI/PTZCtrl/channels/%d", p.channel) + fmt.Sprintf(format, args...)
+}
+
+func (p *hikvisionPTZ) Move(cmd string, hSpeed, vSpeed int) error {
+	data := hikvisionPTZData{}
+	if cmd != "stop" {
+		v, ok := onvifPTZVectors[cmd]
+		if !ok {
+			return ErrPTZUnsupported
+		}
+		data.Pan = hikvisionPTZSpeed(v[0], hSpeed)
+		data.Tilt = hikvisionPTZSpeed(v[1], vSpeed)
+		data.Zoom = hikvisionPTZSpeed(v[2], hSpeed)
+	}
+	return p.nvr.do(http.MethodPut, p.path("/continuous"), &data, nil)
+}
+
+func (p *hikvisionPTZ) GetPresets() ([]ptzPreset, int, error) {
+	presets := struct {
+		Presets []hikvisionPreset `xml:"PTZPreset"`
+	}{}
+	if err := p.nvr.do(http.MethodGet, p.path("/presets"), nil, &presets); err != nil {
+		return nil, 0, err
+	}
+	ret := make([]ptzPreset, 0, len(presets.Presets))
+	for _, v := range presets.Presets {
+		if !v.Enabled {
+			continue
+		}
+		ret = append(ret, ptzPreset{ID: v.ID, Name: v.Name})
+	}
+	return ret, len(ret), nil
+}
+
+func (p *hikvisionPTZ) SetPreset(preset ptzPreset) error {
+	return p.nvr.do(http.MethodPut, p.path("/presets/%d", preset.ID),
+		&hikvisionPreset{ID: preset.ID, Name: preset.Name, Enabled: true}, nil)
+}
+
+func (p *hikvisionPTZ) GoToPreset(presetId uint32) error {
+	return p.nvr.do(http.MethodPut, p.path("/presets/%d/goto", presetId), nil, nil)
+}
+
+func (p *hikvisionPTZ) GoToHome() error {
+	return p.nvr.do(http.MethodPut, p.path("/homeposition/goto"), nil, nil)
+}
+
+func (p *hikvisionPTZ) SetHome() error {
+	return p.nvr.do(http.MethodPut, p.path("/homeposition"), nil, nil)
+}
+
+func (p *hikvisionPTZ) AbsoluteMove(pan, tilt, zoom float64) error {
+	return ErrPTZUnsupported
+}
+
+func (p *hikvisionPTZ) RelativeMove(pan, tilt, zoom float64) error {
+	return ErrPTZUnsupported
+}
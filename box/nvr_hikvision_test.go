@@ -0,0 +1,127 @@
+package box
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestHikvisionNVR(t *testing.T, handler http.HandlerFunc) *hikvisionNVR {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return newHikvisionNVR(host, uint16(p), "admin", "pw")
+}
+
+func TestHikvisionChannels(t *testing.T) {
+	nvr := newTestHikvisionNVR(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ISAPI/ContentMgmt/InputProxy/channels":
+			fmt.Fprint(w, `<InputProxyChannelList><InputProxyChannel><id>1</id><name>Door</name>`+
+				`<sourceInputPortDescriptor><ipAddress>10.0.0.11</ipAddress><model>DS-2CD</model></sourceInputPortDescriptor>`+
+				`</InputProxyChannel><InputProxyChannel><id>2</id><name>Yard</name></InputProxyChannel></InputProxyChannelList>`)
+		case "/ISAPI/ContentMgmt/InputProxy/channels/status":
+			fmt.Fprint(w, `<InputProxyChannelStatusList><InputProxyChannelStatus><id>1</id><online>true</online>`+
+				`</InputProxyChannelStatus><InputProxyChannelStatus><id>2</id><online>false</online></InputProxyChannelStatus>`+
+				`</InputProxyChannelStatusList>`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	channels, err := nvr.Channels()
+	assert.NoError(t, err)
+	assert.Equal(t, []NVRChannel{
+		{ID: 1, Name: "Door", Online: true, IP: "10.0.0.11", Manufacturer: "Hikvision", Model: "DS-2CD"},
+		{ID: 2, Name: "Yard", Manufacturer: "Hikvision"},
+	}, channels)
+}
+
+func TestHikvisionSearchRecords(t *testing.T) {
+	var positions []int
+	nvr := newTestHikvisionNVR(t, func(w http.ResponseWriter, r *http.Request) {
+		search := hikvisionSearch{}
+		body, _ := io.ReadAll(r.Body)
+		assert.NoError(t, xml.Unmarshal(body, &search))
+		assert.Equal(t, []uint32{301}, search.TrackIDs)
+		positions = append(positions, search.Position)
+		status, kind := "MORE", "timing"
+		if search.Position > 0 {
+			status, kind = "OK", "motion"
+		}
+		fmt.Fprintf(w, `<CMSearchResult><responseStatusStrg>%s</responseStatusStrg><matchList><searchMatchItem>`+
+			`<timeSpan><startTime>2024-05-01T10:00:00Z</startTime><endTime>2024-05-01T10:30:00Z</endTime></timeSpan>`+
+			`<metadataMatches><metadataDescriptor>recordType.meta.hikvision.com/%s</metadataDescriptor></metadataMatches>`+
+			`</searchMatchItem></matchList></CMSearchResult>`, status, kind)
+	})
+	begin := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC).Unix()
+	records, err := nvr.SearchRecords(3, begin, begin+3600)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1}, positions)
+	assert.Equal(t, []NVRRecord{
+		{Type: 0, Begin: begin, End: begin + 1800},
+		{Type: 1, Begin: begin, End: begin + 1800},
+	}, records)
+}
+
+func TestHikvisionUris(t *testing.T) {
+	nvr := newHikvisionNVR("10.0.0.2", 0, "admin", "pw")
+	sd, uri, hd := nvr.StreamUris(3, 0)
+	assert.Equal(t, "rtsp://10.0.0.2:554/Streaming/Channels/302", sd)
+	assert.Equal(t, "rtsp://10.0.0.2:554/Streaming/Channels/301", uri)
+	assert.Equal(t, uri, hd)
+
+	channel, ok := nvr.Channel(uri)
+	assert.True(t, ok)
+	assert.EqualValues(t, 3, channel)
+	_, ok = nvr.Channel("rtsp://10.0.0.2:554/unicast/c3/s0/live")
+	assert.False(t, ok)
+
+	begin := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC).Unix()
+	playback, err := nvr.PlaybackUri("rtsp://admin:pw@10.0.0.2:554/Streaming/Channels/301", 3, begin, begin+60)
+	assert.NoError(t, err)
+	assert.Equal(t, "rtsp://admin:pw@10.0.0.2:554/Streaming/tracks/301?starttime=20240501T100000Z&endtime=20240501T100100Z", playback)
+}
+
+func TestHikvisionEvents(t *testing.T) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for _, alert := range []string{
+		`<EventNotificationAlert><channelID>0</channelID><eventType>videoloss</eventType><eventState>inactive</eventState></EventNotificationAlert>`,
+		`<EventNotificationAlert><channelID>2</channelID><dateTime>2024-05-01T10:00:00+08:00</dateTime>` +
+			`<eventType>shelteralarm</eventType><eventState>active</eventState></EventNotificationAlert>`,
+		`<EventNotificationAlert><channelID>1</channelID><eventType>unknown</eventType></EventNotificationAlert>`,
+	} {
+		part, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/xml; charset=\"UTF-8\""}})
+		part.Write([]byte(alert))
+	}
+	part, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"image/jpeg"}})
+	part.Write([]byte{0xff, 0xd8})
+	mw.Close()
+
+	nvr := newTestHikvisionNVR(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/ISAPI/Event/notification/alertStream", r.URL.Path)
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+		w.Write(body.Bytes())
+	})
+	var events []NVREvent
+	err := nvr.Events(context.Background(), func(ev NVREvent) { events = append(events, ev) })
+	assert.Equal(t, io.EOF, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, uint32(2), events[0].Channel)
+	assert.Equal(t, NVREventTamper, events[0].Type)
+	assert.True(t, events[0].Active)
+	assert.Equal(t, time.Date(2024, 5, 1, 2, 0, 0, 0, time.UTC), events[0].Time.UTC())
+}
@@ -0,0 +1,466 @@
+package box
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	univiewapi "github.com/example/goshawk/uniview"
+	"github.com/example/turing-common/log"
+	"github.com/example/turing-common/metrics"
+
+	"github.com/example/minibox/db"
+	"github.com/example/minibox/nvr"
+	"github.com/example/minibox/scheduler"
+	"github.com/example/minibox/utils"
+)
+
+const (
+	nvrRotationCheckInterval = time.Hour
+	// nvrRotationRetry delays the retry of a failed rotation, the NVRs lock the users
+	// after failed logins.
+	nvrRotationRetry = 24 * time.Hour
+	// nvrRotationLock locks the clients of an NVR while its password changes, as
+	// lockNvrClient does before setNvrUserInfo.
+	nvrRotationLock   = defaultDurationForChangePassword * time.Second
+	nvrPasswordLength = 16
+	// nvrPasswordSymbols are the symbols of the generated passwords, the Uniview NVRs
+	// require a digit, a lower case and an upper case letter and a symbol.
+	nvrPasswordSymbols = "!@#%^*_-+="
+)
+
+// The results of the password rotations.
+const (
+	NVRRotationSucceeded  = "succeeded"
+	NVRRotationRolledBack = "rolled_back"
+	NVRRotationFailed     = "failed"
+)
+
+var (
+	ErrNVRRotationInvalid  = errors.New("invalid nvr password rotation")
+	ErrNVRRotationNotFound = errors.New("nvr password rotation not found")
+	ErrNVRRotationBusy     = errors.New("nvr password is already rotating")
+	ErrNVRNotManaged       = errors.New("nvr is not managed by the box")
+	// ErrNVRRotationRolledBack is returned when the NVR refuses its new password, the old
+	// one is set back.
+	ErrNVRRotationRolledBack = errors.New("new nvr password failed, the old one is restored")
+	// ErrNVRRotationUnverified is returned when the new password neither works nor can be
+	// rolled back, the new password is kept as the NVR may have it.
+	ErrNVRRotationUnverified = errors.New("new nvr password failed and could not be rolled back")
+)
+
+var nvrPasswordRotator *NVRPasswordRotator
+
+// NVRRotation rotates the password of the user of a Uniview NVR every IntervalDays. It is
+// persisted in the nvr_rotations table.
+type NVRRotation struct {
+	NvrSN        string     `json:"nvr_sn" gorm:"primary_key"`
+	Enabled      bool       `json:"enabled"`
+	IntervalDays int        `json:"interval_days"`
+	RotatedAt    *time.Time `json:"rotated_at"`
+	AttemptedAt  *time.Time `json:"attempted_at"`
+	Result       string     `json:"result"`
+	LastError    string     `json:"last_error"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"-"`
+}
+
+// due reports whether the password is to rotate at now, the interval runs from the last
+// rotation or from the creation of the rotation. A failed rotation is retried after
+// nvrRotationRetry.
+func (v *NVRRotation) due(now time.Time) bool {
+	if !v.Enabled || v.IntervalDays <= 0 {
+		return false
+	}
+	if v.Result != NVRRotationSucceeded && v.AttemptedAt != nil && now.Sub(*v.AttemptedAt) < nvrRotationRetry {
+		return false
+	}
+	from := v.CreatedAt
+	if v.RotatedAt != nil {
+		from = *v.RotatedAt
+	}
+	return !now.Before(from.AddDate(0, 0, v.IntervalDays))
+}
+
+// nvrAccess is the address and the credentials of a managed NVR.
+type nvrAccess struct {
+	brand    utils.CameraBrand
+	ip       string
+	port     uint16
+	username string
+	password string
+}
+
+// NVRPasswordRotator rotates the passwords of the Uniview NVRs. A new password is set
+// with the old one, stored, then checked with a new client: the old password is set back
+// with a client of its own and stored when the check fails.
+type NVRPasswordRotator struct {
+	device    Box
+	db        db.Client
+	logger    zerolog.Logger
+	lock      sync.Mutex
+	rotations map[string]*NVRRotation
+	rotating  map[string]bool
+	now       func() time.Time
+
+	access   func(sn string) (*nvrAccess, error)
+	change   func(sn, username, password, newPassword string) error
+	rollback func(sn string, a *nvrAccess, password string) error
+	verify   func(a *nvrAccess, password string) error
+	store    func(sn string, a *nvrAccess, password string)
+	generate func() (string, error)
+}
+
+func NewNVRPasswordRotator(device Box, d db.Client) *NVRPasswordRotator {
+	r := &NVRPasswordRotator{
+		device:    device,
+		db:        d,
+		logger:    log.Logger("nvr_rotation"),
+		rotations: make(map[string]*NVRRotation),
+		rotating:  make(map[string]bool),
+		now:       time.Now,
+		verify:    verifyNVRPassword,
+		generate:  generateNVRPassword,
+	}
+	r.access = r.nvrAccess
+	r.change = r.changePassword
+	r.rollback = r.rollbackPassword
+	r.store = r.storePassword
+	nvrPasswordRotator = r
+
+	client := d.GetDBInstance()
+	if err := client.AutoMigrate(&NVRRotation{}); err != nil {
+		r.logger.Error().Err(err).Msg("failed to migrate nvr rotations")
+	}
+	var rotations []*NVRRotation
+	if err := client.Find(&rotations).Error; err != nil {
+		r.logger.Error().Err(err).Msg("failed to load nvr rotations")
+	}
+	r.lock.Lock()
+	for _, v := range rotations {
+		r.rotations[v.NvrSN] = v
+	}
+	r.lock.Unlock()
+	go r.run()
+	return r
+}
+
+func GetNVRPasswordRotator() *NVRPasswordRotator {
+	return nvrPasswordRotator
+}
+
+// Save creates or updates the rotation of an NVR, its last rotation is kept.
+func (r *NVRPasswordRotator) Save(v *NVRRotation) error {
+	if v.NvrSN == "" || v.IntervalDays < 0 || (v.Enabled && v.IntervalDays == 0) {
+		return ErrNVRRotationInvalid
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if old, ok := r.rotations[v.NvrSN]; ok {
+		v.CreatedAt, v.RotatedAt, v.AttemptedAt = old.CreatedAt, old.RotatedAt, old.AttemptedAt
+		v.Result, v.LastError = old.Result, old.LastError
+	}
+	if err := r.db.GetDBInstance().Save(v).Error; err != nil {
+		return err
+	}
+	saved := *v
+	r.rotations[v.NvrSN] = &saved
+	return nil
+}
+
+func (r *NVRPasswordRotator) Delete(sn string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.rotations[sn]; !ok {
+		return ErrNVRRotationNotFound
+	}
+	if err := r.db.GetDBInstance().Where("nvr_sn = ?", sn).Delete(&NVRRotation{}).Error; err != nil {
+		return err
+	}
+	delete(r.rotations, sn)
+	return nil
+}
+
+// List returns the rotations sorted by NVR SN.
+func (r *NVRPasswordRotator) List() []NVRRotation {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ret := make([]NVRRotation, 0, len(r.rotations))
+	for _, v := range r.rotations {
+		ret = append(ret, *v)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].NvrSN < ret[j].NvrSN })
+	return ret
+}
+
+func (r *NVRPasswordRotator) run() {
+	ticker := time.NewTicker(nvrRotationCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.check()
+	}
+}
+
+// check rotates the passwords which are due, one NVR after the other.
+func (r *NVRPasswordRotator) check() {
+	now := r.now()
+	var due []string
+	r.lock.Lock()
+	for sn, v := range r.rotations {
+		if v.due(now) {
+			due = append(due, sn)
+		}
+	}
+	r.lock.Unlock()
+	sort.Strings(due)
+	for _, sn := range due {
+		if err := r.Rotate(sn); err != nil {
+			r.logger.Error().Err(err).Str("nvr_sn", sn).Msg("failed to rotate nvr password")
+		}
+	}
+}
+
+// Rotate sets a new generated password to an NVR now, its rotation, if any, records the
+// result.
+func (r *NVRPasswordRotator) Rotate(sn string) error {
+	r.lock.Lock()
+	if r.rotating[sn] {
+		r.lock.Unlock()
+		return ErrNVRRotationBusy
+	}
+	r.rotating[sn] = true
+	r.lock.Unlock()
+
+	err := r.rotate(sn)
+	result := NVRRotationSucceeded
+	switch {
+	case errors.Is(err, ErrNVRRotationRolledBack):
+		result = NVRRotationRolledBack
+	case err != nil:
+		result = NVRRotationFailed
+	}
+	metrics.CounterVecAdd("nvr_password_rotations_total", []string{"result"}, []string{result}, 1)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.rotating, sn)
+	v, ok := r.rotations[sn]
+	if !ok {
+		return err
+	}
+	now := r.now()
+	v.AttemptedAt, v.Result, v.LastError = &now, result, ""
+	if err != nil {
+		v.LastError = err.Error()
+	} else {
+		v.RotatedAt = &now
+	}
+	if dbErr := r.db.GetDBInstance().Save(v).Error; dbErr != nil {
+		r.logger.Error().Err(dbErr).Str("nvr_sn", sn).Msg("failed to save nvr rotation")
+	}
+	return err
+}
+
+func (r *NVRPasswordRotator) rotate(sn string) error {
+	a, err := r.access(sn)
+	if err != nil {
+		return err
+	}
+	password, err := r.generate()
+	if err != nil {
+		return err
+	}
+	if err := r.change(sn, a.username, a.password, password); err != nil {
+		return err
+	}
+	r.store(sn, a, password)
+	err = r.verify(a, password)
+	if err == nil {
+		r.logger.Info().Str("nvr_sn", sn).Msg("rotated nvr password")
+		return nil
+	}
+
+	r.logger.Error().Err(err).Str("nvr_sn", sn).Msg("new nvr password failed, rolling back")
+	if err := r.rollback(sn, a, password); err != nil {
+		r.logger.Error().Err(err).Str("nvr_sn", sn).Msg("failed to roll back nvr password")
+		return ErrNVRRotationUnverified
+	}
+	r.store(sn, a, a.password)
+	return ErrNVRRotationRolledBack
+}
+
+func (r *NVRPasswordRotator) nvrAccess(sn string) (*nvrAccess, error) {
+	return managedNVRAccess(r.device.GetNVRManager(), sn)
+}
+
+// managedNVRAccess reads the credentials of a Uniview NVR managed by the NVRManager.
+func managedNVRAccess(nm nvr.NVRManager, sn string) (*nvrAccess, error) {
+	if managed, _ := nm.IsNvrServiceLocked(sn); !managed {
+		return nil, ErrNVRNotManaged
+	}
+	username, password, err := readNVRCredential(nm, sn)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range nm.GetAllNvrManaged() {
+		if v["sn"] != sn {
+			continue
+		}
+		if utils.CameraBrand(v["brand"]) != utils.Uniview {
+			return nil, ErrNVRBrandUnsupported
+		}
+		port, err := strconv.ParseUint(v["port"], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		return &nvrAccess{
+			brand:    utils.Uniview,
+			ip:       v["ip"],
+			port:     uint16(port),
+			username: username,
+			password: password,
+		}, nil
+	}
+	return nil, ErrNVRNotManaged
+}
+
+func (r *NVRPasswordRotator) changePassword(sn, username, password, newPassword string) error {
+	nm := r.device.GetNVRManager()
+	nm.LockNvrClients(sn, nvrRotationLock)
+	scheduler.GetScheduler().Suspend(nvrRotationLock)
+	return changeNvrPassword(nm, username, password, sn, newPassword)
+}
+
+// rollbackPassword sets the old password of an NVR back. The clients of the NVRManager
+// reconnected with the new password, which failed, so the NVR is reached at its address
+// with a client of the password it was just given.
+func (r *NVRPasswordRotator) rollbackPassword(sn string, a *nvrAccess, password string) error {
+	r.device.GetNVRManager().LockNvrClients(sn, nvrRotationLock)
+	nc := univiewapi.NewNvrClient(a.ip, a.username, password, a.port,
+		univiewapi.WithHttpClientWrap(metrics.HttpClientCounterCollect),
+		univiewapi.WithLogger(log.Logger("nvr_rotation")),
+	)
+	return setNvrPassword(nc, a.username, password, a.password)
+}
+
+// storePassword saves a password of an NVR through UpdateNVR, then the NVRManager
+// reconnects with it.
+func (r *NVRPasswordRotator) storePassword(sn string, a *nvrAccess, password string) {
+	r.device.UpdateNVR(sn, a.username, password, a.brand, a.ip, a.port)
+	r.device.GetNVRManager().UpdateNvr()
+}
+
+// verifyNVRPassword checks a password with a new client of the NVR.
+func verifyNVRPassword(a *nvrAccess, password string) error {
+	nc := univiewapi.NewNvrClient(a.ip, a.username, password, a.port,
+		univiewapi.WithHttpClientWrap(metrics.HttpClientCounterCollect),
+		univiewapi.WithLogger(log.Logger("nvr_rotation")),
+	)
+	_, err := nc.GetDeviceInfos()
+	return err
+}
+
+// generateNVRPassword generates a random password with the characters classes the NVRs
+// require.
+func generateNVRPassword() (string, error) {
+	classes := []string{
+		"abcdefghijkmnopqrstuvwxyz",
+		"ABCDEFGHJKLMNPQRSTUVWXYZ",
+		"23456789",
+		nvrPasswordSymbols,
+	}
+	all := ""
+	for _, c := range classes {
+		all += c
+	}
+	pick := func(chars string) (byte, error) {
+		i, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return 0, err
+		}
+		return chars[i.Int64()], nil
+	}
+	ret := make([]byte, nvrPasswordLength)
+	for i := range ret {
+		chars := all
+		if i < len(classes) {
+			chars = classes[i]
+		}
+		c, err := pick(chars)
+		if err != nil {
+			return "", err
+		}
+		ret[i] = c
+	}
+	// shuffle so that the classes are not at the start
+	for i := len(ret) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		ret[i], ret[j.Int64()] = ret[j.Int64()], ret[i]
+	}
+	return string(ret), nil
+}
+
+// changeNvrPassword changes the password of a user of a Uniview NVR, the passwords are
+// encrypted with the RSA key of the NVR.
+func changeNvrPassword(nm nvr.NVRManager, username, password, nvrSN, newPassword string) error {
+	nc, err := nm.GetNVRClientBySN(nvrSN)
+	if err != nil {
+		return err
+	}
+	return setNvrPassword(nc, username, password, newPassword)
+}
+
+// setNvrPassword changes the password of a user of the Uniview NVR of nc.
+func setNvrPassword(nc *univiewapi.NvrClient, username, password, newPassword string) error {
+	rsaInfo, err := nc.GetSystemSecurityRSA()
+	if err != nil {
+		return err
+	}
+	// var bigN *big.Int
+	bigN := new(big.Int)
+	_, ok := bigN.SetString(rsaInfo.RSAPublicKeyN, 16)
+	if !ok {
+		return fmt.Errorf("bigInt error")
+	}
+
+	rsaPublicKeyE, err := strconv.Atoi(rsaInfo.RSAPublicKeyE)
+	if err != nil {
+		return fmt.Errorf("rsa E fail")
+	}
+	pub := rsa.PublicKey{
+		N: bigN,
+		E: rsaPublicKeyE,
+	}
+
+	rsaPassword, err := rsa.EncryptPKCS1v15(rand.Reader, &pub, []byte(password))
+	if err != nil {
+		return fmt.Errorf("old password rsa encrypt error")
+	}
+	base64Password := base64.StdEncoding.EncodeToString(rsaPassword)
+
+	rsaNewPassword, err := rsa.EncryptPKCS1v15(rand.Reader, &pub, []byte(newPassword))
+	if err != nil {
+		return fmt.Errorf("new password rsa encrypt error")
+	}
+	base64NewPassword := base64.StdEncoding.EncodeToString(rsaNewPassword)
+
+	info := &univiewapi.SecurityUserPINInfo{
+		UserName:     username,
+		CurrentPIN:   base64Password,
+		NewPIN:       base64NewPassword,
+		RSAPublicKey: rsaInfo,
+	}
+	return nc.PutSystemSecurityUserPIN(info)
+}
@@ -0,0 +1,111 @@
+package box
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"unicode"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testNVRRotation struct {
+	password string
+	stored   []string
+	verify   error
+	rollback error
+	// rollbackWith is the password of the client of the rollback.
+	rollbackWith string
+}
+
+func newTestNVRPasswordRotator(t *testing.T, n *testNVRRotation) *NVRPasswordRotator {
+	r := &NVRPasswordRotator{
+		rotations: make(map[string]*NVRRotation),
+		rotating:  make(map[string]bool),
+		now:       time.Now,
+		generate:  func() (string, error) { return "new", nil },
+	}
+	r.access = func(sn string) (*nvrAccess, error) {
+		return &nvrAccess{ip: "10.0.0.2", port: 80, username: "admin", password: n.password}, nil
+	}
+	r.change = func(sn, username, password, newPassword string) error {
+		if password != n.password || newPassword != "new" {
+			return errors.New("the rollback went through the nvr manager clients")
+		}
+		n.password = newPassword
+		return nil
+	}
+	r.rollback = func(sn string, a *nvrAccess, password string) error {
+		assert.Equal(t, "10.0.0.2", a.ip)
+		n.rollbackWith = password
+		if n.rollback != nil {
+			return n.rollback
+		}
+		n.password = a.password
+		return nil
+	}
+	r.store = func(sn string, a *nvrAccess, password string) {
+		n.stored = append(n.stored, password)
+	}
+	r.verify = func(a *nvrAccess, password string) error {
+		return n.verify
+	}
+	return r
+}
+
+func TestNVRRotationRotate(t *testing.T) {
+	n := &testNVRRotation{password: "old"}
+	assert.NoError(t, newTestNVRPasswordRotator(t, n).rotate("NVR1"))
+	assert.Equal(t, "new", n.password)
+	assert.Equal(t, []string{"new"}, n.stored)
+	assert.Empty(t, n.rollbackWith)
+
+	// the rollback reaches the nvr with the password it was just given
+	n = &testNVRRotation{password: "old", verify: errors.New("unauthorized")}
+	assert.Equal(t, ErrNVRRotationRolledBack, newTestNVRPasswordRotator(t, n).rotate("NVR1"))
+	assert.Equal(t, "old", n.password)
+	assert.Equal(t, "new", n.rollbackWith)
+	assert.Equal(t, []string{"new", "old"}, n.stored)
+
+	n = &testNVRRotation{password: "old", verify: errors.New("unauthorized"), rollback: errors.New("timeout")}
+	assert.Equal(t, ErrNVRRotationUnverified, newTestNVRPasswordRotator(t, n).rotate("NVR1"))
+	assert.Equal(t, "new", n.password)
+	assert.Equal(t, []string{"new"}, n.stored)
+}
+
+func TestNVRRotationDue(t *testing.T) {
+	created := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	v := NVRRotation{Enabled: true, IntervalDays: 30, CreatedAt: created}
+	assert.False(t, v.due(created.AddDate(0, 0, 29)))
+	assert.True(t, v.due(created.AddDate(0, 0, 30)))
+
+	attempted := created.AddDate(0, 0, 30)
+	v.AttemptedAt, v.Result = &attempted, NVRRotationFailed
+	assert.False(t, v.due(attempted.Add(time.Hour)))
+	assert.True(t, v.due(attempted.Add(nvrRotationRetry)))
+
+	v.RotatedAt, v.Result = &attempted, NVRRotationSucceeded
+	assert.False(t, v.due(attempted.Add(nvrRotationRetry)))
+	v.Enabled = false
+	assert.False(t, v.due(attempted.AddDate(1, 0, 0)))
+}
+
+func TestGenerateNVRPassword(t *testing.T) {
+	password, err := generateNVRPassword()
+	assert.NoError(t, err)
+	assert.Len(t, password, nvrPasswordLength)
+	var lower, upper, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	assert.True(t, lower && upper && digit && symbol)
+}
@@ -0,0 +1,517 @@
+package box
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+	"github.com/example/turing-common/metrics"
+
+	"github.com/example/minibox/camera/uniview"
+	"github.com/example/minibox/cloud"
+	"github.com/example/minibox/db"
+	"github.com/example/minibox/utils"
+)
+
+const (
+	nvrStoragePollInterval     = 5 * time.Minute
+	nvrStorageEstimateInterval = 6 * time.Hour
+	nvrStorageHistoryRetention = 30 * 24 * time.Hour
+	nvrStoragePruneInterval    = time.Hour
+	nvrStorageHistoryMaxPoints = 2000
+	// nvrStorageRecordLookback bounds the search of the oldest recording of a channel.
+	nvrStorageRecordLookback = 90 * 24 * time.Hour
+	// nvrStorageMinSpan is the recording history needed to estimate the retention.
+	nvrStorageMinSpan = 24 * time.Hour
+	// nvrDiskFullPercent is the used percentage of a full disk, the NVRs overwrite the
+	// oldest recordings once their disks are full.
+	nvrDiskFullPercent = 98
+	// nvrDiskStatusNormal is the status of a working disk in the disk infos of the NVRs,
+	// the other statuses are abnormal.
+	nvrDiskStatusNormal = 0
+)
+
+// The health of the NVR disks: a failed disk no longer reports its capacity or is gone.
+const (
+	NVRDiskHealthy  = "healthy"
+	NVRDiskFull     = "full"
+	NVRDiskAbnormal = "abnormal"
+	NVRDiskFailed   = "failed"
+)
+
+// The alarms of the NVR disks, raised once for the NVR when a disk turns full, abnormal
+// or failed.
+const (
+	AlarmTypeNVRDiskFailure  = "nvr_disk_failure"
+	AlarmTypeNVRDiskFull     = "nvr_disk_full"
+	AlarmTypeNVRDiskAbnormal = "nvr_disk_abnormal"
+)
+
+var ErrNVRStorageQueryInvalid = errors.New("invalid nvr storage history query")
+
+var nvrStorageMonitor *NVRStorageMonitor
+
+// NVRDisk is the last state of a disk of an NVR, Disk is its position in the disk infos.
+// It is persisted in the nvr_disks table.
+type NVRDisk struct {
+	NvrSN        string    `json:"nvr_sn" gorm:"primary_key"`
+	Disk         int       `json:"disk" gorm:"primary_key;auto_increment:false"`
+	Manufacturer string    `json:"manufacturer"`
+	Status       uint8     `json:"status"`
+	TotalMB      int       `json:"total_mb"`
+	RemainMB     int       `json:"remain_mb"`
+	Health       string    `json:"health"`
+	HealthSince  time.Time `json:"health_since"`
+	SampledAt    time.Time `json:"sampled_at"`
+}
+
+func (d *NVRDisk) usedPercent() float64 {
+	if d.TotalMB <= 0 {
+		return 0
+	}
+	return float64(d.TotalMB-d.RemainMB) * 100 / float64(d.TotalMB)
+}
+
+func (d *NVRDisk) health() string {
+	switch {
+	case d.TotalMB <= 0:
+		return NVRDiskFailed
+	case d.Status != nvrDiskStatusNormal:
+		return NVRDiskAbnormal
+	case d.usedPercent() >= nvrDiskFullPercent:
+		return NVRDiskFull
+	}
+	return NVRDiskHealthy
+}
+
+// NVRDiskSample is a poll of a disk, persisted in the nvr_disk_samples table for
+// nvrStorageHistoryRetention.
+type NVRDiskSample struct {
+	ID        int64     `json:"-"`
+	NvrSN     string    `json:"nvr_sn" gorm:"index:idx_nvr_disk_sample"`
+	Disk      int       `json:"disk"`
+	Status    uint8     `json:"status"`
+	TotalMB   int       `json:"total_mb"`
+	RemainMB  int       `json:"remain_mb"`
+	Health    string    `json:"health"`
+	SampledAt time.Time `json:"sampled_at" gorm:"index:idx_nvr_disk_sample"`
+}
+
+// NVRChannelRetention is the recording history of a channel: RecordedDays since its
+// oldest recording, and RetentionDays, the days of recordings it keeps once the disks are
+// full, unknown until the channel has nvrStorageMinSpan of recordings.
+type NVRChannelRetention struct {
+	CameraID      int        `json:"camera_id"`
+	Channel       uint32     `json:"channel"`
+	OldestRecord  *time.Time `json:"oldest_record"`
+	RecordedDays  float64    `json:"recorded_days"`
+	RetentionDays *float64   `json:"retention_days"`
+}
+
+// NVRStorage is the storage of an NVR: its disks and, estimated from the recordings of
+// its channels, the days until its disks are full.
+type NVRStorage struct {
+	NvrSN         string                `json:"nvr_sn"`
+	Ready         bool                  `json:"ready"`
+	Disks         []NVRDisk             `json:"disks"`
+	DaysUntilFull *float64              `json:"days_until_full"`
+	Channels      []NVRChannelRetention `json:"channels"`
+	EstimatedAt   *time.Time            `json:"estimated_at"`
+}
+
+type nvrDiskInfos struct {
+	ready bool
+	disks []NVRDisk
+}
+
+type nvrChannel struct {
+	cameraID int
+	channel  uint32
+}
+
+// nvrChannelRecords is what the record search of a channel finds: the begin of its
+// oldest recording, 0 when it has none, and the seconds it recorded since.
+type nvrChannelRecords struct {
+	oldest  int64
+	seconds int64
+}
+
+type nvrDiskKey struct {
+	sn   string
+	disk int
+}
+
+// NVRStorageMonitor polls the disks of the NVRs managed by the NVRManager, keeps their
+// history and raises an alarm when a disk turns unhealthy. The retention of the channels
+// is estimated less often, from the recordings the NVRs find.
+type NVRStorageMonitor struct {
+	device    Box
+	db        db.Client
+	logger    zerolog.Logger
+	lock      sync.Mutex
+	disks     map[nvrDiskKey]*NVRDisk
+	ready     map[string]bool
+	estimates map[string]*NVRStorage
+	now       func() time.Time
+
+	diskInfos func() map[string]nvrDiskInfos
+	channels  func(sn string) []nvrChannel
+	records   func(sn string, channel uint32, begin, end int64) (nvrChannelRecords, error)
+	raise     func(sn string, alarm *cloud.AlarmInfo)
+}
+
+func NewNVRStorageMonitor(device Box, d db.Client) *NVRStorageMonitor {
+	m := &NVRStorageMonitor{
+		device:    device,
+		db:        d,
+		logger:    log.Logger("nvr_storage"),
+		disks:     make(map[nvrDiskKey]*NVRDisk),
+		ready:     make(map[string]bool),
+		estimates: make(map[string]*NVRStorage),
+		now:       time.Now,
+	}
+	m.diskInfos = m.nvrDiskInfos
+	m.channels = m.nvrChannels
+	m.records = m.nvrChannelRecords
+	m.raise = m.raiseAlarm
+	nvrStorageMonitor = m
+
+	client := d.GetDBInstance()
+	if err := client.AutoMigrate(&NVRDisk{}, &NVRDiskSample{}); err != nil {
+		m.logger.Error().Err(err).Msg("failed to migrate nvr disks")
+	}
+	var disks []*NVRDisk
+	if err := client.Find(&disks).Error; err != nil {
+		m.logger.Error().Err(err).Msg("failed to load nvr disks")
+	}
+	m.lock.Lock()
+	for _, v := range disks {
+		m.disks[nvrDiskKey{v.NvrSN, v.Disk}] = v
+	}
+	m.lock.Unlock()
+	go m.run()
+	return m
+}
+
+func GetNVRStorageMonitor() *NVRStorageMonitor {
+	return nvrStorageMonitor
+}
+
+func (m *NVRStorageMonitor) run() {
+	ticker := time.NewTicker(nvrStoragePollInterval)
+	defer ticker.Stop()
+	var estimated, pruned time.Time
+	for {
+		m.poll()
+		if now := m.now(); now.Sub(estimated) > nvrStorageEstimateInterval {
+			estimated = now
+			m.estimate()
+		}
+		if now := m.now(); now.Sub(pruned) > nvrStoragePruneInterval {
+			pruned = now
+			m.prune()
+		}
+		<-ticker.C
+	}
+}
+
+// poll samples the disks and raises the alarms of the disks which turned unhealthy.
+func (m *NVRStorageMonitor) poll() {
+	infos := m.diskInfos()
+	m.lock.Lock()
+	changed, alarms := m.apply(infos, m.now())
+	m.lock.Unlock()
+
+	client := m.db.GetDBInstance()
+	for _, d := range changed {
+		sample := &NVRDiskSample{NvrSN: d.NvrSN, Disk: d.Disk, Status: d.Status, TotalMB: d.TotalMB,
+			RemainMB: d.RemainMB, Health: d.Health, SampledAt: d.SampledAt}
+		if err := client.Create(sample).Error; err != nil {
+			m.logger.Error().Err(err).Str("nvr_sn", d.NvrSN).Msg("failed to save nvr disk sample")
+		}
+		if err := client.Save(&d).Error; err != nil {
+			m.logger.Error().Err(err).Str("nvr_sn", d.NvrSN).Msg("failed to save nvr disk")
+		}
+	}
+	for _, d := range alarms {
+		m.alarm(d)
+	}
+}
+
+// apply updates the disks with the infos of the NVRs and returns the sampled disks and the
+// ones which turned unhealthy. A disk an NVR no longer reports is failed, the NVRs which
+// report nothing, as they are offline, are left as they are. m.lock is held.
+func (m *NVRStorageMonitor) apply(infos map[string]nvrDiskInfos, now time.Time) ([]NVRDisk, []NVRDisk) {
+	var changed, alarms []NVRDisk
+	update := func(d *NVRDisk) {
+		health := d.health()
+		d.SampledAt = now
+		if health != d.Health {
+			d.Health, d.HealthSince = health, now
+			if health != NVRDiskHealthy {
+				alarms = append(alarms, *d)
+			}
+		}
+		changed = append(changed, *d)
+	}
+	for sn, info := range infos {
+		m.ready[sn] = info.ready
+		seen := make(map[int]bool)
+		for _, v := range info.disks {
+			seen[v.Disk] = true
+			key := nvrDiskKey{sn, v.Disk}
+			d, ok := m.disks[key]
+			if !ok {
+				d = &NVRDisk{NvrSN: sn, Disk: v.Disk, Health: NVRDiskHealthy, HealthSince: now}
+				m.disks[key] = d
+			}
+			d.Manufacturer, d.Status, d.TotalMB, d.RemainMB = v.Manufacturer, v.Status, v.TotalMB, v.RemainMB
+			update(d)
+		}
+		for key, d := range m.disks {
+			if key.sn == sn && !seen[key.disk] && d.Health != NVRDiskFailed {
+				d.TotalMB, d.RemainMB = 0, 0
+				update(d)
+			}
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		if changed[i].NvrSN != changed[j].NvrSN {
+			return changed[i].NvrSN < changed[j].NvrSN
+		}
+		return changed[i].Disk < changed[j].Disk
+	})
+	return changed, alarms
+}
+
+// alarm raises the alarm of an unhealthy disk, for the NVR rather than for each of its
+// cameras, like the disk alarms of the box.
+func (m *NVRStorageMonitor) alarm(d NVRDisk) {
+	algos := AlarmTypeNVRDiskAbnormal
+	switch d.Health {
+	case NVRDiskFailed:
+		algos = AlarmTypeNVRDiskFailure
+	case NVRDiskFull:
+		algos = AlarmTypeNVRDiskFull
+	}
+	metrics.CounterVecAdd("nvr_disk_alarms_total", []string{"health"}, []string{d.Health}, 1)
+	m.logger.Warn().Str("nvr_sn", d.NvrSN).Int("disk", d.Disk).Str("health", d.Health).Uint8("status", d.Status).Msg("nvr disk is unhealthy")
+	atime := m.now().Format(utils.CloudTimeLayout)
+	m.raise(d.NvrSN, &cloud.AlarmInfo{
+		Source:    cloud.AlarmSourceBridge,
+		BoxId:     m.device.GetBoxId(),
+		StartedAt: atime,
+		EndedAt:   atime,
+		Detection: cloud.Detection{Algos: algos},
+		Metadata:  cloud.AlarmMetaData{NvrSN: d.NvrSN, Disk: d.Disk},
+	})
+}
+
+func (m *NVRStorageMonitor) raiseAlarm(sn string, alarm *cloud.AlarmInfo) {
+	if bridge := GetMQTTBridge(); bridge != nil {
+		bridge.PublishAlarm(alarm)
+	}
+	if hooks := GetWebhookDispatcher(); hooks != nil {
+		hooks.Alarm(alarm)
+	}
+	if err := m.device.CloudClient().UploadAlarmInfo(alarm); err != nil {
+		m.logger.Error().Err(err).Str("nvr_sn", sn).Msg("failed to upload nvr disk alarm")
+	}
+}
+
+// estimate searches the recordings of the channels of the NVRs and estimates their
+// retention.
+func (m *NVRStorageMonitor) estimate() {
+	m.lock.Lock()
+	disks := make(map[string][]NVRDisk)
+	for _, d := range m.disks {
+		disks[d.NvrSN] = append(disks[d.NvrSN], *d)
+	}
+	m.lock.Unlock()
+
+	now := m.now()
+	begin := now.Add(-nvrStorageRecordLookback).Unix()
+	for sn, v := range disks {
+		records := make(map[nvrChannel]nvrChannelRecords)
+		for _, c := range m.channels(sn) {
+			r, err := m.records(sn, c.channel, begin, now.Unix())
+			if err != nil {
+				m.logger.Warn().Err(err).Str("nvr_sn", sn).Uint32("channel", c.channel).Msg("failed to search nvr records")
+				continue
+			}
+			records[c] = r
+		}
+		storage := estimateNVRRetention(v, records, now)
+		m.lock.Lock()
+		m.estimates[sn] = storage
+		m.lock.Unlock()
+	}
+}
+
+// estimateNVRRetention estimates the retention of an NVR from its disks and the record
+// search of its channels. The used MB are shared by the channels as the seconds they
+// recorded, so each channel writes its share since its own oldest recording: at the sum of
+// these rates the disks are full in remain / rate days. Once full, the NVR overwrites the
+// oldest recordings and a channel keeps its share of the disks, total * share / its rate
+// days of recordings.
+func estimateNVRRetention(disks []NVRDisk, records map[nvrChannel]nvrChannelRecords, now time.Time) *NVRStorage {
+	storage := &NVRStorage{EstimatedAt: &now}
+	total, remain := 0, 0
+	for _, d := range disks {
+		if d.Health != NVRDiskFailed {
+			total += d.TotalMB
+			remain += d.RemainMB
+		}
+	}
+	var seconds int64
+	for c, r := range records {
+		ret := NVRChannelRetention{CameraID: c.cameraID, Channel: c.channel}
+		if r.oldest > 0 {
+			t := time.Unix(r.oldest, 0)
+			ret.OldestRecord = &t
+			ret.RecordedDays = roundDays(now.Sub(t))
+			seconds += r.seconds
+		}
+		storage.Channels = append(storage.Channels, ret)
+	}
+	sort.Slice(storage.Channels, func(i, j int) bool { return storage.Channels[i].Channel < storage.Channels[j].Channel })
+
+	used := total - remain
+	if used <= 0 || seconds <= 0 {
+		return storage
+	}
+	full := total > 0 && float64(used)*100/float64(total) >= nvrDiskFullPercent
+	rate := 0.0
+	for i := range storage.Channels {
+		c := &storage.Channels[i]
+		r := records[nvrChannel{cameraID: c.CameraID, channel: c.Channel}]
+		span := now.Sub(time.Unix(r.oldest, 0))
+		if c.OldestRecord == nil || span < nvrStorageMinSpan || r.seconds <= 0 {
+			continue
+		}
+		share := float64(used) * float64(r.seconds) / float64(seconds)
+		channelRate := share / span.Hours() * 24
+		rate += channelRate
+		// a full NVR already overwrites, the channels keep what they have
+		retention := c.RecordedDays
+		if !full {
+			retention = math.Round(float64(total)*share/float64(used)/channelRate*10) / 10
+		}
+		c.RetentionDays = &retention
+	}
+	if rate <= 0 {
+		return storage
+	}
+	untilFull := math.Round(float64(remain)/rate*10) / 10
+	if full {
+		untilFull = 0
+	}
+	storage.DaysUntilFull = &untilFull
+	return storage
+}
+
+func roundDays(d time.Duration) float64 {
+	return math.Round(d.Hours()/24*10) / 10
+}
+
+// List returns the storage of the NVRs sorted by SN, with their last estimates.
+func (m *NVRStorageMonitor) List() []NVRStorage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	storages := make(map[string]*NVRStorage)
+	for _, d := range m.disks {
+		s, ok := storages[d.NvrSN]
+		if !ok {
+			s = &NVRStorage{NvrSN: d.NvrSN, Ready: m.ready[d.NvrSN]}
+			if e, ok := m.estimates[d.NvrSN]; ok {
+				s.DaysUntilFull, s.Channels, s.EstimatedAt = e.DaysUntilFull, e.Channels, e.EstimatedAt
+			}
+			storages[d.NvrSN] = s
+		}
+		s.Disks = append(s.Disks, *d)
+	}
+	ret := make([]NVRStorage, 0, len(storages))
+	for _, s := range storages {
+		sort.Slice(s.Disks, func(i, j int) bool { return s.Disks[i].Disk < s.Disks[j].Disk })
+		ret = append(ret, *s)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].NvrSN < ret[j].NvrSN })
+	return ret
+}
+
+// History returns the samples of the disks of an NVR in [start, end], in unix seconds.
+func (m *NVRStorageMonitor) History(sn string, start, end int64) ([]NVRDiskSample, error) {
+	if sn == "" || start > end {
+		return nil, ErrNVRStorageQueryInvalid
+	}
+	var samples []NVRDiskSample
+	err := m.db.GetDBInstance().Where("nvr_sn = ? AND sampled_at >= ? AND sampled_at <= ?", sn, time.Unix(start, 0), time.Unix(end, 0)).
+		Order("sampled_at").Limit(nvrStorageHistoryMaxPoints).Find(&samples).Error
+	if err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+func (m *NVRStorageMonitor) prune() {
+	err := m.db.GetDBInstance().Where("sampled_at < ?", m.now().Add(-nvrStorageHistoryRetention)).Delete(&NVRDiskSample{}).Error
+	if err != nil {
+		m.logger.Warn().Err(err).Msg("failed to prune nvr disk samples")
+	}
+}
+
+// nvrDiskInfos reads the disk infos of the NVRs from the NVRManager, capacities are in MB.
+func (m *NVRStorageMonitor) nvrDiskInfos() map[string]nvrDiskInfos {
+	ret := make(map[string]nvrDiskInfos)
+	for sn, v := range m.device.GetNVRManager().GetAllNvrSDInfos() {
+		info := nvrDiskInfos{ready: v.IsDiskResReady == 1}
+		for i, hdd := range v.LocalHDDList {
+			info.disks = append(info.disks, NVRDisk{
+				Disk:         i,
+				Manufacturer: hdd.Manufacturer,
+				Status:       uint8(hdd.Status),
+				TotalMB:      hdd.TotalCapacity,
+				RemainMB:     hdd.RemainCapacity,
+			})
+		}
+		ret[sn] = info
+	}
+	return ret
+}
+
+// nvrChannels returns the cameras of an NVR sorted by channel.
+func (m *NVRStorageMonitor) nvrChannels(sn string) []nvrChannel {
+	var ret []nvrChannel
+	for _, cam := range m.device.GetCamGroup().AllCameras() {
+		c, ok := cam.(*uniview.BaseUniviewCamera)
+		if !ok || c.GetNvrSN() != sn {
+			continue
+		}
+		ret = append(ret, nvrChannel{cameraID: c.GetID(), channel: c.GetChannel()})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].channel < ret[j].channel })
+	return ret
+}
+
+// nvrChannelRecords searches the recordings of a channel in [begin, end].
+func (m *NVRStorageMonitor) nvrChannelRecords(sn string, channel uint32, begin, end int64) (nvrChannelRecords, error) {
+	records := getRecordsRet{}
+	if err := m.device.GetAllRecords(sn, channel, begin, end, &records); err != nil {
+		return nvrChannelRecords{}, err
+	}
+	ret := nvrChannelRecords{}
+	for _, r := range records.Records {
+		if ret.oldest == 0 || r.Begin < ret.oldest {
+			ret.oldest = r.Begin
+		}
+		if r.End > r.Begin {
+			ret.seconds += r.End - r.Begin
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,129 @@
+package box
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/example/minibox/cloud"
+	"github.com/example/turing-common/log"
+)
+
+func newTestNVRStorageMonitor() *NVRStorageMonitor {
+	return &NVRStorageMonitor{
+		logger:    log.Logger("nvr_storage"),
+		disks:     make(map[nvrDiskKey]*NVRDisk),
+		ready:     make(map[string]bool),
+		estimates: make(map[string]*NVRStorage),
+		now:       time.Now,
+	}
+}
+
+type nvrStorageTestBox struct {
+	Box
+}
+
+func (nvrStorageTestBox) GetBoxId() string { return "box1" }
+
+func TestNVRStorageAlarm(t *testing.T) {
+	m := newTestNVRStorageMonitor()
+	m.device = nvrStorageTestBox{}
+	var raised []*cloud.AlarmInfo
+	m.raise = func(sn string, alarm *cloud.AlarmInfo) {
+		assert.Equal(t, "nvr1", sn)
+		raised = append(raised, alarm)
+	}
+	m.alarm(NVRDisk{NvrSN: "nvr1", Disk: 2, Health: NVRDiskFull})
+	assert.Len(t, raised, 1)
+	assert.Equal(t, "box1", raised[0].BoxId)
+	assert.Equal(t, AlarmTypeNVRDiskFull, raised[0].Detection.Algos)
+	assert.Equal(t, cloud.AlarmMetaData{NvrSN: "nvr1", Disk: 2}, raised[0].Metadata)
+}
+
+func TestNVRDiskHealth(t *testing.T) {
+	assert.Equal(t, NVRDiskHealthy, (&NVRDisk{TotalMB: 1000, RemainMB: 500}).health())
+	assert.Equal(t, NVRDiskFull, (&NVRDisk{TotalMB: 1000, RemainMB: 20}).health())
+	assert.Equal(t, NVRDiskAbnormal, (&NVRDisk{TotalMB: 1000, RemainMB: 20, Status: 2}).health())
+	assert.Equal(t, NVRDiskFailed, (&NVRDisk{Status: 2}).health())
+}
+
+func TestNVRStorageApply(t *testing.T) {
+	now := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	m := newTestNVRStorageMonitor()
+
+	changed, alarms := m.apply(map[string]nvrDiskInfos{
+		"nvr1": {ready: true, disks: []NVRDisk{{Disk: 0, TotalMB: 1000, RemainMB: 500}, {Disk: 1, TotalMB: 1000, RemainMB: 10}}},
+	}, now)
+	assert.Len(t, changed, 2)
+	assert.Len(t, alarms, 1)
+	assert.Equal(t, 1, alarms[0].Disk)
+	assert.Equal(t, NVRDiskFull, alarms[0].Health)
+
+	// a full disk alarms once, the gone disk fails, an offline NVR is left as it is
+	now = now.Add(nvrStoragePollInterval)
+	changed, alarms = m.apply(map[string]nvrDiskInfos{
+		"nvr1": {ready: true, disks: []NVRDisk{{Disk: 1, TotalMB: 1000, RemainMB: 5}}},
+	}, now)
+	assert.Len(t, changed, 2)
+	assert.Len(t, alarms, 1)
+	assert.Equal(t, 0, alarms[0].Disk)
+	assert.Equal(t, NVRDiskFailed, alarms[0].Health)
+
+	now = now.Add(nvrStoragePollInterval)
+	changed, alarms = m.apply(map[string]nvrDiskInfos{}, now)
+	assert.Empty(t, changed)
+	assert.Empty(t, alarms)
+
+	// the disk is replaced
+	changed, alarms = m.apply(map[string]nvrDiskInfos{
+		"nvr1": {ready: true, disks: []NVRDisk{{Disk: 0, TotalMB: 2000, RemainMB: 2000}, {Disk: 1, TotalMB: 1000, RemainMB: 5}}},
+	}, now)
+	assert.Len(t, changed, 2)
+	assert.Empty(t, alarms)
+
+	storages := m.List()
+	assert.Len(t, storages, 1)
+	assert.True(t, storages[0].Ready)
+	assert.Equal(t, NVRDiskHealthy, storages[0].Disks[0].Health)
+	assert.Equal(t, now, storages[0].Disks[0].HealthSince)
+	assert.Equal(t, NVRDiskFull, storages[0].Disks[1].Health)
+}
+
+func TestEstimateNVRRetention(t *testing.T) {
+	now := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	day := int64(24 * time.Hour / time.Second)
+	// channel 2 records on motion, 2 of its 4 days
+	records := map[nvrChannel]nvrChannelRecords{
+		{cameraID: 12, channel: 2}: {oldest: now.Unix() - 4*day, seconds: 2 * day},
+		{cameraID: 11, channel: 1}: {oldest: now.Unix() - 10*day, seconds: 10 * day},
+		{cameraID: 13, channel: 3}: {},
+	}
+
+	// 1000 MB used, channel 1 writes 83.3 MB a day and channel 2 41.7 MB a day
+	disks := []NVRDisk{{TotalMB: 3000, RemainMB: 2500, Health: NVRDiskHealthy}, {TotalMB: 1000, RemainMB: 500, Health: NVRDiskHealthy}}
+	s := estimateNVRRetention(disks, records, now)
+	if assert.NotNil(t, s.DaysUntilFull) {
+		assert.Equal(t, 24.0, *s.DaysUntilFull)
+	}
+	assert.Len(t, s.Channels, 3)
+	assert.Equal(t, uint32(1), s.Channels[0].Channel)
+	assert.Equal(t, 10.0, s.Channels[0].RecordedDays)
+	assert.Equal(t, 40.0, *s.Channels[0].RetentionDays)
+	assert.Equal(t, 4.0, s.Channels[1].RecordedDays)
+	assert.Equal(t, 16.0, *s.Channels[1].RetentionDays)
+	assert.Nil(t, s.Channels[2].OldestRecord)
+	assert.Nil(t, s.Channels[2].RetentionDays)
+
+	// the full NVR overwrites, the channels keep what they recorded
+	disks = []NVRDisk{{TotalMB: 1000, RemainMB: 10, Health: NVRDiskFull}, {TotalMB: 1000, Health: NVRDiskFailed}}
+	s = estimateNVRRetention(disks, records, now)
+	assert.Equal(t, 0.0, *s.DaysUntilFull)
+	assert.Equal(t, 10.0, *s.Channels[0].RetentionDays)
+	assert.Equal(t, 4.0, *s.Channels[1].RetentionDays)
+
+	// too little history
+	s = estimateNVRRetention(disks, map[nvrChannel]nvrChannelRecords{{cameraID: 11, channel: 1}: {oldest: now.Unix() - 3600, seconds: 3600}}, now)
+	assert.Nil(t, s.DaysUntilFull)
+	assert.Nil(t, s.Channels[0].RetentionDays)
+}
@@ -0,0 +1,299 @@
+package box
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/pion/rtp"
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+)
+
+// onvifBackchannelPacketMs is the audio duration of one RTP packet.
+const onvifBackchannelPacketMs = 20
+
+var (
+	ErrOnvifNoBackchannel    = errors.New("camera has no onvif audio backchannel")
+	ErrOnvifBackchannelCodec = errors.New("no supported codec on the onvif audio backchannel")
+)
+
+var onvifBackchannelOnce sync.Once
+var onvifBackchannels *OnvifBackchannels
+
+// onvifBackchannelCodec is the codec negotiated on the backchannel of a camera.
+type onvifBackchannelCodec struct {
+	media       *description.Media
+	payloadType uint8
+	encodeType  string
+	sampleRate  int
+}
+
+// negotiateBackchannelCodec picks the codec to talk with among the formats the camera
+// offers on its backchannels, G.711 mu-law first, as the cloud sends it by default.
+func negotiateBackchannelCodec(medias []*description.Media) (*onvifBackchannelCodec, error) {
+	var found bool
+	var alaw *onvifBackchannelCodec
+	for _, medi := range medias {
+		if !medi.IsBackChannel {
+			continue
+		}
+		found = true
+		for _, forma := range medi.Formats {
+			g711, ok := forma.(*format.G711)
+			if !ok || g711.ChannelCount > 1 {
+				continue
+			}
+			codec := &onvifBackchannelCodec{
+				media:       medi,
+				payloadType: g711.PayloadTyp,
+				encodeType:  AudioEncodeTypeG711A,
+				sampleRate:  g711.SampleRate,
+			}
+			if codec.sampleRate == 0 {
+				codec.sampleRate = 8000
+			}
+			if g711.MULaw {
+				codec.encodeType = AudioEncodeTypeG711U
+				return codec, nil
+			}
+			if alaw == nil {
+				alaw = codec
+			}
+		}
+	}
+	if !found {
+		return nil, ErrOnvifNoBackchannel
+	}
+	if alaw == nil {
+		return nil, ErrOnvifBackchannelCodec
+	}
+	return alaw, nil
+}
+
+// onvifBackchannelUrl adds the credentials to the rtsp url of a camera.
+func onvifBackchannelUrl(streamUri, username, password string) (string, error) {
+	if !strings.HasPrefix(streamUri, "rtsp") {
+		streamUri = "rtsp://" + streamUri
+	}
+	u, err := url.Parse(streamUri)
+	if err != nil {
+		return "", err
+	}
+	if u.User == nil && username != "" {
+		u.User = url.UserPassword(username, password)
+	}
+	return u.String(), nil
+}
+
+// backchannelFfmpegArgs decodes the input to raw mono G.711 on the stdout.
+func backchannelFfmpegArgs(inputUrl string, codec *onvifBackchannelCodec) []string {
+	return []string{
+		"-hide_banner", "-loglevel", "error",
+		"-re", "-i", inputUrl,
+		"-vn", "-ac", "1", "-ar", strconv.Itoa(codec.sampleRate),
+		"-f", codec.encodeType,
+		"pipe:1",
+	}
+}
+
+type onvifBackchannel struct {
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+// OnvifBackchannels talks to cameras through the ONVIF audio backchannel, an RTSP
+// session opened with the "Require: www.onvif.org/ver20/backchannel" header, where the
+// box sends RTP audio to the camera. The input is transcoded by ffmpeg to the negotiated
+// codec.
+type OnvifBackchannels struct {
+	log      zerolog.Logger
+	mux      sync.Mutex
+	sessions map[string]*onvifBackchannel
+
+	open func(rtspUrl string) (*gortsplib.Client, *onvifBackchannelCodec, error)
+}
+
+func GetOnvifBackchannels() *OnvifBackchannels {
+	onvifBackchannelOnce.Do(func() {
+		onvifBackchannels = &OnvifBackchannels{
+			log:      log.Logger("onvif_backchannel"),
+			sessions: make(map[string]*onvifBackchannel),
+			open:     openBackchannel,
+		}
+	})
+	return onvifBackchannels
+}
+
+func (b *OnvifBackchannels) HasStream(streamId string) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	_, ok := b.sessions[streamId]
+	return ok
+}
+
+func (b *OnvifBackchannels) IsStreamStopped(streamId string) bool {
+	b.mux.Lock()
+	s, ok := b.sessions[streamId]
+	b.mux.Unlock()
+	if !ok {
+		return true
+	}
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// Start opens the backchannel of rtspUrl and sends inputUrl to it, it returns the
+// negotiated encode type.
+func (b *OnvifBackchannels) Start(streamId, inputUrl, rtspUrl string) (string, error) {
+	b.mux.Lock()
+	if _, ok := b.sessions[streamId]; ok {
+		b.mux.Unlock()
+		return "", ErrBackwardAudioOngoing
+	}
+	// hold the stream id while connecting.
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &onvifBackchannel{cancel: cancel, stopped: make(chan struct{})}
+	b.sessions[streamId] = s
+	b.mux.Unlock()
+
+	// the session is stopped on every failure, Stop may be waiting for it.
+	fail := func(err error) (string, error) {
+		cancel()
+		close(s.stopped)
+		b.mux.Lock()
+		if b.sessions[streamId] == s {
+			delete(b.sessions, streamId)
+		}
+		b.mux.Unlock()
+		return "", err
+	}
+	c, codec, err := b.open(rtspUrl)
+	if err != nil {
+		return fail(err)
+	}
+	if ctx.Err() != nil {
+		c.Close()
+		return fail(ErrBackwardAudioHasStopped)
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg", backchannelFfmpegArgs(inputUrl, codec)...)
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		c.Close()
+		return fail(err)
+	}
+
+	go func() {
+		defer close(s.stopped)
+		defer c.Close()
+		if err := writeBackchannel(stdout, codec, c.WritePacketRTP); err != nil && ctx.Err() == nil {
+			b.log.Warn().Err(err).Str("stream_id", streamId).Msg("backchannel write failed")
+		}
+		cancel()
+		cmd.Wait()
+		b.log.Info().Str("stream_id", streamId).Msg("backchannel stopped")
+	}()
+	b.log.Info().Str("stream_id", streamId).Msgf("backchannel started with %s/%d", codec.encodeType, codec.sampleRate)
+	return codec.encodeType, nil
+}
+
+func openBackchannel(rtspUrl string) (*gortsplib.Client, *onvifBackchannelCodec, error) {
+	u, err := base.ParseURL(rtspUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	transport := gortsplib.TransportTCP
+	c := &gortsplib.Client{Transport: &transport, RequestBackChannels: true}
+	if err = c.Start(u.Scheme, u.Host); err != nil {
+		return nil, nil, err
+	}
+	desc, _, err := c.Describe(u)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	codec, err := negotiateBackchannelCodec(desc.Medias)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	if _, err = c.Setup(desc.BaseURL, codec.media, 0, 0); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	if _, err = c.Play(nil); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return c, codec, nil
+}
+
+// Stop ends a backchannel session and waits for it to be closed.
+func (b *OnvifBackchannels) Stop(streamId string) error {
+	b.mux.Lock()
+	s, ok := b.sessions[streamId]
+	delete(b.sessions, streamId)
+	b.mux.Unlock()
+	if !ok {
+		return ErrBackwardAudioNotStarted
+	}
+	s.cancel()
+	<-s.stopped
+	return nil
+}
+
+// writeBackchannel packetizes raw G.711 samples in RTP packets of
+// onvifBackchannelPacketMs, one byte being one sample.
+func writeBackchannel(r io.Reader, codec *onvifBackchannelCodec,
+	write func(medi *description.Media, pkt *rtp.Packet) error) error {
+	size := codec.sampleRate * onvifBackchannelPacketMs / 1000
+	buf := make([]byte, size)
+	seq := uint16(rand.Uint32())
+	timestamp := rand.Uint32()
+	ssrc := rand.Uint32()
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			pkt := &rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					PayloadType:    codec.payloadType,
+					SequenceNumber: seq,
+					Timestamp:      timestamp,
+					SSRC:           ssrc,
+				},
+				Payload: append([]byte(nil), buf[:n]...),
+			}
+			if werr := write(codec.media, pkt); werr != nil {
+				return fmt.Errorf("write rtp: %w", werr)
+			}
+			seq++
+			timestamp += uint32(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -2,10 +2,12 @@ package box
 
 import (
 	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/go-playground/validator/v10"
 
 	univiewapi "github.com/example/goshawk/uniview"
-	"github.com/example/minibox/camera/uniview"
-	"github.com/example/minibox/utils"
 	"github.com/example/turing-common/websocket"
 )
 
@@ -35,7 +37,95 @@ var ptzCmdMap = map[string]int{
 	"stop":             univiewapi.PTZStop,
 }
 
-func (h *handler) ptzCtrl(msg websocket.Message) ([]byte, error) {
+const (
+	// the default field of view of a PTZ camera at its widest zoom, in degrees.
+	ptzDefaultHFov = 60
+	ptzDefaultVFov = 34
+	// the default optical zoom ratio of a PTZ camera.
+	ptzDefaultMaxZoom = 20
+)
+
+// ptzView is the state of a camera the moves relative to the video frame depend on.
+type ptzView struct {
+	// Zoom is the current zoom, normalized to [0,1] of the zoom range.
+	Zoom float64
+	// PanDegrees and TiltDegrees are the degrees of a RelativeMove translation of 1.
+	PanDegrees  float64
+	TiltDegrees float64
+	// ZoomSpan is the RelativeMove zoom translation of the whole zoom range.
+	ZoomSpan float64
+}
+
+// defaultPTZView is a camera at its widest zoom, which pans 360 and tilts 180 degrees.
+var defaultPTZView = ptzView{PanDegrees: 180, TiltDegrees: 90, ZoomSpan: 1}
+
+// ptzViewer is implemented by the PTZ drivers which can report their view.
+type ptzViewer interface {
+	View() (ptzView, error)
+}
+
+// getPTZView returns the view of the camera of a driver, or the default one when the
+// driver can not tell.
+func getPTZView(driver PTZDriver) ptzView {
+	v, ok := driver.(ptzViewer)
+	if !ok {
+		return defaultPTZView
+	}
+	view, err := v.View()
+	if err != nil {
+		return defaultPTZView
+	}
+	return view
+}
+
+// zoomedFov narrows the field of view at the widest zoom to the one at a zoom normalized
+// to [0,1], the zoom ratio is linear to the log of the zoom.
+func zoomedFov(fov, zoom, maxZoom float64) float64 {
+	ratio := math.Pow(maxZoom, zoom)
+	return 2 * math.Atan(math.Tan(fov/2*math.Pi/180)/ratio) * 180 / math.Pi
+}
+
+// frameAngle is the angle in degrees between the center of the frame and a point at d,
+// in [-0.5,0.5] of the frame, for a field of view fov.
+func frameAngle(d, fov float64) float64 {
+	return math.Atan(2*d*math.Tan(fov/2*math.Pi/180)) * 180 / math.Pi
+}
+
+// clickToCenterTranslation converts a normalized point of the video frame to the relative
+// pan and tilt that bring it to the center. hFov and vFov are the field of view of the
+// frame in degrees at the widest zoom, narrowed to the current zoom of view.
+func clickToCenterTranslation(x, y, hFov, vFov, maxZoom float64, view ptzView) (pan, tilt float64) {
+	if hFov <= 0 {
+		hFov = ptzDefaultHFov
+	}
+	if vFov <= 0 {
+		vFov = ptzDefaultVFov
+	}
+	if maxZoom <= 1 {
+		maxZoom = ptzDefaultMaxZoom
+	}
+	hFov, vFov = zoomedFov(hFov, view.Zoom, maxZoom), zoomedFov(vFov, view.Zoom, maxZoom)
+	pan = frameAngle(x-0.5, hFov) / view.PanDegrees
+	tilt = frameAngle(0.5-y, vFov) / view.TiltDegrees
+	return pan, tilt
+}
+
+// areaZoomTranslation converts a normalized rectangle of the video frame to the relative
+// move that centers it and zooms until it fills the frame.
+func areaZoomTranslation(x, y, w, h, hFov, vFov, maxZoom float64, view ptzView) (pan, tilt, zoom float64) {
+	if maxZoom <= 1 {
+		maxZoom = ptzDefaultMaxZoom
+	}
+	pan, tilt = clickToCenterTranslation(x+w/2, y+h/2, hFov, vFov, maxZoom, view)
+	size := math.Max(w, h)
+	if size <= 0 || size >= 1 {
+		return pan, tilt, 0
+	}
+	target := math.Min(view.Zoom+math.Log(1/size)/math.Log(maxZoom), 1)
+	return pan, tilt, (target - view.Zoom) * view.ZoomSpan
+}
+
+func (h *handler) ptzCtrl(msg websocket.Message, session wsSession) ([]byte, error) {
 	args, err := json.Marshal(msg.GetArgs())
 	if err != nil {
 		return msg.ReplyMessage(err).Marshal(), nil
@@ -45,27 +135,20 @@ func (h *handler) ptzCtrl(msg websocket.Message) ([]byte, error) {
 	if err := json.Unmarshal(args, &req); err != nil {
 		return msg.ReplyMessage(err).Marshal(), err
 	}
+	req.ptzLockArg = session.ptzLockArg(req.LeaseSecs)
 	cam, err := h.device.GetCamera(req.CameraID)
 	if err != nil {
 		return msg.ReplyMessage(err).Marshal(), err
 	}
-
-	if cam.GetBrand() == utils.Uniview {
-		aiCam, _ := cam.(*uniview.BaseUniviewCamera)
-
-		channel := aiCam.GetChannel()
-		nc, err := h.device.GetNVRManager().GetNVRClientBySN(aiCam.GetNvrSN())
-		if err != nil {
-			return msg.ReplyMessage(err).Marshal(), err
-		}
-		cmd, ok := ptzCmdMap[req.Command]
-		if !ok {
-			cmd = univiewapi.PTZStop
-		}
-		err = nc.PTZCtrl(channel, cmd, req.HSpeed, req.VSpeed)
+	driver, err := h.getPTZDriver(cam)
+	if err != nil {
 		return msg.ReplyMessage(err).Marshal(), err
 	}
-	return nil, err
+	if err = acquirePTZLock(req.CameraID, req.ptzLockArg); err != nil {
+		return msg.ReplyMessage(ptzLockReplyErr(err)).Marshal(), err
+	}
+	err = driver.Move(req.Command, req.HSpeed, req.VSpeed)
+	return msg.ReplyMessage(err).Marshal(), err
 }
 
 func (h *handler) getPTZPresets(msg websocket.Message) ([]byte, error) {
@@ -81,89 +164,312 @@ func (h *handler) getPTZPresets(msg websocket.Message) ([]byte, error) {
 	if err != nil {
 		return msg.ReplyMessage(err).Marshal(), err
 	}
+	driver, err := h.getPTZDriver(cam)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
 
-	if cam.GetBrand() == utils.Uniview {
-		aiCam, _ := cam.(*uniview.BaseUniviewCamera)
+	presets, num, err := driver.GetPresets()
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(getPtzPresetsRet{Num: num, Presets: presets}).Marshal(), nil
+}
 
-		channel := aiCam.GetChannel()
-		nc, err := h.device.GetNVRManager().GetNVRClientBySN(aiCam.GetNvrSN())
-		if err != nil {
-			return msg.ReplyMessage(err).Marshal(), err
-		}
+func (h *handler) setPTZPreset(msg websocket.Message, session wsSession) ([]byte, error) {
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &setPtzPresetReq{}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	req.ptzLockArg = session.ptzLockArg(req.LeaseSecs)
+	cam, err := h.device.GetCamera(req.CameraID)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	driver, err := h.getPTZDriver(cam)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err = acquirePTZLock(req.CameraID, req.ptzLockArg); err != nil {
+		return msg.ReplyMessage(ptzLockReplyErr(err)).Marshal(), err
+	}
 
-		presets, err := nc.GetPTZPresets(channel)
-		if err != nil {
-			return msg.ReplyMessage(err).Marshal(), err
-		}
-		ret := getPtzPresetsRet{Num: presets.Nums}
-		for _, v := range presets.PresetInfos {
-			ret.Presets = append(ret.Presets, ptzPreset{ID: v.ID, Name: v.Name})
-		}
-		return msg.ReplyMessage(ret).Marshal(), nil
+	if err = driver.SetPreset(req.Preset); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
 	}
-	return msg.ReplyMessage(nil).Marshal(), err
+	return msg.ReplyMessage(nil).Marshal(), nil
 }
 
-func (h *handler) setPTZPreset(msg websocket.Message) ([]byte, error) {
+func (h *handler) goToPTZPreset(msg websocket.Message, session wsSession) ([]byte, error) {
 	args, err := json.Marshal(msg.GetArgs())
 	if err != nil {
 		return msg.ReplyMessage(err).Marshal(), nil
 	}
-	req := &setPtzPresetReq{}
+	req := &goToPtzPresetReq{}
 	if err := json.Unmarshal(args, &req); err != nil {
 		return msg.ReplyMessage(err).Marshal(), err
 	}
+	req.ptzLockArg = session.ptzLockArg(req.LeaseSecs)
+	if err = moveToPTZPreset(h.device, req.CameraID, req.PresetID, req.ptzLockArg); err != nil {
+		return msg.ReplyMessage(ptzLockReplyErr(err)).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+// moveToPTZPreset moves a camera to a preset under the PTZ lock of arg.
+func moveToPTZPreset(device Box, cameraId int, presetId uint32, arg ptzLockArg) error {
+	cam, err := device.GetCamera(cameraId)
+	if err != nil {
+		return err
+	}
+	driver, err := newPTZDriver(device, cam)
+	if err != nil {
+		return err
+	}
+	if err = acquirePTZLock(cameraId, arg); err != nil {
+		return err
+	}
+	return driver.GoToPreset(presetId)
+}
+
+// ptzHome goes to, or with set, saves the home position of a camera.
+func (h *handler) ptzHome(msg websocket.Message, session wsSession) ([]byte, error) {
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &ptzHomeReq{}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	req.ptzLockArg = session.ptzLockArg(req.LeaseSecs)
 	cam, err := h.device.GetCamera(req.CameraID)
 	if err != nil {
 		return msg.ReplyMessage(err).Marshal(), err
 	}
+	driver, err := h.getPTZDriver(cam)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err = acquirePTZLock(req.CameraID, req.ptzLockArg); err != nil {
+		return msg.ReplyMessage(ptzLockReplyErr(err)).Marshal(), err
+	}
 
-	if cam.GetBrand() == utils.Uniview {
-		aiCam, _ := cam.(*uniview.BaseUniviewCamera)
-		channel := aiCam.GetChannel()
+	if req.Set {
+		err = driver.SetHome()
+	} else {
+		err = driver.GoToHome()
+	}
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
 
-		nc, err := h.device.GetNVRManager().GetNVRClientBySN(aiCam.GetNvrSN())
-		if err != nil {
-			return msg.ReplyMessage(err).Marshal(), err
-		}
-		preset := univiewapi.PresetInfo{
-			ID:   req.Preset.ID,
-			Name: req.Preset.Name,
-		}
-		err = nc.PutPTZPreset(channel, uint32(req.Preset.ID), &preset)
-		if err != nil {
-			return msg.ReplyMessage(err).Marshal(), err
-		}
+func (h *handler) ptzAbsoluteMove(msg websocket.Message, session wsSession) ([]byte, error) {
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &ptzAbsoluteMoveReq{}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	req.ptzLockArg = session.ptzLockArg(req.LeaseSecs)
+	if err := validator.New().Struct(req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
 	}
-	return msg.ReplyMessage(nil).Marshal(), err
+	cam, err := h.device.GetCamera(req.CameraID)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	driver, err := h.getPTZDriver(cam)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err = acquirePTZLock(req.CameraID, req.ptzLockArg); err != nil {
+		return msg.ReplyMessage(ptzLockReplyErr(err)).Marshal(), err
+	}
+
+	if err = driver.AbsoluteMove(req.Pan, req.Tilt, req.Zoom); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
 }
 
-func (h *handler) goToPTZPreset(msg websocket.Message) ([]byte, error) {
+func (h *handler) ptzRelativeMove(msg websocket.Message, session wsSession) ([]byte, error) {
 	args, err := json.Marshal(msg.GetArgs())
 	if err != nil {
 		return msg.ReplyMessage(err).Marshal(), nil
 	}
-	req := &goToPtzPresetReq{}
+	req := &ptzRelativeMoveReq{}
 	if err := json.Unmarshal(args, &req); err != nil {
 		return msg.ReplyMessage(err).Marshal(), err
 	}
+	req.ptzLockArg = session.ptzLockArg(req.LeaseSecs)
+	if err := validator.New().Struct(req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
 	cam, err := h.device.GetCamera(req.CameraID)
 	if err != nil {
 		return msg.ReplyMessage(err).Marshal(), err
 	}
+	driver, err := h.getPTZDriver(cam)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err = acquirePTZLock(req.CameraID, req.ptzLockArg); err != nil {
+		return msg.ReplyMessage(ptzLockReplyErr(err)).Marshal(), err
+	}
 
-	if cam.GetBrand() == utils.Uniview {
-		aiCam, _ := cam.(*uniview.BaseUniviewCamera)
-		channel := aiCam.GetChannel()
+	if err = driver.RelativeMove(req.Pan, req.Tilt, req.Zoom); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
 
-		nc, err := h.device.GetNVRManager().GetNVRClientBySN(aiCam.GetNvrSN())
-		if err != nil {
-			return msg.ReplyMessage(err).Marshal(), err
-		}
-		err = nc.PutPTZPresetGoTo(channel, req.PresetID)
-		if err != nil {
-			return msg.ReplyMessage(err).Marshal(), err
+// ptzClickToCenter moves the camera so that the clicked point of the video becomes the center.
+func (h *handler) ptzClickToCenter(msg websocket.Message, session wsSession) ([]byte, error) {
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &ptzClickToCenterReq{}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	req.ptzLockArg = session.ptzLockArg(req.LeaseSecs)
+	if err := validator.New().Struct(req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	cam, err := h.device.GetCamera(req.CameraID)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	driver, err := h.getPTZDriver(cam)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err = acquirePTZLock(req.CameraID, req.ptzLockArg); err != nil {
+		return msg.ReplyMessage(ptzLockReplyErr(err)).Marshal(), err
+	}
+
+	pan, tilt := clickToCenterTranslation(req.X, req.Y, req.HFov, req.VFov, req.MaxZoom, getPTZView(driver))
+	if err = driver.RelativeMove(pan, tilt, 0); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+// ptzAreaZoom centers and zooms the camera on a rectangle drawn on the video.
+func (h *handler) ptzAreaZoom(msg websocket.Message, session wsSession) ([]byte, error) {
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &ptzAreaZoomReq{}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	req.ptzLockArg = session.ptzLockArg(req.LeaseSecs)
+	if err := validator.New().Struct(req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if req.X+req.W > 1 || req.Y+req.H > 1 {
+		return msg.ReplyMessage(ErrInvalid).Marshal(), ErrInvalid
+	}
+	cam, err := h.device.GetCamera(req.CameraID)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	driver, err := h.getPTZDriver(cam)
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err = acquirePTZLock(req.CameraID, req.ptzLockArg); err != nil {
+		return msg.ReplyMessage(ptzLockReplyErr(err)).Marshal(), err
+	}
+
+	pan, tilt, zoom := areaZoomTranslation(req.X, req.Y, req.W, req.H, req.HFov, req.VFov, req.MaxZoom, getPTZView(driver))
+	if err = driver.RelativeMove(pan, tilt, zoom); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	return msg.ReplyMessage(nil).Marshal(), nil
+}
+
+// ptzLockArg returns the PTZ lock identity of the user of a session, a session without a
+// user is the default operator. Only the admins outrank the operators, automation is the
+// role of the box itself.
+func (s wsSession) ptzLockArg(leaseSecs int) ptzLockArg {
+	owner := s.UserID
+	if owner == "" {
+		owner = ptzDefaultOwner
+	}
+	role := PTZRoleOperator
+	if s.Role == PTZRoleAdmin {
+		role = PTZRoleAdmin
+	}
+	return ptzLockArg{Owner: owner, Role: role, LeaseSecs: leaseSecs}
+}
+
+// acquirePTZLock takes the PTZ lock of a camera for a user command, and pauses the tour
+// of the camera.
+func acquirePTZLock(cameraId int, arg ptzLockArg) error {
+	err := GetPTZLockManager().Acquire(cameraId, arg.Owner, arg.Role, time.Duration(arg.LeaseSecs)*time.Second)
+	if err != nil {
+		return err
+	}
+	if ptzRole(arg.Role) != PTZRoleAutomation {
+		notifyPTZManualControl(cameraId)
+	}
+	return nil
+}
+
+func ptzLockReplyErr(err error) interface{} {
+	if lockErr, ok := err.(*PTZLockError); ok {
+		return websocket.Err{
+			Code:           -1,
+			DevelopMessage: ptzLockedCode,
+			Message:        lockErr.Error(),
 		}
 	}
-	return msg.ReplyMessage(nil).Marshal(), err
+	return err
+}
+
+// ptzLock takes or renews the PTZ lock of a camera without moving it.
+func (h *handler) ptzLock(msg websocket.Message, session wsSession) ([]byte, error) {
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &ptzLockReq{}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	req.ptzLockArg = session.ptzLockArg(req.LeaseSecs)
+	if _, err := h.device.GetCamera(req.CameraID); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	if err = acquirePTZLock(req.CameraID, req.ptzLockArg); err != nil {
+		return msg.ReplyMessage(ptzLockReplyErr(err)).Marshal(), err
+	}
+	return msg.ReplyMessage(GetPTZLockManager().Holder(req.CameraID)).Marshal(), nil
+}
+
+func (h *handler) ptzUnlock(msg websocket.Message, session wsSession) ([]byte, error) {
+	args, err := json.Marshal(msg.GetArgs())
+	if err != nil {
+		return msg.ReplyMessage(err).Marshal(), nil
+	}
+	req := &ptzLockReq{}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return msg.ReplyMessage(err).Marshal(), err
+	}
+	req.ptzLockArg = session.ptzLockArg(req.LeaseSecs)
+	GetPTZLockManager().Release(req.CameraID, req.Owner)
+	return msg.ReplyMessage(GetPTZLockManager().Holder(req.CameraID)).Marshal(), nil
 }
@@ -0,0 +1,278 @@
+package box
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+
+	univiewapi "github.com/example/goshawk/uniview"
+	"github.com/example/minibox/camera/base"
+	"github.com/example/minibox/camera/uniview"
+	"github.com/example/minibox/utils"
+)
+
+// The LAPI resources of the PTZ of a channel of a Uniview NVR: its absolute position, in
+// degrees and zoom ratio, and the ranges of the camera.
+const (
+	lapiPTZPositionPath     = "/LAPI/V1.0/Channels/%d/PTZ/AbsoluteMove"
+	lapiPTZCapabilitiesPath = "/LAPI/V1.0/Channels/%d/PTZ/Capabilities"
+)
+
+var ErrPTZUnsupported = errors.New("ptz command is not supported by this camera")
+
+// univiewPTZRanges caches the ranges of the channels by NVR SN and channel, they are the
+// configuration of the cameras.
+var univiewPTZRanges = struct {
+	sync.Mutex
+	ranges map[string]lapiPTZRanges
+}{ranges: make(map[string]lapiPTZRanges)}
+
+// PTZDriver drives the pan/tilt/zoom of one camera, whatever its brand is.
+type PTZDriver interface {
+	// Move starts a continuous move of a ptzCmdMap command, "stop" stops it.
+	Move(cmd string, hSpeed, vSpeed int) error
+	// GetPresets returns the presets and their number, as the camera counts them.
+	GetPresets() ([]ptzPreset, int, error)
+	SetPreset(preset ptzPreset) error
+	GoToPreset(presetId uint32) error
+	GoToHome() error
+	SetHome() error
+	// AbsoluteMove moves to a position, pan and tilt are in [-1,1] and zoom in [0,1].
+	AbsoluteMove(pan, tilt, zoom float64) error
+	// RelativeMove moves by a translation in [-1,1], 1 being half the range of an axis.
+	RelativeMove(pan, tilt, zoom float64) error
+}
+
+func (h *handler) getPTZDriver(cam base.Camera) (PTZDriver, error) {
+	return newPTZDriver(h.device, cam)
+}
+
+// newPTZDriver returns the PTZ driver of cam, Uniview, Hikvision and Dahua cameras are
+// driven through their NVR and the other brands through ONVIF.
+func newPTZDriver(device Box, cam base.Camera) (PTZDriver, error) {
+	if cam.GetBrand() == utils.Uniview {
+		aiCam, ok := cam.(*uniview.BaseUniviewCamera)
+		if !ok {
+			return nil, ErrPTZUnsupported
+		}
+		nc, err := device.GetNVRManager().GetNVRClientBySN(aiCam.GetNvrSN())
+		if err != nil {
+			return nil, err
+		}
+		sn := aiCam.GetNvrSN()
+		return &univiewPTZ{nc: nc, sn: sn, channel: aiCam.GetChannel(), lapi: func() (*lapiClient, error) {
+			a, err := managedNVRAccess(device.GetNVRManager(), sn)
+			if err != nil {
+				return nil, err
+			}
+			return newLAPIClient(fmt.Sprintf("http://%s:%d", a.ip, a.port), a.username, a.password), nil
+		}}, nil
+	}
+	if isDriverBrand(cam.GetBrand()) {
+		drv, channel, err := cameraNVRDriver(cam)
+		if err != nil {
+			return nil, err
+		}
+		return drv.PTZ(channel), nil
+	}
+
+	if cam.GetIP() == "" {
+		return nil, ErrPTZUnsupported
+	}
+	return getOnvifPTZ(onvifDeviceService(device, cam.GetIP()), cam.GetUserName(), cameraPassword(cam))
+}
+
+// onvifDeviceService returns the ONVIF device service of the device at ip, at the port
+// the searcher found it on, if it did.
+func onvifDeviceService(device Box, ip string) string {
+	xaddr := fmt.Sprintf("http://%s/onvif/device_service", ip)
+	if searcher := device.GetSearcher(); searcher != nil {
+		if dev := searcher.GetDeviceByHost(ip); dev.Params.Xaddr != "" {
+			ip, port := utils.ParseXAddr(dev.Params.Xaddr)
+			xaddr = fmt.Sprintf("http://%s:%v/onvif/device_service", ip, port)
+		}
+	}
+	return xaddr
+}
+
+// univiewPTZ drives a camera through its Uniview NVR: the continuous moves and the presets
+// with the goshawk client of the NVRManager, the absolute and relative moves with LAPI.
+type univiewPTZ struct {
+	nc      univiewapi.Client
+	sn      string
+	channel uint32
+	lapi    func() (*lapiClient, error)
+}
+
+type lapiPTZPosition struct {
+	PanDegree  float64 `json:"PanDegree"`
+	TiltDegree float64 `json:"TiltDegree"`
+	ZoomRatio  float64 `json:"ZoomRatio"`
+}
+
+// lapiPTZRanges are the ranges of the position of a camera.
+type lapiPTZRanges struct {
+	PanMinDegree  float64 `json:"PanMinDegree"`
+	PanMaxDegree  float64 `json:"PanMaxDegree"`
+	TiltMinDegree float64 `json:"TiltMinDegree"`
+	TiltMaxDegree float64 `json:"TiltMaxDegree"`
+	MaxZoomRatio  float64 `json:"MaxZoomRatio"`
+}
+
+// position converts a position, pan and tilt in [-1,1] and zoom in [0,1], to the degrees
+// and the zoom ratio of the camera. The zoom ratio is exponential to the zoom, as in
+// zoomedFov.
+func (r lapiPTZRanges) position(pan, tilt, zoom float64) lapiPTZPosition {
+	return lapiPTZPosition{
+		PanDegree:  r.PanMinDegree + (pan+1)/2*(r.PanMaxDegree-r.PanMinDegree),
+		TiltDegree: r.TiltMinDegree + (tilt+1)/2*(r.TiltMaxDegree-r.TiltMinDegree),
+		ZoomRatio:  math.Pow(r.MaxZoomRatio, zoom),
+	}
+}
+
+// normalize converts a position of the camera back to the one of position.
+func (r lapiPTZRanges) normalize(p lapiPTZPosition) (pan, tilt, zoom float64) {
+	pan = (p.PanDegree-r.PanMinDegree)/(r.PanMaxDegree-r.PanMinDegree)*2 - 1
+	tilt = (p.TiltDegree-r.TiltMinDegree)/(r.TiltMaxDegree-r.TiltMinDegree)*2 - 1
+	if p.ZoomRatio > 1 {
+		zoom = math.Log(p.ZoomRatio) / math.Log(r.MaxZoomRatio)
+	}
+	return pan, tilt, math.Min(zoom, 1)
+}
+
+// translate moves a position by a translation in [-1,1] of half the ranges. A camera which
+// pans all around wraps its pan, the other axes stop at the end of their range.
+func (r lapiPTZRanges) translate(pan, tilt, zoom, dPan, dTilt, dZoom float64) (float64, float64, float64) {
+	pan += dPan
+	if r.PanMaxDegree-r.PanMinDegree >= 360 {
+		pan = math.Mod(pan+3, 2) - 1
+	}
+	clamp := func(v, min, max float64) float64 {
+		return math.Max(min, math.Min(max, v))
+	}
+	return clamp(pan, -1, 1), clamp(tilt+dTilt, -1, 1), clamp(zoom+dZoom, 0, 1)
+}
+
+func (u *univiewPTZ) Move(cmd string, hSpeed, vSpeed int) error {
+	c, ok := ptzCmdMap[cmd]
+	if !ok {
+		c = univiewapi.PTZStop
+	}
+	return u.nc.PTZCtrl(u.channel, c, hSpeed, vSpeed)
+}
+
+func (u *univiewPTZ) GetPresets() ([]ptzPreset, int, error) {
+	presets, err := u.nc.GetPTZPresets(u.channel)
+	if err != nil {
+		return nil, 0, err
+	}
+	ret := make([]ptzPreset, 0, len(presets.PresetInfos))
+	for _, v := range presets.PresetInfos {
+		ret = append(ret, ptzPreset{ID: v.ID, Name: v.Name})
+	}
+	return ret, presets.Nums, nil
+}
+
+func (u *univiewPTZ) SetPreset(preset ptzPreset) error {
+	return u.nc.PutPTZPreset(u.channel, uint32(preset.ID), &univiewapi.PresetInfo{
+		ID:   preset.ID,
+		Name: preset.Name,
+	})
+}
+
+func (u *univiewPTZ) GoToPreset(presetId uint32) error {
+	return u.nc.PutPTZPresetGoTo(u.channel, presetId)
+}
+
+// GoToHome is not supported, the LAPI of the Uniview NVRs has no home position.
+func (u *univiewPTZ) GoToHome() error {
+	return ErrPTZUnsupported
+}
+
+func (u *univiewPTZ) SetHome() error {
+	return ErrPTZUnsupported
+}
+
+func (u *univiewPTZ) AbsoluteMove(pan, tilt, zoom float64) error {
+	l, err := u.lapi()
+	if err != nil {
+		return err
+	}
+	r, err := u.ranges(l)
+	if err != nil {
+		return err
+	}
+	return l.do(http.MethodPut, fmt.Sprintf(lapiPTZPositionPath, u.channel), r.position(pan, tilt, zoom), nil)
+}
+
+// RelativeMove moves from the current position of the camera, LAPI has no relative move.
+func (u *univiewPTZ) RelativeMove(pan, tilt, zoom float64) error {
+	l, err := u.lapi()
+	if err != nil {
+		return err
+	}
+	r, err := u.ranges(l)
+	if err != nil {
+		return err
+	}
+	var p lapiPTZPosition
+	if err = l.do(http.MethodGet, fmt.Sprintf(lapiPTZPositionPath, u.channel), nil, &p); err != nil {
+		return err
+	}
+	curPan, curTilt, curZoom := r.normalize(p)
+	pan, tilt, zoom = r.translate(curPan, curTilt, curZoom, pan, tilt, zoom)
+	return l.do(http.MethodPut, fmt.Sprintf(lapiPTZPositionPath, u.channel), r.position(pan, tilt, zoom), nil)
+}
+
+// View reads the current zoom, a translation of 1 is half the range of an axis.
+func (u *univiewPTZ) View() (ptzView, error) {
+	l, err := u.lapi()
+	if err != nil {
+		return ptzView{}, err
+	}
+	r, err := u.ranges(l)
+	if err != nil {
+		return ptzView{}, err
+	}
+	var p lapiPTZPosition
+	if err = l.do(http.MethodGet, fmt.Sprintf(lapiPTZPositionPath, u.channel), nil, &p); err != nil {
+		return ptzView{}, err
+	}
+	_, _, zoom := r.normalize(p)
+	return ptzView{
+		Zoom:        zoom,
+		PanDegrees:  (r.PanMaxDegree - r.PanMinDegree) / 2,
+		TiltDegrees: (r.TiltMaxDegree - r.TiltMinDegree) / 2,
+		ZoomSpan:    1,
+	}, nil
+}
+
+// ranges returns the ranges of the camera, read once. The ranges a camera does not report
+// are the ones of defaultPTZView.
+func (u *univiewPTZ) ranges(l *lapiClient) (lapiPTZRanges, error) {
+	key := fmt.Sprintf("%s/%d", u.sn, u.channel)
+	univiewPTZRanges.Lock()
+	r, ok := univiewPTZRanges.ranges[key]
+	univiewPTZRanges.Unlock()
+	if ok {
+		return r, nil
+	}
+	if err := l.do(http.MethodGet, fmt.Sprintf(lapiPTZCapabilitiesPath, u.channel), nil, &r); err != nil {
+		return r, err
+	}
+	if r.PanMaxDegree <= r.PanMinDegree {
+		r.PanMinDegree, r.PanMaxDegree = 0, 2*defaultPTZView.PanDegrees
+	}
+	if r.TiltMaxDegree <= r.TiltMinDegree {
+		r.TiltMinDegree, r.TiltMaxDegree = -defaultPTZView.TiltDegrees, defaultPTZView.TiltDegrees
+	}
+	if r.MaxZoomRatio <= 1 {
+		r.MaxZoomRatio = ptzDefaultMaxZoom
+	}
+	univiewPTZRanges.Lock()
+	univiewPTZRanges.ranges[key] = r
+	univiewPTZRanges.Unlock()
+	return r, nil
+}
@@ -0,0 +1,233 @@
+package box
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+
+	"github.com/example/minibox/db"
+)
+
+const (
+	ptzEventDefaultCooldown = 30 * time.Second
+	ptzEventMaxClipSecs     = 300
+	// the clip is cut from the recording, wait for it to land on the NVR.
+	ptzEventClipDelay = 10 * time.Second
+)
+
+var (
+	ErrPTZEventRuleInvalid  = errors.New("invalid ptz event rule")
+	ErrPTZEventRuleNotFound = errors.New("ptz event rule not found")
+)
+
+var ptzEventLinker *PTZEventLinker
+
+// PTZEventRule moves TargetCameraID to PresetID when a source reports EventType, and
+// optionally records a clip of ClipSecs from the target camera. SourceID is a camera id
+// for camera events, a MAC for Halo events or a door station id for SIP events, empty
+// matches any source. EventType is the cloud event type of camera events, e.g. intrude,
+// the raw Halo event type, e.g. Gunshot, and the event type of a door station.
+type PTZEventRule struct {
+	ID             int64     `json:"id"`
+	Name           string    `json:"name"`
+	SourceType     string    `json:"source_type" gorm:"index"`
+	SourceID       string    `json:"source_id"`
+	EventType      string    `json:"event_type"`
+	TargetCameraID int       `json:"target_camera_id"`
+	PresetID       uint32    `json:"preset_id"`
+	ClipSecs       int       `json:"clip_secs"`
+	CooldownSecs   int       `json:"cooldown_secs"`
+	Enabled        bool      `json:"enabled"`
+	CreatedAt      time.Time `json:"-"`
+	UpdatedAt      time.Time `json:"-"`
+}
+
+func (r *PTZEventRule) validate() error {
+	if !isEventSource(r.SourceType) {
+		return ErrPTZEventRuleInvalid
+	}
+	if r.EventType == "" || r.TargetCameraID < 1 || r.PresetID == 0 {
+		return ErrPTZEventRuleInvalid
+	}
+	if r.ClipSecs < 0 || r.ClipSecs > ptzEventMaxClipSecs || r.CooldownSecs < 0 {
+		return ErrPTZEventRuleInvalid
+	}
+	return nil
+}
+
+func (r *PTZEventRule) match(sourceType, sourceId, eventType string) bool {
+	return r.Enabled && r.SourceType == sourceType &&
+		(r.SourceID == "" || strings.EqualFold(r.SourceID, sourceId)) &&
+		strings.EqualFold(r.EventType, eventType)
+}
+
+func (r *PTZEventRule) cooldown() time.Duration {
+	if r.CooldownSecs == 0 {
+		return ptzEventDefaultCooldown
+	}
+	return time.Duration(r.CooldownSecs) * time.Second
+}
+
+func ptzEventOwner(id int64) string {
+	return fmt.Sprintf("ptz_event:%d", id)
+}
+
+// PTZEventLinker runs the PTZ event rules. A triggered rule takes the PTZ lock as an
+// operator, so it pauses the tours of the target camera but does not take over a user.
+type PTZEventLinker struct {
+	device    Box
+	db        db.Client
+	logger    zerolog.Logger
+	lock      sync.Mutex
+	rules     map[int64]*PTZEventRule
+	triggered map[int64]time.Time
+	now       func() time.Time
+
+	goToPreset func(rule PTZEventRule) error
+	recordClip func(rule PTZEventRule, startedAt time.Time) error
+}
+
+func NewPTZEventLinker(device Box, d db.Client) *PTZEventLinker {
+	l := &PTZEventLinker{
+		device:    device,
+		db:        d,
+		logger:    log.Logger("ptz_event"),
+		rules:     make(map[int64]*PTZEventRule),
+		triggered: make(map[int64]time.Time),
+		now:       time.Now,
+	}
+	l.goToPreset = func(rule PTZEventRule) error {
+		// the box moves the camera itself, an event neither takes the camera from a user
+		// nor pauses its tour.
+		return moveToPTZPreset(device, rule.TargetCameraID, rule.PresetID, ptzLockArg{
+			Owner: ptzEventOwner(rule.ID),
+			Role:  PTZRoleAutomation,
+			// hold the camera on the preset while the clip is recorded.
+			LeaseSecs: rule.ClipSecs,
+		})
+	}
+	l.recordClip = func(rule PTZEventRule, startedAt time.Time) error {
+		return GetRecordVideoProcess(device).Start(RecordVideoArg{
+			TaskId:    fmt.Sprintf("%s:%d", ptzEventOwner(rule.ID), startedAt.Unix()),
+			CameraID:  rule.TargetCameraID,
+			StartedAt: startedAt.Unix(),
+			EndedAt:   startedAt.Unix() + int64(rule.ClipSecs),
+		})
+	}
+	ptzEventLinker = l
+
+	client := d.GetDBInstance()
+	if err := client.AutoMigrate(&PTZEventRule{}); err != nil {
+		l.logger.Error().Err(err).Msg("failed to migrate ptz event rules")
+	}
+	var rules []*PTZEventRule
+	if err := client.Find(&rules).Error; err != nil {
+		l.logger.Error().Err(err).Msg("failed to load ptz event rules")
+		return l
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, r := range rules {
+		l.rules[r.ID] = r
+	}
+	return l
+}
+
+func GetPTZEventLinker() *PTZEventLinker {
+	return ptzEventLinker
+}
+
+// Save creates or updates a rule.
+func (l *PTZEventLinker) Save(r *PTZEventRule) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if r.ID > 0 {
+		if _, ok := l.rules[r.ID]; !ok {
+			return ErrPTZEventRuleNotFound
+		}
+	}
+	if err := l.db.GetDBInstance().Save(r).Error; err != nil {
+		return err
+	}
+	l.rules[r.ID] = r
+	return nil
+}
+
+func (l *PTZEventLinker) Delete(id int64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, ok := l.rules[id]; !ok {
+		return ErrPTZEventRuleNotFound
+	}
+	if err := l.db.GetDBInstance().Where("id = ?", id).Delete(&PTZEventRule{}).Error; err != nil {
+		return err
+	}
+	delete(l.rules, id)
+	delete(l.triggered, id)
+	return nil
+}
+
+// List returns the rules targeting a camera, or all of them when cameraId is 0.
+func (l *PTZEventLinker) List(cameraId int) []PTZEventRule {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ret := make([]PTZEventRule, 0, len(l.rules))
+	for _, r := range l.rules {
+		if cameraId == 0 || r.TargetCameraID == cameraId {
+			ret = append(ret, *r)
+		}
+	}
+	return ret
+}
+
+// Trigger runs the rules matching an event in the background, a rule fires at most once
+// per cooldown.
+func (l *PTZEventLinker) Trigger(sourceType, sourceId, eventType string) {
+	for _, r := range l.match(sourceType, sourceId, eventType) {
+		go l.fire(r)
+	}
+}
+
+func (l *PTZEventLinker) match(sourceType, sourceId, eventType string) []PTZEventRule {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	var ret []PTZEventRule
+	for _, r := range l.rules {
+		if !r.match(sourceType, sourceId, eventType) {
+			continue
+		}
+		if last, ok := l.triggered[r.ID]; ok && now.Sub(last) < r.cooldown() {
+			continue
+		}
+		l.triggered[r.ID] = now
+		ret = append(ret, *r)
+	}
+	return ret
+}
+
+func (l *PTZEventLinker) fire(r PTZEventRule) {
+	startedAt := l.now()
+	logger := l.logger.With().Int64("rule_id", r.ID).Int("camera_id", r.TargetCameraID).Logger()
+	if err := l.goToPreset(r); err != nil {
+		logger.Warn().Err(err).Msgf("failed to go to preset %d", r.PresetID)
+		return
+	}
+	logger.Info().Msgf("%s %s event, went to preset %d", r.SourceType, r.EventType, r.PresetID)
+	if r.ClipSecs == 0 {
+		return
+	}
+	time.Sleep(time.Duration(r.ClipSecs)*time.Second + ptzEventClipDelay)
+	if err := l.recordClip(r, startedAt); err != nil {
+		logger.Warn().Err(err).Msg("failed to record ptz event clip")
+	}
+}
@@ -0,0 +1,77 @@
+package box
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/example/turing-common/log"
+)
+
+func TestPTZEventRuleValidate(t *testing.T) {
+	rule := &PTZEventRule{SourceType: EventSourceHalo, EventType: "Gunshot", TargetCameraID: 1, PresetID: 2}
+	assert.NoError(t, rule.validate())
+
+	for _, r := range []PTZEventRule{
+		{SourceType: "nvr", EventType: "Gunshot", TargetCameraID: 1, PresetID: 2},
+		{SourceType: EventSourceHalo, TargetCameraID: 1, PresetID: 2},
+		{SourceType: EventSourceHalo, EventType: "Gunshot", PresetID: 2},
+		{SourceType: EventSourceHalo, EventType: "Gunshot", TargetCameraID: 1},
+		{SourceType: EventSourceHalo, EventType: "Gunshot", TargetCameraID: 1, PresetID: 2, ClipSecs: 3600},
+	} {
+		assert.Equal(t, ErrPTZEventRuleInvalid, r.validate(), r)
+	}
+}
+
+func TestPTZEventLinkerTrigger(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := &PTZEventLinker{
+		logger:    log.Logger("ptz_event"),
+		rules:     make(map[int64]*PTZEventRule),
+		triggered: make(map[int64]time.Time),
+		now:       func() time.Time { return now },
+	}
+	l.rules[1] = &PTZEventRule{ID: 1, Enabled: true, SourceType: EventSourceCamera, SourceID: "3", EventType: "intrude", TargetCameraID: 7, PresetID: 2}
+	l.rules[2] = &PTZEventRule{ID: 2, Enabled: true, SourceType: EventSourceHalo, EventType: "Gunshot", TargetCameraID: 7, PresetID: 5, CooldownSecs: 5}
+	l.rules[3] = &PTZEventRule{ID: 3, Enabled: false, SourceType: EventSourceHalo, EventType: "Gunshot", TargetCameraID: 8, PresetID: 1}
+
+	assert.Empty(t, l.match(EventSourceCamera, "4", "intrude"))
+	assert.Empty(t, l.match(EventSourceHalo, "3", "intrude"))
+	fired := l.match(EventSourceCamera, "3", "intrude")
+	if assert.Len(t, fired, 1) {
+		assert.Equal(t, uint32(2), fired[0].PresetID)
+	}
+	assert.Len(t, l.match(EventSourceHalo, "00:11:22:33:44:55", "gunshot"), 1)
+
+	// both rules cool down, the halo rule with its own cooldown.
+	now = now.Add(5 * time.Second)
+	assert.Empty(t, l.match(EventSourceCamera, "3", "intrude"))
+	assert.Len(t, l.match(EventSourceHalo, "00:11:22:33:44:55", "Gunshot"), 1)
+	now = now.Add(ptzEventDefaultCooldown)
+	assert.Len(t, l.match(EventSourceCamera, "3", "intrude"), 1)
+}
+
+func TestPTZEventLinkerFire(t *testing.T) {
+	var moved []PTZEventRule
+	var recorded int
+	l := &PTZEventLinker{
+		logger: log.Logger("ptz_event"),
+		now:    time.Now,
+		goToPreset: func(rule PTZEventRule) error {
+			moved = append(moved, rule)
+			return nil
+		},
+		recordClip: func(rule PTZEventRule, startedAt time.Time) error {
+			recorded++
+			return nil
+		},
+	}
+	l.fire(PTZEventRule{ID: 1, TargetCameraID: 7, PresetID: 2})
+	assert.Len(t, moved, 1)
+	assert.Equal(t, 0, recorded)
+
+	l.goToPreset = func(rule PTZEventRule) error { return &PTZLockError{} }
+	l.fire(PTZEventRule{ID: 1, TargetCameraID: 7, PresetID: 2, ClipSecs: 10})
+	assert.Equal(t, 0, recorded)
+}
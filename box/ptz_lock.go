@@ -0,0 +1,129 @@
+package box
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	PTZRoleAdmin      = "admin"
+	PTZRoleOperator   = "operator"
+	PTZRoleAutomation = "automation"
+
+	ptzLockDefaultLease = 30 * time.Second
+	ptzLockMaxLease     = 10 * time.Minute
+	ptzLockedCode       = "ptz_locked"
+	// ptzDefaultOwner is the owner of the commands of a session without a user.
+	ptzDefaultOwner = "operator"
+)
+
+var ErrPTZNoOwner = errors.New("ptz command without an authenticated user")
+
+var ptzRolePriority = map[string]int{
+	PTZRoleAutomation: 1,
+	PTZRoleOperator:   2,
+	PTZRoleAdmin:      3,
+}
+
+var ptzLockOnce sync.Once
+var ptzLockManager *PTZLockManager
+
+type ptzLockHolder struct {
+	CameraID  int    `json:"camera_id"`
+	Owner     string `json:"owner"`
+	Role      string `json:"role"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// PTZLockError rejects a PTZ command of a camera locked by another owner.
+type PTZLockError struct {
+	Holder ptzLockHolder
+}
+
+func (e *PTZLockError) Error() string {
+	return fmt.Sprintf("ptz of camera %d is locked by %s (%s) until %s", e.Holder.CameraID,
+		e.Holder.Owner, e.Holder.Role, time.Unix(e.Holder.ExpiresAt, 0).Format(time.RFC3339))
+}
+
+// PTZLockManager arbitrates the PTZ control of the cameras. A lock is held by one owner
+// for a lease, renewed by every command of the owner. A higher role takes the lock over,
+// admin > operator > automation.
+type PTZLockManager struct {
+	mux   sync.Mutex
+	locks map[int]*ptzLockHolder
+	now   func() time.Time
+}
+
+func GetPTZLockManager() *PTZLockManager {
+	ptzLockOnce.Do(func() {
+		ptzLockManager = newPTZLockManager()
+	})
+	return ptzLockManager
+}
+
+func newPTZLockManager() *PTZLockManager {
+	return &PTZLockManager{
+		locks: make(map[int]*ptzLockHolder),
+		now:   time.Now,
+	}
+}
+
+// ptzRole returns the known role of role, commands without role are from operators.
+func ptzRole(role string) string {
+	if _, ok := ptzRolePriority[role]; ok {
+		return role
+	}
+	return PTZRoleOperator
+}
+
+// Acquire takes or renews the lock of a camera, it returns a *PTZLockError when the lock
+// is held by another owner of the same or a higher role.
+func (m *PTZLockManager) Acquire(cameraId int, owner, role string, lease time.Duration) error {
+	if owner == "" {
+		return ErrPTZNoOwner
+	}
+	role = ptzRole(role)
+	if lease <= 0 {
+		lease = ptzLockDefaultLease
+	}
+	if lease > ptzLockMaxLease {
+		lease = ptzLockMaxLease
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	now := m.now()
+	if h, ok := m.locks[cameraId]; ok && h.Owner != owner && now.Unix() < h.ExpiresAt &&
+		ptzRolePriority[role] <= ptzRolePriority[h.Role] {
+		return &PTZLockError{Holder: *h}
+	}
+	m.locks[cameraId] = &ptzLockHolder{
+		CameraID:  cameraId,
+		Owner:     owner,
+		Role:      role,
+		ExpiresAt: now.Add(lease).Unix(),
+	}
+	return nil
+}
+
+// Release drops the lock of a camera if owner holds it.
+func (m *PTZLockManager) Release(cameraId int, owner string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if h, ok := m.locks[cameraId]; ok && h.Owner == owner {
+		delete(m.locks, cameraId)
+	}
+}
+
+// Holder returns the current holder of the lock of a camera, or nil.
+func (m *PTZLockManager) Holder(cameraId int) *ptzLockHolder {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	h, ok := m.locks[cameraId]
+	if !ok || m.now().Unix() >= h.ExpiresAt {
+		return nil
+	}
+	ret := *h
+	return &ret
+}
@@ -0,0 +1,57 @@
+package box
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPTZLockManager(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	m := newPTZLockManager()
+	m.now = func() time.Time { return now }
+
+	assert.NoError(t, m.Acquire(1, "tour", PTZRoleAutomation, time.Minute))
+	// a user takes over the automation.
+	assert.NoError(t, m.Acquire(1, "alice", PTZRoleOperator, 0))
+	assert.Equal(t, "alice", m.Holder(1).Owner)
+
+	err := m.Acquire(1, "tour", PTZRoleAutomation, time.Minute)
+	assert.IsType(t, &PTZLockError{}, err)
+	err = m.Acquire(1, "bob", "", 0)
+	if assert.IsType(t, &PTZLockError{}, err) {
+		assert.Equal(t, ptzLockHolder{CameraID: 1, Owner: "alice", Role: PTZRoleOperator, ExpiresAt: now.Add(ptzLockDefaultLease).Unix()},
+			err.(*PTZLockError).Holder)
+		assert.Contains(t, err.Error(), "locked by alice (operator)")
+	}
+
+	// admins win, and the lock is free again once the lease expires.
+	assert.NoError(t, m.Acquire(1, "root", PTZRoleAdmin, 10*time.Second))
+	assert.Error(t, m.Acquire(1, "alice", PTZRoleOperator, 0))
+	now = now.Add(10 * time.Second)
+	assert.Nil(t, m.Holder(1))
+	assert.NoError(t, m.Acquire(1, "alice", PTZRoleOperator, 0))
+
+	m.Release(1, "bob")
+	assert.NotNil(t, m.Holder(1))
+	m.Release(1, "alice")
+	assert.Nil(t, m.Holder(1))
+
+	// other cameras are independent.
+	assert.NoError(t, m.Acquire(2, "bob", PTZRoleOperator, 0))
+	assert.NoError(t, m.Acquire(3, "alice", PTZRoleOperator, 0))
+}
+
+func TestPTZLockSession(t *testing.T) {
+	// a session without a user is the default operator.
+	assert.Equal(t, ptzLockArg{Owner: ptzDefaultOwner, Role: PTZRoleOperator}, wsSession{}.ptzLockArg(0))
+	assert.Equal(t, ErrPTZNoOwner, newPTZLockManager().Acquire(1, "", PTZRoleOperator, 0))
+
+	arg := wsSession{UserID: "root", Role: "admin"}.ptzLockArg(30)
+	assert.Equal(t, ptzLockArg{Owner: "root", Role: PTZRoleAdmin, LeaseSecs: 30}, arg)
+
+	// a transport can not hand the automation role to a user.
+	arg = wsSession{UserID: "tour", Role: "automation"}.ptzLockArg(0)
+	assert.Equal(t, PTZRoleOperator, arg.Role)
+}
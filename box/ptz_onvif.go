@@ -0,0 +1,441 @@
+package box
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	onvifRequestTimeout = 5 * time.Second
+	// onvifPTZIdle evicts the cached drivers of the cameras no longer driven.
+	onvifPTZIdle = time.Hour
+	// ptzMaxSpeed is the max h_speed/v_speed of ptz_ctrl, as Uniview's.
+	ptzMaxSpeed = 9
+
+	onvifEnvelope = `<?xml version="1.0" encoding="UTF-8"?>` +
+		`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"` +
+		` xmlns:tds="http://www.onvif.org/ver10/device/wsdl"` +
+		` xmlns:trt="http://www.onvif.org/ver10/media/wsdl"` +
+		` xmlns:tptz="http://www.onvif.org/ver20/ptz/wsdl"` +
+		` xmlns:tt="http://www.onvif.org/ver10/schema">` +
+		`<s:Header>%s</s:Header><s:Body>%s</s:Body></s:Envelope>`
+	onvifSecurity = `<Security s:mustUnderstand="1" xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd">` +
+		`<UsernameToken><Username>%s</Username>` +
+		`<Password Type="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordDigest">%s</Password>` +
+		`<Nonce EncodingType="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary">%s</Nonce>` +
+		`<Created xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd">%s</Created>` +
+		`</UsernameToken></Security>`
+)
+
+var (
+	ErrOnvifNoPTZ        = errors.New("camera has no onvif ptz profile")
+	ErrPTZPresetNotFound = errors.New("ptz preset not found")
+)
+
+// onvifPTZVectors are the pan, tilt and zoom directions of the ptzCmdMap commands.
+var onvifPTZVectors = map[string][3]float64{
+	"turn_left":        {-1, 0, 0},
+	"turn_right":       {1, 0, 0},
+	"turn_upper":       {0, 1, 0},
+	"turn_lower":       {0, -1, 0},
+	"turn_left_upper":  {-1, 1, 0},
+	"turn_left_lower":  {-1, -1, 0},
+	"turn_right_upper": {1, 1, 0},
+	"turn_right_lower": {1, -1, 0},
+	"zoom_in":          {0, 0, 1},
+	"zoom_out":         {0, 0, -1},
+}
+
+// onvifPTZCache holds the drivers by device service and username.
+var onvifPTZCache = struct {
+	sync.Mutex
+	clients map[string]*onvifPTZ
+}{clients: make(map[string]*onvifPTZ)}
+
+// onvifPTZ drives a camera through the ONVIF PTZ service of its first PTZ profile.
+type onvifPTZ struct {
+	client   *http.Client
+	username string
+	password string
+	ptzUrl   string
+	profile  string
+	usedAt   time.Time
+
+	lock  sync.Mutex
+	nodes *onvifPTZNodes
+}
+
+type onvifFault struct {
+	Reason string `xml:"Body>Fault>Reason>Text"`
+	Detail string `xml:"Body>Fault>Code>Subcode>Value"`
+}
+
+// getOnvifPTZ returns the cached driver of a device service, the PTZ service address and
+// the profile token are looked up once, out of the cache lock. A driver is looked up again
+// when the password of the camera changed.
+func getOnvifPTZ(xaddr, username, password string) (*onvifPTZ, error) {
+	key := xaddr + "@" + username
+	now := time.Now()
+	onvifPTZCache.Lock()
+	for k, c := range onvifPTZCache.clients {
+		if now.Sub(c.usedAt) > onvifPTZIdle {
+			delete(onvifPTZCache.clients, k)
+		}
+	}
+	if c, ok := onvifPTZCache.clients[key]; ok && c.password == password {
+		c.usedAt = now
+		onvifPTZCache.Unlock()
+		return c, nil
+	}
+	onvifPTZCache.Unlock()
+
+	c := &onvifPTZ{
+		client:   &http.Client{Timeout: onvifRequestTimeout},
+		username: username,
+		password: password,
+		usedAt:   now,
+	}
+	if err := c.init(xaddr); err != nil {
+		return nil, err
+	}
+	onvifPTZCache.Lock()
+	defer onvifPTZCache.Unlock()
+	if cached, ok := onvifPTZCache.clients[key]; ok && cached.password == password {
+		return cached, nil
+	}
+	onvifPTZCache.clients[key] = c
+	return c, nil
+}
+
+func (o *onvifPTZ) init(xaddr string) error {
+	var caps struct {
+		Media string `xml:"Body>GetCapabilitiesResponse>Capabilities>Media>XAddr"`
+		PTZ   string `xml:"Body>GetCapabilitiesResponse>Capabilities>PTZ>XAddr"`
+	}
+	err := o.call(xaddr, `<tds:GetCapabilities><tds:Category>All</tds:Category></tds:GetCapabilities>`, &caps)
+	if err != nil {
+		return err
+	}
+	if caps.PTZ == "" || caps.Media == "" {
+		return ErrOnvifNoPTZ
+	}
+
+	var profiles struct {
+		Profiles []struct {
+			Token string    `xml:"token,attr"`
+			PTZ   *struct{} `xml:"PTZConfiguration"`
+		} `xml:"Body>GetProfilesResponse>Profiles"`
+	}
+	if err = o.call(caps.Media, `<trt:GetProfiles/>`, &profiles); err != nil {
+		return err
+	}
+	for _, p := range profiles.Profiles {
+		if p.PTZ != nil {
+			o.ptzUrl = caps.PTZ
+			o.profile = p.Token
+			return nil
+		}
+	}
+	return ErrOnvifNoPTZ
+}
+
+func (o *onvifPTZ) Move(cmd string, hSpeed, vSpeed int) error {
+	if cmd == "stop" {
+		return o.stop()
+	}
+	v, ok := onvifPTZVectors[cmd]
+	if !ok {
+		return ErrPTZUnsupported
+	}
+	hs, vs := onvifSpeed(hSpeed), onvifSpeed(vSpeed)
+	body := fmt.Sprintf(`<tptz:ContinuousMove><tptz:ProfileToken>%s</tptz:ProfileToken><tptz:Velocity>`+
+		`<tt:PanTilt x="%s" y="%s"/><tt:Zoom x="%s"/></tptz:Velocity></tptz:ContinuousMove>`,
+		xmlEscape(o.profile), onvifFloat(v[0]*hs), onvifFloat(v[1]*vs), onvifFloat(v[2]*hs))
+	return o.call(o.ptzUrl, body, nil)
+}
+
+func (o *onvifPTZ) stop() error {
+	body := fmt.Sprintf(`<tptz:Stop><tptz:ProfileToken>%s</tptz:ProfileToken>`+
+		`<tptz:PanTilt>true</tptz:PanTilt><tptz:Zoom>true</tptz:Zoom></tptz:Stop>`, xmlEscape(o.profile))
+	return o.call(o.ptzUrl, body, nil)
+}
+
+// GetPresets maps the ONVIF preset tokens to ids, numeric tokens are kept as they are
+// and the others are numbered by their position.
+func (o *onvifPTZ) GetPresets() ([]ptzPreset, int, error) {
+	presets, err := o.presets()
+	if err != nil {
+		return nil, 0, err
+	}
+	ret := make([]ptzPreset, 0, len(presets))
+	for i, p := range presets {
+		ret = append(ret, ptzPreset{ID: onvifPresetId(p.Token, i), Name: p.Name})
+	}
+	return ret, len(ret), nil
+}
+
+func (o *onvifPTZ) SetPreset(preset ptzPreset) error {
+	token, err := o.presetToken(uint32(preset.ID))
+	if err != nil && err != ErrPTZPresetNotFound {
+		return err
+	}
+	body := fmt.Sprintf(`<tptz:SetPreset><tptz:ProfileToken>%s</tptz:ProfileToken><tptz:PresetName>%s</tptz:PresetName>`,
+		xmlEscape(o.profile), xmlEscape(preset.Name))
+	// without a token the camera creates a new preset.
+	if token != "" {
+		body += fmt.Sprintf(`<tptz:PresetToken>%s</tptz:PresetToken>`, xmlEscape(token))
+	}
+	return o.call(o.ptzUrl, body+`</tptz:SetPreset>`, nil)
+}
+
+func (o *onvifPTZ) GoToPreset(presetId uint32) error {
+	token, err := o.presetToken(presetId)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf(`<tptz:GotoPreset><tptz:ProfileToken>%s</tptz:ProfileToken><tptz:PresetToken>%s</tptz:PresetToken></tptz:GotoPreset>`,
+		xmlEscape(o.profile), xmlEscape(token))
+	return o.call(o.ptzUrl, body, nil)
+}
+
+func (o *onvifPTZ) GoToHome() error {
+	body := fmt.Sprintf(`<tptz:GotoHomePosition><tptz:ProfileToken>%s</tptz:ProfileToken></tptz:GotoHomePosition>`, xmlEscape(o.profile))
+	return o.call(o.ptzUrl, body, nil)
+}
+
+func (o *onvifPTZ) SetHome() error {
+	body := fmt.Sprintf(`<tptz:SetHomePosition><tptz:ProfileToken>%s</tptz:ProfileToken></tptz:SetHomePosition>`, xmlEscape(o.profile))
+	return o.call(o.ptzUrl, body, nil)
+}
+
+func (o *onvifPTZ) AbsoluteMove(pan, tilt, zoom float64) error {
+	body := fmt.Sprintf(`<tptz:AbsoluteMove><tptz:ProfileToken>%s</tptz:ProfileToken><tptz:Position>`+
+		`<tt:PanTilt x="%s" y="%s"/><tt:Zoom x="%s"/></tptz:Position></tptz:AbsoluteMove>`,
+		xmlEscape(o.profile), onvifFloat(pan), onvifFloat(tilt), onvifFloat(zoom))
+	return o.call(o.ptzUrl, body, nil)
+}
+
+func (o *onvifPTZ) RelativeMove(pan, tilt, zoom float64) error {
+	body := fmt.Sprintf(`<tptz:RelativeMove><tptz:ProfileToken>%s</tptz:ProfileToken><tptz:Translation>`+
+		`<tt:PanTilt x="%s" y="%s"/><tt:Zoom x="%s"/></tptz:Translation></tptz:RelativeMove>`,
+		xmlEscape(o.profile), onvifFloat(pan), onvifFloat(tilt), onvifFloat(zoom))
+	return o.call(o.ptzUrl, body, nil)
+}
+
+// onvifPTZSpace is a coordinate space of a PTZ node.
+type onvifPTZSpace struct {
+	URI  string  `xml:"URI"`
+	XMin float64 `xml:"XRange>Min"`
+	XMax float64 `xml:"XRange>Max"`
+	YMin float64 `xml:"YRange>Min"`
+	YMax float64 `xml:"YRange>Max"`
+}
+
+type onvifPTZNodes struct {
+	PanTilt []onvifPTZSpace `xml:"Body>GetNodesResponse>PTZNode>SupportedPTZSpaces>AbsolutePanTiltPositionSpace"`
+	Zoom    []onvifPTZSpace `xml:"Body>GetNodesResponse>PTZNode>SupportedPTZSpaces>AbsoluteZoomPositionSpace"`
+}
+
+// getNodes returns the spaces of the PTZ node, read once with GetNodes as they are the
+// configuration of the camera.
+func (o *onvifPTZ) getNodes() (*onvifPTZNodes, error) {
+	o.lock.Lock()
+	nodes := o.nodes
+	o.lock.Unlock()
+	if nodes != nil {
+		return nodes, nil
+	}
+	nodes = &onvifPTZNodes{}
+	if err := o.call(o.ptzUrl, `<tptz:GetNodes/>`, nodes); err != nil {
+		return nil, err
+	}
+	o.lock.Lock()
+	o.nodes = nodes
+	o.lock.Unlock()
+	return nodes, nil
+}
+
+// View reads the current zoom with GetStatus and the spaces of the node. The relative
+// moves are in the generic spaces, a translation of 1 is the degrees of the spherical space
+// over the width of the generic one, when the node has both.
+func (o *onvifPTZ) View() (ptzView, error) {
+	nodes, err := o.getNodes()
+	if err != nil {
+		return ptzView{}, err
+	}
+	var status struct {
+		Zoom *struct {
+			X float64 `xml:"x,attr"`
+		} `xml:"Body>GetStatusResponse>PTZStatus>Position>Zoom"`
+	}
+	body := fmt.Sprintf(`<tptz:GetStatus><tptz:ProfileToken>%s</tptz:ProfileToken></tptz:GetStatus>`, xmlEscape(o.profile))
+	if err := o.call(o.ptzUrl, body, &status); err != nil {
+		return ptzView{}, err
+	}
+
+	view := defaultPTZView
+	var generic, degrees *onvifPTZSpace
+	for i, space := range nodes.PanTilt {
+		switch {
+		case strings.HasSuffix(space.URI, "PositionGenericSpace"):
+			generic = &nodes.PanTilt[i]
+		case strings.HasSuffix(space.URI, "SphericalPositionSpaceDegrees"):
+			degrees = &nodes.PanTilt[i]
+		}
+	}
+	if generic != nil && degrees != nil {
+		if generic.XMax > generic.XMin && degrees.XMax > degrees.XMin {
+			view.PanDegrees = (degrees.XMax - degrees.XMin) / (generic.XMax - generic.XMin)
+		}
+		if generic.YMax > generic.YMin && degrees.YMax > degrees.YMin {
+			view.TiltDegrees = (degrees.YMax - degrees.YMin) / (generic.YMax - generic.YMin)
+		}
+	}
+	for _, space := range nodes.Zoom {
+		if !strings.HasSuffix(space.URI, "PositionGenericSpace") || space.XMax <= space.XMin {
+			continue
+		}
+		view.ZoomSpan = space.XMax - space.XMin
+		if status.Zoom != nil {
+			view.Zoom = math.Max(0, math.Min(1, (status.Zoom.X-space.XMin)/view.ZoomSpan))
+		}
+	}
+	return view, nil
+}
+
+type onvifPreset struct {
+	Token string `xml:"token,attr"`
+	Name  string `xml:"Name"`
+}
+
+func (o *onvifPTZ) presets() ([]onvifPreset, error) {
+	var resp struct {
+		Presets []onvifPreset `xml:"Body>GetPresetsResponse>Preset"`
+	}
+	body := fmt.Sprintf(`<tptz:GetPresets><tptz:ProfileToken>%s</tptz:ProfileToken></tptz:GetPresets>`, xmlEscape(o.profile))
+	if err := o.call(o.ptzUrl, body, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Presets, nil
+}
+
+// presetToken returns the token of a preset id of GetPresets.
+func (o *onvifPTZ) presetToken(presetId uint32) (string, error) {
+	presets, err := o.presets()
+	if err != nil {
+		return "", err
+	}
+	for i, p := range presets {
+		if onvifPresetId(p.Token, i) == int(presetId) {
+			return p.Token, nil
+		}
+	}
+	return "", ErrPTZPresetNotFound
+}
+
+func onvifPresetId(token string, index int) int {
+	if id, err := strconv.Atoi(token); err == nil && id > 0 {
+		return id
+	}
+	return index + 1
+}
+
+// onvifSpeed normalizes a ptz_ctrl speed to the ONVIF generic velocity space.
+func onvifSpeed(speed int) float64 {
+	if speed <= 0 {
+		return 0.5
+	}
+	if speed > ptzMaxSpeed {
+		speed = ptzMaxSpeed
+	}
+	return float64(speed) / ptzMaxSpeed
+}
+
+func onvifFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', 4, 64)
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// onvifHeader returns the SOAP header of a request, with a new UsernameToken when there is
+// a username.
+func onvifHeader(username, password string) (string, error) {
+	if username == "" {
+		return "", nil
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return onvifSecurityHeader(username, password, nonce, time.Now()), nil
+}
+
+// onvifSecurityHeader builds a WS-Security UsernameToken with a password digest.
+func onvifSecurityHeader(username, password string, nonce []byte, created time.Time) string {
+	ts := created.UTC().Format(time.RFC3339)
+	h := sha1.New()
+	h.Write(nonce)
+	h.Write([]byte(ts))
+	h.Write([]byte(password))
+	digest := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	return fmt.Sprintf(onvifSecurity, xmlEscape(username), digest, base64.StdEncoding.EncodeToString(nonce), ts)
+}
+
+func (o *onvifPTZ) call(url, body string, resp interface{}) error {
+	return onvifCall(o.client, o.username, o.password, url, body, resp)
+}
+
+// onvifCall posts a SOAP request and decodes the response envelope into resp.
+func onvifCall(client *http.Client, username, password, url, body string, resp interface{}) error {
+	header, err := onvifHeader(username, password)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(fmt.Sprintf(onvifEnvelope, header, body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml; charset=utf-8")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	return onvifResponse(res, resp)
+}
+
+// onvifResponse decodes the envelope of a SOAP response into resp, a fault is returned as
+// an error.
+func onvifResponse(res *http.Response, resp interface{}) error {
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		var fault onvifFault
+		if xml.Unmarshal(data, &fault) == nil && fault.Reason != "" {
+			return fmt.Errorf("onvif fault: %s %s", fault.Reason, fault.Detail)
+		}
+		return fmt.Errorf("onvif request failed with status %d", res.StatusCode)
+	}
+	if resp == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, resp)
+}
@@ -0,0 +1,129 @@
+package box
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newOnvifTestServer(t *testing.T, requests *[]string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		body := string(data)
+		assert.Contains(t, body, "<UsernameToken><Username>admin</Username>")
+		*requests = append(*requests, body)
+
+		var resp string
+		switch {
+		case strings.Contains(body, "GetCapabilities"):
+			resp = fmt.Sprintf(`<tds:GetCapabilitiesResponse><tds:Capabilities>`+
+				`<tt:Media><tt:XAddr>%s/onvif/media</tt:XAddr></tt:Media>`+
+				`<tt:PTZ><tt:XAddr>%s/onvif/ptz</tt:XAddr></tt:PTZ>`+
+				`</tds:Capabilities></tds:GetCapabilitiesResponse>`, server.URL, server.URL)
+		case strings.Contains(body, "GetProfiles"):
+			resp = `<trt:GetProfilesResponse>` +
+				`<trt:Profiles token="audio"><tt:Name>audio</tt:Name></trt:Profiles>` +
+				`<trt:Profiles token="main"><tt:Name>main</tt:Name><tt:PTZConfiguration token="ptz"/></trt:Profiles>` +
+				`</trt:GetProfilesResponse>`
+		case strings.Contains(body, "GetPresets"):
+			resp = `<tptz:GetPresetsResponse>` +
+				`<tptz:Preset token="7"><tt:Name>gate</tt:Name></tptz:Preset>` +
+				`<tptz:Preset token="door"><tt:Name>door</tt:Name></tptz:Preset>` +
+				`</tptz:GetPresetsResponse>`
+		case strings.Contains(body, "GetNodes"):
+			resp = `<tptz:GetNodesResponse><tptz:PTZNode token="node"><tt:SupportedPTZSpaces>` +
+				`<tt:AbsolutePanTiltPositionSpace><tt:URI>http://www.onvif.org/ver10/tptz/PanTiltSpaces/PositionGenericSpace</tt:URI>` +
+				`<tt:XRange><tt:Min>-1</tt:Min><tt:Max>1</tt:Max></tt:XRange><tt:YRange><tt:Min>-1</tt:Min><tt:Max>1</tt:Max></tt:YRange></tt:AbsolutePanTiltPositionSpace>` +
+				`<tt:AbsolutePanTiltPositionSpace><tt:URI>http://www.onvif.org/ver10/tptz/PanTiltSpaces/SphericalPositionSpaceDegrees</tt:URI>` +
+				`<tt:XRange><tt:Min>0</tt:Min><tt:Max>350</tt:Max></tt:XRange><tt:YRange><tt:Min>-90</tt:Min><tt:Max>0</tt:Max></tt:YRange></tt:AbsolutePanTiltPositionSpace>` +
+				`<tt:AbsoluteZoomPositionSpace><tt:URI>http://www.onvif.org/ver10/tptz/ZoomSpaces/PositionGenericSpace</tt:URI>` +
+				`<tt:XRange><tt:Min>0</tt:Min><tt:Max>1</tt:Max></tt:XRange></tt:AbsoluteZoomPositionSpace>` +
+				`</tt:SupportedPTZSpaces></tptz:PTZNode></tptz:GetNodesResponse>`
+		case strings.Contains(body, "GetStatus"):
+			resp = `<tptz:GetStatusResponse><tptz:PTZStatus><tt:Position>` +
+				`<tt:PanTilt x="0.2" y="-0.1"/><tt:Zoom x="0.25"/></tt:Position></tptz:PTZStatus></tptz:GetStatusResponse>`
+		case strings.Contains(body, "GotoHomePosition"):
+			w.WriteHeader(http.StatusInternalServerError)
+			resp = `<s:Fault><s:Code><s:Value>s:Receiver</s:Value><s:Subcode><s:Value>ter:NoHomePosition</s:Value></s:Subcode></s:Code>` +
+				`<s:Reason><s:Text>no home position</s:Text></s:Reason></s:Fault>`
+		}
+		fmt.Fprintf(w, `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body>%s</s:Body></s:Envelope>`, resp)
+	}))
+	return server
+}
+
+func TestOnvifPTZ(t *testing.T) {
+	var requests []string
+	server := newOnvifTestServer(t, &requests)
+	defer server.Close()
+
+	driver, err := getOnvifPTZ(server.URL+"/onvif/device_service", "admin", "123456")
+	assert.NoError(t, err)
+	assert.Equal(t, "main", driver.profile)
+	assert.Equal(t, server.URL+"/onvif/ptz", driver.ptzUrl)
+
+	cached, err := getOnvifPTZ(server.URL+"/onvif/device_service", "admin", "123456")
+	assert.NoError(t, err)
+	assert.True(t, driver == cached)
+	assert.Contains(t, onvifPTZCache.clients, server.URL+"/onvif/device_service@admin")
+	changed, err := getOnvifPTZ(server.URL+"/onvif/device_service", "admin", "654321")
+	assert.NoError(t, err)
+	assert.False(t, driver == changed)
+	assert.True(t, changed == onvifPTZCache.clients[server.URL+"/onvif/device_service@admin"])
+
+	requests = nil
+	view, err := driver.View()
+	assert.NoError(t, err)
+	assert.Equal(t, ptzView{Zoom: 0.25, PanDegrees: 175, TiltDegrees: 45, ZoomSpan: 1}, view)
+	assert.Equal(t, view, getPTZView(driver))
+	// the nodes are read once, the status on every view
+	assert.Len(t, requests, 3)
+	assert.Contains(t, requests[0], "GetNodes")
+	assert.Contains(t, requests[2], "GetStatus")
+
+	presets, num, err := driver.GetPresets()
+	assert.NoError(t, err)
+	assert.Equal(t, []ptzPreset{{ID: 7, Name: "gate"}, {ID: 2, Name: "door"}}, presets)
+	assert.Equal(t, 2, num)
+
+	requests = nil
+	assert.NoError(t, driver.GoToPreset(2))
+	assert.Contains(t, requests[1], "<tptz:PresetToken>door</tptz:PresetToken>")
+	assert.Equal(t, ErrPTZPresetNotFound, driver.GoToPreset(3))
+
+	requests = nil
+	assert.NoError(t, driver.SetPreset(ptzPreset{ID: 9, Name: "new"}))
+	assert.NotContains(t, requests[1], "PresetToken")
+
+	requests = nil
+	assert.NoError(t, driver.Move("turn_left_upper", 9, 0))
+	assert.Contains(t, requests[0], `<tt:PanTilt x="-1.0000" y="0.5000"/><tt:Zoom x="0.0000"/>`)
+	assert.NoError(t, driver.Move("stop", 0, 0))
+	assert.Contains(t, requests[1], "<tptz:Stop>")
+	assert.Equal(t, ErrPTZUnsupported, driver.Move("wiper_on", 0, 0))
+
+	requests = nil
+	assert.NoError(t, driver.AbsoluteMove(0.5, -0.25, 1))
+	assert.Contains(t, requests[0], `<tptz:Position><tt:PanTilt x="0.5000" y="-0.2500"/><tt:Zoom x="1.0000"/></tptz:Position>`)
+	assert.NoError(t, driver.RelativeMove(0.1, 0, -0.5))
+	assert.Contains(t, requests[1], `<tptz:Translation><tt:PanTilt x="0.1000" y="0.0000"/><tt:Zoom x="-0.5000"/></tptz:Translation>`)
+
+	err = driver.GoToHome()
+	assert.EqualError(t, err, "onvif fault: no home position ter:NoHomePosition")
+}
+
+func TestOnvifSecurityHeader(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	header := onvifSecurityHeader("admin", "123456", []byte("0123456789abcdef"), created)
+	assert.Contains(t, header, "<Username>admin</Username>")
+	assert.Contains(t, header, ">MDEyMzQ1Njc4OWFiY2RlZg==</Nonce>")
+	assert.Contains(t, header, ">2024-01-02T03:04:05Z</Created>")
+	assert.NotContains(t, header, "123456<")
+}
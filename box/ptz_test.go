@@ -2,6 +2,10 @@ package box
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/golang/mock/gomock"
@@ -115,3 +119,98 @@ func TestGoToPtzPreset(t *testing.T) {
 	_, err := h.Handle(req)
 	assert.NoError(t, err)
 }
+
+func TestClickToCenterTranslation(t *testing.T) {
+	pan, tilt := clickToCenterTranslation(0.5, 0.5, 60, 34, 20, defaultPTZView)
+	assert.Equal(t, 0.0, pan)
+	assert.Equal(t, 0.0, tilt)
+
+	// the right edge is half the field of view away.
+	pan, tilt = clickToCenterTranslation(1, 0, 60, 34, 20, defaultPTZView)
+	assert.InDelta(t, 30.0/180, pan, 1e-9)
+	assert.InDelta(t, 17.0/90, tilt, 1e-9)
+
+	pan, tilt = clickToCenterTranslation(0, 1, 0, 0, 0, defaultPTZView)
+	assert.InDelta(t, -float64(ptzDefaultHFov)/2/180, pan, 1e-9)
+	assert.InDelta(t, -float64(ptzDefaultVFov)/2/90, tilt, 1e-9)
+
+	// a quarter of the frame is less than a quarter of the field of view away.
+	pan, _ = clickToCenterTranslation(0.75, 0.5, 60, 34, 20, defaultPTZView)
+	assert.InDelta(t, math.Atan(math.Tan(math.Pi/6)/2)*180/math.Pi/180, pan, 1e-9)
+
+	// zoomed 4x in, the edge is 4 times closer.
+	zoomed := ptzView{Zoom: 0.5, PanDegrees: 180, TiltDegrees: 90, ZoomSpan: 1}
+	pan, _ = clickToCenterTranslation(1, 0.5, 60, 34, 16, zoomed)
+	assert.InDelta(t, math.Atan(math.Tan(math.Pi/6)/4)*180/math.Pi/180, pan, 1e-9)
+
+	// a camera which pans 350 degrees over a translation of 2.
+	pan, _ = clickToCenterTranslation(1, 0.5, 60, 34, 20, ptzView{PanDegrees: 175, TiltDegrees: 90, ZoomSpan: 1})
+	assert.InDelta(t, 30.0/175, pan, 1e-9)
+}
+
+func TestAreaZoomTranslation(t *testing.T) {
+	pan, tilt, zoom := areaZoomTranslation(0.25, 0.25, 0.5, 0.5, 60, 34, 16, defaultPTZView)
+	assert.Equal(t, 0.0, pan)
+	assert.Equal(t, 0.0, tilt)
+	assert.InDelta(t, 0.25, zoom, 1e-9)
+
+	pan, _, zoom = areaZoomTranslation(0.5, 0.25, 0.5, 0.5, 60, 34, 0, defaultPTZView)
+	assert.InDelta(t, 0.25*60/180, pan, 0.01)
+	assert.InDelta(t, math.Log(2)/math.Log(ptzDefaultMaxZoom), zoom, 1e-9)
+
+	_, _, zoom = areaZoomTranslation(0, 0, 1, 1, 60, 34, 16, defaultPTZView)
+	assert.Equal(t, 0.0, zoom)
+	_, _, zoom = areaZoomTranslation(0, 0, 0.001, 0.001, 60, 34, 16, defaultPTZView)
+	assert.Equal(t, 1.0, zoom)
+
+	// the zoom stops at the end of the range, in the units of the camera.
+	_, _, zoom = areaZoomTranslation(0.25, 0.25, 0.5, 0.5, 60, 34, 16, ptzView{Zoom: 0.9, PanDegrees: 180, TiltDegrees: 90, ZoomSpan: 2})
+	assert.InDelta(t, 0.2, zoom, 1e-9)
+}
+
+func TestUniviewPTZLAPI(t *testing.T) {
+	var capabilities int
+	var moves []lapiPTZPosition
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := "null"
+		switch {
+		case r.URL.Path == "/LAPI/V1.0/Channels/2/PTZ/Capabilities":
+			capabilities++
+			data = `{"PanMinDegree":0,"PanMaxDegree":360,"TiltMinDegree":0,"TiltMaxDegree":90,"MaxZoomRatio":16}`
+		case r.URL.Path == "/LAPI/V1.0/Channels/2/PTZ/AbsoluteMove" && r.Method == http.MethodGet:
+			data = `{"PanDegree":350,"TiltDegree":45,"ZoomRatio":4}`
+		case r.URL.Path == "/LAPI/V1.0/Channels/2/PTZ/AbsoluteMove" && r.Method == http.MethodPut:
+			var p lapiPTZPosition
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&p))
+			moves = append(moves, p)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"Response":{"StatusCode":0,"StatusString":"Succeed","Data":%s}}`, data)
+	}))
+	defer server.Close()
+
+	driver := &univiewPTZ{sn: "nvr-lapi", channel: 2, lapi: func() (*lapiClient, error) {
+		return newLAPIClient(server.URL, "admin", "123456"), nil
+	}}
+	view, err := driver.View()
+	assert.NoError(t, err)
+	assert.Equal(t, ptzView{Zoom: 0.5, PanDegrees: 180, TiltDegrees: 45, ZoomSpan: 1}, view)
+
+	assert.NoError(t, driver.AbsoluteMove(0, 1, 0))
+	// the pan wraps past 360 degrees, the zoom goes from 4x to 8x
+	assert.NoError(t, driver.RelativeMove(0.1, 0, 0.25))
+	if assert.Len(t, moves, 2) {
+		assert.Equal(t, lapiPTZPosition{PanDegree: 180, TiltDegree: 90, ZoomRatio: 1}, moves[0])
+		assert.InDelta(t, 8, moves[1].PanDegree, 1e-9)
+		assert.InDelta(t, 45, moves[1].TiltDegree, 1e-9)
+		assert.InDelta(t, 8, moves[1].ZoomRatio, 1e-9)
+	}
+	assert.Equal(t, 1, capabilities)
+
+	// click to center and area zoom move by the translations of the view
+	pan, tilt := clickToCenterTranslation(1, 0.5, 60, 34, 16, view)
+	assert.InDelta(t, zoomedFov(60, 0.5, 16)/2/180, pan, 1e-9)
+	assert.Equal(t, 0.0, tilt)
+}
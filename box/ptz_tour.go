@@ -0,0 +1,298 @@
+package box
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+
+	"github.com/example/minibox/db"
+)
+
+const (
+	ptzTourScheduleCheck      = 30 * time.Second
+	ptzTourDefaultResumeAfter = 60 * time.Second
+	ptzTourRetryInterval      = 10 * time.Second
+)
+
+var (
+	ErrPTZTourInvalid  = errors.New("invalid ptz tour")
+	ErrPTZTourConflict = errors.New("camera already has an enabled ptz tour")
+	ErrPTZTourNotFound = errors.New("ptz tour not found")
+)
+
+var ptzTourRunner *PTZTourRunner
+
+type ptzTourStep struct {
+	PresetID  uint32 `json:"preset_id"`
+	DwellSecs int    `json:"dwell_secs"`
+}
+
+// PTZTour cycles a camera through its presets. It is persisted in the ptz_tours table,
+// Steps and Schedules are stored as json.
+type PTZTour struct {
+	ID              int64            `json:"id"`
+	CameraID        int              `json:"camera_id" gorm:"index"`
+	Name            string           `json:"name"`
+	Enabled         bool             `json:"enabled"`
+	ResumeAfterSecs int              `json:"resume_after_secs"`
+	StepsJSON       string           `json:"-" gorm:"column:steps"`
+	SchedulesJSON   string           `json:"-" gorm:"column:schedules"`
+	Steps           []ptzTourStep    `json:"steps" gorm:"-"`
+	Schedules       []scheduleWindow `json:"schedules" gorm:"-"`
+	CreatedAt       time.Time        `json:"-"`
+	UpdatedAt       time.Time        `json:"-"`
+}
+
+func (t *PTZTour) validate() error {
+	if t.CameraID < 1 || len(t.Steps) == 0 || t.ResumeAfterSecs < 0 {
+		return ErrPTZTourInvalid
+	}
+	for _, s := range t.Steps {
+		if s.PresetID == 0 || s.DwellSecs < 1 {
+			return ErrPTZTourInvalid
+		}
+	}
+	for _, s := range t.Schedules {
+		if !s.valid() {
+			return ErrPTZTourInvalid
+		}
+	}
+	return nil
+}
+
+func (t *PTZTour) encode() error {
+	steps, err := json.Marshal(t.Steps)
+	if err != nil {
+		return err
+	}
+	schedules, err := json.Marshal(t.Schedules)
+	if err != nil {
+		return err
+	}
+	t.StepsJSON, t.SchedulesJSON = string(steps), string(schedules)
+	return nil
+}
+
+func (t *PTZTour) decode() error {
+	if err := json.Unmarshal([]byte(t.StepsJSON), &t.Steps); err != nil {
+		return err
+	}
+	if t.SchedulesJSON == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(t.SchedulesJSON), &t.Schedules)
+}
+
+func (t *PTZTour) resumeAfter() time.Duration {
+	if t.ResumeAfterSecs == 0 {
+		return ptzTourDefaultResumeAfter
+	}
+	return time.Duration(t.ResumeAfterSecs) * time.Second
+}
+
+// PTZTourRunner runs the enabled PTZ tours, a tour pauses when a user takes manual
+// control of its camera and resumes after ResumeAfterSecs.
+type PTZTourRunner struct {
+	device  Box
+	db      db.Client
+	logger  zerolog.Logger
+	lock    sync.Mutex
+	tours   map[int64]*PTZTour
+	cancels map[int64]context.CancelFunc
+	paused  map[int]time.Time
+
+	driver func(cameraId int) (PTZDriver, error)
+	now    func() time.Time
+	after  func(d time.Duration) <-chan time.Time
+}
+
+func NewPTZTourRunner(device Box, d db.Client) *PTZTourRunner {
+	r := &PTZTourRunner{
+		device:  device,
+		db:      d,
+		logger:  log.Logger("ptz_tour"),
+		tours:   make(map[int64]*PTZTour),
+		cancels: make(map[int64]context.CancelFunc),
+		paused:  make(map[int]time.Time),
+		now:     time.Now,
+		after:   time.After,
+	}
+	r.driver = func(cameraId int) (PTZDriver, error) {
+		cam, err := device.GetCamera(cameraId)
+		if err != nil {
+			return nil, err
+		}
+		return newPTZDriver(device, cam)
+	}
+	ptzTourRunner = r
+
+	client := d.GetDBInstance()
+	if err := client.AutoMigrate(&PTZTour{}); err != nil {
+		r.logger.Error().Err(err).Msg("failed to migrate ptz tours")
+	}
+	var tours []*PTZTour
+	if err := client.Find(&tours).Error; err != nil {
+		r.logger.Error().Err(err).Msg("failed to load ptz tours")
+		return r
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, t := range tours {
+		if err := t.decode(); err != nil {
+			r.logger.Error().Err(err).Int64("tour_id", t.ID).Msg("failed to decode ptz tour")
+			continue
+		}
+		r.tours[t.ID] = t
+		r.startLocked(t)
+	}
+	return r
+}
+
+func GetPTZTourRunner() *PTZTourRunner {
+	return ptzTourRunner
+}
+
+// Save creates or updates a tour, and restarts it.
+func (r *PTZTourRunner) Save(t *PTZTour) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	if err := t.encode(); err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if t.Enabled {
+		for id, other := range r.tours {
+			if id != t.ID && other.CameraID == t.CameraID && other.Enabled {
+				return ErrPTZTourConflict
+			}
+		}
+	}
+	if t.ID > 0 {
+		old, ok := r.tours[t.ID]
+		if !ok {
+			return ErrPTZTourNotFound
+		}
+		t.CreatedAt = old.CreatedAt
+	}
+	if err := r.db.GetDBInstance().Save(t).Error; err != nil {
+		return err
+	}
+	r.stopLocked(t.ID)
+	r.tours[t.ID] = t
+	r.startLocked(t)
+	return nil
+}
+
+func (r *PTZTourRunner) Delete(id int64) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.tours[id]; !ok {
+		return ErrPTZTourNotFound
+	}
+	if err := r.db.GetDBInstance().Where("id = ?", id).Delete(&PTZTour{}).Error; err != nil {
+		return err
+	}
+	r.stopLocked(id)
+	delete(r.tours, id)
+	return nil
+}
+
+// List returns the tours of a camera, or all of them when cameraId is 0.
+func (r *PTZTourRunner) List(cameraId int) []PTZTour {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ret := make([]PTZTour, 0, len(r.tours))
+	for _, t := range r.tours {
+		if cameraId == 0 || t.CameraID == cameraId {
+			ret = append(ret, *t)
+		}
+	}
+	return ret
+}
+
+// NotifyManualControl pauses the tour of a camera controlled by a user.
+func (r *PTZTourRunner) NotifyManualControl(cameraId int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, t := range r.tours {
+		if t.CameraID == cameraId && t.Enabled {
+			r.paused[cameraId] = r.now().Add(t.resumeAfter())
+			r.logger.Info().Int("camera_id", cameraId).Msgf("pause ptz tour %d for manual control", t.ID)
+		}
+	}
+}
+
+func (r *PTZTourRunner) pausedUntil(cameraId int) time.Time {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.paused[cameraId]
+}
+
+func (r *PTZTourRunner) startLocked(t *PTZTour) {
+	if !t.Enabled {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancels[t.ID] = cancel
+	go r.run(ctx, *t)
+}
+
+func (r *PTZTourRunner) stopLocked(id int64) {
+	if cancel, ok := r.cancels[id]; ok {
+		cancel()
+		delete(r.cancels, id)
+	}
+	if t, ok := r.tours[id]; ok {
+		GetPTZLockManager().Release(t.CameraID, ptzTourOwner(id))
+	}
+}
+
+func (r *PTZTourRunner) run(ctx context.Context, t PTZTour) {
+	r.logger.Info().Int("camera_id", t.CameraID).Msgf("ptz tour %d started", t.ID)
+	step := 0
+	for {
+		wait := time.Duration(t.Steps[step].DwellSecs) * time.Second
+		now := r.now()
+		if until := r.pausedUntil(t.CameraID); now.Before(until) {
+			wait = until.Sub(now)
+		} else if !scheduleActive(t.Schedules, now) {
+			wait = ptzTourScheduleCheck
+		} else if err := GetPTZLockManager().Acquire(t.CameraID, ptzTourOwner(t.ID), PTZRoleAutomation, wait+ptzTourRetryInterval); err != nil {
+			// a user holds the camera, wait for the lock to expire.
+			wait = ptzTourRetryInterval
+		} else if err := r.goTo(t.CameraID, t.Steps[step].PresetID); err != nil {
+			r.logger.Warn().Err(err).Int("camera_id", t.CameraID).Msgf("ptz tour %d failed to go to preset %d", t.ID, t.Steps[step].PresetID)
+			wait = ptzTourRetryInterval
+		} else {
+			step = (step + 1) % len(t.Steps)
+		}
+
+		select {
+		case <-ctx.Done():
+			r.logger.Info().Int("camera_id", t.CameraID).Msgf("ptz tour %d stopped", t.ID)
+			return
+		case <-r.after(wait):
+		}
+	}
+}
+
+func ptzTourOwner(id int64) string {
+	return fmt.Sprintf("ptz_tour:%d", id)
+}
+
+func (r *PTZTourRunner) goTo(cameraId int, presetId uint32) error {
+	driver, err := r.driver(cameraId)
+	if err != nil {
+		return err
+	}
+	return driver.GoToPreset(presetId)
+}
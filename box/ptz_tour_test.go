@@ -0,0 +1,105 @@
+package box
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/example/turing-common/log"
+)
+
+type fakePTZDriver struct {
+	mux     sync.Mutex
+	presets []uint32
+}
+
+func (f *fakePTZDriver) Move(cmd string, hSpeed, vSpeed int) error  { return nil }
+func (f *fakePTZDriver) GetPresets() ([]ptzPreset, int, error)      { return nil, 0, nil }
+func (f *fakePTZDriver) SetPreset(preset ptzPreset) error           { return nil }
+func (f *fakePTZDriver) GoToHome() error                            { return nil }
+func (f *fakePTZDriver) SetHome() error                             { return nil }
+func (f *fakePTZDriver) AbsoluteMove(pan, tilt, zoom float64) error { return nil }
+func (f *fakePTZDriver) RelativeMove(pan, tilt, zoom float64) error { return nil }
+func (f *fakePTZDriver) GoToPreset(presetId uint32) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.presets = append(f.presets, presetId)
+	return nil
+}
+
+func (f *fakePTZDriver) visited() []uint32 {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return append([]uint32{}, f.presets...)
+}
+
+func TestPTZTourValidate(t *testing.T) {
+	tour := &PTZTour{CameraID: 1, Steps: []ptzTourStep{{PresetID: 1, DwellSecs: 10}}}
+	assert.NoError(t, tour.validate())
+
+	tour.Schedules = []scheduleWindow{{Start: "22:00", End: "24:00"}}
+	assert.NoError(t, tour.validate())
+	for _, s := range []scheduleWindow{
+		{Start: "22:00", End: "22:00"},
+		{Start: "25:00", End: "06:00"},
+		{Start: "night", End: "06:00"},
+		{Weekdays: []time.Weekday{7}, Start: "22:00", End: "06:00"},
+	} {
+		tour.Schedules = []scheduleWindow{s}
+		assert.Equal(t, ErrPTZTourInvalid, tour.validate(), s)
+	}
+
+	tour.Schedules = nil
+	tour.Steps = []ptzTourStep{{PresetID: 1, DwellSecs: 0}}
+	assert.Equal(t, ErrPTZTourInvalid, tour.validate())
+	tour.Steps = nil
+	assert.Equal(t, ErrPTZTourInvalid, tour.validate())
+}
+
+func TestPTZTourRunPauses(t *testing.T) {
+	driver := &fakePTZDriver{}
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)
+	waits := make(chan time.Duration)
+	ticks := make(chan time.Time)
+	r := &PTZTourRunner{
+		logger:  log.Logger("ptz_tour"),
+		tours:   make(map[int64]*PTZTour),
+		cancels: make(map[int64]context.CancelFunc),
+		paused:  make(map[int]time.Time),
+		driver: func(cameraId int) (PTZDriver, error) {
+			return driver, nil
+		},
+		now: func() time.Time { return now },
+		after: func(d time.Duration) <-chan time.Time {
+			waits <- d
+			return ticks
+		},
+	}
+	tour := &PTZTour{ID: 1, CameraID: 7, Enabled: true, Steps: []ptzTourStep{{PresetID: 3, DwellSecs: 1}, {PresetID: 5, DwellSecs: 1}}}
+	r.tours[tour.ID] = tour
+
+	r.NotifyManualControl(7)
+	assert.Equal(t, now.Add(ptzTourDefaultResumeAfter), r.pausedUntil(7))
+	r.paused[7] = now.Add(500 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.run(ctx, *tour)
+
+	// the runner waits for the manual control to end before its first step.
+	assert.Equal(t, 500*time.Millisecond, <-waits)
+	assert.Empty(t, driver.visited())
+	now = now.Add(500 * time.Millisecond)
+	ticks <- now
+
+	assert.Equal(t, time.Second, <-waits)
+	assert.Equal(t, []uint32{3}, driver.visited())
+	now = now.Add(time.Second)
+	ticks <- now
+
+	assert.Equal(t, time.Second, <-waits)
+	assert.Equal(t, []uint32{3, 5}, driver.visited())
+}
@@ -0,0 +1,554 @@
+package box
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+	"github.com/example/turing-common/metrics"
+
+	"github.com/example/minibox/db"
+)
+
+// The groups of push endpoints, the cameras and the sensors posting to the box.
+const (
+	PushAuthGroupUniview  = "uniview"
+	PushAuthGroupGuardian = "guardian"
+	PushAuthGroupSunell   = "sunell"
+	PushAuthGroupThermal  = "thermal_1"
+	PushAuthGroupHalo     = "halo"
+)
+
+const (
+	// PushAuthMethodNone only checks the source address of the requests.
+	PushAuthMethodNone   = "none"
+	PushAuthMethodBasic  = "basic"
+	PushAuthMethodDigest = "digest"
+	PushAuthMethodToken  = "token"
+
+	PushAuthRejectSource      = "source"
+	PushAuthRejectMissing     = "missing_credentials"
+	PushAuthRejectCredentials = "invalid_credentials"
+
+	// PushAuthTokenHeader carries the token of the token rules, an "Authorization: Bearer"
+	// header is accepted too. The token is never read from the query, which the proxies
+	// and the access logs keep.
+	PushAuthTokenHeader = "X-Auth-Token"
+
+	pushAuthRealm    = "minibox"
+	pushAuthNonceTTL = 5 * time.Minute
+)
+
+var (
+	ErrPushAuthRuleInvalid  = errors.New("invalid push auth rule")
+	ErrPushAuthRuleNotFound = errors.New("push auth rule not found")
+)
+
+var pushAuth *PushAuth
+
+// PushAuthRule accepts the requests of a group of push endpoints from Sources, IPs or
+// CIDRs, any source when it is empty, which pass Method. The rules of a group are
+// alternatives, a group without enabled rules accepts any request. It is persisted in the
+// push_auth_rules table, Sources are stored as json and the password and the token are
+// stored as refs to the credential vault.
+type PushAuthRule struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Enabled     bool      `json:"enabled"`
+	Group       string    `json:"group"`
+	Method      string    `json:"method"`
+	Username    string    `json:"username"`
+	Password    string    `json:"password,omitempty"`
+	Token       string    `json:"token,omitempty"`
+	HasSecret   bool      `json:"has_secret" gorm:"-"`
+	SourcesJSON string    `json:"-" gorm:"column:sources"`
+	Sources     []string  `json:"sources" gorm:"-"`
+	CreatedAt   time.Time `json:"-"`
+	UpdatedAt   time.Time `json:"-"`
+
+	networks []*net.IPNet
+}
+
+// IsPushAuthGroup tells if group is a group of push endpoints, the api module of a group
+// has its name.
+func IsPushAuthGroup(group string) bool {
+	switch group {
+	case PushAuthGroupUniview, PushAuthGroupGuardian, PushAuthGroupSunell, PushAuthGroupThermal, PushAuthGroupHalo:
+		return true
+	}
+	return false
+}
+
+func (r *PushAuthRule) validate() error {
+	if !IsPushAuthGroup(r.Group) {
+		return ErrPushAuthRuleInvalid
+	}
+	switch r.Method {
+	case PushAuthMethodNone:
+		if len(r.Sources) == 0 {
+			return ErrPushAuthRuleInvalid
+		}
+	case PushAuthMethodBasic, PushAuthMethodDigest:
+		if r.Username == "" {
+			return ErrPushAuthRuleInvalid
+		}
+	case PushAuthMethodToken:
+	default:
+		return ErrPushAuthRuleInvalid
+	}
+	return r.parseSources()
+}
+
+// secret returns the secret of the method of the rule.
+func (r *PushAuthRule) secret() string {
+	switch r.Method {
+	case PushAuthMethodBasic, PushAuthMethodDigest:
+		return r.Password
+	case PushAuthMethodToken:
+		return r.Token
+	}
+	return ""
+}
+
+func (r *PushAuthRule) parseSources() error {
+	r.networks = r.networks[:0]
+	for _, s := range r.Sources {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return ErrPushAuthRuleInvalid
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			r.networks = append(r.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return ErrPushAuthRuleInvalid
+		}
+		r.networks = append(r.networks, n)
+	}
+	return nil
+}
+
+func (r *PushAuthRule) encode() error {
+	sources, err := json.Marshal(r.Sources)
+	if err != nil {
+		return err
+	}
+	r.SourcesJSON = string(sources)
+	return nil
+}
+
+func (r *PushAuthRule) decode() error {
+	if r.SourcesJSON != "" {
+		if err := json.Unmarshal([]byte(r.SourcesJSON), &r.Sources); err != nil {
+			return err
+		}
+	}
+	return r.parseSources()
+}
+
+func (r *PushAuthRule) matchSource(ip net.IP) bool {
+	if len(r.networks) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range r.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// PushAuthResult is the decision on a request, Challenges are the WWW-Authenticate
+// headers of a rejection.
+type PushAuthResult struct {
+	Allowed    bool
+	Reason     string
+	Challenges []string
+}
+
+// PushAuth authenticates the requests of the cameras and the sensors to the push
+// endpoints of the box.
+type PushAuth struct {
+	db       db.Client
+	logger   zerolog.Logger
+	lock     sync.Mutex
+	rules    map[int64]*PushAuthRule
+	nonceKey []byte
+	nonces   map[string]pushAuthNonce
+	now      func() time.Time
+}
+
+// pushAuthNonce is the highest nonce count a digest nonce was used with, until the nonce
+// expires.
+type pushAuthNonce struct {
+	count   uint64
+	expires time.Time
+}
+
+func NewPushAuth(d db.Client) *PushAuth {
+	a := &PushAuth{
+		db:       d,
+		logger:   log.Logger("push_auth"),
+		rules:    make(map[int64]*PushAuthRule),
+		nonceKey: make([]byte, 32),
+		nonces:   make(map[string]pushAuthNonce),
+		now:      time.Now,
+	}
+	if _, err := rand.Read(a.nonceKey); err != nil {
+		// without a key no nonce is valid, the digest rules reject every request.
+		a.logger.Error().Err(err).Msg("failed to generate push auth nonce key")
+		a.nonceKey = nil
+	}
+	pushAuth = a
+
+	client := d.GetDBInstance()
+	if err := client.AutoMigrate(&PushAuthRule{}); err != nil {
+		a.logger.Error().Err(err).Msg("failed to migrate push auth rules")
+	}
+	var rules []*PushAuthRule
+	if err := client.Find(&rules).Error; err != nil {
+		a.logger.Error().Err(err).Msg("failed to load push auth rules")
+	}
+	a.lock.Lock()
+	for _, v := range rules {
+		if err := v.decode(); err != nil {
+			a.logger.Error().Err(err).Int64("rule_id", v.ID).Msg("failed to decode push auth rule")
+			continue
+		}
+		// a rule without its secret rejects the requests rather than being left out
+		id := strconv.FormatInt(v.ID, 10)
+		if err := migrateSecret(d, CredentialKindPushAuthPassword, id, &v.Password, &PushAuthRule{}, "password", "id = ?", v.ID); err != nil {
+			a.logger.Error().Err(err).Int64("rule_id", v.ID).Msg("failed to load push auth rule password")
+		}
+		if err := migrateSecret(d, CredentialKindPushAuthToken, id, &v.Token, &PushAuthRule{}, "token", "id = ?", v.ID); err != nil {
+			a.logger.Error().Err(err).Int64("rule_id", v.ID).Msg("failed to load push auth rule token")
+		}
+		a.rules[v.ID] = v
+	}
+	a.lock.Unlock()
+	return a
+}
+
+func GetPushAuth() *PushAuth {
+	return pushAuth
+}
+
+// Save creates or updates a rule, an empty password or token keeps the saved one.
+func (a *PushAuth) Save(v *PushAuthRule) error {
+	if err := v.validate(); err != nil {
+		return err
+	}
+	if err := v.encode(); err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if v.ID > 0 {
+		old, ok := a.rules[v.ID]
+		if !ok {
+			return ErrPushAuthRuleNotFound
+		}
+		if v.Password == "" {
+			v.Password = old.Password
+		}
+		if v.Token == "" {
+			v.Token = old.Token
+		}
+		v.CreatedAt = old.CreatedAt
+	}
+	if v.Method != PushAuthMethodNone && v.secret() == "" {
+		return ErrPushAuthRuleInvalid
+	}
+	if err := a.save(v); err != nil {
+		return err
+	}
+	saved := *v
+	a.rules[v.ID] = &saved
+	v.HasSecret, v.Password, v.Token = v.secret() != "", "", ""
+	return nil
+}
+
+// save stores a rule with the vault refs of its password and token. The secrets are kept
+// by the id of the rule, a new rule is created without them first.
+func (a *PushAuth) save(v *PushAuthRule) error {
+	client := a.db.GetDBInstance()
+	row := *v
+	created := v.ID == 0
+	if created {
+		row.Password, row.Token = "", ""
+		if err := client.Create(&row).Error; err != nil {
+			return err
+		}
+	}
+	id := strconv.FormatInt(row.ID, 10)
+	var err error
+	if row.Password, err = sealSecret(CredentialKindPushAuthPassword, id, v.Password); err == nil {
+		row.Token, err = sealSecret(CredentialKindPushAuthToken, id, v.Token)
+	}
+	if err == nil {
+		err = client.Save(&row).Error
+	}
+	if err != nil {
+		if created {
+			client.Where("id = ?", row.ID).Delete(&PushAuthRule{})
+		}
+		return err
+	}
+	v.ID, v.CreatedAt, v.UpdatedAt = row.ID, row.CreatedAt, row.UpdatedAt
+	return nil
+}
+
+func (a *PushAuth) Delete(id int64) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.rules[id]; !ok {
+		return ErrPushAuthRuleNotFound
+	}
+	if err := a.db.GetDBInstance().Where("id = ?", id).Delete(&PushAuthRule{}).Error; err != nil {
+		return err
+	}
+	delete(a.rules, id)
+	dropSecret(CredentialKindPushAuthPassword, strconv.FormatInt(id, 10))
+	dropSecret(CredentialKindPushAuthToken, strconv.FormatInt(id, 10))
+	return nil
+}
+
+// List returns the rules without their passwords and tokens.
+func (a *PushAuth) List() []PushAuthRule {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	ret := make([]PushAuthRule, 0, len(a.rules))
+	for _, v := range a.rules {
+		c := *v
+		c.HasSecret, c.Password, c.Token = c.secret() != "", "", ""
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// Check authenticates a request to the endpoints of group, the rejections are counted
+// in push_auth_rejected_total.
+func (a *PushAuth) Check(group string, r *http.Request) PushAuthResult {
+	a.lock.Lock()
+	var rules []PushAuthRule
+	for _, v := range a.rules {
+		if v.Enabled && v.Group == group {
+			rules = append(rules, *v)
+		}
+	}
+	a.lock.Unlock()
+	if len(rules) == 0 {
+		return PushAuthResult{Allowed: true}
+	}
+
+	var ip net.IP
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = net.ParseIP(host)
+	}
+	ret := PushAuthResult{Reason: PushAuthRejectSource}
+	var basic, digest bool
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.matchSource(ip) {
+			continue
+		}
+		ok, presented := a.authorize(rule, r)
+		if ok {
+			return PushAuthResult{Allowed: true}
+		}
+		if presented {
+			ret.Reason = PushAuthRejectCredentials
+		} else if ret.Reason == PushAuthRejectSource {
+			ret.Reason = PushAuthRejectMissing
+		}
+		basic = basic || rule.Method == PushAuthMethodBasic
+		digest = digest || rule.Method == PushAuthMethodDigest
+	}
+	if digest {
+		ret.Challenges = append(ret.Challenges, fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=MD5, nonce="%s"`,
+			pushAuthRealm, a.nonce()))
+	}
+	if basic {
+		ret.Challenges = append(ret.Challenges, fmt.Sprintf(`Basic realm="%s"`, pushAuthRealm))
+	}
+	metrics.CounterVecAdd("push_auth_rejected_total", []string{"group", "reason"}, []string{group, ret.Reason}, 1)
+	a.logger.Debug().Str("group", group).Str("remote", r.RemoteAddr).Str("path", r.URL.Path).
+		Str("reason", ret.Reason).Msg("push request rejected")
+	return ret
+}
+
+// authorize checks the credentials of a request against a rule, presented tells the
+// request has credentials of the method of the rule.
+func (a *PushAuth) authorize(rule *PushAuthRule, r *http.Request) (ok bool, presented bool) {
+	switch rule.Method {
+	case PushAuthMethodNone:
+		return true, false
+	case PushAuthMethodBasic:
+		username, password, found := r.BasicAuth()
+		if !found {
+			return false, false
+		}
+		return secureCompare(username, rule.Username) && secureCompare(password, rule.Password), true
+	case PushAuthMethodDigest:
+		params, found := parseDigestAuthorization(r.Header.Get("Authorization"))
+		if !found {
+			return false, false
+		}
+		return a.checkDigest(rule, r, params), true
+	case PushAuthMethodToken:
+		token := r.Header.Get(PushAuthTokenHeader)
+		if token == "" {
+			if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+				token = h[7:]
+			}
+		}
+		if token == "" {
+			return false, false
+		}
+		return secureCompare(token, rule.Token), true
+	}
+	return false, false
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// nonce returns a digest nonce, the unix time it was issued signed by the nonce key of
+// the box, so that it needs no state.
+func (a *PushAuth) nonce() string {
+	ts := strconv.FormatInt(a.now().Unix(), 10)
+	mac := hmac.New(sha256.New, a.nonceKey)
+	mac.Write([]byte(ts))
+	return ts + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *PushAuth) validNonce(nonce string) bool {
+	i := strings.IndexByte(nonce, '.')
+	if i < 0 || len(a.nonceKey) == 0 {
+		return false
+	}
+	ts, err := strconv.ParseInt(nonce[:i], 10, 64)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, a.nonceKey)
+	mac.Write([]byte(nonce[:i]))
+	if !hmac.Equal([]byte(nonce[i+1:]), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return false
+	}
+	age := a.now().Sub(time.Unix(ts, 0))
+	return age >= 0 && age <= pushAuthNonceTTL
+}
+
+func (a *PushAuth) checkDigest(rule *PushAuthRule, r *http.Request, p map[string]string) bool {
+	if p["username"] != rule.Username || p["realm"] != pushAuthRealm || !a.validNonce(p["nonce"]) {
+		return false
+	}
+	if p["uri"] != r.URL.RequestURI() && p["uri"] != r.URL.Path {
+		return false
+	}
+	if alg := p["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+		return false
+	}
+	ha1 := md5Hex(rule.Username + ":" + pushAuthRealm + ":" + rule.Password)
+	ha2 := md5Hex(r.Method + ":" + p["uri"])
+	var expected string
+	// a digest without qop has no nonce count, it is accepted once per nonce.
+	count := uint64(1)
+	switch p["qop"] {
+	case "":
+		expected = md5Hex(ha1 + ":" + p["nonce"] + ":" + ha2)
+	case "auth":
+		expected = md5Hex(ha1 + ":" + p["nonce"] + ":" + p["nc"] + ":" + p["cnonce"] + ":auth:" + ha2)
+		var err error
+		if count, err = strconv.ParseUint(p["nc"], 16, 64); err != nil {
+			return false
+		}
+	default:
+		return false
+	}
+	if !secureCompare(strings.ToLower(p["response"]), expected) {
+		return false
+	}
+	return a.useNonce(p["nonce"], count)
+}
+
+// useNonce records the use of a valid nonce with a nonce count, a nonce is only accepted
+// with increasing counts so that a request can not be replayed.
+func (a *PushAuth) useNonce(nonce string, count uint64) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := a.now()
+	for k, v := range a.nonces {
+		if now.After(v.expires) {
+			delete(a.nonces, k)
+		}
+	}
+	if v, ok := a.nonces[nonce]; ok && count <= v.count {
+		return false
+	}
+	a.nonces[nonce] = pushAuthNonce{count: count, expires: now.Add(pushAuthNonceTTL)}
+	return true
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseDigestAuthorization returns the parameters of a digest Authorization header.
+func parseDigestAuthorization(h string) (map[string]string, bool) {
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Digest ") {
+		return nil, false
+	}
+	params := make(map[string]string)
+	s := strings.TrimSpace(h[7:])
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimSpace(s[eq+1:])
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				return nil, false
+			}
+			value, s = s[1:end+1], s[end+2:]
+		} else if comma := strings.IndexByte(s, ','); comma >= 0 {
+			value, s = strings.TrimSpace(s[:comma]), s[comma:]
+		} else {
+			value, s = strings.TrimSpace(s), ""
+		}
+		params[key] = value
+		s = strings.TrimLeft(s, ", ")
+	}
+	return params, true
+}
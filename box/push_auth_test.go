@@ -0,0 +1,130 @@
+package box
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPushAuth(rules ...*PushAuthRule) *PushAuth {
+	a := &PushAuth{rules: make(map[int64]*PushAuthRule), nonceKey: []byte("key"),
+		nonces: make(map[string]pushAuthNonce), now: time.Now}
+	for i, r := range rules {
+		r.ID, r.Enabled = int64(i+1), true
+		if err := r.parseSources(); err != nil {
+			panic(err)
+		}
+		a.rules[r.ID] = r
+	}
+	return a
+}
+
+func TestPushAuthRuleValidate(t *testing.T) {
+	for _, r := range []PushAuthRule{
+		{Group: "unknown", Method: PushAuthMethodToken},
+		{Group: PushAuthGroupHalo, Method: "ntlm"},
+		{Group: PushAuthGroupHalo, Method: PushAuthMethodNone},
+		{Group: PushAuthGroupHalo, Method: PushAuthMethodBasic},
+		{Group: PushAuthGroupHalo, Method: PushAuthMethodToken, Sources: []string{"10.0.0.300"}},
+	} {
+		assert.Equal(t, ErrPushAuthRuleInvalid, r.validate())
+	}
+	r := PushAuthRule{Group: PushAuthGroupHalo, Method: PushAuthMethodNone, Sources: []string{"10.0.0.5", "192.168.1.0/24"}}
+	assert.NoError(t, r.validate())
+	assert.True(t, r.matchSource([]byte{10, 0, 0, 5}))
+	assert.True(t, r.matchSource([]byte{192, 168, 1, 7}))
+	assert.False(t, r.matchSource([]byte{10, 0, 0, 6}))
+}
+
+func TestPushAuthCheck(t *testing.T) {
+	a := newTestPushAuth(
+		&PushAuthRule{Group: PushAuthGroupHalo, Method: PushAuthMethodToken, Token: "secret"},
+		&PushAuthRule{Group: PushAuthGroupSunell, Method: PushAuthMethodNone, Sources: []string{"10.0.0.0/24"}},
+		&PushAuthRule{Group: PushAuthGroupGuardian, Method: PushAuthMethodBasic, Username: "cam", Password: "pw",
+			Sources: []string{"10.0.0.8"}},
+	)
+	request := func(remote string, set func(r *http.Request)) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/event/events", nil)
+		r.RemoteAddr = remote
+		if set != nil {
+			set(r)
+		}
+		return r
+	}
+
+	assert.True(t, a.Check(PushAuthGroupUniview, request("10.1.1.1:80", nil)).Allowed)
+
+	ret := a.Check(PushAuthGroupHalo, request("10.1.1.1:80", nil))
+	assert.False(t, ret.Allowed)
+	assert.Equal(t, PushAuthRejectMissing, ret.Reason)
+	ret = a.Check(PushAuthGroupHalo, request("10.1.1.1:80", func(r *http.Request) { r.Header.Set(PushAuthTokenHeader, "wrong") }))
+	assert.Equal(t, PushAuthRejectCredentials, ret.Reason)
+	assert.True(t, a.Check(PushAuthGroupHalo, request("10.1.1.1:80", func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer secret")
+	})).Allowed)
+	ret = a.Check(PushAuthGroupHalo, request("10.1.1.1:80", func(r *http.Request) { r.URL.RawQuery = "token=secret" }))
+	assert.Equal(t, PushAuthRejectMissing, ret.Reason)
+
+	assert.True(t, a.Check(PushAuthGroupSunell, request("10.0.0.9:80", nil)).Allowed)
+	ret = a.Check(PushAuthGroupSunell, request("10.0.1.9:80", nil))
+	assert.Equal(t, PushAuthResult{Reason: PushAuthRejectSource}, ret)
+
+	ret = a.Check(PushAuthGroupGuardian, request("10.0.0.8:80", nil))
+	assert.Equal(t, []string{`Basic realm="minibox"`}, ret.Challenges)
+	assert.True(t, a.Check(PushAuthGroupGuardian, request("10.0.0.8:80", func(r *http.Request) { r.SetBasicAuth("cam", "pw") })).Allowed)
+	ret = a.Check(PushAuthGroupGuardian, request("10.0.0.9:80", func(r *http.Request) { r.SetBasicAuth("cam", "pw") }))
+	assert.Equal(t, PushAuthRejectSource, ret.Reason)
+}
+
+func TestPushAuthDigest(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	a := newTestPushAuth(&PushAuthRule{Group: PushAuthGroupUniview, Method: PushAuthMethodDigest, Username: "admin", Password: "pw"})
+	a.now = func() time.Time { return now }
+	uri := "/LAPI/V1.0/System/Event/Notification/Alarm"
+
+	ret := a.Check(PushAuthGroupUniview, httptest.NewRequest(http.MethodPost, uri, nil))
+	assert.False(t, ret.Allowed)
+	assert.Len(t, ret.Challenges, 1)
+	params, ok := parseDigestAuthorization(ret.Challenges[0])
+	assert.True(t, ok)
+	nonce := params["nonce"]
+	assert.Equal(t, "minibox", params["realm"])
+
+	digest := func(password, nonce, nc string) *http.Request {
+		ha1 := md5Hex("admin:minibox:" + password)
+		ha2 := md5Hex("POST:" + uri)
+		response := md5Hex(ha1 + ":" + nonce + ":" + nc + ":abc:auth:" + ha2)
+		r := httptest.NewRequest(http.MethodPost, uri, nil)
+		r.Header.Set("Authorization", fmt.Sprintf(`Digest username="admin", realm="minibox", nonce="%s", uri="%s", `+
+			`algorithm=MD5, qop=auth, nc=%s, cnonce="abc", response="%s"`, nonce, uri, nc, response))
+		return r
+	}
+	assert.Equal(t, PushAuthRejectCredentials, a.Check(PushAuthGroupUniview, digest("wrong", nonce, "00000001")).Reason)
+	assert.True(t, a.Check(PushAuthGroupUniview, digest("pw", nonce, "00000001")).Allowed)
+	assert.False(t, a.Check(PushAuthGroupUniview, digest("pw", nonce+"0", "00000002")).Allowed)
+
+	// a nonce count is used once.
+	assert.False(t, a.Check(PushAuthGroupUniview, digest("pw", nonce, "00000001")).Allowed)
+	assert.True(t, a.Check(PushAuthGroupUniview, digest("pw", nonce, "00000002")).Allowed)
+	assert.False(t, a.Check(PushAuthGroupUniview, digest("pw", nonce, "zz")).Allowed)
+
+	now = now.Add(pushAuthNonceTTL + time.Second)
+	assert.False(t, a.Check(PushAuthGroupUniview, digest("pw", nonce, "00000003")).Allowed)
+
+	// without a nonce key no nonce is valid.
+	a.nonceKey = nil
+	assert.False(t, a.validNonce(a.nonce()))
+}
+
+func TestPushAuthListRedactsSecrets(t *testing.T) {
+	a := newTestPushAuth(&PushAuthRule{Group: PushAuthGroupHalo, Method: PushAuthMethodToken, Token: "secret"})
+	rules := a.List()
+	assert.Len(t, rules, 1)
+	assert.Empty(t, rules[0].Token)
+	assert.True(t, rules[0].HasSecret)
+	assert.Equal(t, "secret", a.rules[1].Token)
+}
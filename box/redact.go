@@ -0,0 +1,87 @@
+package box
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// Redacted replaces the secrets in the dumps and the logs.
+const Redacted = "******"
+
+// RedactSecret returns Redacted for a set secret, an empty one stays empty so that the
+// dumps still tell whether it is set.
+func RedactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return Redacted
+}
+
+// RedactURI redacts the password of the userinfo of a uri, such as the rtsp uris of the
+// cameras.
+func RedactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.User == nil {
+		return uri
+	}
+	if _, ok := u.User.Password(); !ok {
+		return uri
+	}
+	u.User = url.UserPassword(u.User.Username(), Redacted)
+	// the userinfo escapes the stars of Redacted
+	return strings.Replace(u.String(), url.QueryEscape(Redacted), Redacted, 1)
+}
+
+// isSecretKey reports whether a json key names a secret: passwords, secrets and tokens.
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	return strings.Contains(key, "password") || strings.Contains(key, "passwd") ||
+		strings.Contains(key, "secret") || strings.Contains(key, "token")
+}
+
+// RedactJSON redacts the values of the secret keys and the passwords of the uris of a
+// json document, data is returned as is when it is not json.
+func RedactJSON(data []byte) []byte {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return data
+	}
+	ret, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return data
+	}
+	return ret
+}
+
+// RedactedJSON marshals v as json and redacts it, for the logs of structures holding
+// credentials.
+func RedactedJSON(v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return []byte("null")
+	}
+	return RedactJSON(data)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if s, ok := e.(string); ok && isSecretKey(k) {
+				v[k] = RedactSecret(s)
+				continue
+			}
+			v[k] = redactValue(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactValue(e)
+		}
+	case string:
+		if strings.Contains(v, "://") {
+			return RedactURI(v)
+		}
+	}
+	return v
+}
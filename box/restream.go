@@ -0,0 +1,442 @@
+package box
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/pion/rtp"
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+	"github.com/example/turing-common/metrics"
+
+	"github.com/example/minibox/utils"
+)
+
+const (
+	// restreamRtspHost is the loopback the proxy listens on: it serves the camera streams
+	// with their credentials added upstream, and has no authentication of its own.
+	restreamRtspHost        = "127.0.0.1"
+	restreamRtspPort        = 8554
+	restreamPathPrefix      = "camera"
+	restreamIdleTimeout     = 10 * time.Second
+	restreamDescribeTimeout = 10 * time.Second
+	restreamMinBackoff      = 2 * time.Second
+	restreamMaxBackoff      = 30 * time.Second
+)
+
+var ErrRestreamPath = errors.New("invalid restream path")
+
+var restreamOnce sync.Once
+var restreamProxy *RestreamProxy
+
+// restreamPath is one camera stream pulled once and served to every consumer.
+type restreamPath struct {
+	name      string
+	source    string
+	consumers map[string]struct{}
+	stream    *gortsplib.ServerStream
+	ctx       context.Context
+	cancel    context.CancelFunc
+	idleTimer *time.Timer
+}
+
+type restreamStatus struct {
+	Path      string   `json:"path"`
+	Uri       string   `json:"uri"`
+	Ready     bool     `json:"ready"`
+	Consumers []string `json:"consumers"`
+}
+
+// RestreamProxy is an embedded rtsp server. Every camera stream is pulled from the
+// NVR/camera once, and fanned out to the stream.Manager, the archiver, the mosaic
+// composer and the local rtsp clients. A pull is closed when its last consumer is
+// released for longer than restreamIdleTimeout.
+type RestreamProxy struct {
+	log       zerolog.Logger
+	mux       sync.Mutex
+	server    *gortsplib.Server
+	paths     map[string]*restreamPath
+	consumers map[string]string
+	sessions  map[*gortsplib.ServerSession]string
+
+	resolve func(cameraId int64, resolution string) (string, error)
+	pull    func(p *restreamPath)
+}
+
+func GetRestreamProxy(device Box) *RestreamProxy {
+	restreamOnce.Do(func() {
+		restreamProxy = newRestreamProxy(func(cameraId int64, resolution string) (string, error) {
+			cam, err := device.GetCamera(int(cameraId))
+			if err != nil {
+				return "", err
+			}
+			return cameraSourceUri(cam.GetUri(), cam.GetSdUri(), cam.GetHdUri(), resolution, cam.GetUserName(), cameraPassword(cam))
+		})
+		restreamProxy.server = &gortsplib.Server{
+			Handler:     restreamProxy,
+			RTSPAddress: fmt.Sprintf("%s:%d", restreamRtspHost, restreamRtspPort),
+		}
+		if err := restreamProxy.server.Start(); err != nil {
+			restreamProxy.log.Error().Err(err).Msg("failed to start rtsp proxy server")
+			restreamProxy.server = nil
+		}
+	})
+	return restreamProxy
+}
+
+func newRestreamProxy(resolve func(cameraId int64, resolution string) (string, error)) *RestreamProxy {
+	p := &RestreamProxy{
+		log:       log.Logger("restream"),
+		paths:     make(map[string]*restreamPath),
+		consumers: make(map[string]string),
+		sessions:  make(map[*gortsplib.ServerSession]string),
+		resolve:   resolve,
+	}
+	p.pull = p.runPull
+	return p
+}
+
+// restreamPathName returns the proxy path of a camera stream, e.g. camera/12/sd.
+func restreamPathName(cameraId int64, resolution string) string {
+	switch utils.Resolution(resolution) {
+	case utils.HD:
+		resolution = string(utils.HD)
+	case utils.SD:
+		resolution = string(utils.SD)
+	default:
+		resolution = "main"
+	}
+	return fmt.Sprintf("%s/%d/%s", restreamPathPrefix, cameraId, resolution)
+}
+
+func parseRestreamPathName(name string) (int64, string, error) {
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	if len(parts) != 3 || parts[0] != restreamPathPrefix {
+		return 0, "", ErrRestreamPath
+	}
+	cameraId, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || cameraId < 1 {
+		return 0, "", ErrRestreamPath
+	}
+	if restreamPathName(cameraId, parts[2]) != strings.Join(parts, "/") {
+		return 0, "", ErrRestreamPath
+	}
+	return cameraId, parts[2], nil
+}
+
+// cameraSourceUri picks the camera uri of resolution, the same way as getStreamInputUri.
+func cameraSourceUri(uri, sdUri, hdUri, resolution, username, password string) (string, error) {
+	switch utils.Resolution(resolution) {
+	case utils.HD:
+		uri = hdUri
+	case utils.SD:
+		uri = sdUri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "rtsp" || u.Host == "" {
+		return "", fmt.Errorf("can not proxy stream uri %s", u.Redacted())
+	}
+	if u.User == nil && username != "" && password != "" {
+		u.User = url.UserPassword(username, password)
+	}
+	return u.String(), nil
+}
+
+func (m *RestreamProxy) Enabled() bool {
+	return m.server != nil
+}
+
+// Acquire registers consumer on the camera stream and returns the local uri to pull it
+// from. A consumer holds at most one stream, acquiring again moves it.
+func (m *RestreamProxy) Acquire(consumer string, cameraId int64, resolution string) (string, error) {
+	name := restreamPathName(cameraId, resolution)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if prev, ok := m.consumers[consumer]; ok && prev != name {
+		m.releaseLocked(consumer)
+	}
+	p, err := m.ensurePathLocked(name, cameraId, resolution)
+	if err != nil {
+		return "", err
+	}
+	p.consumers[consumer] = struct{}{}
+	m.consumers[consumer] = name
+	if p.idleTimer != nil {
+		p.idleTimer.Stop()
+		p.idleTimer = nil
+	}
+	metrics.GaugeVecSet("restream_consumers", []string{"path"}, []string{name}, float64(len(p.consumers)))
+	return m.localUri(name), nil
+}
+
+// Release unregisters consumer, it is a no-op for an unknown consumer.
+func (m *RestreamProxy) Release(consumer string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.releaseLocked(consumer)
+}
+
+// ReleasePrefix unregisters every consumer starting with prefix.
+func (m *RestreamProxy) ReleasePrefix(prefix string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for consumer := range m.consumers {
+		if strings.HasPrefix(consumer, prefix) {
+			m.releaseLocked(consumer)
+		}
+	}
+}
+
+// All returns the status of every proxied stream.
+func (m *RestreamProxy) All() []restreamStatus {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	ret := make([]restreamStatus, 0, len(m.paths))
+	for name, p := range m.paths {
+		s := restreamStatus{Path: name, Uri: m.localUri(name), Ready: p.stream != nil}
+		for c := range p.consumers {
+			s.Consumers = append(s.Consumers, c)
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+func (m *RestreamProxy) localUri(name string) string {
+	return fmt.Sprintf("rtsp://%s:%d/%s", restreamRtspHost, restreamRtspPort, name)
+}
+
+func (m *RestreamProxy) ensurePathLocked(name string, cameraId int64, resolution string) (*restreamPath, error) {
+	if p, ok := m.paths[name]; ok {
+		return p, nil
+	}
+	source, err := m.resolve(cameraId, resolution)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &restreamPath{
+		name:      name,
+		source:    source,
+		consumers: make(map[string]struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	m.paths[name] = p
+	// a path opened by a describe only lives until its first setup.
+	m.scheduleIdleLocked(p)
+	go m.pull(p)
+	return p, nil
+}
+
+func (m *RestreamProxy) releaseLocked(consumer string) {
+	name, ok := m.consumers[consumer]
+	if !ok {
+		return
+	}
+	delete(m.consumers, consumer)
+	p, ok := m.paths[name]
+	if !ok {
+		return
+	}
+	delete(p.consumers, consumer)
+	metrics.GaugeVecSet("restream_consumers", []string{"path"}, []string{name}, float64(len(p.consumers)))
+	if len(p.consumers) == 0 {
+		m.scheduleIdleLocked(p)
+	}
+}
+
+func (m *RestreamProxy) scheduleIdleLocked(p *restreamPath) {
+	if p.idleTimer != nil {
+		p.idleTimer.Stop()
+	}
+	p.idleTimer = time.AfterFunc(restreamIdleTimeout, func() {
+		m.closeIfIdle(p)
+	})
+}
+
+func (m *RestreamProxy) closeIfIdle(p *restreamPath) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.paths[p.name] != p || len(p.consumers) > 0 {
+		return
+	}
+	delete(m.paths, p.name)
+	metrics.GaugeVecSet("restream_consumers", []string{"path"}, []string{p.name}, 0)
+	p.cancel()
+	m.log.Info().Str("path", p.name).Msg("close idle camera pull")
+}
+
+// runPull keeps pulling the camera stream until the path is closed.
+func (m *RestreamProxy) runPull(p *restreamPath) {
+	backoff := restreamMinBackoff
+	for {
+		start := time.Now()
+		err := m.pullOnce(p)
+		if p.ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > restreamMaxBackoff {
+			backoff = restreamMinBackoff
+		}
+		m.log.Warn().Err(err).Str("path", p.name).Msgf("camera pull stopped, retry in %v", backoff)
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > restreamMaxBackoff {
+			backoff = restreamMaxBackoff
+		}
+	}
+}
+
+func (m *RestreamProxy) pullOnce(p *restreamPath) error {
+	u, err := base.ParseURL(p.source)
+	if err != nil {
+		return err
+	}
+	transport := gortsplib.TransportTCP
+	c := gortsplib.Client{Transport: &transport}
+	if err = c.Start(u.Scheme, u.Host); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-p.ctx.Done():
+		case <-done:
+		}
+		c.Close()
+	}()
+
+	desc, _, err := c.Describe(u)
+	if err != nil {
+		return err
+	}
+	if err = c.SetupAll(desc.BaseURL, desc.Medias); err != nil {
+		return err
+	}
+	stream := gortsplib.NewServerStream(m.server, desc)
+	defer stream.Close()
+	c.OnPacketRTPAny(func(medi *description.Media, forma format.Format, pkt *rtp.Packet) {
+		stream.WritePacketRTP(medi, pkt)
+	})
+	if _, err = c.Play(nil); err != nil {
+		return err
+	}
+
+	m.mux.Lock()
+	p.stream = stream
+	m.mux.Unlock()
+	metrics.CounterVecAdd("restream_pulls_total", []string{"path"}, []string{p.name}, 1)
+	m.log.Info().Str("path", p.name).Msg("camera pull started")
+
+	err = c.Wait()
+
+	m.mux.Lock()
+	if p.stream == stream {
+		p.stream = nil
+	}
+	m.mux.Unlock()
+	return err
+}
+
+// waitStream waits for the first pull of a path, so that a consumer started together
+// with the path does not fail on a not yet ready stream.
+func (m *RestreamProxy) waitStream(name string) (*restreamPath, *gortsplib.ServerStream) {
+	deadline := time.Now().Add(restreamDescribeTimeout)
+	for {
+		m.mux.Lock()
+		p, ok := m.paths[name]
+		var stream *gortsplib.ServerStream
+		if ok {
+			stream = p.stream
+		}
+		m.mux.Unlock()
+		if !ok || stream != nil || time.Now().After(deadline) {
+			return p, stream
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// OnDescribe implements gortsplib.ServerHandlerOnDescribe.
+func (m *RestreamProxy) OnDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	name := strings.Trim(ctx.Path, "/")
+	cameraId, resolution, err := parseRestreamPathName(name)
+	if err != nil {
+		return &base.Response{StatusCode: base.StatusNotFound}, nil, nil
+	}
+	m.mux.Lock()
+	_, err = m.ensurePathLocked(name, cameraId, resolution)
+	m.mux.Unlock()
+	if err != nil {
+		m.log.Warn().Err(err).Str("path", name).Msg("failed to open camera pull")
+		return &base.Response{StatusCode: base.StatusNotFound}, nil, nil
+	}
+	if _, stream := m.waitStream(name); stream != nil {
+		return &base.Response{StatusCode: base.StatusOK}, stream, nil
+	}
+	return &base.Response{StatusCode: base.StatusServiceUnavailable}, nil, nil
+}
+
+// OnSetup implements gortsplib.ServerHandlerOnSetup, every reading session is a consumer
+// of its path.
+func (m *RestreamProxy) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	name := strings.Trim(ctx.Path, "/")
+	cameraId, resolution, err := parseRestreamPathName(name)
+	if err != nil {
+		return &base.Response{StatusCode: base.StatusNotFound}, nil, nil
+	}
+	consumer := fmt.Sprintf("rtsp:%p", ctx.Session)
+	if _, err = m.Acquire(consumer, cameraId, resolution); err != nil {
+		return &base.Response{StatusCode: base.StatusNotFound}, nil, nil
+	}
+	m.mux.Lock()
+	m.sessions[ctx.Session] = consumer
+	m.mux.Unlock()
+	if _, stream := m.waitStream(name); stream != nil {
+		return &base.Response{StatusCode: base.StatusOK}, stream, nil
+	}
+	return &base.Response{StatusCode: base.StatusServiceUnavailable}, nil, nil
+}
+
+// OnPlay implements gortsplib.ServerHandlerOnPlay.
+func (m *RestreamProxy) OnPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Response, error) {
+	return &base.Response{StatusCode: base.StatusOK}, nil
+}
+
+// OnSessionClose implements gortsplib.ServerHandlerOnSessionClose.
+func (m *RestreamProxy) OnSessionClose(ctx *gortsplib.ServerHandlerOnSessionCloseCtx) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if consumer, ok := m.sessions[ctx.Session]; ok {
+		delete(m.sessions, ctx.Session)
+		m.releaseLocked(consumer)
+	}
+}
+
+func restreamStreamConsumer(streamId string) string {
+	return "stream:" + streamId
+}
+
+func restreamMosaicConsumer(streamId string) string {
+	return "mosaic:" + streamId + "/"
+}
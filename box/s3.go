@@ -126,6 +126,9 @@ func (b *baseBox) UploadS3ByTokenName(cameraId int, filename string, height, wid
 	s3File.Format = format
 	s3File.Height = height
 	s3File.Width = width
+	if hooks := GetWebhookDispatcher(); hooks != nil && tokenName == TokenNameCameraEvent && strings.HasPrefix(contentType, "image/") {
+		hooks.KeepEventImage(s3File.Key, filename)
+	}
 	return s3File, err
 }
 
@@ -0,0 +1,92 @@
+package box
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errDayMinute = errors.New("invalid time of day")
+
+// scheduleWindow is a daily time window of the box local time, End before Start spans
+// midnight. Empty Weekdays means every day. The PTZ tours and the halo rules run in their
+// schedule windows.
+type scheduleWindow struct {
+	Weekdays []time.Weekday `json:"weekdays"`
+	Start    string         `json:"start"`
+	End      string         `json:"end"`
+}
+
+// valid tells if the window has two different "HH:MM" bounds and known weekdays.
+func (s scheduleWindow) valid() bool {
+	start, err := parseDayMinute(s.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseDayMinute(s.End)
+	if err != nil || start == end {
+		return false
+	}
+	for _, d := range s.Weekdays {
+		if d < time.Sunday || d > time.Saturday {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDayMinute parses "HH:MM" to the minute of the day.
+func parseDayMinute(s string) (int, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(s, "%d:%d", &hour, &minute); err != nil {
+		return 0, errDayMinute
+	}
+	if hour < 0 || hour > 24 || minute < 0 || minute > 59 || hour == 24 && minute > 0 {
+		return 0, errDayMinute
+	}
+	return hour*60 + minute, nil
+}
+
+func hasWeekday(days []time.Weekday, d time.Weekday) bool {
+	if len(days) == 0 {
+		return true
+	}
+	for _, v := range days {
+		if v == d {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleActive tells if now is in one of the schedules, no schedule means always.
+func scheduleActive(schedules []scheduleWindow, now time.Time) bool {
+	if len(schedules) == 0 {
+		return true
+	}
+	minute := now.Hour()*60 + now.Minute()
+	for _, s := range schedules {
+		start, err := parseDayMinute(s.Start)
+		if err != nil {
+			continue
+		}
+		end, err := parseDayMinute(s.End)
+		if err != nil {
+			continue
+		}
+		if start < end {
+			if hasWeekday(s.Weekdays, now.Weekday()) && minute >= start && minute < end {
+				return true
+			}
+			continue
+		}
+		// the window spans midnight, its early part belongs to the day before.
+		if hasWeekday(s.Weekdays, now.Weekday()) && minute >= start {
+			return true
+		}
+		if hasWeekday(s.Weekdays, now.AddDate(0, 0, -1).Weekday()) && minute < end {
+			return true
+		}
+	}
+	return false
+}
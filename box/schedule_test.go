@@ -0,0 +1,27 @@
+package box
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleActive(t *testing.T) {
+	// 2024-01-01 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.Local)
+	}
+	assert.True(t, scheduleActive(nil, at(1, 3, 0)))
+
+	office := []scheduleWindow{{Weekdays: []time.Weekday{time.Monday, time.Tuesday}, Start: "08:30", End: "18:00"}}
+	assert.True(t, scheduleActive(office, at(1, 8, 30)))
+	assert.False(t, scheduleActive(office, at(1, 18, 0)))
+	assert.False(t, scheduleActive(office, at(3, 10, 0)))
+
+	night := []scheduleWindow{{Weekdays: []time.Weekday{time.Monday}, Start: "22:00", End: "06:00"}}
+	assert.True(t, scheduleActive(night, at(1, 23, 0)))
+	assert.True(t, scheduleActive(night, at(2, 5, 59)))
+	assert.False(t, scheduleActive(night, at(1, 5, 0)))
+	assert.False(t, scheduleActive(night, at(2, 6, 0)))
+}
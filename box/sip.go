@@ -0,0 +1,453 @@
+package box
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+const (
+	sipVersion       = "SIP/2.0"
+	sipBranchPrefix  = "z9hG4bK"
+	sipUserAgent     = "minibox"
+	sipMaxForwards   = "70"
+	sipDefaultPort   = 5060
+	sipPayloadPCMU   = 0
+	sipPayloadPCMA   = 8
+	sipAudioRate     = 8000
+	sipAllowedMethod = "INVITE, ACK, CANCEL, BYE, OPTIONS"
+)
+
+var (
+	ErrSipMessage      = errors.New("invalid sip message")
+	ErrSipChallenge    = errors.New("unsupported sip auth challenge")
+	ErrSipNoAudio      = errors.New("no supported audio in the sip answer")
+	ErrSipInvalidUri   = errors.New("invalid sip uri")
+	ErrSipNoCredential = errors.New("sip server asks for credentials but no username is set")
+)
+
+// sipCompactHeaders maps the compact forms of RFC 3261 7.3.3 to the long ones.
+var sipCompactHeaders = map[string]string{
+	"v": "Via",
+	"f": "From",
+	"t": "To",
+	"i": "Call-ID",
+	"m": "Contact",
+	"l": "Content-Length",
+	"c": "Content-Type",
+	"k": "Supported",
+}
+
+func canonicalSipHeader(name string) string {
+	lower := strings.ToLower(strings.TrimSpace(name))
+	if long, ok := sipCompactHeaders[lower]; ok {
+		return long
+	}
+	switch lower {
+	case "call-id":
+		return "Call-ID"
+	case "cseq":
+		return "CSeq"
+	case "www-authenticate":
+		return "WWW-Authenticate"
+	}
+	return textproto.CanonicalMIMEHeaderKey(lower)
+}
+
+type sipHeader struct {
+	name  string
+	value string
+}
+
+// sipMessage is a SIP request, or a response when Method is empty. The header names are
+// kept in their canonical long form and in their order.
+type sipMessage struct {
+	Method     string
+	RequestURI string
+	StatusCode int
+	Reason     string
+	headers    []sipHeader
+	Body       []byte
+}
+
+func (m *sipMessage) IsResponse() bool {
+	return m.Method == ""
+}
+
+func (m *sipMessage) Get(name string) string {
+	name = canonicalSipHeader(name)
+	for _, h := range m.headers {
+		if h.name == name {
+			return h.value
+		}
+	}
+	return ""
+}
+
+func (m *sipMessage) Values(name string) []string {
+	name = canonicalSipHeader(name)
+	var ret []string
+	for _, h := range m.headers {
+		if h.name == name {
+			ret = append(ret, h.value)
+		}
+	}
+	return ret
+}
+
+func (m *sipMessage) Add(name, value string) {
+	m.headers = append(m.headers, sipHeader{name: canonicalSipHeader(name), value: value})
+}
+
+// Set replaces the values of a header, in place of the first one.
+func (m *sipMessage) Set(name, value string) {
+	name = canonicalSipHeader(name)
+	headers := m.headers[:0]
+	found := false
+	for _, h := range m.headers {
+		if h.name != name {
+			headers = append(headers, h)
+			continue
+		}
+		if !found {
+			headers = append(headers, sipHeader{name: name, value: value})
+			found = true
+		}
+	}
+	m.headers = headers
+	if !found {
+		m.Add(name, value)
+	}
+}
+
+// CSeq returns the sequence number and the method of the CSeq header.
+func (m *sipMessage) CSeq() (int, string) {
+	seq, method, _ := strings.Cut(strings.TrimSpace(m.Get("CSeq")), " ")
+	n, _ := strconv.Atoi(seq)
+	return n, strings.TrimSpace(method)
+}
+
+// Branch returns the branch of the top Via, which identifies a transaction.
+func (m *sipMessage) Branch() string {
+	via, _, _ := strings.Cut(m.Get("Via"), ",")
+	return sipHeaderParam(via, "branch")
+}
+
+// Bytes encodes the message, Content-Length is always set from the body.
+func (m *sipMessage) Bytes() []byte {
+	var b bytes.Buffer
+	if m.IsResponse() {
+		fmt.Fprintf(&b, "%s %d %s\r\n", sipVersion, m.StatusCode, m.Reason)
+	} else {
+		fmt.Fprintf(&b, "%s %s %s\r\n", m.Method, m.RequestURI, sipVersion)
+	}
+	for _, h := range m.headers {
+		if h.name == "Content-Length" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\r\n", h.name, h.value)
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", len(m.Body))
+	b.Write(m.Body)
+	return b.Bytes()
+}
+
+func parseSipMessage(data []byte) (*sipMessage, error) {
+	head, body, ok := bytes.Cut(data, []byte("\r\n\r\n"))
+	if !ok {
+		if head, body, ok = bytes.Cut(data, []byte("\n\n")); !ok {
+			return nil, ErrSipMessage
+		}
+	}
+	lines := strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n")
+	m := &sipMessage{}
+	first := strings.SplitN(strings.TrimSpace(lines[0]), " ", 3)
+	if len(first) != 3 {
+		return nil, ErrSipMessage
+	}
+	if first[0] == sipVersion {
+		code, err := strconv.Atoi(first[1])
+		if err != nil || code < 100 || code > 699 {
+			return nil, ErrSipMessage
+		}
+		m.StatusCode, m.Reason = code, first[2]
+	} else {
+		if first[2] != sipVersion {
+			return nil, ErrSipMessage
+		}
+		m.Method, m.RequestURI = strings.ToUpper(first[0]), first[1]
+	}
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		// a line starting with a white space continues the previous header.
+		if (line[0] == ' ' || line[0] == '\t') && len(m.headers) > 0 {
+			m.headers[len(m.headers)-1].value += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, ErrSipMessage
+		}
+		m.Add(name, strings.TrimSpace(value))
+	}
+	if l := m.Get("Content-Length"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 || n > len(body) {
+			return nil, ErrSipMessage
+		}
+		body = body[:n]
+	}
+	if len(body) > 0 {
+		m.Body = append([]byte(nil), body...)
+	}
+	return m, nil
+}
+
+// newSipResponse answers a request, toTag is added to the To header if it has none.
+func newSipResponse(req *sipMessage, code int, reason, toTag string) *sipMessage {
+	res := &sipMessage{StatusCode: code, Reason: reason}
+	for _, via := range req.Values("Via") {
+		res.Add("Via", via)
+	}
+	res.Add("From", req.Get("From"))
+	to := req.Get("To")
+	if toTag != "" && sipHeaderParam(to, "tag") == "" {
+		to += ";tag=" + toTag
+	}
+	res.Add("To", to)
+	res.Add("Call-ID", req.Get("Call-ID"))
+	res.Add("CSeq", req.Get("CSeq"))
+	res.Add("User-Agent", sipUserAgent)
+	return res
+}
+
+// sipHeaderParam returns a ;name=value parameter of a header, the parameters of the uri
+// in <> are ignored.
+func sipHeaderParam(value, name string) string {
+	if i := strings.LastIndex(value, ">"); i >= 0 {
+		value = value[i+1:]
+	}
+	for _, p := range strings.Split(value, ";")[1:] {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if strings.EqualFold(k, name) {
+			return strings.Trim(v, "\"")
+		}
+	}
+	return ""
+}
+
+// sipHeaderUri returns the uri of a From, To or Contact header, like
+// "Door" <sip:1001@10.0.0.9>;tag=1.
+func sipHeaderUri(value string) string {
+	if i := strings.Index(value, "<"); i >= 0 {
+		if j := strings.Index(value[i:], ">"); j > 0 {
+			return value[i+1 : i+j]
+		}
+	}
+	uri, _, _ := strings.Cut(strings.TrimSpace(value), ";")
+	return uri
+}
+
+// parseSipUri splits sip:user@host:port;params, the host keeps its port.
+func parseSipUri(uri string) (user, host string, err error) {
+	lower := strings.ToLower(uri)
+	switch {
+	case strings.HasPrefix(lower, "sip:"):
+		uri = uri[4:]
+	case strings.HasPrefix(lower, "sips:"):
+		uri = uri[5:]
+	default:
+		return "", "", ErrSipInvalidUri
+	}
+	uri, _, _ = strings.Cut(uri, ";")
+	uri, _, _ = strings.Cut(uri, "?")
+	if at := strings.LastIndex(uri, "@"); at >= 0 {
+		user, host = uri[:at], uri[at+1:]
+		user, _, _ = strings.Cut(user, ":")
+	} else {
+		host = uri
+	}
+	if host == "" {
+		return "", "", ErrSipInvalidUri
+	}
+	return user, host, nil
+}
+
+// sipHostPort adds the default sip port to a host without one.
+func sipHostPort(host string) string {
+	if strings.LastIndex(host, ":") > strings.LastIndex(host, "]") {
+		return host
+	}
+	return fmt.Sprintf("%s:%d", host, sipDefaultPort)
+}
+
+// parseSipChallenge parses the parameters of a WWW-Authenticate or Proxy-Authenticate
+// digest challenge, quoted values may contain commas.
+func parseSipChallenge(value string) (map[string]string, error) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(value), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, ErrSipChallenge
+	}
+	params := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		after = strings.TrimSpace(after)
+		var v string
+		if strings.HasPrefix(after, "\"") {
+			end := strings.Index(after[1:], "\"")
+			if end < 0 {
+				return nil, ErrSipChallenge
+			}
+			v, after = after[1:end+1], after[end+2:]
+		} else {
+			v, after, _ = strings.Cut(after, ",")
+			after = "," + after
+		}
+		params[key] = strings.TrimSpace(v)
+		_, rest, _ = strings.Cut(after, ",")
+		rest = strings.TrimSpace(rest)
+	}
+	if params["nonce"] == "" {
+		return nil, ErrSipChallenge
+	}
+	if alg := params["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+		return nil, ErrSipChallenge
+	}
+	return params, nil
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// sipDigestAuthorization answers a digest challenge of RFC 2617, with qop=auth when the
+// server offers it.
+func sipDigestAuthorization(challenge, method, uri, username, password, cnonce string, nc int) (string, error) {
+	params, err := parseSipChallenge(challenge)
+	if err != nil {
+		return "", err
+	}
+	realm, nonce := params["realm"], params["nonce"]
+	ha1 := md5Hex(username + ":" + realm + ":" + password)
+	ha2 := md5Hex(method + ":" + uri)
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, username, realm, nonce, uri)
+	qopAuth := false
+	for _, q := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qopAuth = true
+		}
+	}
+	if qopAuth {
+		ncValue := fmt.Sprintf("%08x", nc)
+		response := md5Hex(strings.Join([]string{ha1, nonce, ncValue, cnonce, "auth", ha2}, ":"))
+		auth += fmt.Sprintf(`, response="%s", qop=auth, nc=%s, cnonce="%s"`, response, ncValue, cnonce)
+	} else {
+		auth += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+nonce+":"+ha2))
+	}
+	auth += ", algorithm=MD5"
+	if opaque := params["opaque"]; opaque != "" {
+		auth += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return auth, nil
+}
+
+// sipSdpOffer offers to send G.711 audio from ip:port.
+func sipSdpOffer(ip string, port int, sessionId int64) []byte {
+	lines := []string{
+		"v=0",
+		fmt.Sprintf("o=%s %d %d IN IP4 %s", sipUserAgent, sessionId, sessionId, ip),
+		"s=" + sipUserAgent,
+		"c=IN IP4 " + ip,
+		"t=0 0",
+		fmt.Sprintf("m=audio %d RTP/AVP %d %d", port, sipPayloadPCMU, sipPayloadPCMA),
+		fmt.Sprintf("a=rtpmap:%d PCMU/%d", sipPayloadPCMU, sipAudioRate),
+		fmt.Sprintf("a=rtpmap:%d PCMA/%d", sipPayloadPCMA, sipAudioRate),
+		"a=ptime:20",
+		"a=sendonly",
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// sipMedia is where and how to send the audio of a call, from the sdp answer.
+type sipMedia struct {
+	IP          string
+	Port        int
+	PayloadType uint8
+}
+
+// parseSipSdpAnswer reads the audio address and the first G.711 format of an sdp answer.
+func parseSipSdpAnswer(body []byte) (*sipMedia, error) {
+	var media *sipMedia
+	var sessionIP string
+	for _, line := range strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "c="):
+			fields := strings.Fields(line[2:])
+			if len(fields) < 3 {
+				continue
+			}
+			ip, _, _ := strings.Cut(fields[2], "/")
+			if media == nil {
+				sessionIP = ip
+			} else {
+				media.IP = ip
+			}
+		case strings.HasPrefix(line, "m=audio "):
+			if media != nil {
+				continue
+			}
+			fields := strings.Fields(line[2:])
+			if len(fields) < 4 {
+				return nil, ErrSipNoAudio
+			}
+			port, err := strconv.Atoi(fields[1])
+			if err != nil || port == 0 {
+				return nil, ErrSipNoAudio
+			}
+			found := false
+			for _, f := range fields[3:] {
+				if f == strconv.Itoa(sipPayloadPCMU) || f == strconv.Itoa(sipPayloadPCMA) {
+					pt, _ := strconv.Atoi(f)
+					media = &sipMedia{Port: port, PayloadType: uint8(pt)}
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, ErrSipNoAudio
+			}
+		}
+	}
+	if media == nil {
+		return nil, ErrSipNoAudio
+	}
+	if media.IP == "" {
+		media.IP = sessionIP
+	}
+	if media.IP == "" {
+		return nil, ErrSipNoAudio
+	}
+	return media, nil
+}
+
+// codec maps the answered format to the backchannel codec, ffmpeg and the RTP
+// packetization are the same as for ONVIF backchannels.
+func (m *sipMedia) codec() *onvifBackchannelCodec {
+	codec := &onvifBackchannelCodec{payloadType: m.PayloadType, encodeType: AudioEncodeTypeG711A, sampleRate: sipAudioRate}
+	if m.PayloadType == sipPayloadPCMU {
+		codec.encodeType = AudioEncodeTypeG711U
+	}
+	return codec
+}
@@ -0,0 +1,1106 @@
+package box
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/pion/rtp"
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+
+	"github.com/example/minibox/db"
+	"github.com/example/minibox/utils"
+)
+
+const (
+	SipEventDoorbell = "doorbell"
+
+	// SipCallReport reports whether the call of a backward audio session was answered, the
+	// start of the session is replied while the call rings.
+	SipCallReport   = "nest.box.sip.call_report"
+	SipCallCalling  = "calling"
+	SipCallAnswered = "answered"
+	SipCallFailed   = "failed"
+
+	sipT1               = 500 * time.Millisecond
+	sipT2               = 4 * time.Second
+	sipTransactionTime  = 64 * sipT1
+	sipDefaultExpires   = 300
+	sipDefaultRingSecs  = 30
+	sipMaxRingSecs      = 120
+	sipRegisterRetry    = 30 * time.Second
+	sipRingCooldown     = 10 * time.Second
+	sipMaxMessageSize   = 65535
+	sipInviteTimeoutPad = 5 * time.Second
+)
+
+var (
+	ErrSipConfigInvalid      = errors.New("invalid sip config")
+	ErrSipDoorStationInvalid = errors.New("invalid sip door station")
+	ErrSipDoorStationExists  = errors.New("sip door station caller already exists")
+	ErrSipDoorStationMissing = errors.New("sip door station not found")
+	ErrSipNotRunning         = errors.New("sip agent is not enabled")
+	ErrSipTimeout            = errors.New("sip request timed out")
+)
+
+var sipAgent *SIPAgent
+
+// SIPConfig is the user agent of the box, registered to Server or peer-to-peer when
+// Server is empty. There is a single row in the sip_configs table, the password is stored
+// as a ref to the credential vault.
+type SIPConfig struct {
+	ID         int64     `json:"-"`
+	Enabled    bool      `json:"enabled"`
+	Server     string    `json:"server"`
+	Domain     string    `json:"domain"`
+	Username   string    `json:"username"`
+	Password   string    `json:"password,omitempty"`
+	ListenPort int       `json:"listen_port"`
+	Expires    int       `json:"expires"`
+	RingSecs   int       `json:"ring_secs"`
+	CreatedAt  time.Time `json:"-"`
+	UpdatedAt  time.Time `json:"-"`
+}
+
+func (c *SIPConfig) validate() error {
+	if c.ListenPort < 0 || c.ListenPort > 65535 || c.RingSecs < 0 || c.RingSecs > sipMaxRingSecs {
+		return ErrSipConfigInvalid
+	}
+	if c.Expires != 0 && (c.Expires < 60 || c.Expires > 3600) {
+		return ErrSipConfigInvalid
+	}
+	if c.Server != "" && c.Username == "" {
+		return ErrSipConfigInvalid
+	}
+	return nil
+}
+
+func (c *SIPConfig) listenPort() int {
+	if c.ListenPort == 0 {
+		return sipDefaultPort
+	}
+	return c.ListenPort
+}
+
+func (c *SIPConfig) expires() int {
+	if c.Expires == 0 {
+		return sipDefaultExpires
+	}
+	return c.Expires
+}
+
+func (c *SIPConfig) ringTimeout() time.Duration {
+	if c.RingSecs == 0 {
+		return sipDefaultRingSecs * time.Second
+	}
+	return time.Duration(c.RingSecs) * time.Second
+}
+
+// domain is the host part of the box address of record.
+func (c *SIPConfig) domain() string {
+	if c.Domain != "" {
+		return c.Domain
+	}
+	host, _, err := net.SplitHostPort(sipHostPort(c.Server))
+	if err != nil {
+		return c.Server
+	}
+	return host
+}
+
+// targetUri completes a call target: an extension is called on the domain of the server,
+// a host or an ip is called peer-to-peer.
+func (c *SIPConfig) targetUri(target string) (string, error) {
+	target = strings.TrimSpace(target)
+	lower := strings.ToLower(target)
+	if !strings.HasPrefix(lower, "sip:") && !strings.HasPrefix(lower, "sips:") {
+		if !strings.Contains(target, "@") && c.Server != "" {
+			target += "@" + c.domain()
+		}
+		target = "sip:" + target
+	}
+	if _, _, err := parseSipUri(target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// SIPDoorStation is a door station calling the box, Caller is the user of its sip uri
+// or its ip. A call from it raises EventType with a snapshot of CameraID.
+type SIPDoorStation struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Caller    string    `json:"caller"`
+	CameraID  int       `json:"camera_id"`
+	EventType string    `json:"event_type"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+func (s *SIPDoorStation) validate() error {
+	if strings.TrimSpace(s.Caller) == "" || s.CameraID < 1 {
+		return ErrSipDoorStationInvalid
+	}
+	return nil
+}
+
+func (s *SIPDoorStation) eventType() string {
+	if s.EventType == "" {
+		return SipEventDoorbell
+	}
+	return s.EventType
+}
+
+// SIPStatus is the state of the agent reported to the app.
+type SIPStatus struct {
+	Enabled    bool     `json:"enabled"`
+	Running    bool     `json:"running"`
+	Server     string   `json:"server"`
+	Registered bool     `json:"registered"`
+	LastError  string   `json:"last_error,omitempty"`
+	Calls      []string `json:"calls"`
+	Ringing    int      `json:"ringing"`
+}
+
+// sipCall is an outbound call bridging a backward audio session.
+type sipCall struct {
+	streamId  string
+	callId    string
+	from      string
+	to        string
+	remoteUri string
+	addr      *net.UDPAddr
+	cseq      int
+	cancel    context.CancelFunc
+	stopped   chan struct{}
+	hungUp    bool
+}
+
+// sipRinging is an inbound call from a door station which is not answered.
+type sipRinging struct {
+	invite  *sipMessage
+	addr    net.Addr
+	toTag   string
+	timer   *time.Timer
+	station SIPDoorStation
+}
+
+// SIPAgent is a SIP user agent over UDP. It bridges backward audio sessions into calls,
+// the input is sent as G.711 RTP like an ONVIF backchannel, and turns the calls of door
+// stations into events. The calls of door stations are not answered, they ring until the
+// caller gives up or the ring timeout.
+type SIPAgent struct {
+	device   Box
+	db       db.Client
+	logger   zerolog.Logger
+	lock     sync.Mutex
+	config   SIPConfig
+	stations map[int64]*SIPDoorStation
+
+	conn         net.PacketConn
+	cancel       context.CancelFunc
+	registered   bool
+	lastError    string
+	transactions map[string]chan *sipMessage
+	calls        map[string]*sipCall
+	ringing      map[string]*sipRinging
+	rung         map[int64]time.Time
+
+	onRing    func(station SIPDoorStation)
+	sendAudio func(ctx context.Context, inputUrl string, codec *onvifBackchannelCodec,
+		write func(medi *description.Media, pkt *rtp.Packet) error) error
+}
+
+func NewSIPAgent(device Box, d db.Client) *SIPAgent {
+	a := &SIPAgent{
+		device:       device,
+		db:           d,
+		logger:       log.Logger("sip"),
+		stations:     make(map[int64]*SIPDoorStation),
+		transactions: make(map[string]chan *sipMessage),
+		calls:        make(map[string]*sipCall),
+		ringing:      make(map[string]*sipRinging),
+		rung:         make(map[int64]time.Time),
+	}
+	a.onRing = a.raiseDoorbellEvent
+	a.sendAudio = ffmpegBackchannelAudio
+	sipAgent = a
+
+	client := d.GetDBInstance()
+	if err := client.AutoMigrate(&SIPConfig{}, &SIPDoorStation{}); err != nil {
+		a.logger.Error().Err(err).Msg("failed to migrate sip tables")
+	}
+	if err := client.Limit(1).Find(&a.config).Error; err != nil {
+		a.logger.Error().Err(err).Msg("failed to load sip config")
+	}
+	if err := migrateSecret(d, CredentialKindSIP, credentialDeviceConfig, &a.config.Password, &SIPConfig{}, "password", "id = ?", a.config.ID); err != nil {
+		a.logger.Error().Err(err).Msg("failed to load sip password")
+	}
+	var stations []*SIPDoorStation
+	if err := client.Find(&stations).Error; err != nil {
+		a.logger.Error().Err(err).Msg("failed to load sip door stations")
+	}
+	for _, s := range stations {
+		a.stations[s.ID] = s
+	}
+	if a.config.Enabled {
+		if err := a.start(a.config); err != nil {
+			a.logger.Error().Err(err).Msg("failed to start sip agent")
+		}
+	}
+	return a
+}
+
+func GetSIPAgent() *SIPAgent {
+	return sipAgent
+}
+
+// Config returns the config without its password.
+func (a *SIPAgent) Config() SIPConfig {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	c := a.config
+	c.Password = ""
+	return c
+}
+
+// SaveConfig stores the config and restarts the agent with it. An empty password keeps
+// the saved one of the same username.
+func (a *SIPAgent) SaveConfig(c SIPConfig) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	a.lock.Lock()
+	if c.Password == "" && c.Username == a.config.Username {
+		c.Password = a.config.Password
+	}
+	c.ID, c.CreatedAt = a.config.ID, a.config.CreatedAt
+	row := c
+	password, err := sealSecret(CredentialKindSIP, credentialDeviceConfig, c.Password)
+	if err == nil {
+		row.Password = password
+		err = a.db.GetDBInstance().Save(&row).Error
+	}
+	if err != nil {
+		a.lock.Unlock()
+		return err
+	}
+	c.ID, c.CreatedAt, c.UpdatedAt = row.ID, row.CreatedAt, row.UpdatedAt
+	a.config = c
+	a.lock.Unlock()
+
+	a.stop()
+	if !c.Enabled {
+		return nil
+	}
+	return a.start(c)
+}
+
+func (a *SIPAgent) SaveDoorStation(s *SIPDoorStation) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if s.ID > 0 {
+		if _, ok := a.stations[s.ID]; !ok {
+			return ErrSipDoorStationMissing
+		}
+	}
+	for _, v := range a.stations {
+		if v.ID != s.ID && strings.EqualFold(v.Caller, s.Caller) {
+			return ErrSipDoorStationExists
+		}
+	}
+	if err := a.db.GetDBInstance().Save(s).Error; err != nil {
+		return err
+	}
+	a.stations[s.ID] = s
+	return nil
+}
+
+func (a *SIPAgent) DeleteDoorStation(id int64) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.stations[id]; !ok {
+		return ErrSipDoorStationMissing
+	}
+	if err := a.db.GetDBInstance().Where("id = ?", id).Delete(&SIPDoorStation{}).Error; err != nil {
+		return err
+	}
+	delete(a.stations, id)
+	delete(a.rung, id)
+	return nil
+}
+
+func (a *SIPAgent) ListDoorStations() []SIPDoorStation {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	ret := make([]SIPDoorStation, 0, len(a.stations))
+	for _, v := range a.stations {
+		ret = append(ret, *v)
+	}
+	return ret
+}
+
+func (a *SIPAgent) Status() SIPStatus {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	s := SIPStatus{
+		Enabled:    a.config.Enabled,
+		Running:    a.conn != nil,
+		Server:     a.config.Server,
+		Registered: a.registered,
+		LastError:  a.lastError,
+		Calls:      make([]string, 0, len(a.calls)),
+		Ringing:    len(a.ringing),
+	}
+	for id := range a.calls {
+		s.Calls = append(s.Calls, id)
+	}
+	return s
+}
+
+func (a *SIPAgent) start(c SIPConfig) error {
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", c.listenPort()))
+	if err != nil {
+		a.setError(err)
+		return err
+	}
+	a.serve(conn, c)
+	return nil
+}
+
+// serve runs the agent on conn and registers to the server of c if any.
+func (a *SIPAgent) serve(conn net.PacketConn, c SIPConfig) {
+	ctx, cancel := context.WithCancel(context.Background())
+	a.lock.Lock()
+	a.conn, a.cancel, a.config = conn, cancel, c
+	a.lock.Unlock()
+	go a.readLoop(conn)
+	if c.Server != "" {
+		go a.registerLoop(ctx, c)
+	}
+	a.logger.Info().Str("addr", conn.LocalAddr().String()).Str("server", c.Server).Msg("sip agent started")
+}
+
+// stop hangs up the calls and closes the socket of the agent.
+func (a *SIPAgent) stop() {
+	a.lock.Lock()
+	streamIds := make([]string, 0, len(a.calls))
+	for id := range a.calls {
+		streamIds = append(streamIds, id)
+	}
+	a.lock.Unlock()
+	for _, id := range streamIds {
+		a.Stop(id)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for id, r := range a.ringing {
+		r.timer.Stop()
+		delete(a.ringing, id)
+	}
+	if a.conn == nil {
+		return
+	}
+	a.cancel()
+	a.conn.Close()
+	a.conn, a.cancel, a.registered = nil, nil, false
+}
+
+func (a *SIPAgent) setError(err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err == nil {
+		a.lastError = ""
+		return
+	}
+	a.lastError = err.Error()
+}
+
+func (a *SIPAgent) readLoop(conn net.PacketConn) {
+	buf := make([]byte, sipMaxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				a.logger.Warn().Err(err).Msg("sip read failed")
+			}
+			return
+		}
+		m, err := parseSipMessage(buf[:n])
+		if err != nil {
+			// keep alives of some PBXs are only a CRLF.
+			continue
+		}
+		if m.IsResponse() {
+			a.dispatchResponse(m)
+			continue
+		}
+		a.handleRequest(conn, m, addr)
+	}
+}
+
+func sipTransactionKey(branch, method string) string {
+	return branch + " " + method
+}
+
+func (a *SIPAgent) dispatchResponse(res *sipMessage) {
+	_, method := res.CSeq()
+	a.lock.Lock()
+	ch, ok := a.transactions[sipTransactionKey(res.Branch(), method)]
+	a.lock.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case ch <- res:
+	default:
+	}
+}
+
+func (a *SIPAgent) send(m *sipMessage, addr net.Addr) error {
+	a.lock.Lock()
+	conn := a.conn
+	a.lock.Unlock()
+	if conn == nil {
+		return ErrSipNotRunning
+	}
+	_, err := conn.WriteTo(m.Bytes(), addr)
+	return err
+}
+
+// request runs a client transaction: the request is retransmitted until a response, and
+// the final response is returned. An INVITE waits for its final response until timeout.
+func (a *SIPAgent) request(ctx context.Context, req *sipMessage, addr net.Addr, timeout time.Duration) (*sipMessage, error) {
+	_, method := req.CSeq()
+	key := sipTransactionKey(req.Branch(), method)
+	ch := make(chan *sipMessage, 8)
+	a.lock.Lock()
+	a.transactions[key] = ch
+	a.lock.Unlock()
+	defer func() {
+		a.lock.Lock()
+		delete(a.transactions, key)
+		a.lock.Unlock()
+	}()
+
+	if err := a.send(req, addr); err != nil {
+		return nil, err
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	interval := sipT1
+	retransmit := time.NewTimer(interval)
+	defer retransmit.Stop()
+	provisional := false
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline.C:
+			return nil, ErrSipTimeout
+		case <-retransmit.C:
+			if provisional {
+				continue
+			}
+			if err := a.send(req, addr); err != nil {
+				return nil, err
+			}
+			interval *= 2
+			if interval > sipT2 && method != "INVITE" {
+				interval = sipT2
+			}
+			retransmit.Reset(interval)
+		case res := <-ch:
+			if res.StatusCode >= 200 {
+				return res, nil
+			}
+			provisional = true
+		}
+	}
+}
+
+// requestWithAuth sends the request built by newReq, and once again with the credentials
+// of c when the server challenges it.
+func (a *SIPAgent) requestWithAuth(ctx context.Context, c SIPConfig, addr net.Addr, timeout time.Duration,
+	newReq func(cseq int) *sipMessage, cseq *int) (*sipMessage, error) {
+	*cseq++
+	req := newReq(*cseq)
+	res, err := a.request(ctx, req, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 401 && res.StatusCode != 407 {
+		return res, nil
+	}
+	if c.Username == "" {
+		return nil, ErrSipNoCredential
+	}
+	challengeHeader, authHeader := "WWW-Authenticate", "Authorization"
+	if res.StatusCode == 407 {
+		challengeHeader, authHeader = "Proxy-Authenticate", "Proxy-Authorization"
+	}
+	if req.Method == "INVITE" {
+		a.ack(req, res, addr)
+	}
+	auth, err := sipDigestAuthorization(res.Get(challengeHeader), req.Method, req.RequestURI,
+		c.Username, c.Password, sipRandomId(), 1)
+	if err != nil {
+		return nil, err
+	}
+	*cseq++
+	req = newReq(*cseq)
+	req.Set(authHeader, auth)
+	return a.request(ctx, req, addr, timeout)
+}
+
+// ack acknowledges a non-2xx final response to an INVITE, in its transaction.
+func (a *SIPAgent) ack(invite, res *sipMessage, addr net.Addr) {
+	seq, _ := invite.CSeq()
+	ack := &sipMessage{Method: "ACK", RequestURI: invite.RequestURI}
+	ack.Add("Via", invite.Get("Via"))
+	ack.Add("Max-Forwards", sipMaxForwards)
+	ack.Add("From", invite.Get("From"))
+	ack.Add("To", res.Get("To"))
+	ack.Add("Call-ID", invite.Get("Call-ID"))
+	ack.Add("CSeq", fmt.Sprintf("%d ACK", seq))
+	a.send(ack, addr)
+}
+
+func sipRandomId() string {
+	return strconv.FormatUint(rand.Uint64(), 36)
+}
+
+// localAddr is the address of the box seen by remote, it is the host of Via, Contact and
+// the sdp.
+func (a *SIPAgent) localAddr(remote *net.UDPAddr) (string, int) {
+	a.lock.Lock()
+	conn := a.conn
+	a.lock.Unlock()
+	port := 0
+	if conn != nil {
+		if u, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			port = u.Port
+		}
+	}
+	ip := "127.0.0.1"
+	if c, err := net.DialUDP("udp", nil, remote); err == nil {
+		ip = c.LocalAddr().(*net.UDPAddr).IP.String()
+		c.Close()
+	}
+	return ip, port
+}
+
+func (a *SIPAgent) newRequest(c SIPConfig, method, uri, from, to, callId string, cseq int, local string) *sipMessage {
+	req := &sipMessage{Method: method, RequestURI: uri}
+	req.Add("Via", fmt.Sprintf("%s/UDP %s;branch=%s%s;rport", sipVersion, local, sipBranchPrefix, sipRandomId()))
+	req.Add("Max-Forwards", sipMaxForwards)
+	req.Add("From", from)
+	req.Add("To", to)
+	req.Add("Call-ID", callId)
+	req.Add("CSeq", fmt.Sprintf("%d %s", cseq, method))
+	req.Add("Contact", fmt.Sprintf("<sip:%s@%s>", c.contactUser(), local))
+	req.Add("User-Agent", sipUserAgent)
+	return req
+}
+
+func (c *SIPConfig) contactUser() string {
+	if c.Username == "" {
+		return sipUserAgent
+	}
+	return c.Username
+}
+
+// fromHeader is the address of record of the box, the ip of the box peer-to-peer.
+func (c *SIPConfig) fromHeader(localIP, tag string) string {
+	domain := c.domain()
+	if domain == "" {
+		domain = localIP
+	}
+	return fmt.Sprintf("<sip:%s@%s>;tag=%s", c.contactUser(), domain, tag)
+}
+
+// requestAddr is where the requests to uri are sent, the server when registered.
+func (c *SIPConfig) requestAddr(uri string) (*net.UDPAddr, error) {
+	host := c.Server
+	if host == "" {
+		_, h, err := parseSipUri(uri)
+		if err != nil {
+			return nil, err
+		}
+		host = h
+	}
+	return net.ResolveUDPAddr("udp", sipHostPort(host))
+}
+
+func (a *SIPAgent) registerLoop(ctx context.Context, c SIPConfig) {
+	callId := sipRandomId()
+	fromTag := sipRandomId()
+	cseq := 0
+	for {
+		wait := sipRegisterRetry
+		expires, err := a.register(ctx, c, callId, fromTag, &cseq)
+		if ctx.Err() != nil {
+			return
+		}
+		a.lock.Lock()
+		a.registered = err == nil
+		a.lock.Unlock()
+		a.setError(err)
+		if err != nil {
+			a.logger.Warn().Err(err).Str("server", c.Server).Msg("sip register failed")
+		} else {
+			// refresh before the registration expires.
+			wait = time.Duration(expires) * time.Second * 4 / 5
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// register binds the box to its address of record on the server, it returns the expires
+// granted by the server.
+func (a *SIPAgent) register(ctx context.Context, c SIPConfig, callId, fromTag string, cseq *int) (int, error) {
+	addr, err := c.requestAddr("")
+	if err != nil {
+		return 0, err
+	}
+	ip, port := a.localAddr(addr)
+	local := net.JoinHostPort(ip, strconv.Itoa(port))
+	uri := "sip:" + c.domain()
+	aor := fmt.Sprintf("<sip:%s@%s>", c.Username, c.domain())
+	newReq := func(n int) *sipMessage {
+		req := a.newRequest(c, "REGISTER", uri, aor+";tag="+fromTag, aor, callId, n, local)
+		req.Add("Expires", strconv.Itoa(c.expires()))
+		return req
+	}
+	res, err := a.requestWithAuth(ctx, c, addr, sipTransactionTime, newReq, cseq)
+	if err != nil {
+		return 0, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return 0, fmt.Errorf("sip register: %d %s", res.StatusCode, res.Reason)
+	}
+	expires := c.expires()
+	if v := sipHeaderParam(res.Get("Contact"), "expires"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			expires = n
+		}
+	} else if n, err := strconv.Atoi(res.Get("Expires")); err == nil && n > 0 {
+		expires = n
+	}
+	return expires, nil
+}
+
+func (a *SIPAgent) HasStream(streamId string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, ok := a.calls[streamId]
+	return ok
+}
+
+func (a *SIPAgent) IsStreamStopped(streamId string) bool {
+	a.lock.Lock()
+	call, ok := a.calls[streamId]
+	a.lock.Unlock()
+	if !ok {
+		return true
+	}
+	select {
+	case <-call.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// Call calls target and sends inputUrl to it once answered. The call rings in the
+// background, answered is called with the encode type of the answered codec, or with the
+// error of the call. target is a sip uri, an extension of the server or a host.
+func (a *SIPAgent) Call(streamId, inputUrl, target string, answered func(encodeType string, err error)) error {
+	a.lock.Lock()
+	c := a.config
+	if a.conn == nil {
+		a.lock.Unlock()
+		return ErrSipNotRunning
+	}
+	if _, ok := a.calls[streamId]; ok {
+		a.lock.Unlock()
+		return ErrBackwardAudioOngoing
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	// hold the stream id while calling.
+	call := &sipCall{streamId: streamId, callId: sipRandomId(), cancel: cancel, stopped: make(chan struct{})}
+	a.calls[streamId] = call
+	a.lock.Unlock()
+
+	go func() {
+		codec, rtpConn, err := a.invite(ctx, c, call, target)
+		if err != nil {
+			cancel()
+			close(call.stopped)
+			a.lock.Lock()
+			if a.calls[streamId] == call {
+				delete(a.calls, streamId)
+			}
+			a.lock.Unlock()
+			answered("", err)
+			return
+		}
+		a.logger.Info().Str("stream_id", streamId).Str("target", call.remoteUri).
+			Msgf("sip call answered with %s", codec.encodeType)
+		answered(codec.encodeType, nil)
+		a.bridge(ctx, call, inputUrl, codec, rtpConn)
+	}()
+	return nil
+}
+
+func (a *SIPAgent) invite(ctx context.Context, c SIPConfig, call *sipCall, target string) (*onvifBackchannelCodec, *sipRtpConn, error) {
+	uri, err := c.targetUri(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr, err := c.requestAddr(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	ip, port := a.localAddr(addr)
+	rtpConn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, nil, err
+	}
+	rtpPort := rtpConn.LocalAddr().(*net.UDPAddr).Port
+
+	call.from = c.fromHeader(ip, sipRandomId())
+	call.addr = addr
+	local := net.JoinHostPort(ip, strconv.Itoa(port))
+	offer := sipSdpOffer(ip, rtpPort, time.Now().Unix())
+	var invite *sipMessage
+	newReq := func(n int) *sipMessage {
+		invite = a.newRequest(c, "INVITE", uri, call.from, "<"+uri+">", call.callId, n, local)
+		invite.Add("Content-Type", "application/sdp")
+		invite.Add("Allow", sipAllowedMethod)
+		invite.Body = offer
+		return invite
+	}
+	res, err := a.requestWithAuth(ctx, c, addr, c.ringTimeout()+sipInviteTimeoutPad, newReq, &call.cseq)
+	// a call stopped while ringing is cancelled too, the callee would ring on otherwise.
+	if err == ErrSipTimeout || ctx.Err() != nil {
+		a.cancelInvite(invite, addr)
+	}
+	if err != nil {
+		rtpConn.Close()
+		return nil, nil, err
+	}
+	if res.StatusCode >= 300 {
+		a.ack(invite, res, addr)
+		rtpConn.Close()
+		return nil, nil, fmt.Errorf("sip call: %d %s", res.StatusCode, res.Reason)
+	}
+
+	call.to = res.Get("To")
+	call.remoteUri = uri
+	if contact := sipHeaderUri(res.Get("Contact")); contact != "" {
+		call.remoteUri = contact
+	}
+	// the 2xx ACK is a new transaction to the remote target.
+	ack := a.newRequest(c, "ACK", call.remoteUri, call.from, call.to, call.callId, call.cseq, local)
+	ack.Set("CSeq", fmt.Sprintf("%d ACK", call.cseq))
+	a.send(ack, addr)
+
+	media, err := parseSipSdpAnswer(res.Body)
+	if err != nil {
+		rtpConn.Close()
+		a.bye(c, call)
+		return nil, nil, err
+	}
+	rtpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(media.IP, strconv.Itoa(media.Port)))
+	if err != nil {
+		rtpConn.Close()
+		a.bye(c, call)
+		return nil, nil, err
+	}
+	return media.codec(), &sipRtpConn{PacketConn: rtpConn, remote: rtpAddr}, nil
+}
+
+// cancelInvite gives up a call which is not answered.
+func (a *SIPAgent) cancelInvite(invite *sipMessage, addr net.Addr) {
+	if invite == nil {
+		return
+	}
+	seq, _ := invite.CSeq()
+	cancel := &sipMessage{Method: "CANCEL", RequestURI: invite.RequestURI}
+	cancel.Add("Via", invite.Get("Via"))
+	cancel.Add("Max-Forwards", sipMaxForwards)
+	cancel.Add("From", invite.Get("From"))
+	cancel.Add("To", invite.Get("To"))
+	cancel.Add("Call-ID", invite.Get("Call-ID"))
+	cancel.Add("CSeq", fmt.Sprintf("%d CANCEL", seq))
+	a.send(cancel, addr)
+}
+
+// sipRtpConn sends the RTP packets of a call to its remote media address.
+type sipRtpConn struct {
+	net.PacketConn
+	remote net.Addr
+}
+
+func (c *sipRtpConn) write(_ *description.Media, pkt *rtp.Packet) error {
+	data, err := pkt.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = c.WriteTo(data, c.remote)
+	return err
+}
+
+// bridge sends the input to the call until it ends, then hangs up if the remote has not.
+func (a *SIPAgent) bridge(ctx context.Context, call *sipCall, inputUrl string, codec *onvifBackchannelCodec, rtpConn *sipRtpConn) {
+	defer close(call.stopped)
+	defer rtpConn.Close()
+	if err := a.sendAudio(ctx, inputUrl, codec, rtpConn.write); err != nil && ctx.Err() == nil {
+		a.logger.Warn().Err(err).Str("stream_id", call.streamId).Msg("sip audio failed")
+	}
+	a.lock.Lock()
+	c, hungUp := a.config, call.hungUp
+	a.lock.Unlock()
+	if !hungUp {
+		a.bye(c, call)
+	}
+	a.logger.Info().Str("stream_id", call.streamId).Msg("sip call ended")
+}
+
+func (a *SIPAgent) bye(c SIPConfig, call *sipCall) {
+	ip, port := a.localAddr(call.addr)
+	local := net.JoinHostPort(ip, strconv.Itoa(port))
+	newReq := func(n int) *sipMessage {
+		return a.newRequest(c, "BYE", call.remoteUri, call.from, call.to, call.callId, n, local)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sipTransactionTime)
+	defer cancel()
+	if _, err := a.requestWithAuth(ctx, c, call.addr, sipTransactionTime, newReq, &call.cseq); err != nil {
+		a.logger.Warn().Err(err).Str("stream_id", call.streamId).Msg("sip bye failed")
+	}
+}
+
+// Stop hangs up the call of a backward audio session.
+func (a *SIPAgent) Stop(streamId string) error {
+	a.lock.Lock()
+	call, ok := a.calls[streamId]
+	delete(a.calls, streamId)
+	a.lock.Unlock()
+	if !ok {
+		return ErrBackwardAudioNotStarted
+	}
+	call.cancel()
+	<-call.stopped
+	return nil
+}
+
+func (a *SIPAgent) handleRequest(conn net.PacketConn, req *sipMessage, addr net.Addr) {
+	reply := func(res *sipMessage) {
+		if _, err := conn.WriteTo(res.Bytes(), addr); err != nil {
+			a.logger.Warn().Err(err).Str("method", req.Method).Msg("sip reply failed")
+		}
+	}
+	switch req.Method {
+	case "INVITE":
+		a.handleInvite(req, addr, reply)
+	case "CANCEL":
+		a.handleCancel(req, reply)
+	case "BYE":
+		a.handleBye(req, reply)
+	case "OPTIONS":
+		res := newSipResponse(req, 200, "OK", sipRandomId())
+		res.Add("Allow", sipAllowedMethod)
+		reply(res)
+	case "ACK":
+	default:
+		res := newSipResponse(req, 405, "Method Not Allowed", sipRandomId())
+		res.Add("Allow", sipAllowedMethod)
+		reply(res)
+	}
+}
+
+// matchStation finds the door station of a caller, by the user of its From uri or by its
+// ip.
+func (a *SIPAgent) matchStation(from string, addr net.Addr) *SIPDoorStation {
+	user, host, _ := parseSipUri(sipHeaderUri(from))
+	ip := ""
+	if u, ok := addr.(*net.UDPAddr); ok {
+		ip = u.IP.String()
+	}
+	hostOnly, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostOnly = host
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, s := range a.stations {
+		if !s.Enabled {
+			continue
+		}
+		if (user != "" && strings.EqualFold(s.Caller, user)) || s.Caller == ip || strings.EqualFold(s.Caller, hostOnly) {
+			v := *s
+			return &v
+		}
+	}
+	return nil
+}
+
+func (a *SIPAgent) handleInvite(req *sipMessage, addr net.Addr, reply func(*sipMessage)) {
+	callId := req.Get("Call-ID")
+	a.lock.Lock()
+	r, ok := a.ringing[callId]
+	a.lock.Unlock()
+	if ok {
+		// a retransmission of the INVITE.
+		reply(newSipResponse(req, 180, "Ringing", r.toTag))
+		return
+	}
+	station := a.matchStation(req.Get("From"), addr)
+	if station == nil {
+		a.logger.Info().Str("from", req.Get("From")).Str("addr", addr.String()).Msg("sip call from an unknown caller")
+		reply(newSipResponse(req, 403, "Forbidden", sipRandomId()))
+		return
+	}
+	reply(newSipResponse(req, 100, "Trying", ""))
+	r = &sipRinging{invite: req, addr: addr, toTag: sipRandomId(), station: *station}
+	reply(newSipResponse(req, 180, "Ringing", r.toTag))
+
+	a.lock.Lock()
+	timeout := a.config.ringTimeout()
+	r.timer = time.AfterFunc(timeout, func() {
+		if a.endRinging(callId) != nil {
+			reply(newSipResponse(req, 480, "Temporarily Unavailable", r.toTag))
+		}
+	})
+	a.ringing[callId] = r
+	now := time.Now()
+	fire := now.Sub(a.rung[station.ID]) >= sipRingCooldown
+	if fire {
+		a.rung[station.ID] = now
+	}
+	a.lock.Unlock()
+
+	a.logger.Info().Int64("door_station_id", station.ID).Str("from", req.Get("From")).Msg("sip door station is ringing")
+	if fire {
+		go a.onRing(*station)
+	}
+}
+
+func (a *SIPAgent) endRinging(callId string) *sipRinging {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	r, ok := a.ringing[callId]
+	if !ok {
+		return nil
+	}
+	r.timer.Stop()
+	delete(a.ringing, callId)
+	return r
+}
+
+func (a *SIPAgent) handleCancel(req *sipMessage, reply func(*sipMessage)) {
+	r := a.endRinging(req.Get("Call-ID"))
+	if r == nil {
+		reply(newSipResponse(req, 481, "Call/Transaction Does Not Exist", sipRandomId()))
+		return
+	}
+	reply(newSipResponse(req, 200, "OK", r.toTag))
+	reply(newSipResponse(r.invite, 487, "Request Terminated", r.toTag))
+}
+
+func (a *SIPAgent) handleBye(req *sipMessage, reply func(*sipMessage)) {
+	callId := req.Get("Call-ID")
+	a.lock.Lock()
+	var call *sipCall
+	for _, c := range a.calls {
+		if c.callId == callId {
+			call = c
+			break
+		}
+	}
+	if call != nil {
+		call.hungUp = true
+	}
+	a.lock.Unlock()
+	if call == nil {
+		reply(newSipResponse(req, 481, "Call/Transaction Does Not Exist", sipRandomId()))
+		return
+	}
+	reply(newSipResponse(req, 200, "OK", ""))
+	call.cancel()
+}
+
+// raiseDoorbellEvent uploads the event of a ringing door station with a snapshot of its
+// camera, and runs the linkage rules of the station.
+func (a *SIPAgent) raiseDoorbellEvent(station SIPDoorStation) {
+	now := time.Now()
+	eventType := station.eventType()
+	file, err := a.uploadSnapshot(station.CameraID)
+	if err != nil {
+		a.logger.Warn().Err(err).Int("camera_id", station.CameraID).Msg("failed to upload door station snapshot")
+	}
+	if _, err := a.device.UploadAICameraEvent(station.CameraID, file, now, now.Add(time.Second), now, eventType, nil); err != nil {
+		a.logger.Error().Err(err).Int64("door_station_id", station.ID).Msg("failed to upload door station event")
+	}
+	TriggerEventLinkage(EventSourceSip, strconv.FormatInt(station.ID, 10), eventType)
+}
+
+func (a *SIPAgent) uploadSnapshot(cameraId int) (*utils.S3File, error) {
+	cam, err := a.device.GetCamera(cameraId)
+	if err != nil {
+		return nil, err
+	}
+	uri, err := utils.GetLiveUrl(cam.GetUri(), cam.GetUserName(), cameraPassword(cam))
+	if err != nil {
+		return nil, err
+	}
+	filePath := filepath.Join(a.device.GetConfig().GetDataStoreDir(), fmt.Sprintf("sip_snap_%d_%d.jpg", cameraId, time.Now().UnixNano()))
+	filePath, err = utils.GetLiveViewSnapshotFile(uri, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(filePath)
+	return a.device.UploadS3ByTokenName(cameraId, filePath, 0, 0, "jpg", TokenNameCameraEvent)
+}
+
+// ffmpegBackchannelAudio transcodes the input to the codec of a call with ffmpeg and sends
+// it until the input ends or ctx is done.
+func ffmpegBackchannelAudio(ctx context.Context, inputUrl string, codec *onvifBackchannelCodec,
+	write func(medi *description.Media, pkt *rtp.Packet) error) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", backchannelFfmpegArgs(inputUrl, codec)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	err = writeBackchannel(stdout, codec, write)
+	if err != nil {
+		cmd.Process.Kill()
+	}
+	cmd.Wait()
+	return err
+}
@@ -0,0 +1,379 @@
+package box
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/example/turing-common/log"
+)
+
+func TestParseSipMessage(t *testing.T) {
+	m, err := parseSipMessage([]byte("INVITE sip:100@10.0.0.2 SIP/2.0\r\n" +
+		"v: SIP/2.0/UDP 10.0.0.9:5060;branch=z9hG4bKa1\r\n" +
+		"f: \"Door\" <sip:1001@10.0.0.9>;tag=f1\r\n" +
+		"t: <sip:100@10.0.0.2>\r\n" +
+		"i: call-1\r\n" +
+		"CSeq: 3 INVITE\r\n" +
+		"Subject: front\r\n door\r\n" +
+		"l: 4\r\n\r\nv=0\r\nignored"))
+	assert.NoError(t, err)
+	assert.Equal(t, "INVITE", m.Method)
+	assert.Equal(t, "sip:100@10.0.0.2", m.RequestURI)
+	assert.Equal(t, "call-1", m.Get("Call-ID"))
+	assert.Equal(t, "front door", m.Get("subject"))
+	assert.Equal(t, "z9hG4bKa1", m.Branch())
+	assert.Equal(t, []byte("v=0\r"), m.Body)
+	seq, method := m.CSeq()
+	assert.Equal(t, 3, seq)
+	assert.Equal(t, "INVITE", method)
+	assert.Equal(t, "f1", sipHeaderParam(m.Get("From"), "tag"))
+	assert.Equal(t, "sip:1001@10.0.0.9", sipHeaderUri(m.Get("From")))
+
+	res := newSipResponse(m, 180, "Ringing", "t1")
+	parsed, err := parseSipMessage(res.Bytes())
+	assert.NoError(t, err)
+	assert.True(t, parsed.IsResponse())
+	assert.Equal(t, 180, parsed.StatusCode)
+	assert.Equal(t, "<sip:100@10.0.0.2>;tag=t1", parsed.Get("To"))
+	assert.Equal(t, "0", parsed.Get("Content-Length"))
+
+	_, err = parseSipMessage([]byte("\r\n\r\n"))
+	assert.Equal(t, ErrSipMessage, err)
+	_, err = parseSipMessage([]byte("SIP/2.0 99 Bad\r\n\r\n"))
+	assert.Equal(t, ErrSipMessage, err)
+}
+
+func TestSipDigestAuthorization(t *testing.T) {
+	// the example of RFC 2617 3.5.
+	challenge := `Digest realm="testrealm@host.com", qop="auth,auth-int", ` +
+		`nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`
+	auth, err := sipDigestAuthorization(challenge, "GET", "/dir/index.html", "Mufasa", "Circle Of Life", "0a4f113b", 1)
+	assert.NoError(t, err)
+	assert.Contains(t, auth, `response="6629fae49393a05397450978507c4ef1", qop=auth, nc=00000001, cnonce="0a4f113b"`)
+	assert.Contains(t, auth, `opaque="5ccc069c403ebaf9f0171e9517f40e41"`)
+
+	auth, err = sipDigestAuthorization(`Digest realm="pbx", nonce="n1"`, "REGISTER", "sip:pbx", "box", "secret", "c", 1)
+	assert.NoError(t, err)
+	ha1, ha2 := md5Hex("box:pbx:secret"), md5Hex("REGISTER:sip:pbx")
+	assert.Contains(t, auth, fmt.Sprintf(`response="%s"`, md5Hex(ha1+":n1:"+ha2)))
+	assert.NotContains(t, auth, "qop")
+
+	_, err = sipDigestAuthorization(`Basic realm="pbx"`, "REGISTER", "sip:pbx", "box", "secret", "c", 1)
+	assert.Equal(t, ErrSipChallenge, err)
+	_, err = sipDigestAuthorization(`Digest realm="pbx", nonce="n1", algorithm=SHA-256`, "REGISTER", "sip:pbx", "box", "secret", "c", 1)
+	assert.Equal(t, ErrSipChallenge, err)
+}
+
+func TestParseSipSdpAnswer(t *testing.T) {
+	media, err := parseSipSdpAnswer([]byte("v=0\r\nc=IN IP4 10.0.0.2\r\nm=audio 4000 RTP/AVP 18 8 101\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, &sipMedia{IP: "10.0.0.2", Port: 4000, PayloadType: 8}, media)
+	assert.Equal(t, AudioEncodeTypeG711A, media.codec().encodeType)
+
+	media, err = parseSipSdpAnswer([]byte("v=0\r\nc=IN IP4 10.0.0.2\r\nm=audio 4000 RTP/AVP 0\r\nc=IN IP4 10.0.0.3\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.3", media.IP)
+	assert.Equal(t, AudioEncodeTypeG711U, media.codec().encodeType)
+
+	_, err = parseSipSdpAnswer([]byte("v=0\r\nc=IN IP4 10.0.0.2\r\nm=audio 4000 RTP/AVP 18\r\n"))
+	assert.Equal(t, ErrSipNoAudio, err)
+	_, err = parseSipSdpAnswer([]byte("v=0\r\nm=audio 4000 RTP/AVP 0\r\n"))
+	assert.Equal(t, ErrSipNoAudio, err)
+}
+
+func TestSipConfigTargetUri(t *testing.T) {
+	pbx := &SIPConfig{Server: "10.0.0.1:5080", Username: "box"}
+	uri, err := pbx.targetUri("201")
+	assert.NoError(t, err)
+	assert.Equal(t, "sip:201@10.0.0.1", uri)
+	uri, err = pbx.targetUri("sip:paging@10.0.0.7")
+	assert.NoError(t, err)
+	assert.Equal(t, "sip:paging@10.0.0.7", uri)
+
+	p2p := &SIPConfig{}
+	uri, err = p2p.targetUri("10.0.0.7")
+	assert.NoError(t, err)
+	assert.Equal(t, "sip:10.0.0.7", uri)
+	addr, err := p2p.requestAddr(uri)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.7:5060", addr.String())
+	_, err = p2p.targetUri("sip:")
+	assert.Equal(t, ErrSipInvalidUri, err)
+
+	assert.Equal(t, ErrSipConfigInvalid, (&SIPConfig{Server: "pbx"}).validate())
+	assert.Equal(t, ErrSipConfigInvalid, (&SIPConfig{Expires: 10}).validate())
+	assert.NoError(t, pbx.validate())
+}
+
+func newTestSIPAgent(t *testing.T, c SIPConfig) *SIPAgent {
+	a := &SIPAgent{
+		logger:       log.Logger("sip"),
+		stations:     make(map[int64]*SIPDoorStation),
+		transactions: make(map[string]chan *sipMessage),
+		calls:        make(map[string]*sipCall),
+		ringing:      make(map[string]*sipRinging),
+		rung:         make(map[int64]time.Time),
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.serve(conn, c)
+	t.Cleanup(a.stop)
+	return a
+}
+
+func newTestSipPeer(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readSip(t *testing.T, conn net.PacketConn) (*sipMessage, net.Addr) {
+	t.Helper()
+	buf := make([]byte, sipMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseSipMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, addr
+}
+
+func writeSip(t *testing.T, conn net.PacketConn, m *sipMessage, addr net.Addr) {
+	t.Helper()
+	if _, err := conn.WriteTo(m.Bytes(), addr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testSipRequest(method, from, callId, branch string, cseq int, via net.Addr) *sipMessage {
+	m := &sipMessage{Method: method, RequestURI: "sip:box@127.0.0.1"}
+	m.Add("Via", fmt.Sprintf("SIP/2.0/UDP %s;branch=%s", via, branch))
+	m.Add("From", from+";tag=door")
+	m.Add("To", "<sip:box@127.0.0.1>")
+	m.Add("Call-ID", callId)
+	m.Add("CSeq", fmt.Sprintf("%d %s", cseq, method))
+	return m
+}
+
+func TestSipAgentRegister(t *testing.T) {
+	registrar := newTestSipPeer(t)
+	a := newTestSIPAgent(t, SIPConfig{Enabled: true})
+	c := SIPConfig{Enabled: true, Server: registrar.LocalAddr().String(), Username: "box", Password: "secret"}
+
+	type result struct {
+		expires int
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		cseq := 0
+		expires, err := a.register(context.Background(), c, "reg-1", "tag-1", &cseq)
+		done <- result{expires, err}
+	}()
+
+	req, addr := readSip(t, registrar)
+	assert.Equal(t, "REGISTER", req.Method)
+	assert.Equal(t, "sip:127.0.0.1", req.RequestURI)
+	assert.Equal(t, "300", req.Get("Expires"))
+	challenge := newSipResponse(req, 401, "Unauthorized", "r1")
+	challenge.Add("WWW-Authenticate", `Digest realm="pbx", nonce="n1", qop="auth"`)
+	writeSip(t, registrar, challenge, addr)
+
+	req, addr = readSip(t, registrar)
+	seq, _ := req.CSeq()
+	assert.Equal(t, 2, seq)
+	assert.Contains(t, req.Get("Authorization"), `username="box", realm="pbx", nonce="n1", uri="sip:127.0.0.1"`)
+	ok := newSipResponse(req, 200, "OK", "r1")
+	ok.Add("Contact", req.Get("Contact")+";expires=120")
+	writeSip(t, registrar, ok, addr)
+
+	r := <-done
+	assert.NoError(t, r.err)
+	assert.Equal(t, 120, r.expires)
+}
+
+func TestSipAgentDoorStation(t *testing.T) {
+	a := newTestSIPAgent(t, SIPConfig{Enabled: true, RingSecs: 1})
+	rang := make(chan SIPDoorStation, 4)
+	a.lock.Lock()
+	a.onRing = func(s SIPDoorStation) { rang <- s }
+	a.stations[1] = &SIPDoorStation{ID: 1, Name: "front", Caller: "1001", CameraID: 3, Enabled: true}
+	a.lock.Unlock()
+	door := newTestSipPeer(t)
+	agentAddr := a.conn.LocalAddr()
+
+	invite := testSipRequest("INVITE", "<sip:1001@127.0.0.1>", "call-1", "z9hG4bK1", 1, door.LocalAddr())
+	writeSip(t, door, invite, agentAddr)
+	res, _ := readSip(t, door)
+	assert.Equal(t, 100, res.StatusCode)
+	res, _ = readSip(t, door)
+	assert.Equal(t, 180, res.StatusCode)
+	toTag := sipHeaderParam(res.Get("To"), "tag")
+	assert.NotEmpty(t, toTag)
+	assert.Equal(t, int64(1), (<-rang).ID)
+
+	// a retransmission rings once.
+	writeSip(t, door, invite, agentAddr)
+	res, _ = readSip(t, door)
+	assert.Equal(t, 180, res.StatusCode)
+	assert.Equal(t, 1, a.Status().Ringing)
+
+	writeSip(t, door, testSipRequest("CANCEL", "<sip:1001@127.0.0.1>", "call-1", "z9hG4bK1", 1, door.LocalAddr()), agentAddr)
+	res, _ = readSip(t, door)
+	_, method := res.CSeq()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "CANCEL", method)
+	res, _ = readSip(t, door)
+	_, method = res.CSeq()
+	assert.Equal(t, 487, res.StatusCode)
+	assert.Equal(t, "INVITE", method)
+	assert.Equal(t, toTag, sipHeaderParam(res.Get("To"), "tag"))
+	assert.Equal(t, 0, a.Status().Ringing)
+
+	// the station rings until the ring timeout, in the cooldown of its event.
+	writeSip(t, door, testSipRequest("INVITE", "<sip:1001@127.0.0.1>", "call-2", "z9hG4bK2", 1, door.LocalAddr()), agentAddr)
+	readSip(t, door)
+	readSip(t, door)
+	res, _ = readSip(t, door)
+	assert.Equal(t, 480, res.StatusCode)
+	assert.Len(t, rang, 0)
+
+	writeSip(t, door, testSipRequest("INVITE", "<sip:9999@127.0.0.1>", "call-3", "z9hG4bK3", 1, door.LocalAddr()), agentAddr)
+	res, _ = readSip(t, door)
+	assert.Equal(t, 403, res.StatusCode)
+
+	writeSip(t, door, testSipRequest("BYE", "<sip:1001@127.0.0.1>", "call-4", "z9hG4bK4", 2, door.LocalAddr()), agentAddr)
+	res, _ = readSip(t, door)
+	assert.Equal(t, 481, res.StatusCode)
+}
+
+func answerSipInvite(t *testing.T, callee, media net.PacketConn, invite *sipMessage, addr net.Addr) {
+	t.Helper()
+	writeSip(t, callee, newSipResponse(invite, 180, "Ringing", "c1"), addr)
+	ok := newSipResponse(invite, 200, "OK", "c1")
+	ok.Add("Contact", fmt.Sprintf("<sip:100@%s>", callee.LocalAddr()))
+	ok.Add("Content-Type", "application/sdp")
+	ok.Body = []byte(fmt.Sprintf("v=0\r\nc=IN IP4 127.0.0.1\r\nm=audio %d RTP/AVP 8\r\n", media.LocalAddr().(*net.UDPAddr).Port))
+	writeSip(t, callee, ok, addr)
+}
+
+func TestSipAgentCall(t *testing.T) {
+	a := newTestSIPAgent(t, SIPConfig{Enabled: true, Username: "box", Password: "secret"})
+	a.lock.Lock()
+	a.sendAudio = func(ctx context.Context, inputUrl string, codec *onvifBackchannelCodec,
+		write func(medi *description.Media, pkt *rtp.Packet) error) error {
+		if err := writeBackchannel(bytes.NewReader(make([]byte, 160)), codec, write); err != nil {
+			return err
+		}
+		<-ctx.Done()
+		return nil
+	}
+	a.lock.Unlock()
+	callee := newTestSipPeer(t)
+	media := newTestSipPeer(t)
+	target := fmt.Sprintf("sip:100@%s", callee.LocalAddr())
+
+	type result struct {
+		encodeType string
+		err        error
+	}
+	done := make(chan result, 1)
+	answered := func(encodeType string, err error) {
+		done <- result{encodeType, err}
+	}
+	assert.NoError(t, a.Call("s1", "rtmp://in", target, answered))
+	invite, addr := readSip(t, callee)
+	assert.Equal(t, "INVITE", invite.Method)
+	assert.Equal(t, target, invite.RequestURI)
+	assert.Contains(t, string(invite.Body), "m=audio ")
+	challenge := newSipResponse(invite, 401, "Unauthorized", "c1")
+	challenge.Add("WWW-Authenticate", `Digest realm="door", nonce="n2"`)
+	writeSip(t, callee, challenge, addr)
+	ack, _ := readSip(t, callee)
+	assert.Equal(t, "ACK", ack.Method)
+
+	invite, addr = readSip(t, callee)
+	assert.Contains(t, invite.Get("Authorization"), `username="box", realm="door"`)
+	answerSipInvite(t, callee, media, invite, addr)
+	ack, _ = readSip(t, callee)
+	assert.Equal(t, "ACK", ack.Method)
+	assert.Equal(t, "2 ACK", ack.Get("CSeq"))
+	assert.Equal(t, fmt.Sprintf("sip:100@%s", callee.LocalAddr()), ack.RequestURI)
+	r := <-done
+	assert.NoError(t, r.err)
+	assert.Equal(t, AudioEncodeTypeG711A, r.encodeType)
+	assert.True(t, a.HasStream("s1"))
+	assert.Equal(t, ErrBackwardAudioOngoing, a.Call("s1", "rtmp://in", target, answered))
+
+	buf := make([]byte, 1500)
+	media.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := media.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 12+160, n)
+	assert.Equal(t, byte(8), buf[1]&0x7f)
+
+	// the callee hangs up.
+	bye := testSipRequest("BYE", "<sip:100@127.0.0.1>", invite.Get("Call-ID"), "z9hG4bKbye", 1, callee.LocalAddr())
+	writeSip(t, callee, bye, a.conn.LocalAddr())
+	res, _ := readSip(t, callee)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Eventually(t, func() bool { return a.IsStreamStopped("s1") }, 3*time.Second, 10*time.Millisecond)
+	assert.NoError(t, a.Stop("s1"))
+	assert.False(t, a.HasStream("s1"))
+
+	// the box hangs up.
+	assert.NoError(t, a.Call("s2", "rtmp://in", strings.TrimPrefix(target, "sip:"), answered))
+	invite, addr = readSip(t, callee)
+	answerSipInvite(t, callee, media, invite, addr)
+	readSip(t, callee)
+	r = <-done
+	assert.NoError(t, r.err)
+	stopped := make(chan error, 1)
+	go func() { stopped <- a.Stop("s2") }()
+	bye, addr = readSip(t, callee)
+	assert.Equal(t, "BYE", bye.Method)
+	assert.Equal(t, invite.Get("Call-ID"), bye.Get("Call-ID"))
+	writeSip(t, callee, newSipResponse(bye, 200, "OK", ""), addr)
+	assert.NoError(t, <-stopped)
+	assert.Equal(t, ErrBackwardAudioNotStarted, a.Stop("s2"))
+
+	// a declined call releases its stream id.
+	assert.NoError(t, a.Call("s3", "rtmp://in", target, answered))
+	invite, addr = readSip(t, callee)
+	writeSip(t, callee, newSipResponse(invite, 486, "Busy Here", "c2"), addr)
+	readSip(t, callee)
+	r = <-done
+	assert.EqualError(t, r.err, "sip call: 486 Busy Here")
+	assert.False(t, a.HasStream("s3"))
+
+	// a call stopped while ringing is cancelled.
+	assert.NoError(t, a.Call("s4", "rtmp://in", target, answered))
+	invite, addr = readSip(t, callee)
+	writeSip(t, callee, newSipResponse(invite, 180, "Ringing", "c3"), addr)
+	go func() { stopped <- a.Stop("s4") }()
+	cancel, _ := readSip(t, callee)
+	assert.Equal(t, "CANCEL", cancel.Method)
+	assert.Equal(t, invite.Get("Call-ID"), cancel.Get("Call-ID"))
+	r = <-done
+	assert.Equal(t, context.Canceled, r.err)
+	assert.NoError(t, <-stopped)
+	assert.False(t, a.HasStream("s4"))
+}
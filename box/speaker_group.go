@@ -0,0 +1,367 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+
+	"github.com/example/minibox/db"
+)
+
+const (
+	speakerGroupMaxMembers = 32
+
+	SpeakerMemberStarted = "started"
+	SpeakerMemberFailed  = "failed"
+	SpeakerMemberAlive   = "alive"
+	SpeakerMemberStopped = "stopped"
+)
+
+var (
+	ErrSpeakerGroupInvalid  = errors.New("invalid speaker group")
+	ErrSpeakerGroupNotFound = errors.New("speaker group not found")
+	ErrSpeakerGroupNoMember = errors.New("no member of the speaker group can play backward audio")
+	ErrSpeakerGroupDisabled = errors.New("speaker group is not running on this box")
+)
+
+var speakerGroups *SpeakerGroups
+
+// backwardAudioStreams is the part of stream.Manager used to talk to the members.
+type backwardAudioStreams interface {
+	HasStream(streamId string) bool
+	StartStream(streamId, streamType, inputUrl, outputUrl string) (string, error)
+	StopStream(streamId string) error
+	IsStreamStopped(streamId string) bool
+}
+
+// SpeakerGroup is a paging zone, a named group of speakers and camera backchannels
+// talked to at once. It is persisted in the speaker_groups table, Members are stored as
+// json with the vault refs of their passwords.
+type SpeakerGroup struct {
+	ID          int64         `json:"id"`
+	Name        string        `json:"name"`
+	MembersJSON string        `json:"-" gorm:"column:members"`
+	Members     []audioTarget `json:"members" gorm:"-"`
+	CreatedAt   time.Time     `json:"-"`
+	UpdatedAt   time.Time     `json:"-"`
+}
+
+func (g *SpeakerGroup) validate() error {
+	if strings.TrimSpace(g.Name) == "" || len(g.Members) == 0 || len(g.Members) > speakerGroupMaxMembers {
+		return ErrSpeakerGroupInvalid
+	}
+	keys := make(map[string]bool)
+	for _, m := range g.Members {
+		if m.validate() != nil || keys[m.key()] {
+			return ErrSpeakerGroupInvalid
+		}
+		keys[m.key()] = true
+	}
+	return nil
+}
+
+func (g *SpeakerGroup) encode() error {
+	members, err := json.Marshal(g.Members)
+	if err != nil {
+		return err
+	}
+	g.MembersJSON = string(members)
+	return nil
+}
+
+func (g *SpeakerGroup) decode() error {
+	return json.Unmarshal([]byte(g.MembersJSON), &g.Members)
+}
+
+// speakerMemberStatus reports the backward audio of one member, without its credentials.
+type speakerMemberStatus struct {
+	DeviceType AudioDeviceType `json:"device_type"`
+	CameraID   int             `json:"camera_id,omitempty"`
+	StreamUri  string          `json:"device_stream_uri,omitempty"`
+	Status     string          `json:"status"`
+	Error      string          `json:"error,omitempty"`
+}
+
+func newSpeakerMemberStatus(t audioTarget, status string, err error) speakerMemberStatus {
+	s := speakerMemberStatus{
+		DeviceType: t.DeviceType,
+		CameraID:   t.CameraID,
+		StreamUri:  t.StreamUri,
+		Status:     status,
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+type speakerSession struct {
+	members []audioTarget
+	streams []string
+}
+
+// SpeakerGroups stores the speaker groups and fans a backward audio session out to the
+// members of a group, each member gets its own stream of the stream manager.
+type SpeakerGroups struct {
+	db       db.Client
+	logger   zerolog.Logger
+	lock     sync.Mutex
+	groups   map[int64]*SpeakerGroup
+	sessions map[string]*speakerSession
+
+	streams func() backwardAudioStreams
+	output  func(t audioTarget) (string, string, error)
+}
+
+func NewSpeakerGroups(device Box, d db.Client) *SpeakerGroups {
+	g := &SpeakerGroups{
+		db:       d,
+		logger:   log.Logger("speaker_group"),
+		groups:   make(map[int64]*SpeakerGroup),
+		sessions: make(map[string]*speakerSession),
+		streams: func() backwardAudioStreams {
+			return newAudioTargetStreams(device)
+		},
+		output: func(t audioTarget) (string, string, error) {
+			return audioTargetOutput(device, t)
+		},
+	}
+	speakerGroups = g
+
+	client := d.GetDBInstance()
+	if err := client.AutoMigrate(&SpeakerGroup{}); err != nil {
+		g.logger.Error().Err(err).Msg("failed to migrate speaker groups")
+	}
+	var groups []*SpeakerGroup
+	if err := client.Find(&groups).Error; err != nil {
+		g.logger.Error().Err(err).Msg("failed to load speaker groups")
+		return g
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, v := range groups {
+		if err := v.decode(); err != nil {
+			g.logger.Error().Err(err).Int64("group_id", v.ID).Msg("failed to decode speaker group")
+			continue
+		}
+		if err := loadAudioTargets(d, CredentialKindSpeakerGroup, v.ID, v.Members, &SpeakerGroup{}, "members"); err != nil {
+			g.logger.Error().Err(err).Int64("group_id", v.ID).Msg("failed to load speaker group passwords")
+		}
+		g.groups[v.ID] = v
+	}
+	return g
+}
+
+func GetSpeakerGroups() *SpeakerGroups {
+	return speakerGroups
+}
+
+// Save creates or updates a group, the sessions already started keep their members.
+func (g *SpeakerGroups) Save(v *SpeakerGroup) error {
+	if err := v.validate(); err != nil {
+		return err
+	}
+	if err := v.encode(); err != nil {
+		return err
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	members := 0
+	if v.ID > 0 {
+		old, ok := g.groups[v.ID]
+		if !ok {
+			return ErrSpeakerGroupNotFound
+		}
+		members = len(old.Members)
+	}
+	if err := g.save(v); err != nil {
+		return err
+	}
+	dropAudioTargets(CredentialKindSpeakerGroup, v.ID, len(v.Members), members)
+	g.groups[v.ID] = v
+	return nil
+}
+
+// save stores a group with the vault refs of the member passwords. The passwords are kept
+// by the id of the group, a new group is created without its members first.
+func (g *SpeakerGroups) save(v *SpeakerGroup) error {
+	client := g.db.GetDBInstance()
+	row := *v
+	created := v.ID == 0
+	if created {
+		row.MembersJSON = "[]"
+		if err := client.Create(&row).Error; err != nil {
+			return err
+		}
+	}
+	members, err := sealAudioTargets(CredentialKindSpeakerGroup, row.ID, v.Members)
+	if err == nil {
+		row.Members = members
+		if err = row.encode(); err == nil {
+			err = client.Save(&row).Error
+		}
+	}
+	if err != nil {
+		if created {
+			client.Where("id = ?", row.ID).Delete(&SpeakerGroup{})
+		}
+		return err
+	}
+	v.ID, v.CreatedAt, v.UpdatedAt = row.ID, row.CreatedAt, row.UpdatedAt
+	return nil
+}
+
+func (g *SpeakerGroups) Delete(id int64) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if _, ok := g.groups[id]; !ok {
+		return ErrSpeakerGroupNotFound
+	}
+	if err := g.db.GetDBInstance().Where("id = ?", id).Delete(&SpeakerGroup{}).Error; err != nil {
+		return err
+	}
+	dropAudioTargets(CredentialKindSpeakerGroup, id, 0, len(g.groups[id].Members))
+	delete(g.groups, id)
+	return nil
+}
+
+// List returns the groups, the member passwords are left out.
+func (g *SpeakerGroups) List() []SpeakerGroup {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	ret := make([]SpeakerGroup, 0, len(g.groups))
+	for _, v := range g.groups {
+		group := *v
+		group.Members = redactAudioTargets(v.Members)
+		ret = append(ret, group)
+	}
+	return ret
+}
+
+func (g *SpeakerGroups) HasSession(streamId string) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	_, ok := g.sessions[streamId]
+	return ok
+}
+
+// Start sends inputUrl to all the members of a group at once. The session goes on with
+// the members which started, it fails only when none did.
+func (g *SpeakerGroups) Start(streamId string, groupId int64, inputUrl string) ([]speakerMemberStatus, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if _, ok := g.sessions[streamId]; ok {
+		return nil, ErrBackwardAudioOngoing
+	}
+	group, ok := g.groups[groupId]
+	if !ok {
+		return nil, ErrSpeakerGroupNotFound
+	}
+
+	streams := g.streams()
+	statuses := make([]speakerMemberStatus, len(group.Members))
+	started := make([]bool, len(group.Members))
+	var wg sync.WaitGroup
+	for i, m := range group.Members {
+		wg.Add(1)
+		go func(i int, m audioTarget) {
+			defer wg.Done()
+			err := g.startMember(streams, speakerMemberStreamId(m), inputUrl, m)
+			if err != nil {
+				g.logger.Warn().Err(err).Str("stream_id", streamId).Msgf("failed to start backward audio of %s", m.key())
+				statuses[i] = newSpeakerMemberStatus(m, SpeakerMemberFailed, err)
+				return
+			}
+			started[i] = true
+			statuses[i] = newSpeakerMemberStatus(m, SpeakerMemberStarted, nil)
+		}(i, m)
+	}
+	wg.Wait()
+
+	session := &speakerSession{}
+	for i, m := range group.Members {
+		if started[i] {
+			session.members = append(session.members, m)
+			session.streams = append(session.streams, speakerMemberStreamId(m))
+		}
+	}
+	if len(session.members) == 0 {
+		return statuses, ErrSpeakerGroupNoMember
+	}
+	g.sessions[streamId] = session
+	return statuses, nil
+}
+
+func (g *SpeakerGroups) startMember(streams backwardAudioStreams, memberStreamId, inputUrl string, m audioTarget) error {
+	if streams.HasStream(memberStreamId) {
+		return ErrBackwardAudioOngoing
+	}
+	outputUrl, streamType, err := g.output(m)
+	if err != nil {
+		return err
+	}
+	_, err = streams.StartStream(memberStreamId, streamType, inputUrl, outputUrl)
+	return err
+}
+
+// Stop ends a session on all its members.
+func (g *SpeakerGroups) Stop(streamId string) error {
+	g.lock.Lock()
+	session, ok := g.sessions[streamId]
+	delete(g.sessions, streamId)
+	g.lock.Unlock()
+	if !ok {
+		return ErrBackwardAudioNotStarted
+	}
+	streams := g.streams()
+	var lastErr error
+	for _, id := range session.streams {
+		if !streams.HasStream(id) {
+			continue
+		}
+		if err := streams.StopStream(id); err != nil {
+			g.logger.Warn().Err(err).Str("stream_id", id).Msg("failed to stop member backward audio")
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Heartbeat reports the members of a session, it returns ErrBackwardAudioHasStopped once
+// all of them have stopped.
+func (g *SpeakerGroups) Heartbeat(streamId string) ([]speakerMemberStatus, error) {
+	g.lock.Lock()
+	session, ok := g.sessions[streamId]
+	g.lock.Unlock()
+	if !ok {
+		return nil, ErrBackwardAudioNotStarted
+	}
+	streams := g.streams()
+	statuses := make([]speakerMemberStatus, len(session.members))
+	alive := false
+	for i, m := range session.members {
+		id := session.streams[i]
+		if streams.HasStream(id) && !streams.IsStreamStopped(id) {
+			statuses[i] = newSpeakerMemberStatus(m, SpeakerMemberAlive, nil)
+			alive = true
+			continue
+		}
+		statuses[i] = newSpeakerMemberStatus(m, SpeakerMemberStopped, nil)
+	}
+	if !alive {
+		return statuses, ErrBackwardAudioHasStopped
+	}
+	return statuses, nil
+}
+
+// speakerMemberStreamId names the stream of a member by its device, so a member is
+// talked to by one session at a time.
+func speakerMemberStreamId(m audioTarget) string {
+	return "speaker_group:" + m.key()
+}
@@ -0,0 +1,127 @@
+package box
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/example/turing-common/log"
+)
+
+type fakeAudioStreams struct {
+	mux     sync.Mutex
+	streams map[string]string
+	stopped map[string]bool
+}
+
+func newFakeAudioStreams() *fakeAudioStreams {
+	return &fakeAudioStreams{streams: make(map[string]string), stopped: make(map[string]bool)}
+}
+
+func (f *fakeAudioStreams) HasStream(streamId string) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	_, ok := f.streams[streamId]
+	return ok
+}
+
+func (f *fakeAudioStreams) StartStream(streamId, streamType, inputUrl, outputUrl string) (string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.streams[streamId] = outputUrl
+	return outputUrl, nil
+}
+
+func (f *fakeAudioStreams) StopStream(streamId string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	delete(f.streams, streamId)
+	return nil
+}
+
+func (f *fakeAudioStreams) IsStreamStopped(streamId string) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.stopped[streamId]
+}
+
+func TestSpeakerGroupValidate(t *testing.T) {
+	speaker := audioTarget{DeviceType: AudioDTSpeaker, StreamUri: "10.0.0.2", Username: "root", Password: "pass"}
+	camera := audioTarget{DeviceType: AudioDTCamera, CameraID: 3}
+	onvifCamera := audioTarget{DeviceType: AudioDTOnvif, CameraID: 3}
+	onvifUri := audioTarget{DeviceType: AudioDTOnvif, StreamUri: "rtsp://10.0.0.3/stream1"}
+	assert.NoError(t, (&SpeakerGroup{Name: "lobby", Members: []audioTarget{speaker, camera, onvifCamera, onvifUri}}).validate())
+	assert.Equal(t, "onvif:3", onvifCamera.key())
+	assert.Equal(t, "onvif:rtsp://10.0.0.3/stream1", onvifUri.key())
+
+	for _, g := range []SpeakerGroup{
+		{Members: []audioTarget{speaker}},
+		{Name: "lobby"},
+		{Name: "lobby", Members: []audioTarget{speaker, speaker}},
+		{Name: "lobby", Members: []audioTarget{{DeviceType: AudioDTGroup}}},
+		{Name: "lobby", Members: []audioTarget{{DeviceType: AudioDTOnvif}}},
+	} {
+		assert.Equal(t, ErrSpeakerGroupInvalid, g.validate(), g)
+	}
+}
+
+func TestSpeakerGroupSession(t *testing.T) {
+	streams := newFakeAudioStreams()
+	g := &SpeakerGroups{
+		logger:   log.Logger("speaker_group"),
+		groups:   make(map[int64]*SpeakerGroup),
+		sessions: make(map[string]*speakerSession),
+		streams:  func() backwardAudioStreams { return streams },
+		output: func(m audioTarget) (string, string, error) {
+			if m.DeviceType == AudioDTCamera && m.CameraID == 9 {
+				return "", "", ErrNotBackwardAudioCamera
+			}
+			return "out/" + m.key(), "", nil
+		},
+	}
+	speaker := audioTarget{DeviceType: AudioDTSpeaker, StreamUri: "10.0.0.2", Username: "root", Password: "pass"}
+	g.groups[1] = &SpeakerGroup{ID: 1, Name: "lobby", Members: []audioTarget{
+		speaker,
+		{DeviceType: AudioDTCamera, CameraID: 3},
+		{DeviceType: AudioDTCamera, CameraID: 9},
+	}}
+	g.groups[2] = &SpeakerGroup{ID: 2, Name: "dock", Members: []audioTarget{speaker, {DeviceType: AudioDTCamera, CameraID: 9}}}
+
+	_, err := g.Start("s1", 5, "rtmp://in")
+	assert.Equal(t, ErrSpeakerGroupNotFound, err)
+	members, err := g.Start("s1", 1, "rtmp://in")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{SpeakerMemberStarted, SpeakerMemberStarted, SpeakerMemberFailed},
+		[]string{members[0].Status, members[1].Status, members[2].Status})
+	assert.Equal(t, ErrNotBackwardAudioCamera.Error(), members[2].Error)
+	assert.Len(t, streams.streams, 2)
+	_, err = g.Start("s1", 1, "rtmp://in")
+	assert.Equal(t, ErrBackwardAudioOngoing, err)
+
+	// the speaker is busy with the first session.
+	members, err = g.Start("s2", 2, "rtmp://in")
+	assert.Equal(t, ErrSpeakerGroupNoMember, err)
+	assert.Equal(t, ErrBackwardAudioOngoing.Error(), members[0].Error)
+	assert.False(t, g.HasSession("s2"))
+
+	streams.stopped[speakerMemberStreamId(speaker)] = true
+	members, err = g.Heartbeat("s1")
+	assert.NoError(t, err)
+	assert.Equal(t, SpeakerMemberStopped, members[0].Status)
+	assert.Equal(t, SpeakerMemberAlive, members[1].Status)
+	streams.stopped[speakerMemberStreamId(audioTarget{DeviceType: AudioDTCamera, CameraID: 3})] = true
+	_, err = g.Heartbeat("s1")
+	assert.Equal(t, ErrBackwardAudioHasStopped, err)
+
+	assert.NoError(t, g.Stop("s1"))
+	assert.Empty(t, streams.streams)
+	assert.Equal(t, ErrBackwardAudioNotStarted, g.Stop("s1"))
+	_, err = g.Heartbeat("s1")
+	assert.Equal(t, ErrBackwardAudioNotStarted, err)
+
+	for _, group := range g.List() {
+		assert.Empty(t, group.Members[0].Password)
+	}
+	assert.Equal(t, "pass", g.groups[1].Members[0].Password)
+}
@@ -0,0 +1,388 @@
+package box
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+	"github.com/example/turing-common/metrics"
+
+	"github.com/example/minibox/camera/uniview"
+	"github.com/example/minibox/stream"
+	"github.com/example/minibox/utils"
+)
+
+const (
+	StreamHealthReport = "nest.box.camera.stream_health_report"
+
+	streamHealthInterval    = 15 * time.Second
+	streamProbeWindow       = 5 * time.Second
+	streamProbeTimeout      = 15 * time.Second
+	streamStallRestartAfter = 20 * time.Second
+	streamMaxRestarts       = 5
+	streamDegradedFpsRatio  = 0.5
+
+	StreamHealthy  = "healthy"
+	StreamDegraded = "degraded"
+	StreamStalled  = "stalled"
+)
+
+// streamMetricLabels are the labels of the stream quality metrics, a camera may have
+// several streams of the same resolution. The series of a stream are deleted once it is
+// untracked.
+var streamMetricLabels = []string{"stream_id", "camera_id", "resolution"}
+
+// streamGauges are the stream quality metrics.
+var streamGauges = []string{"stream_fps", "stream_bitrate_kbps", "stream_keyframe_interval_seconds", "stream_stall_seconds"}
+
+var shmOnce sync.Once
+var streamHealthMonitor *StreamHealthMonitor
+
+// streamQuality is measured from the video packets of a probe window.
+type streamQuality struct {
+	Packets          int     `json:"packets"`
+	Fps              float64 `json:"fps"`
+	BitrateKbps      float64 `json:"bitrate_kbps"`
+	KeyFrameInterval float64 `json:"keyframe_interval"`
+}
+
+type streamHealth struct {
+	StreamId   string        `json:"stream_id"`
+	CameraId   int64         `json:"camera_id"`
+	StreamType string        `json:"stream_type"`
+	Resolution string        `json:"resolution"`
+	Status     string        `json:"status"`
+	Quality    streamQuality `json:"quality"`
+	StallSecs  int64         `json:"stall_secs"`
+	Restarts   int           `json:"restarts"`
+	CheckedAt  int64         `json:"checked_at"`
+
+	inputUri    string
+	outputUri   string
+	lastFrameAt time.Time
+	nominalFps  float64
+}
+
+// StreamHealthMonitor watches the streams started by the stream.Manager, restarts the
+// stalled ones and reports degraded streams to the cloud.
+type StreamHealthMonitor struct {
+	log     zerolog.Logger
+	device  Box
+	mux     sync.Mutex
+	streams map[string]*streamHealth
+}
+
+func GetStreamHealthMonitor(device Box) *StreamHealthMonitor {
+	shmOnce.Do(func() {
+		streamHealthMonitor = &StreamHealthMonitor{
+			log:     log.Logger("stream_health"),
+			device:  device,
+			streams: make(map[string]*streamHealth),
+		}
+		go streamHealthMonitor.run(context.Background())
+	})
+	return streamHealthMonitor
+}
+
+func (m *StreamHealthMonitor) Track(streamId string, cameraId int64, streamType, resolution, inputUri, outputUri string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.streams[streamId] = &streamHealth{
+		StreamId:    streamId,
+		CameraId:    cameraId,
+		StreamType:  streamType,
+		Resolution:  resolution,
+		Status:      StreamHealthy,
+		inputUri:    inputUri,
+		outputUri:   outputUri,
+		lastFrameAt: time.Now(),
+	}
+}
+
+func (m *StreamHealthMonitor) Untrack(streamId string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	s, ok := m.streams[streamId]
+	if !ok {
+		return
+	}
+	delete(m.streams, streamId)
+	labels := s.metricLabels()
+	for _, name := range streamGauges {
+		metrics.GaugeVecDelete(name, streamMetricLabels, labels)
+	}
+}
+
+func (s *streamHealth) metricLabels() []string {
+	return []string{s.StreamId, strconv.FormatInt(s.CameraId, 10), s.Resolution}
+}
+
+// All returns a copy of the health of every tracked stream.
+func (m *StreamHealthMonitor) All() []streamHealth {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	ret := make([]streamHealth, 0, len(m.streams))
+	for _, s := range m.streams {
+		ret = append(ret, *s)
+	}
+	return ret
+}
+
+func (m *StreamHealthMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(streamHealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.checkAll()
+		}
+	}
+}
+
+func (m *StreamHealthMonitor) checkAll() {
+	m.mux.Lock()
+	ids := make([]string, 0, len(m.streams))
+	for id := range m.streams {
+		ids = append(ids, id)
+	}
+	m.mux.Unlock()
+
+	manager := stream.GetManager(m.device.GetConfig())
+	wg := sync.WaitGroup{}
+	for _, id := range ids {
+		if !manager.HasStream(id) {
+			m.Untrack(id)
+			GetRestreamProxy(m.device).Release(restreamStreamConsumer(id))
+			continue
+		}
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			m.check(id)
+		}(id)
+	}
+	wg.Wait()
+}
+
+func (m *StreamHealthMonitor) check(streamId string) {
+	m.mux.Lock()
+	s, ok := m.streams[streamId]
+	if !ok {
+		m.mux.Unlock()
+		return
+	}
+	probeUri, probed := streamProbeUri(s.inputUri)
+	m.mux.Unlock()
+
+	manager := stream.GetManager(m.device.GetConfig())
+	stopped := manager.IsStreamStopped(streamId)
+	var quality streamQuality
+	if !stopped && probed {
+		out, err := probeStream(probeUri)
+		if err != nil {
+			m.log.Debug().Err(err).Str("stream_id", streamId).Msg("probe stream failed")
+		}
+		quality = parseProbePackets(out, streamProbeWindow)
+	}
+
+	now := time.Now()
+	m.mux.Lock()
+	if _, ok = m.streams[streamId]; !ok {
+		m.mux.Unlock()
+		return
+	}
+	oldStatus := s.Status
+	s.Quality = quality
+	s.CheckedAt = now.Unix()
+	// without a probe, the state of the stream.Manager is all there is to know
+	if quality.Packets > 0 || (!probed && !stopped) {
+		s.lastFrameAt = now
+		if quality.Fps > s.nominalFps {
+			s.nominalFps = quality.Fps
+		}
+	}
+	stall := now.Sub(s.lastFrameAt)
+	s.StallSecs = int64(stall.Seconds())
+	s.Status = streamStatus(quality, s.nominalFps, stall, stopped, probed)
+	needRestart := s.Status == StreamStalled && stall >= streamStallRestartAfter && s.Restarts < streamMaxRestarts
+	if needRestart {
+		// give the restarted stream a full stall period before the next restart.
+		s.Restarts++
+		s.lastFrameAt = now
+	}
+	// set under the lock, so that Untrack deletes the series after the last set
+	labels := s.metricLabels()
+	if probed {
+		metrics.GaugeVecSet("stream_fps", streamMetricLabels, labels, quality.Fps)
+		metrics.GaugeVecSet("stream_bitrate_kbps", streamMetricLabels, labels, quality.BitrateKbps)
+		metrics.GaugeVecSet("stream_keyframe_interval_seconds", streamMetricLabels, labels, quality.KeyFrameInterval)
+	}
+	metrics.GaugeVecSet("stream_stall_seconds", streamMetricLabels, labels, stall.Seconds())
+	snapshot := *s
+	m.mux.Unlock()
+
+	if oldStatus != snapshot.Status {
+		m.log.Info().Str("stream_id", streamId).Msgf("stream status changed from %s to %s", oldStatus, snapshot.Status)
+		m.report(snapshot)
+	}
+	if needRestart {
+		m.restart(snapshot)
+	}
+}
+
+// streamStatus classifies a stream, a stream is degraded when its frame rate drops
+// under half of the best one seen. A stream which can not be probed is healthy until the
+// stream.Manager stops it.
+func streamStatus(q streamQuality, nominalFps float64, stall time.Duration, stopped, probed bool) string {
+	if !probed && !stopped {
+		return StreamHealthy
+	}
+	if stopped || q.Packets == 0 {
+		if stall >= streamHealthInterval || stopped {
+			return StreamStalled
+		}
+		return StreamDegraded
+	}
+	if nominalFps > 0 && q.Fps < nominalFps*streamDegradedFpsRatio {
+		return StreamDegraded
+	}
+	return StreamHealthy
+}
+
+func (m *StreamHealthMonitor) restart(s streamHealth) {
+	manager := stream.GetManager(m.device.GetConfig())
+	metrics.CounterVecAdd("stream_restarts_total", []string{"camera_id"}, []string{strconv.FormatInt(s.CameraId, 10)}, 1)
+	m.log.Warn().Str("stream_id", s.StreamId).Int("restarts", s.Restarts).Msg("restart stalled stream")
+
+	if err := manager.StopStream(s.StreamId); err != nil {
+		m.log.Warn().Err(err).Str("stream_id", s.StreamId).Msg("stop stalled stream failed")
+	}
+	// ask the camera for an I frame, so that the players can decode the restarted stream at once.
+	if cam, err := m.device.GetCamera(int(s.CameraId)); err == nil && cam.GetBrand() == utils.Uniview {
+		if unvCam, ok := cam.(*uniview.BaseUniviewCamera); ok {
+			streamIndex := uint32(utils.GetResolutionIdByString(s.Resolution))
+			if err := unvCam.RequestKeyFrame(unvCam.GetChannel(), streamIndex, 0); err != nil {
+				m.log.Debug().Err(err).Str("stream_id", s.StreamId).Msg("request key frame failed")
+			}
+		}
+	}
+	if _, err := manager.StartStream(s.StreamId, s.StreamType, s.inputUri, s.outputUri); err != nil {
+		m.log.Error().Err(err).Str("stream_id", s.StreamId).Msg("restart stalled stream failed")
+	}
+}
+
+func (m *StreamHealthMonitor) report(s streamHealth) {
+	ws := m.device.WsClient()
+	if ws == nil {
+		return
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"act": StreamHealthReport,
+		"arg": s,
+	})
+	if err != nil {
+		return
+	}
+	ws.Send(payload)
+}
+
+// streamProbeUri returns the uri to probe the input of a stream at. Only the local inputs
+// are probed: the restream proxy and the mosaic composer share the pull of the camera,
+// where a probe of the camera would open a session of its own and a probe of the output
+// would pull the stream back over the uplink. The playbacks are not probed.
+func streamProbeUri(inputUri string) (string, bool) {
+	u, err := url.Parse(inputUri)
+	if err != nil || (u.Scheme != "rtsp" && u.Scheme != "rtmp") {
+		return "", false
+	}
+	if ip := net.ParseIP(u.Hostname()); u.Hostname() != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", false
+	}
+	return inputUri, true
+}
+
+// probeStream reads the video packets of a stream during streamProbeWindow, one
+// "pts_time,size,flags" line per packet.
+func probeStream(uri string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), streamProbeTimeout)
+	defer cancel()
+	args := []string{"-v", "error"}
+	if strings.HasPrefix(uri, "rtsp") {
+		args = append(args, "-rtsp_transport", "tcp")
+	}
+	args = append(args,
+		"-select_streams", "v:0",
+		"-read_intervals", "%+"+strconv.Itoa(int(streamProbeWindow.Seconds())),
+		"-show_entries", "packet=pts_time,size,flags",
+		"-of", "csv=p=0",
+		uri,
+	)
+	cmd := exec.CommandContext(ctx, "ffprobe", args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	return out.String(), err
+}
+
+func parseProbePackets(out string, window time.Duration) streamQuality {
+	q := streamQuality{}
+	var first, last, lastKey float64
+	var keyIntervals []float64
+	var bytesRead int64
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) < 3 {
+			continue
+		}
+		pts, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[1], 10, 64)
+		if q.Packets == 0 {
+			first = pts
+			lastKey = -1
+		}
+		q.Packets++
+		last = pts
+		bytesRead += size
+		if strings.HasPrefix(fields[2], "K") {
+			if lastKey >= 0 {
+				keyIntervals = append(keyIntervals, pts-lastKey)
+			}
+			lastKey = pts
+		}
+	}
+	if q.Packets == 0 {
+		return q
+	}
+	duration := last - first
+	if duration <= 0 {
+		duration = window.Seconds()
+	}
+	q.Fps = float64(q.Packets-1) / duration
+	if q.Packets == 1 {
+		q.Fps = 1 / duration
+	}
+	q.BitrateKbps = float64(bytesRead*8) / duration / 1000
+	if len(keyIntervals) > 0 {
+		var sum float64
+		for _, v := range keyIntervals {
+			sum += v
+		}
+		q.KeyFrameInterval = sum / float64(len(keyIntervals))
+	}
+	return q
+}
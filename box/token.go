@@ -58,7 +58,7 @@ func (b *baseBox) GetTokenByBox(name string) (*cloud.Token, error) {
 		return nil, err
 	}
 	b.setTokenInCache(cacheKey, *token)
-	b.logger.Debug().Msgf("GetTokenByBox, token: %+v", *token)
+	b.logger.Debug().Msgf("GetTokenByBox, token: %s", RedactedJSON(token))
 	return token, nil
 }
 
@@ -101,6 +101,6 @@ func (b *baseBox) GetTokenByCamera(cameraId int, name string) (*cloud.Token, err
 		return nil, err
 	}
 	b.setTokenInCache(cacheKey, *token)
-	b.logger.Debug().Msgf("GetTokenByCamera, token: %+v", *token)
+	b.logger.Debug().Msgf("GetTokenByCamera, token: %s", RedactedJSON(token))
 	return token, nil
 }
@@ -0,0 +1,367 @@
+package box
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+
+	"github.com/example/minibox/camera/base"
+	"github.com/example/minibox/db"
+	"github.com/example/minibox/nvr"
+	"github.com/example/minibox/pem"
+)
+
+// The kinds of the credentials of the vault, the device of an NVR credential is its SN,
+// the one of a camera its id, and the one of a rule, a webhook or a target its id.
+const (
+	CredentialKindNVR              = "nvr"
+	CredentialKindCamera           = "camera"
+	CredentialKindMQTT             = "mqtt"
+	CredentialKindSIP              = "sip"
+	CredentialKindPushAuthPassword = "push_auth_password"
+	CredentialKindPushAuthToken    = "push_auth_token"
+	CredentialKindWebhook          = "webhook"
+	CredentialKindSpeakerGroup     = "speaker_group"
+	CredentialKindAnnouncement     = "announcement"
+
+	// credentialDeviceConfig is the device of the single row configs.
+	credentialDeviceConfig = "config"
+
+	// vaultRefPrefix starts the refs stored in the tables in place of the secrets kept in
+	// the vault, vault:<kind>/<device>.
+	vaultRefPrefix = "vault:"
+)
+
+var (
+	ErrCredentialNotFound = errors.New("credential not found")
+	ErrCredentialInvalid  = errors.New("invalid credential")
+	ErrVaultLocked        = errors.New("credential vault has no rsa key")
+)
+
+var credentialVault *CredentialVault
+
+// Credential is a device credential of the vault. Its password is encrypted with the RSA
+// key of the box and stored base64 encoded in Secret, it is persisted in the credentials
+// table.
+type Credential struct {
+	Kind      string    `json:"kind" gorm:"primary_key"`
+	Device    string    `json:"device" gorm:"primary_key"`
+	Username  string    `json:"username"`
+	Secret    string    `json:"-"`
+	HasSecret bool      `json:"has_secret" gorm:"-"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type credentialKey struct {
+	kind   string
+	device string
+}
+
+// vaultEncrypt encrypts with the public key of the box encryptor, which decrypts with
+// its private key.
+func vaultEncrypt(data []byte) ([]byte, error) {
+	encryptor := pem.GetEncryptor()
+	if encryptor == nil {
+		return nil, ErrVaultLocked
+	}
+	return rsa.EncryptPKCS1v15(rand.Reader, encryptor.GetDestPublicKey(), data)
+}
+
+func vaultDecrypt(data []byte) ([]byte, error) {
+	encryptor := pem.GetEncryptor()
+	if encryptor == nil {
+		return nil, ErrVaultLocked
+	}
+	return encryptor.DoPrivateDecrypt(data)
+}
+
+// CredentialVault keeps the credentials of the devices encrypted, on disk and in memory.
+// The passwords are only decrypted by Get.
+type CredentialVault struct {
+	db          db.Client
+	logger      zerolog.Logger
+	lock        sync.Mutex
+	credentials map[credentialKey]*Credential
+
+	encrypt func([]byte) ([]byte, error)
+	decrypt func([]byte) ([]byte, error)
+}
+
+func NewCredentialVault(d db.Client) *CredentialVault {
+	v := &CredentialVault{
+		db:          d,
+		logger:      log.Logger("credential_vault"),
+		credentials: make(map[credentialKey]*Credential),
+		encrypt:     vaultEncrypt,
+		decrypt:     vaultDecrypt,
+	}
+	credentialVault = v
+
+	client := d.GetDBInstance()
+	if err := client.AutoMigrate(&Credential{}); err != nil {
+		v.logger.Error().Err(err).Msg("failed to migrate credentials")
+	}
+	var credentials []*Credential
+	if err := client.Find(&credentials).Error; err != nil {
+		v.logger.Error().Err(err).Msg("failed to load credentials")
+	}
+	v.lock.Lock()
+	for _, c := range credentials {
+		v.credentials[credentialKey{c.Kind, c.Device}] = c
+	}
+	v.lock.Unlock()
+	return v
+}
+
+func GetCredentialVault() *CredentialVault {
+	return credentialVault
+}
+
+// sealNVRCredential keeps the credential of an NVR in the vault and returns the ref the
+// table of the NVR manager stores in place of its password. The password is returned as
+// it is when the box has no vault or the vault fails.
+func sealNVRCredential(sn, username, password string) string {
+	v := GetCredentialVault()
+	if v == nil || password == "" {
+		return password
+	}
+	if _, _, ok := parseVaultRef(password); ok {
+		return password
+	}
+	if err := v.Put(CredentialKindNVR, sn, username, password); err != nil {
+		v.logger.Error().Err(err).Str("nvr_sn", sn).Msg("failed to store nvr credential")
+		return password
+	}
+	return vaultRef(CredentialKindNVR, sn)
+}
+
+// readNVRCredential reads the username and the password of an NVR from the table of the
+// NVR manager.
+func readNVRCredential(nm nvr.NVRManager, sn string) (string, string, error) {
+	username, stored, _, _, err := nm.ReadNVRFromDB(sn)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := ResolveSecret(stored)
+	if err != nil {
+		return "", "", err
+	}
+	return username, password, nil
+}
+
+// putCameraCredential keeps the credential of a camera in the vault, when the box has one
+// and the credential changed. A camera row may store vaultRef(CredentialKindCamera, id) in
+// place of its password.
+func putCameraCredential(id int, username, password string) {
+	v := GetCredentialVault()
+	if v == nil || id < 1 || password == "" {
+		return
+	}
+	if _, _, ok := parseVaultRef(password); ok {
+		return
+	}
+	device := strconv.Itoa(id)
+	if u, p, err := v.Get(CredentialKindCamera, device); err == nil && u == username && p == password {
+		return
+	}
+	if err := v.Put(CredentialKindCamera, device, username, password); err != nil {
+		v.logger.Error().Err(err).Int("camera_id", id).Msg("failed to store camera credential")
+	}
+}
+
+// cameraPassword returns the password of a camera to build its clients with, the one of
+// the vault when the camera stores a ref.
+func cameraPassword(cam base.Camera) string {
+	password, err := ResolveSecret(cam.GetPassword())
+	if err != nil {
+		log.Logger("credential_vault").Error().Err(err).Int("camera_id", cam.GetID()).Msg("failed to read camera credential")
+	}
+	return password
+}
+
+func vaultRef(kind, device string) string {
+	return vaultRefPrefix + kind + "/" + device
+}
+
+func parseVaultRef(s string) (string, string, bool) {
+	if !strings.HasPrefix(s, vaultRefPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, vaultRefPrefix), "/", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// ResolveSecret returns the secret of a value stored in a table in place of a secret: a
+// vault ref is read from the vault, any other value is the secret itself. The NVR manager
+// resolves the passwords of its table with it when it builds the clients of the NVRs.
+func ResolveSecret(stored string) (string, error) {
+	kind, device, ok := parseVaultRef(stored)
+	if !ok {
+		return stored, nil
+	}
+	v := GetCredentialVault()
+	if v == nil {
+		return "", ErrVaultLocked
+	}
+	_, secret, err := v.Get(kind, device)
+	return secret, err
+}
+
+// sealSecret keeps a secret in the vault and returns the ref to store in its place. An
+// empty secret is stored as it is, and so is every secret when the box has no vault.
+func sealSecret(kind, device, secret string) (string, error) {
+	v := GetCredentialVault()
+	if v == nil || secret == "" {
+		return secret, nil
+	}
+	if _, _, ok := parseVaultRef(secret); ok {
+		return secret, nil
+	}
+	if err := v.Put(kind, device, "", secret); err != nil {
+		return "", err
+	}
+	return vaultRef(kind, device), nil
+}
+
+// loadSecret returns the secret of a value loaded from a table, and the ref to store in
+// its place. A secret still stored as it is is moved to the vault, the caller stores the
+// ref when it differs from the loaded value.
+func loadSecret(kind, device, stored string) (string, string, error) {
+	if _, _, ok := parseVaultRef(stored); !ok {
+		ref, err := sealSecret(kind, device, stored)
+		return stored, ref, err
+	}
+	secret, err := ResolveSecret(stored)
+	return secret, stored, err
+}
+
+// migrateSecret sets *secret, loaded from column of a row of model, to its secret. A
+// secret still stored as it is is moved to the vault and the column of the row, the one
+// matching where, is set to its ref.
+func migrateSecret(d db.Client, kind, device string, secret *string, model interface{}, column string, where ...interface{}) error {
+	stored := *secret
+	value, ref, err := loadSecret(kind, device, stored)
+	*secret = value
+	if err != nil || ref == stored {
+		return err
+	}
+	return d.GetDBInstance().Model(model).Where(where[0], where[1:]...).Update(column, ref).Error
+}
+
+// dropSecret removes the secret of a deleted device from the vault.
+func dropSecret(kind, device string) {
+	v := GetCredentialVault()
+	if v == nil {
+		return
+	}
+	if err := v.Delete(kind, device); err != nil && err != ErrCredentialNotFound {
+		v.logger.Error().Err(err).Str("kind", kind).Str("device", device).Msg("failed to delete credential")
+	}
+}
+
+func (v *CredentialVault) seal(password string) (string, error) {
+	data, err := v.encrypt([]byte(password))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func (v *CredentialVault) open(secret string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+	password, err := v.decrypt(data)
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+// Put stores the credential of a device, replacing the saved one.
+func (v *CredentialVault) Put(kind, device, username, password string) error {
+	if kind == "" || device == "" {
+		return ErrCredentialInvalid
+	}
+	secret, err := v.seal(password)
+	if err != nil {
+		return err
+	}
+	c := &Credential{Kind: kind, Device: device, Username: username, Secret: secret}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if old, ok := v.credentials[credentialKey{kind, device}]; ok {
+		c.CreatedAt = old.CreatedAt
+	}
+	if err := v.db.GetDBInstance().Save(c).Error; err != nil {
+		return err
+	}
+	v.credentials[credentialKey{kind, device}] = c
+	return nil
+}
+
+// Get returns the username and the decrypted password of a device.
+func (v *CredentialVault) Get(kind, device string) (string, string, error) {
+	v.lock.Lock()
+	c, ok := v.credentials[credentialKey{kind, device}]
+	v.lock.Unlock()
+	if !ok {
+		return "", "", ErrCredentialNotFound
+	}
+	password, err := v.open(c.Secret)
+	if err != nil {
+		return "", "", err
+	}
+	return c.Username, password, nil
+}
+
+func (v *CredentialVault) Delete(kind, device string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if _, ok := v.credentials[credentialKey{kind, device}]; !ok {
+		return ErrCredentialNotFound
+	}
+	if err := v.db.GetDBInstance().Where("kind = ? AND device = ?", kind, device).Delete(&Credential{}).Error; err != nil {
+		return err
+	}
+	delete(v.credentials, credentialKey{kind, device})
+	return nil
+}
+
+// List returns the credentials sorted by kind and device, without their secrets.
+func (v *CredentialVault) List() []Credential {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	ret := make([]Credential, 0, len(v.credentials))
+	for _, c := range v.credentials {
+		ret = append(ret, Credential{
+			Kind:      c.Kind,
+			Device:    c.Device,
+			Username:  c.Username,
+			HasSecret: c.Secret != "",
+			UpdatedAt: c.UpdatedAt,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Kind != ret[j].Kind {
+			return ret[i].Kind < ret[j].Kind
+		}
+		return ret[i].Device < ret[j].Device
+	})
+	return ret
+}
@@ -0,0 +1,112 @@
+package box
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCredentialVault(t *testing.T) *CredentialVault {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CredentialVault{
+		credentials: make(map[credentialKey]*Credential),
+		encrypt: func(data []byte) ([]byte, error) {
+			return rsa.EncryptPKCS1v15(rand.Reader, &key.PublicKey, data)
+		},
+		decrypt: func(data []byte) ([]byte, error) {
+			return rsa.DecryptPKCS1v15(rand.Reader, key, data)
+		},
+	}
+}
+
+func TestCredentialVaultGet(t *testing.T) {
+	v := newTestCredentialVault(t)
+	secret, err := v.seal("pw")
+	assert.NoError(t, err)
+	assert.NotContains(t, secret, "pw")
+	v.credentials[credentialKey{CredentialKindNVR, "NVR2"}] = &Credential{Kind: CredentialKindNVR, Device: "NVR2", Username: "admin", Secret: secret}
+	v.credentials[credentialKey{CredentialKindNVR, "NVR1"}] = &Credential{Kind: CredentialKindNVR, Device: "NVR1", Username: "root"}
+
+	username, password, err := v.Get(CredentialKindNVR, "NVR2")
+	assert.NoError(t, err)
+	assert.Equal(t, "admin", username)
+	assert.Equal(t, "pw", password)
+	_, _, err = v.Get(CredentialKindNVR, "NVR3")
+	assert.Equal(t, ErrCredentialNotFound, err)
+
+	assert.Equal(t, []Credential{
+		{Kind: CredentialKindNVR, Device: "NVR1", Username: "root"},
+		{Kind: CredentialKindNVR, Device: "NVR2", Username: "admin", HasSecret: true},
+	}, v.List())
+	assert.Equal(t, ErrCredentialInvalid, v.Put(CredentialKindNVR, "", "admin", "pw"))
+}
+
+func TestVaultSecrets(t *testing.T) {
+	saved := credentialVault
+	defer func() { credentialVault = saved }()
+
+	// without a vault the secrets are stored as they are
+	credentialVault = nil
+	ref, err := sealSecret(CredentialKindWebhook, "1", "s3cret")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", ref)
+	secret, ref, err := loadSecret(CredentialKindWebhook, "1", "s3cret")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", secret)
+	assert.Equal(t, "s3cret", ref)
+	_, _, err = loadSecret(CredentialKindWebhook, "1", vaultRef(CredentialKindWebhook, "1"))
+	assert.Equal(t, ErrVaultLocked, err)
+	assert.Equal(t, "s3cret", sealNVRCredential("NVR1", "admin", "s3cret"))
+
+	v := newTestCredentialVault(t)
+	credentialVault = v
+	sealed, err := v.seal("s3cret")
+	assert.NoError(t, err)
+	v.credentials[credentialKey{CredentialKindAnnouncement, "3/1"}] = &Credential{Kind: CredentialKindAnnouncement, Device: "3/1", Secret: sealed}
+
+	ref = vaultRef(CredentialKindAnnouncement, "3/1")
+	assert.Equal(t, "vault:announcement/3/1", ref)
+	kind, device, ok := parseVaultRef(ref)
+	assert.True(t, ok)
+	assert.Equal(t, CredentialKindAnnouncement, kind)
+	assert.Equal(t, "3/1", device)
+	_, _, ok = parseVaultRef("vault:announcement")
+	assert.False(t, ok)
+
+	secret, stored, err := loadSecret(CredentialKindAnnouncement, "3/1", ref)
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", secret)
+	assert.Equal(t, ref, stored)
+	_, _, err = loadSecret(CredentialKindAnnouncement, "3/2", vaultRef(CredentialKindAnnouncement, "3/2"))
+	assert.Equal(t, ErrCredentialNotFound, err)
+
+	// the clients resolve the refs of the tables and take the other values as they are
+	secret, err = ResolveSecret(ref)
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", secret)
+	secret, err = ResolveSecret("plain")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", secret)
+	assert.Equal(t, ref, sealNVRCredential("NVR1", "admin", ref))
+
+	// the refs and the empty secrets are stored as they are
+	stored, err = sealSecret(CredentialKindAnnouncement, "3/1", ref)
+	assert.NoError(t, err)
+	assert.Equal(t, ref, stored)
+	stored, err = sealSecret(CredentialKindAnnouncement, "3/0", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "", stored)
+
+	targets := []audioTarget{
+		{DeviceType: AudioDTCamera, CameraID: 2},
+		{DeviceType: AudioDTSpeaker, StreamUri: "rtsp://10.0.0.3/audio", Username: "admin", Password: ref},
+	}
+	assert.NoError(t, loadAudioTargets(nil, CredentialKindAnnouncement, 3, targets, &Announcement{}, "targets"))
+	assert.Equal(t, "", targets[0].Password)
+	assert.Equal(t, "s3cret", targets[1].Password)
+}
@@ -0,0 +1,754 @@
+package box
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/example/turing-common/log"
+
+	"github.com/example/minibox/apis/structs"
+	"github.com/example/minibox/cloud"
+	"github.com/example/minibox/db"
+	"github.com/example/minibox/utils"
+)
+
+const (
+	WebhookKindCameraEvent = "camera_event"
+	WebhookKindAlarm       = "alarm"
+	WebhookKindHaloEvent   = "halo_event"
+	WebhookKindTest        = "test"
+
+	WebhookSnapshotNone    = ""
+	WebhookSnapshotDataUri = "data_uri"
+	WebhookSnapshotUrl     = "url"
+
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+
+	// The headers of a delivery, the signature is the hex HMAC-SHA256 of
+	// "<timestamp>.<body>" keyed by the secret of the webhook.
+	WebhookHeaderEvent     = "X-Minibox-Event"
+	WebhookHeaderDelivery  = "X-Minibox-Delivery"
+	WebhookHeaderTimestamp = "X-Minibox-Timestamp"
+	WebhookHeaderSignature = "X-Minibox-Signature"
+
+	webhookSnapshotDir     = "webhook_snapshots"
+	webhookSnapshotPath    = "api/webhooks/snapshots/"
+	webhookTimeout         = 10 * time.Second
+	webhookPollInterval    = 5 * time.Second
+	webhookPruneInterval   = time.Hour
+	webhookBatchSize       = 20
+	webhookMaxAttempts     = 8
+	webhookFirstBackoff    = 10 * time.Second
+	webhookMaxBackoff      = 30 * time.Minute
+	webhookLogRetention    = 7 * 24 * time.Hour
+	webhookSnapshotTTL     = 24 * time.Hour
+	webhookEventImageTTL   = time.Minute
+	webhookEventImageMax   = 16
+	webhookDefaultLogLimit = 50
+	webhookMaxLogLimit     = 500
+)
+
+var (
+	ErrWebhookInvalid  = errors.New("invalid webhook")
+	ErrWebhookNotFound = errors.New("webhook not found")
+	ErrWebhookStatus   = errors.New("unexpected webhook response status")
+)
+
+var webhookDispatcher *WebhookDispatcher
+
+// Webhook posts the selected camera events, the alarms and the Halo events to a local
+// Url. EventTypes are the keys of defaultAlgoMap. Snapshot adds a snapshot of the camera
+// to the camera events, as a data uri or as a url on the box. It is persisted in the
+// webhooks table, EventTypes are stored as json and the secret as a ref to the credential
+// vault.
+type Webhook struct {
+	ID             int64     `json:"id"`
+	Name           string    `json:"name"`
+	Url            string    `json:"url"`
+	Secret         string    `json:"secret,omitempty"`
+	HasSecret      bool      `json:"has_secret" gorm:"-"`
+	Enabled        bool      `json:"enabled"`
+	Alarms         bool      `json:"alarms"`
+	HaloEvents     bool      `json:"halo_events"`
+	Snapshot       string    `json:"snapshot"`
+	EventTypesJSON string    `json:"-" gorm:"column:event_types"`
+	EventTypes     []string  `json:"event_types" gorm:"-"`
+	CreatedAt      time.Time `json:"-"`
+	UpdatedAt      time.Time `json:"-"`
+}
+
+func (w *Webhook) validate() error {
+	u, err := url.Parse(w.Url)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return ErrWebhookInvalid
+	}
+	switch w.Snapshot {
+	case WebhookSnapshotNone, WebhookSnapshotDataUri, WebhookSnapshotUrl:
+	default:
+		return ErrWebhookInvalid
+	}
+	for _, t := range w.EventTypes {
+		if _, ok := defaultAlgoMap[t]; !ok {
+			return ErrWebhookInvalid
+		}
+	}
+	return nil
+}
+
+func (w *Webhook) encode() error {
+	eventTypes, err := json.Marshal(w.EventTypes)
+	if err != nil {
+		return err
+	}
+	w.EventTypesJSON = string(eventTypes)
+	return nil
+}
+
+func (w *Webhook) decode() error {
+	if w.EventTypesJSON == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(w.EventTypesJSON), &w.EventTypes)
+}
+
+func (w *Webhook) hasEventType(eventType string) bool {
+	for _, t := range w.EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns the signature of a body sent at timestamp.
+func (w *Webhook) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDelivery is a payload to post to a webhook, it is retried with backoff until it
+// is delivered or has failed webhookMaxAttempts times. The deliveries are kept in the
+// webhook_deliveries table for webhookLogRetention as the delivery log.
+type WebhookDelivery struct {
+	ID            int64      `json:"id"`
+	WebhookID     int64      `json:"webhook_id" gorm:"index"`
+	Kind          string     `json:"kind"`
+	EventType     string     `json:"event_type"`
+	Payload       string     `json:"-"`
+	Status        string     `json:"status" gorm:"index"`
+	Attempts      int        `json:"attempts"`
+	StatusCode    int        `json:"status_code"`
+	LastError     string     `json:"last_error"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	DeliveredAt   *time.Time `json:"delivered_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// webhookPayload is the json body of a delivery.
+type webhookPayload struct {
+	EventID     string                `json:"event_id"`
+	Kind        string                `json:"kind"`
+	EventType   string                `json:"event_type,omitempty"`
+	BoxID       string                `json:"box_id"`
+	Timestamp   time.Time             `json:"timestamp"`
+	CameraID    int                   `json:"camera_id,omitempty"`
+	StartedAt   *time.Time            `json:"started_at,omitempty"`
+	EndedAt     *time.Time            `json:"ended_at,omitempty"`
+	Meta        *structs.MetaScanData `json:"meta,omitempty"`
+	Alarm       *cloud.AlarmInfo      `json:"alarm,omitempty"`
+	Halo        *cloud.HaloEventInfo  `json:"halo,omitempty"`
+	Snapshot    string                `json:"snapshot,omitempty"`
+	SnapshotUrl string                `json:"snapshot_url,omitempty"`
+
+	// imageKey is the S3 key of the image of the event, if it has one.
+	imageKey string
+}
+
+// webhookEventImage is the content of an event image uploaded to S3, kept until the
+// webhooks of the event are queued.
+type webhookEventImage struct {
+	data       []byte
+	uploadedAt time.Time
+}
+
+// webhookBackoff is the delay before the next attempt of a delivery which failed
+// attempts times.
+func webhookBackoff(attempts int) time.Duration {
+	d := webhookFirstBackoff
+	for i := 1; i < attempts && d < webhookMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > webhookMaxBackoff {
+		return webhookMaxBackoff
+	}
+	return d
+}
+
+func webhookRandomId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// webhookRetry is the backoff of a webhook, after its failures in a row. A webhook which
+// backs off is not posted to until the end of its backoff.
+type webhookRetry struct {
+	failures int
+	until    time.Time
+}
+
+// WebhookDispatcher queues the events of the box as deliveries of the matching webhooks
+// and posts them in the background.
+type WebhookDispatcher struct {
+	device   Box
+	db       db.Client
+	logger   zerolog.Logger
+	lock     sync.Mutex
+	webhooks map[int64]*Webhook
+	client   *http.Client
+	kick     chan struct{}
+	now      func() time.Time
+	retries  map[int64]webhookRetry
+
+	snapshot    func(cameraId int) ([]byte, error)
+	snapshotDir string
+	images      map[string]webhookEventImage
+	snapshotUrl func(name string) string
+}
+
+func NewWebhookDispatcher(device Box, d db.Client) *WebhookDispatcher {
+	w := &WebhookDispatcher{
+		device:      device,
+		db:          d,
+		logger:      log.Logger("webhook"),
+		webhooks:    make(map[int64]*Webhook),
+		client:      &http.Client{Timeout: webhookTimeout},
+		kick:        make(chan struct{}, 1),
+		now:         time.Now,
+		retries:     make(map[int64]webhookRetry),
+		snapshotDir: filepath.Join(device.GetConfig().GetDataStoreDir(), webhookSnapshotDir),
+		images:      make(map[string]webhookEventImage),
+	}
+	w.snapshot = w.cameraSnapshot
+	w.snapshotUrl = func(name string) string {
+		return fmt.Sprintf("http://%s:%d/%s%s", utils.GetLocalIp(), device.GetConfig().GetAPIServicePort(), webhookSnapshotPath, name)
+	}
+	webhookDispatcher = w
+
+	client := d.GetDBInstance()
+	if err := client.AutoMigrate(&Webhook{}, &WebhookDelivery{}); err != nil {
+		w.logger.Error().Err(err).Msg("failed to migrate webhook tables")
+	}
+	var webhooks []*Webhook
+	if err := client.Find(&webhooks).Error; err != nil {
+		w.logger.Error().Err(err).Msg("failed to load webhooks")
+	}
+	w.lock.Lock()
+	for _, v := range webhooks {
+		if err := v.decode(); err != nil {
+			w.logger.Error().Err(err).Int64("webhook_id", v.ID).Msg("failed to decode webhook")
+			continue
+		}
+		if err := migrateSecret(d, CredentialKindWebhook, strconv.FormatInt(v.ID, 10), &v.Secret, &Webhook{}, "secret", "id = ?", v.ID); err != nil {
+			w.logger.Error().Err(err).Int64("webhook_id", v.ID).Msg("failed to load webhook secret")
+		}
+		w.webhooks[v.ID] = v
+	}
+	w.lock.Unlock()
+	go w.run()
+	return w
+}
+
+func GetWebhookDispatcher() *WebhookDispatcher {
+	return webhookDispatcher
+}
+
+// Save creates or updates a webhook, an empty secret keeps the saved one.
+func (w *WebhookDispatcher) Save(v *Webhook) error {
+	if err := v.validate(); err != nil {
+		return err
+	}
+	if err := v.encode(); err != nil {
+		return err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if v.ID > 0 {
+		old, ok := w.webhooks[v.ID]
+		if !ok {
+			return ErrWebhookNotFound
+		}
+		if v.Secret == "" {
+			v.Secret = old.Secret
+		}
+		v.CreatedAt = old.CreatedAt
+	}
+	if err := w.save(v); err != nil {
+		return err
+	}
+	saved := *v
+	w.webhooks[v.ID] = &saved
+	v.HasSecret, v.Secret = v.Secret != "", ""
+	return nil
+}
+
+// save stores a webhook with the vault ref of its secret. The secret is kept by the id of
+// the webhook, a new webhook is created without it first.
+func (w *WebhookDispatcher) save(v *Webhook) error {
+	client := w.db.GetDBInstance()
+	row := *v
+	created := v.ID == 0
+	if created {
+		row.Secret = ""
+		if err := client.Create(&row).Error; err != nil {
+			return err
+		}
+	}
+	secret, err := sealSecret(CredentialKindWebhook, strconv.FormatInt(row.ID, 10), v.Secret)
+	if err == nil {
+		row.Secret = secret
+		err = client.Save(&row).Error
+	}
+	if err != nil {
+		if created {
+			client.Where("id = ?", row.ID).Delete(&Webhook{})
+		}
+		return err
+	}
+	v.ID, v.CreatedAt, v.UpdatedAt = row.ID, row.CreatedAt, row.UpdatedAt
+	return nil
+}
+
+// Delete removes a webhook with its deliveries.
+func (w *WebhookDispatcher) Delete(id int64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.webhooks[id]; !ok {
+		return ErrWebhookNotFound
+	}
+	client := w.db.GetDBInstance()
+	if err := client.Where("id = ?", id).Delete(&Webhook{}).Error; err != nil {
+		return err
+	}
+	if err := client.Where("webhook_id = ?", id).Delete(&WebhookDelivery{}).Error; err != nil {
+		w.logger.Warn().Err(err).Int64("webhook_id", id).Msg("failed to delete webhook deliveries")
+	}
+	delete(w.webhooks, id)
+	delete(w.retries, id)
+	dropSecret(CredentialKindWebhook, strconv.FormatInt(id, 10))
+	return nil
+}
+
+// List returns the webhooks without their secrets.
+func (w *WebhookDispatcher) List() []Webhook {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	ret := make([]Webhook, 0, len(w.webhooks))
+	for _, v := range w.webhooks {
+		c := *v
+		c.HasSecret, c.Secret = c.Secret != "", ""
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// Deliveries returns the latest deliveries of a webhook, newest first.
+func (w *WebhookDispatcher) Deliveries(webhookId int64, limit int) ([]WebhookDelivery, error) {
+	w.lock.Lock()
+	_, ok := w.webhooks[webhookId]
+	w.lock.Unlock()
+	if !ok {
+		return nil, ErrWebhookNotFound
+	}
+	if limit <= 0 {
+		limit = webhookDefaultLogLimit
+	} else if limit > webhookMaxLogLimit {
+		limit = webhookMaxLogLimit
+	}
+	var deliveries []WebhookDelivery
+	err := w.db.GetDBInstance().Where("webhook_id = ?", webhookId).Order("id desc").Limit(limit).Find(&deliveries).Error
+	return deliveries, err
+}
+
+// Test queues a test delivery to a webhook.
+func (w *WebhookDispatcher) Test(id int64) error {
+	w.lock.Lock()
+	v, ok := w.webhooks[id]
+	var hook Webhook
+	if ok {
+		hook = *v
+	}
+	w.lock.Unlock()
+	if !ok {
+		return ErrWebhookNotFound
+	}
+	return w.enqueue([]Webhook{hook}, webhookPayload{Kind: WebhookKindTest})
+}
+
+// SnapshotFile returns the path of a snapshot served to the webhooks.
+func (w *WebhookDispatcher) SnapshotFile(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || !strings.HasSuffix(name, ".jpg") {
+		return "", os.ErrNotExist
+	}
+	path := filepath.Join(w.snapshotDir, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// CameraEvent queues an AI event of a camera, eventType is a key of defaultAlgoMap.
+// imageKey is the S3 key of the image of the event, empty for the events without one.
+func (w *WebhookDispatcher) CameraEvent(cameraId int, eventType string, startAt, endAt time.Time, meta *structs.MetaScanData, imageKey string) {
+	hooks := w.match(func(v *Webhook) bool { return v.hasEventType(eventType) })
+	if len(hooks) == 0 {
+		return
+	}
+	go w.enqueue(hooks, webhookPayload{
+		Kind:      WebhookKindCameraEvent,
+		EventType: eventType,
+		CameraID:  cameraId,
+		StartedAt: &startAt,
+		EndedAt:   &endAt,
+		Meta:      meta,
+		imageKey:  imageKey,
+	})
+}
+
+// KeepEventImage keeps the content of an event image uploaded to S3 under key, so that
+// the webhooks of the event send the image the cloud got rather than a new snapshot.
+func (w *WebhookDispatcher) KeepEventImage(key, file string) {
+	if key == "" || len(w.match(func(v *Webhook) bool { return v.Snapshot != WebhookSnapshotNone })) == 0 {
+		return
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		w.logger.Warn().Err(err).Str("file", file).Msg("failed to read event image")
+		return
+	}
+	now := w.now()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for k, v := range w.images {
+		if now.Sub(v.uploadedAt) > webhookEventImageTTL {
+			delete(w.images, k)
+		}
+	}
+	if len(w.images) >= webhookEventImageMax {
+		return
+	}
+	w.images[key] = webhookEventImage{data: data, uploadedAt: now}
+}
+
+// eventImage returns and forgets the image kept under key.
+func (w *WebhookDispatcher) eventImage(key string) []byte {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	image, ok := w.images[key]
+	if !ok {
+		return nil
+	}
+	delete(w.images, key)
+	return image.data
+}
+
+func (w *WebhookDispatcher) Alarm(alarm *cloud.AlarmInfo) {
+	hooks := w.match(func(v *Webhook) bool { return v.Alarms })
+	if len(hooks) == 0 {
+		return
+	}
+	go w.enqueue(hooks, webhookPayload{Kind: WebhookKindAlarm, Alarm: alarm})
+}
+
+func (w *WebhookDispatcher) HaloEvent(eventType string, event *cloud.HaloEventInfo) {
+	hooks := w.match(func(v *Webhook) bool { return v.HaloEvents })
+	if len(hooks) == 0 {
+		return
+	}
+	go w.enqueue(hooks, webhookPayload{Kind: WebhookKindHaloEvent, EventType: eventType, Halo: event})
+}
+
+func (w *WebhookDispatcher) match(f func(v *Webhook) bool) []Webhook {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var ret []Webhook
+	for _, v := range w.webhooks {
+		if v.Enabled && f(v) {
+			ret = append(ret, *v)
+		}
+	}
+	return ret
+}
+
+// enqueue stores a delivery of the payload for each webhook. A camera event sends its
+// own image, the events without one get a snapshot taken once for all the webhooks.
+func (w *WebhookDispatcher) enqueue(hooks []Webhook, p webhookPayload) error {
+	now := w.now()
+	p.EventID, p.BoxID, p.Timestamp = webhookRandomId(), w.device.GetBoxId(), now
+
+	var snapshot []byte
+	var snapshotTaken bool
+	var snapshotUrl string
+	var lastErr error
+	for _, hook := range hooks {
+		payload := p
+		if hook.Snapshot != WebhookSnapshotNone && p.CameraID > 0 {
+			if !snapshotTaken {
+				snapshotTaken = true
+				var err error
+				if p.imageKey != "" {
+					snapshot = w.eventImage(p.imageKey)
+				} else if snapshot, err = w.snapshot(p.CameraID); err != nil {
+					w.logger.Warn().Err(err).Int("camera_id", p.CameraID).Msg("failed to take webhook snapshot")
+				}
+			}
+			if len(snapshot) > 0 && hook.Snapshot == WebhookSnapshotDataUri {
+				payload.Snapshot = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(snapshot)
+			}
+			if len(snapshot) > 0 && hook.Snapshot == WebhookSnapshotUrl {
+				if snapshotUrl == "" {
+					snapshotUrl = w.saveSnapshot(p.EventID, snapshot)
+				}
+				payload.SnapshotUrl = snapshotUrl
+			}
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		d := &WebhookDelivery{
+			WebhookID:     hook.ID,
+			Kind:          p.Kind,
+			EventType:     p.EventType,
+			Payload:       string(body),
+			Status:        WebhookDeliveryPending,
+			NextAttemptAt: now,
+		}
+		if err := w.db.GetDBInstance().Create(d).Error; err != nil {
+			w.logger.Error().Err(err).Int64("webhook_id", hook.ID).Msg("failed to queue webhook delivery")
+			lastErr = err
+		}
+	}
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+	return lastErr
+}
+
+func (w *WebhookDispatcher) saveSnapshot(eventId string, snapshot []byte) string {
+	if err := os.MkdirAll(w.snapshotDir, 0755); err != nil {
+		w.logger.Warn().Err(err).Msg("failed to create webhook snapshot dir")
+		return ""
+	}
+	name := eventId + ".jpg"
+	if err := os.WriteFile(filepath.Join(w.snapshotDir, name), snapshot, 0644); err != nil {
+		w.logger.Warn().Err(err).Msg("failed to save webhook snapshot")
+		return ""
+	}
+	return w.snapshotUrl(name)
+}
+
+func (w *WebhookDispatcher) cameraSnapshot(cameraId int) ([]byte, error) {
+	cam, err := w.device.GetCamera(cameraId)
+	if err != nil {
+		return nil, err
+	}
+	uri, err := utils.GetLiveUrl(cam.GetUri(), cam.GetUserName(), cameraPassword(cam))
+	if err != nil {
+		return nil, err
+	}
+	filePath := filepath.Join(w.device.GetConfig().GetDataStoreDir(), fmt.Sprintf("webhook_snap_%d_%d.jpg", cameraId, time.Now().UnixNano()))
+	filePath, err = utils.GetLiveViewSnapshotFile(uri, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(filePath)
+	return os.ReadFile(filePath)
+}
+
+func (w *WebhookDispatcher) run() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	var pruned time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.kick:
+		}
+		w.deliverDue()
+		if now := w.now(); now.Sub(pruned) > webhookPruneInterval {
+			pruned = now
+			w.prune()
+		}
+	}
+}
+
+// deliverDue posts the pending deliveries whose next attempt is due, to the webhooks
+// which do not back off. The webhooks are posted to concurrently, so that a slow one does
+// not hold back the others, and the deliveries of one webhook in order.
+func (w *WebhookDispatcher) deliverDue() {
+	now := w.now()
+	var wg sync.WaitGroup
+	for _, id := range w.dueWebhooks(now) {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			w.deliverWebhook(id, now)
+		}(id)
+	}
+	wg.Wait()
+}
+
+// dueWebhooks returns the webhooks which do not back off at now.
+func (w *WebhookDispatcher) dueWebhooks(now time.Time) []int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var ret []int64
+	for id := range w.webhooks {
+		if now.Before(w.retries[id].until) {
+			continue
+		}
+		ret = append(ret, id)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// deliverWebhook posts the due deliveries of a webhook in order, until one fails.
+func (w *WebhookDispatcher) deliverWebhook(id int64, now time.Time) {
+	var deliveries []WebhookDelivery
+	err := w.db.GetDBInstance().Where("webhook_id = ? AND status = ? AND next_attempt_at <= ?", id, WebhookDeliveryPending, now).
+		Order("id").Limit(webhookBatchSize).Find(&deliveries).Error
+	if err != nil {
+		w.logger.Error().Err(err).Int64("webhook_id", id).Msg("failed to load webhook deliveries")
+		return
+	}
+	for i := range deliveries {
+		// the webhook backs off, the next deliveries wait for the end of its backoff.
+		if !w.attempt(&deliveries[i]) {
+			return
+		}
+	}
+}
+
+// retry backs a webhook off after a failed delivery, a delivered one ends its backoff.
+func (w *WebhookDispatcher) retry(id int64, failed bool, now time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.webhooks[id]; !ok || !failed {
+		delete(w.retries, id)
+		return
+	}
+	r := w.retries[id]
+	r.failures++
+	r.until = now.Add(webhookBackoff(r.failures))
+	w.retries[id] = r
+}
+
+// attempt posts a delivery, it returns false when the webhook failed to take it.
+func (w *WebhookDispatcher) attempt(d *WebhookDelivery) bool {
+	w.lock.Lock()
+	v, ok := w.webhooks[d.WebhookID]
+	var hook Webhook
+	if ok {
+		hook = *v
+	}
+	w.lock.Unlock()
+
+	var err error
+	if !ok || !hook.Enabled {
+		d.Status, d.LastError = WebhookDeliveryFailed, "webhook is removed or disabled"
+	} else {
+		d.Attempts++
+		d.StatusCode, err = w.post(&hook, d)
+		now := w.now()
+		w.retry(d.WebhookID, err != nil, now)
+		switch {
+		case err == nil:
+			d.Status, d.LastError, d.DeliveredAt = WebhookDeliveryDelivered, "", &now
+		case d.Attempts >= webhookMaxAttempts:
+			d.Status, d.LastError = WebhookDeliveryFailed, err.Error()
+		default:
+			d.LastError, d.NextAttemptAt = err.Error(), now.Add(webhookBackoff(d.Attempts))
+		}
+	}
+	if err != nil {
+		w.logger.Warn().Err(err).Int64("webhook_id", d.WebhookID).Int64("delivery_id", d.ID).
+			Int("attempts", d.Attempts).Msg("webhook delivery failed")
+	}
+	if err := w.db.GetDBInstance().Save(d).Error; err != nil {
+		w.logger.Error().Err(err).Int64("delivery_id", d.ID).Msg("failed to save webhook delivery")
+	}
+	return err == nil
+}
+
+// post sends a delivery and returns the response status, a non 2xx status is an error.
+func (w *WebhookDispatcher) post(hook *Webhook, d *WebhookDelivery) (int, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequest(http.MethodPost, hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(w.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookHeaderEvent, d.Kind)
+	req.Header.Set(WebhookHeaderDelivery, strconv.FormatInt(d.ID, 10))
+	req.Header.Set(WebhookHeaderTimestamp, timestamp)
+	if hook.Secret != "" {
+		req.Header.Set(WebhookHeaderSignature, hook.sign(timestamp, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("%w: %s", ErrWebhookStatus, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// prune removes the finished deliveries and the snapshots which are out of retention.
+func (w *WebhookDispatcher) prune() {
+	now := w.now()
+	err := w.db.GetDBInstance().Where("status <> ? AND created_at < ?", WebhookDeliveryPending, now.Add(-webhookLogRetention)).
+		Delete(&WebhookDelivery{}).Error
+	if err != nil {
+		w.logger.Warn().Err(err).Msg("failed to prune webhook deliveries")
+	}
+	entries, err := os.ReadDir(w.snapshotDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err == nil && now.Sub(info.ModTime()) > webhookSnapshotTTL {
+			os.Remove(filepath.Join(w.snapshotDir, e.Name()))
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package box
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookValidate(t *testing.T) {
+	assert.NoError(t, (&Webhook{Url: "http://10.0.0.5:8080/hook", EventTypes: []string{"intrude", "doorbell"}}).validate())
+	assert.NoError(t, (&Webhook{Url: "https://vms.local/hook", Snapshot: WebhookSnapshotDataUri}).validate())
+
+	for _, w := range []Webhook{
+		{},
+		{Url: "ftp://10.0.0.5/hook"},
+		{Url: "http://10.0.0.5/hook", Snapshot: "jpeg"},
+		{Url: "http://10.0.0.5/hook", EventTypes: []string{"intrude:110"}},
+	} {
+		assert.Equal(t, ErrWebhookInvalid, w.validate())
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, 10*time.Second, webhookBackoff(1))
+	assert.Equal(t, 20*time.Second, webhookBackoff(2))
+	assert.Equal(t, 80*time.Second, webhookBackoff(4))
+	assert.Equal(t, webhookMaxBackoff, webhookBackoff(20))
+}
+
+func TestWebhookPost(t *testing.T) {
+	status := http.StatusNoContent
+	var header http.Header
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	w := &WebhookDispatcher{client: srv.Client(), now: func() time.Time { return time.Unix(1700000000, 0) }}
+	hook := &Webhook{Url: srv.URL, Secret: "s3cret"}
+	d := &WebhookDelivery{ID: 7, Kind: WebhookKindAlarm, Payload: `{"kind":"alarm"}`}
+	code, err := w.post(hook, d)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, code)
+	assert.Equal(t, `{"kind":"alarm"}`, string(body))
+	assert.Equal(t, "alarm", header.Get(WebhookHeaderEvent))
+	assert.Equal(t, "7", header.Get(WebhookHeaderDelivery))
+	assert.Equal(t, "1700000000", header.Get(WebhookHeaderTimestamp))
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(`1700000000.{"kind":"alarm"}`))
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), header.Get(WebhookHeaderSignature))
+
+	status = http.StatusBadGateway
+	code, err = w.post(&Webhook{Url: srv.URL}, d)
+	assert.True(t, errors.Is(err, ErrWebhookStatus))
+	assert.Equal(t, http.StatusBadGateway, code)
+	assert.Empty(t, header.Get(WebhookHeaderSignature))
+}
+
+func TestWebhookSnapshotFile(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "abc.jpg"), []byte("jpg"), 0644))
+	w := &WebhookDispatcher{snapshotDir: dir}
+
+	path, err := w.SnapshotFile("abc.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "abc.jpg"), path)
+	for _, name := range []string{"", "missing.jpg", "../abc.jpg", "abc.png"} {
+		_, err = w.SnapshotFile(name)
+		assert.Error(t, err)
+	}
+}
+
+func TestWebhookEventImage(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "event.jpg")
+	assert.NoError(t, os.WriteFile(file, []byte("jpg"), 0644))
+	now := time.Unix(1700000000, 0)
+	w := &WebhookDispatcher{
+		webhooks: map[int64]*Webhook{1: {ID: 1, Enabled: true}},
+		images:   make(map[string]webhookEventImage),
+		now:      func() time.Time { return now },
+	}
+
+	// no webhook sends snapshots.
+	w.KeepEventImage("events/1.jpg", file)
+	assert.Empty(t, w.images)
+
+	w.webhooks[1].Snapshot = WebhookSnapshotDataUri
+	w.KeepEventImage("events/1.jpg", file)
+	assert.Equal(t, []byte("jpg"), w.eventImage("events/1.jpg"))
+	assert.Nil(t, w.eventImage("events/1.jpg"))
+
+	// the images of the events never queued expire.
+	w.KeepEventImage("events/2.jpg", file)
+	now = now.Add(webhookEventImageTTL + time.Second)
+	w.KeepEventImage("events/3.jpg", file)
+	assert.Nil(t, w.eventImage("events/2.jpg"))
+	assert.NotNil(t, w.eventImage("events/3.jpg"))
+}
+
+func TestWebhookRetry(t *testing.T) {
+	now := time.Now()
+	w := &WebhookDispatcher{
+		webhooks: map[int64]*Webhook{1: {ID: 1}, 2: {ID: 2}, 3: {ID: 3}},
+		retries:  make(map[int64]webhookRetry),
+	}
+	assert.Equal(t, []int64{1, 2, 3}, w.dueWebhooks(now))
+
+	// a failing webhook backs off as a whole, longer after each failure.
+	w.retry(2, true, now)
+	assert.Equal(t, []int64{1, 3}, w.dueWebhooks(now))
+	assert.Equal(t, []int64{1, 2, 3}, w.dueWebhooks(now.Add(webhookFirstBackoff)))
+	w.retry(2, true, now)
+	assert.Equal(t, []int64{1, 3}, w.dueWebhooks(now.Add(webhookFirstBackoff)))
+
+	w.retry(2, false, now)
+	assert.Equal(t, []int64{1, 2, 3}, w.dueWebhooks(now))
+	assert.Empty(t, w.retries)
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/example/turing-common/log"
 
 	"github.com/example/minibox/apis"
+	"github.com/example/minibox/apis/common"
 	"github.com/example/minibox/apis/ppl_2"
 	"github.com/example/minibox/box"
 	"github.com/example/minibox/configs"
@@ -76,6 +77,8 @@ func main() {
 	}
 	go d.Cleanup()
 	injector.Map(d)
+	// the box and the modules load their secrets from the vault
+	box.NewCredentialVault(d)
 
 	scheduler.InitScheduler(cfg.GetStreamConfig())
 
@@ -93,6 +96,7 @@ func main() {
 	arpSearcher.Init()
 	b.SetArpSearcher(arpSearcher)
 	injector.Map(b)
+	injector.Map(common.ThermalBaseAPI{Box: b, DB: d, Logger: log.Logger("thermal_1")})
 	b.Start() // wait success run
 
 	ppl_2.InitPcService(b, cfg.GetPpl2Cfg())
@@ -100,8 +104,23 @@ func main() {
 	atr := box.NewArchiveTaskRunner(b, d, cfg.GetCloudStorageConfig())
 	go atr.HandleArchiveTasks()
 	atr.TryRecover()
-
-	err = apis.Run(injector, cfg)
+	box.NewPTZTourRunner(b, d)
+	box.NewPTZEventLinker(b, d)
+	box.NewAnnouncer(b, d)
+	box.NewSpeakerGroups(b, d)
+	box.NewSIPAgent(b, d)
+	box.NewMQTTBridge(b, d)
+	box.NewWebhookDispatcher(b, d)
+	box.NewHaloSeries(d)
+	box.NewHaloRuleEngine(d)
+	box.NewHaloMonitor(b, d)
+	box.NewPushAuth(d)
+	box.NewNVRDrivers(b, d)
+	box.NewNVRPasswordRotator(b, d)
+	box.NewFirmwareManager(b, d)
+	box.NewNVRStorageMonitor(b, d)
+
+	err = apis.Run(injector, cfg, configFile)
 	if err != nil {
 		logger.Fatal().Msgf("Failed to run api server: %s", err)
 	}
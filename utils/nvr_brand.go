@@ -0,0 +1,9 @@
+package utils
+
+const (
+	// Hikvision is the brand of the Hikvision NVRs and of their cameras, driven through
+	// ISAPI.
+	Hikvision CameraBrand = "Hikvision"
+	// Dahua is the brand of the Dahua NVRs and cameras, driven through their HTTP CGIs.
+	Dahua CameraBrand = "Dahua"
+)